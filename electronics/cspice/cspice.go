@@ -1,8 +1,17 @@
 // ported from https://github.com/andrewytliu/cspice
+// go build cspice.go netlist.go mna.go devices.go tran.go noise.go tolerance.go
+// reads its own netlist format or a subset of spice3, see netlist.go,
+// .cir, .sp and .spice files are taken to be spice:
+// cspice samples/divider.cir
+// cspice samples/sample1.netlist out.plt out.gv
+// -check runs the netlists and compares the operating points and
+// measurements they print with the .out file next to each:
+// cspice -check samples/*.cir
 package main
 
 import (
 	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
@@ -10,45 +19,138 @@ import (
 	"math"
 	"math/cmplx"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 )
 
+var (
+	spice  = flag.Bool("spice", false, "read the netlist as spice whatever its name")
+	op     = flag.Bool("op", false, "print the dc operating point as well")
+	mna    = flag.Bool("mna", false, "run TIME analyses by nodal analysis instead of the transfer functions")
+	check  = flag.Bool("check", false, "compare what the netlists print with their .out files")
+	update = flag.Bool("update", false, "with -check, rewrite the .out files")
+)
+
 func main() {
 	log.SetPrefix("cspice: ")
 	log.SetFlags(0)
 
 	flag.Usage = usage
 	flag.Parse()
-	if flag.NArg() != 3 {
+	if *check {
+		checkFiles(flag.Args())
+	}
+	if flag.NArg() < 1 || flag.NArg() > 3 {
 		usage()
 	}
 
-	ci := &Circuit{}
-	sm := &Simulation{}
-	err := ci.LoadNetFile(flag.Arg(0))
-	ck(err)
+	name := flag.Arg(0)
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	plotfile, dotfile := base+".plt", base+".gv"
+	if flag.NArg() > 1 {
+		plotfile = flag.Arg(1)
+	}
+	if flag.NArg() > 2 {
+		dotfile = flag.Arg(2)
+	}
 
-	ci.Print(os.Stdout)
-	err = sm.Init(ci, flag.Arg(1), flag.Arg(2))
+	sm := &Simulation{Out: os.Stdout, Log: os.Stdout, CSV: true}
+	err := sm.Run(name, plotfile, dotfile)
 	ck(err)
+}
 
+func checkFiles(names []string) {
+	status := 0
+	for _, name := range names {
+		if err := checkFile(name); err != nil {
+			fmt.Printf("FAIL %s: %v\n", name, err)
+			status = 1
+		} else {
+			fmt.Printf("ok   %s\n", name)
+		}
+	}
+	os.Exit(status)
+}
+
+func checkFile(name string) error {
+	var out bytes.Buffer
+	sm := &Simulation{Out: &out, Log: io.Discard}
+	if err := sm.Run(name, os.DevNull, os.DevNull); err != nil {
+		return err
+	}
+
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	if *update {
+		return os.WriteFile(base+".out", out.Bytes(), 0644)
+	}
+	want, err := os.ReadFile(base + ".out")
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		return fmt.Errorf("output differs from %s.out", base)
+	}
+	return nil
+}
+
+func load(name string) (*Circuit, error) {
+	ci := &Circuit{}
+	var err error
+	if *spice || isSpice(name) {
+		err = ci.LoadSpice(name)
+	} else {
+		err = ci.LoadNetFile(name)
+	}
+	if *mna {
+		for _, cfg := range ci.Analyses {
+			cfg.MNA = cfg.MNA || cfg.Type == 'T'
+		}
+	}
+	return ci, err
+}
+
+func (sm *Simulation) Run(name, plotfile, dotfile string) error {
+	ci, err := load(name)
+	if err != nil {
+		return err
+	}
+
+	ci.Print(sm.Log)
+	err = sm.Init(ci, plotfile, dotfile)
+	if err != nil {
+		return err
+	}
+	defer sm.PlotFile.Close()
+	defer sm.DotFile.Close()
+
+	if *op {
+		err = sm.Simulate(&Analysis{Type: 'O'})
+		if err != nil {
+			return err
+		}
+	}
 	for _, cfg := range ci.Analyses {
 		err = sm.Simulate(cfg)
-		ck(err)
+		if err != nil {
+			return err
+		}
 	}
 	err = sm.Simulate(&Analysis{Type: 'C'})
-	ck(err)
+	if err != nil {
+		return err
+	}
 
 	err = sm.PlotFile.Close()
-	ck(err)
-
-	err = sm.DotFile.Close()
-	ck(err)
+	if err != nil {
+		return err
+	}
+	return sm.DotFile.Close()
 }
 
 func usage() {
-	fmt.Fprintln(os.Stderr, "usage: [options] netlist output.plt output.gv")
+	fmt.Fprintln(os.Stderr, "usage: cspice [options] netlist [output.plt [output.gv]]")
 	flag.PrintDefaults()
 	os.Exit(2)
 }
@@ -205,29 +307,46 @@ type Simulation struct {
 	Transfers map[*Source]Transfer
 	PlotFile  *os.File
 	DotFile   *os.File
+	Out       io.Writer // operating points and measurements
+	Log       io.Writer // the circuit and the trees of the transfer functions
+	CSV       bool      // write the waveforms of a nodal transient as csv too
 }
 
 type Circuit struct {
-	IDs      map[int]int // map node id to index to nodes
-	Nodes    []*Node     // list of node indexed by a node id
-	Elems    []Element   // list of circuit elements
-	Sources  []*Source   // list of voltage/current sources
-	OutputID [2]int      // node id to high/low node
-	Analyses []*Analysis // frequency/time parameters for analysis
+	Title    string
+	IDs      map[int]int    // map node id to index to nodes
+	Names    map[int]string // node id to its name in a spice netlist
+	Nodes    []*Node        // list of node indexed by a node id
+	Elems    []Element      // list of circuit elements
+	Devices  []Device       // the same elements for nodal analysis
+	Sources  []*Source      // list of voltage/current sources
+	OutputID [2]int         // node id to high/low node
+	Analyses []*Analysis    // frequency/time parameters for analysis
+	Measures []*Measure     // what to take from a nodal transient
+
+	Tolerances map[string]float64 // element name to how far off its value can be, a fraction
 }
 
 type Analysis struct {
 	Type   int
 	Start  float64
 	End    float64
-	Step   float64
+	Step   float64 // points per decade for a frequency sweep
+	Linear bool    // frequency sweep in Step points evenly spaced
+	MNA    bool    // time response by nodal analysis
 	File   string
 	Source string
+	Runs   int   // of a monte carlo analysis
+	Seed   int64 // for the random values of the runs
 }
 
+// the coefficients of the numerator and denominator, expanded from
+// the trees so they can be worked out again for other element values
 type Transfer struct {
-	Num []float64
-	Den []float64
+	Num      []float64
+	Den      []float64
+	NumTrees [][]Element
+	DenTrees [][]Element
 }
 
 type Node struct {
@@ -246,6 +365,9 @@ type Source struct {
 	Name string
 	Prev float64
 	Next float64
+	DC   float64 // the value at the operating point
+	AC   float64 // magnitude in an ac sweep, 0 for none
+	Wave *Wave   // how it changes in a nodal transient
 	Node [2]int
 }
 
@@ -345,18 +467,28 @@ func (ci *Circuit) NodeByID(id int) *Node {
 	return ci.Nodes[ci.IndexByID(id)]
 }
 
+func (ci *Circuit) NodeName(id int) string {
+	if name, found := ci.Names[id]; found {
+		return name
+	}
+	return fmt.Sprint(id)
+}
+
 func (ci *Circuit) Print(w io.Writer) {
 	fmt.Fprintf(w, "===== Circuit Detail =====\n")
+	if ci.Title != "" {
+		fmt.Fprintf(w, "%s\n", ci.Title)
+	}
 	for _, n := range ci.Nodes {
-		fmt.Fprintf(w, "[%2d]\n", n.ID)
+		fmt.Fprintf(w, "[%2s]\n", ci.NodeName(n.ID))
 		for _, e := range n.Conns {
-			fmt.Fprintf(w, " -> [%2d] %v\n", e.Dest.ID, e.Elem)
+			fmt.Fprintf(w, " -> [%2s] %v\n", ci.NodeName(e.Dest.ID), e.Elem)
 		}
 	}
 
 	fmt.Fprintf(w, "--------- Source ---------\n")
 	for _, s := range ci.Sources {
-		fmt.Fprintf(w, "%v [%v] -> [%v] %.3e %.3e\n", s.Name, s.Node[0], s.Node[1], s.Prev, s.Next)
+		fmt.Fprintf(w, "%v [%v] -> [%v] %.3e %.3e\n", s.Name, ci.NodeName(s.Node[0]), ci.NodeName(s.Node[1]), s.Prev, s.Next)
 	}
 	fmt.Fprintf(w, "==========================\n")
 }
@@ -371,27 +503,56 @@ func (ci *Circuit) addComponent(line string, typ rune) error {
 	if err != nil {
 		return err
 	}
+	ci.AddComponent(typ, name, n1, n2, parseUnit(v1))
+
+	// an optional tolerance in percent after the value
+	if f := strings.Fields(line); len(f) > 4 && strings.HasSuffix(f[4], "%") {
+		tol, err := strconv.ParseFloat(strings.TrimSuffix(f[4], "%"), 64)
+		if err != nil || tol < 0 {
+			return fmt.Errorf("bad tolerance %s", f[4])
+		}
+		ci.SetTolerance(name, tol/100)
+	}
+	return nil
+}
 
-	var ce Element
-	cp := Component{name, parseUnit(v1), 1, 0}
+// the value of the element name is only known to within tol of it
+func (ci *Circuit) SetTolerance(name string, tol float64) {
+	if ci.Tolerances == nil {
+		ci.Tolerances = make(map[string]float64)
+	}
+	ci.Tolerances[name] = tol
+}
+
+// adds a resistor, inductor or capacitor between nodes n1 and n2
+func (ci *Circuit) AddComponent(typ rune, name string, n1, n2 int, value float64) {
+	var (
+		ce Element
+		d  Device
+	)
+	cp := Component{name, value, 1, 0}
+	port := Twoport{name, n1, n2}
 	switch typ {
 	case 'R':
 		cp.Order = 0
 		ce = &Resistor{cp}
+		d = &RDevice{Twoport: port, R: value}
 	case 'L':
 		cp.Order = -1
 		ce = &Inductor{cp}
+		d = &LDevice{Twoport: port, L: value}
 	case 'C':
 		cp.Order = 1
 		ce = &Capacitor{cp}
+		d = &CDevice{Twoport: port, C: value}
 	}
 
 	ci.Elems = append(ci.Elems, ce)
+	ci.Devices = append(ci.Devices, d)
 	nod1 := ci.NodeByID(n1)
 	nod2 := ci.NodeByID(n2)
 	nod1.AddConn(&Connection{nod2, ce})
 	nod2.AddConn(&Connection{nod1, ce})
-	return nil
 }
 
 func (ci *Circuit) addSource(line string, typ int) error {
@@ -412,21 +573,34 @@ func (ci *Circuit) addSource(line string, typ int) error {
 		return nil
 	}
 
-	ci.Sources = append(ci.Sources, &Source{
+	// the operating point is where the step leaves the circuit
+	ci.AddSource(&Source{
 		Type: typ,
 		Name: name,
 		Node: [2]int{n1, n2},
 		Prev: v1,
 		Next: v2,
+		DC:   v2,
 	})
-	if typ == 'V' {
+	return nil
+}
+
+// a current source drives its current out into Node[0], the other way
+// around from spice
+func (ci *Circuit) AddSource(src *Source) {
+	ci.Sources = append(ci.Sources, src)
+	n1, n2 := src.Node[0], src.Node[1]
+	port := Twoport{src.Name, n1, n2}
+	if src.Type == 'V' {
 		nod1 := ci.NodeByID(n1)
 		nod2 := ci.NodeByID(n2)
-		nod1.AddEquiv(&Equivalent{nod2, ci.Sources[len(ci.Sources)-1]})
-		nod2.AddEquiv(&Equivalent{nod1, ci.Sources[len(ci.Sources)-1]})
+		nod1.AddEquiv(&Equivalent{nod2, src})
+		nod2.AddEquiv(&Equivalent{nod1, src})
+		ci.Devices = append(ci.Devices, &VDevice{Twoport: port, Src: src})
+	} else {
+		port.A, port.B = n2, n1
+		ci.Devices = append(ci.Devices, &IDevice{Twoport: port, Src: src})
 	}
-
-	return nil
 }
 
 func (ci *Circuit) addVCCS(line string) error {
@@ -434,14 +608,17 @@ func (ci *Circuit) addVCCS(line string) error {
 		name           string
 		n1, n2, n3, n4 int
 		s1             string
-		v1             float64
 	)
 	_, err := fmt.Sscan(line, &name, &n1, &n2, &n3, &n4, &s1)
 	if err != nil {
 		return err
 	}
-	v1 = parseUnit(s1)
+	ci.AddVCCS(name, n1, n2, n3, n4, parseUnit(s1))
+	return nil
+}
 
+// current v1 * (V(n1) - V(n2)) between n3 and n4
+func (ci *Circuit) AddVCCS(name string, n1, n2, n3, n4 int, v1 float64) {
 	ce := &VCCS{Component{name, v1, 1, 0}}
 	re := &VCCS{Component{name, v1, -1, 0}}
 
@@ -466,7 +643,7 @@ func (ci *Circuit) addVCCS(line string) error {
 		nod4.AddConn(&Connection{nod1, ce})
 	}
 
-	return err
+	ci.Devices = append(ci.Devices, &GDevice{Twoport: Twoport{name, n3, n4}, C: n1, D: n2, Gm: v1})
 }
 
 func (ci *Circuit) addAnalysis(line string, typ int) error {
@@ -474,12 +651,18 @@ func (ci *Circuit) addAnalysis(line string, typ int) error {
 		op               string
 		start, end, step string
 		source, file     string
+		runs             int
 		err              error
 	)
 
-	if typ == 'F' {
+	switch typ {
+	case 'F', 'N':
 		_, err = fmt.Sscan(line, &op, &start, &end, &step, &source, &file)
-	} else {
+	case 'S':
+		_, err = fmt.Sscan(line, &op, &start, &end, &step, &source)
+	case 'M':
+		_, err = fmt.Sscan(line, &op, &runs, &start, &end, &step, &source)
+	default:
 		_, err = fmt.Sscan(line, &op, &start, &end, &step, &file)
 	}
 	if err != nil {
@@ -493,6 +676,8 @@ func (ci *Circuit) addAnalysis(line string, typ int) error {
 		Step:   parseUnit(step),
 		Source: source,
 		File:   file,
+		Runs:   runs,
+		Seed:   1,
 	})
 	return nil
 }
@@ -534,15 +719,15 @@ func (ci *Circuit) LoadNetFile(name string) error {
 			_, err = fmt.Sscan(line, &op, &ci.OutputID[0], &ci.OutputID[1])
 
 		case 'R':
-			// R[ID] [NODE1] [NODE2] [VALUE] # Resistor
+			// R[ID] [NODE1] [NODE2] [VALUE] [TOL%] # Resistor
 			err = ci.addComponent(line, 'R')
 
 		case 'L':
-			// L[ID] [NODE1] [NODE2] [VALUE] # Inductor
+			// L[ID] [NODE1] [NODE2] [VALUE] [TOL%] # Inductor
 			err = ci.addComponent(line, 'L')
 
 		case 'C':
-			// C[ID] [NODE1] [NODE2] [VALUE] # Capacitor
+			// C[ID] [NODE1] [NODE2] [VALUE] [TOL%] # Capacitor
 			err = ci.addComponent(line, 'C')
 
 		default:
@@ -555,6 +740,18 @@ func (ci *Circuit) LoadNetFile(name string) error {
 				// TIME  [START] [END] [STEP] [OUTPUT] # Transient response
 				err = ci.addAnalysis(line, 'T')
 
+			case strings.HasPrefix(xline, "NOISE"):
+				// NOISE [START] [END] [STEP] [SRC] [OUTPUT] # Output noise density
+				err = ci.addAnalysis(line, 'N')
+
+			case strings.HasPrefix(xline, "SENS"):
+				// SENS  [START] [END] [STEP] [SRC] # Sensitivity of gain and corner
+				err = ci.addAnalysis(line, 'S')
+
+			case strings.HasPrefix(xline, "MC"):
+				// MC    [RUNS] [START] [END] [STEP] [SRC] # Monte Carlo over the tolerances
+				err = ci.addAnalysis(line, 'M')
+
 			default:
 				err = fmt.Errorf("unknown directive")
 			}
@@ -696,11 +893,15 @@ func (sm *Simulation) Init(ci *Circuit, plotfile, dotfile string) error {
 	}
 
 	sm.Circuit = ci
-	sm.findTransfers()
 	return nil
 }
 
+// the transfer functions are only worked out once an analysis needs
+// them, enumerating the trees of a big circuit takes a while
 func (sm *Simulation) findTransfers() {
+	if sm.Transfers != nil {
+		return
+	}
 	sm.Transfers = make(map[*Source]Transfer)
 
 	ci := sm.Circuit
@@ -778,23 +979,34 @@ func (sm *Simulation) findFormula(src *Source) Transfer {
 		panic("unknown analysis")
 	}
 
-	fmt.Println("======== Print out Den Trees ========")
-	printFormula(os.Stdout, den)
-	fmt.Println()
-	fmt.Println("======== Print out Num Trees ========")
-	printFormula(os.Stdout, num)
-	fmt.Println()
+	fmt.Fprintln(sm.Log, "======== Print out Den Trees ========")
+	printFormula(sm.Log, den)
+	fmt.Fprintln(sm.Log)
+	fmt.Fprintln(sm.Log, "======== Print out Num Trees ========")
+	printFormula(sm.Log, num)
+	fmt.Fprintln(sm.Log)
+
+	tf := Transfer{NumTrees: num, DenTrees: den}
+	tf.Expand()
+	return tf
+}
 
+// works the coefficients out from the trees with the values
+// the elements have now
+func (tf *Transfer) Expand() {
 	// 5. expand formula
-	cden := expandFormula(den)
-	cnum := expandFormula(num)
+	cden := expandFormula(tf.DenTrees)
+	cnum := expandFormula(tf.NumTrees)
 
 	// 6. adjust the order of num and den
 	cnum, cden = adjustFormulaOrder(cnum, cden)
-	return Transfer{
-		Num: convertFormulaToCoeff(cnum),
-		Den: convertFormulaToCoeff(cden),
-	}
+	tf.Num = convertFormulaToCoeff(cnum)
+	tf.Den = convertFormulaToCoeff(cden)
+}
+
+// H(s) at s = 2*pi*freq
+func (tf *Transfer) At(freq float64) complex128 {
+	return evalFormula(tf.Num, freq) / evalFormula(tf.Den, freq)
 }
 
 // key, val => order, coefficient
@@ -920,36 +1132,62 @@ func (sm *Simulation) Simulate(cfg *Analysis) error {
 	case 'F':
 		return sm.doFreq(cfg)
 	case 'T':
+		if cfg.MNA {
+			return sm.doTransient(cfg)
+		}
 		return sm.doTime(cfg)
+	case 'O':
+		return sm.doOp(cfg)
+	case 'N':
+		return sm.doNoise(cfg)
+	case 'S':
+		return sm.doSens(cfg)
+	case 'M':
+		return sm.doMonteCarlo(cfg)
+	}
+	return fmt.Errorf("unknown analysis type %q", rune(cfg.Type))
+}
+
+// the transfer from the source called name to the output
+func (sm *Simulation) sourceTransfer(name string) (*Source, Transfer, error) {
+	sm.findTransfers()
+	for src, tf := range sm.Transfers {
+		if src.Name == name {
+			return src, tf, nil
+		}
 	}
-	return fmt.Errorf("unknown analysis type %q", cfg.Type)
+	return nil, Transfer{}, fmt.Errorf("can't find source %q", name)
 }
 
-func (sm *Simulation) doFreq(cfg *Analysis) error {
-	var (
-		src *Source
-		tf  Transfer
-		t   []float64
-		y   []complex128
-	)
-	for key, val := range sm.Transfers {
-		if key.Name == cfg.Source {
-			src = key
-			tf = val
-			break
+// the frequencies a sweep steps through, Step per decade
+// or Step evenly spaced
+func (cfg *Analysis) Frequencies() []float64 {
+	var t []float64
+	ratio := math.Exp(math.Log(10) / cfg.Step)
+	for i, freq := 0, cfg.Start; freq <= cfg.End; i++ {
+		t = append(t, freq)
+		if cfg.Linear {
+			freq = cfg.Start + float64(i+1)*(cfg.End-cfg.Start)/float64(max(int(cfg.Step)-1, 1))
+		} else {
+			freq *= ratio
 		}
 	}
-	if src == nil {
-		return fmt.Errorf("can't find source %q", cfg.Source)
+	return t
+}
+
+func (sm *Simulation) doFreq(cfg *Analysis) error {
+	_, tf, err := sm.sourceTransfer(cfg.Source)
+	if err != nil {
+		return err
 	}
 
 	// step through the frequency spectrum and evaluate it using the transfer function
 	// H(s) at points s = 2*pi*freq, this will give values we need to calculate
 	// magnitude/phase response
-	ratio := math.Exp(math.Log(10) / cfg.Step)
-	for freq := cfg.Start; freq <= cfg.End; freq *= ratio {
-		t = append(t, freq)
-		y = append(y, evalFormula(tf.Num, freq)/evalFormula(tf.Den, freq))
+	t := cfg.Frequencies()
+	y := make([]complex128, len(t))
+	for i, freq := range t {
+		y[i] = tf.At(freq)
 	}
 	sm.plotFreq(t, y, cfg)
 
@@ -992,6 +1230,8 @@ func (sm *Simulation) doTime(cfg *Analysis) error {
 		t = append(t, s)
 	}
 
+	sm.findTransfers()
+
 	// based on the superposition principle, we can loop over all
 	// sources of current/voltage, evaluate them using the transfer function
 	// and then add them up to get the full response
@@ -0,0 +1,315 @@
+// the nonlinear devices, only their dc equations, the junction and gate
+// capacitances are left out so put capacitors in the netlist where they
+// matter. every device is linearized around the last guess into a
+// conductance and a current source:
+//
+// diode      shockley, IS N
+// npn pnp    ebers-moll transport model, IS BF BR
+// nmos pmos  level 1 shichman-hodges, VTO KP LAMBDA and W L on the
+//            instance or the model, no body effect
+//
+// other parameters on a .model card are read and ignored, so the
+// vendor models in ../spice load
+// go build cspice.go netlist.go mna.go devices.go tran.go noise.go tolerance.go
+
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// thermal voltage kT/q at 27C
+const vt = 0.025865
+
+type Model struct {
+	Name   string
+	Type   string
+	Params map[string]float64
+}
+
+func (md *Model) Get(name string, def float64) float64 {
+	if v, found := md.Params[name]; found {
+		return v
+	}
+	return def
+}
+
+// limits the change of a junction voltage between iterations so the
+// exponential doesn't blow up, from spice3
+func pnjlim(vnew, vold, vt, vcrit float64, limited *bool) float64 {
+	if vnew > vcrit && math.Abs(vnew-vold) > 2*vt {
+		if vold > 0 {
+			arg := 1 + (vnew-vold)/vt
+			if arg > 0 {
+				vnew = vold + vt*math.Log(arg)
+			} else {
+				vnew = vcrit
+			}
+		} else {
+			vnew = vt * math.Log(vnew/vt)
+		}
+		*limited = true
+	}
+	return vnew
+}
+
+func vcrit(is, nvt float64) float64 {
+	return nvt * math.Log(nvt/(math.Sqrt2*is))
+}
+
+// a junction's current and conductance at v
+func junction(is, nvt, v float64) (i, g float64) {
+	e := math.Exp(v / nvt)
+	return is*(e-1) + gmin*v, is*e/nvt + gmin
+}
+
+type Diode struct {
+	Twoport // anode and cathode
+	IS, N   float64
+	vd      float64
+}
+
+func NewDiode(name string, a, k int, md *Model, area float64) *Diode {
+	return &Diode{
+		Twoport: Twoport{name, a, k},
+		IS:      md.Get("is", 1e-14) * area,
+		N:       md.Get("n", 1),
+		vd:      0.6,
+	}
+}
+
+func (d *Diode) Stamp(m *MNA) {
+	nvt := d.N * vt
+	v := pnjlim(m.V(d.A)-m.V(d.B), d.vd, nvt, vcrit(d.IS, nvt), &m.Limited)
+	d.vd = v
+	i, g := junction(d.IS, nvt, v)
+	m.Conductance(d.A, d.B, g)
+	m.CurrentSource(d.A, d.B, i-g*v)
+}
+
+func (d *Diode) Current(m *MNA) float64 {
+	i, _ := junction(d.IS, d.N*vt, m.V(d.A)-m.V(d.B))
+	return i
+}
+
+func (d *Diode) Report(m *MNA) string {
+	return fmt.Sprintf("vd=% .4e id=% .4e", m.V(d.A)-m.V(d.B), d.Current(m))
+}
+
+// the voltages and currents are worked in the npn direction and
+// turned around with Pol for a pnp
+type BJT struct {
+	ID         string
+	C, B, E    int
+	Pol        float64
+	IS, BF, BR float64
+	vbe, vbc   float64
+}
+
+func NewBJT(name string, c, b, e int, md *Model, area float64) *BJT {
+	q := &BJT{
+		ID:  name,
+		C:   c,
+		B:   b,
+		E:   e,
+		Pol: 1,
+		IS:  md.Get("is", 1e-16) * area,
+		BF:  md.Get("bf", 100),
+		BR:  md.Get("br", 1),
+		vbe: 0.6,
+	}
+	if md.Type == "pnp" {
+		q.Pol = -1
+	}
+	return q
+}
+
+func (q *BJT) Name() string {
+	return q.ID
+}
+
+func (q *BJT) Setup(m *MNA) {}
+
+func (q *BJT) Accept(m *MNA) {}
+
+// collector and base current and how they change with vbe and vbc
+func (q *BJT) eval(vbe, vbc float64) (ic, ib, gcbe, gcbc, gbbe, gbbc float64) {
+	iF, gf := junction(q.IS, vt, vbe)
+	iR, gr := junction(q.IS, vt, vbc)
+	ic = iF - iR - iR/q.BR
+	ib = iF/q.BF + iR/q.BR
+	return ic, ib, gf, -gr * (1 + 1/q.BR), gf / q.BF, gr / q.BR
+}
+
+func (q *BJT) Stamp(m *MNA) {
+	p := q.Pol
+	vc := vcrit(q.IS, vt)
+	vbe := pnjlim(p*(m.V(q.B)-m.V(q.E)), q.vbe, vt, vc, &m.Limited)
+	vbc := pnjlim(p*(m.V(q.B)-m.V(q.C)), q.vbc, vt, vc, &m.Limited)
+	q.vbe, q.vbc = vbe, vbc
+
+	// both currents leave through the emitter
+	ic, ib, gcbe, gcbc, gbbe, gbbc := q.eval(vbe, vbc)
+	m.Transconductance(q.C, q.E, q.B, q.E, gcbe)
+	m.Transconductance(q.C, q.E, q.B, q.C, gcbc)
+	m.CurrentSource(q.C, q.E, p*(ic-gcbe*vbe-gcbc*vbc))
+	m.Transconductance(q.B, q.E, q.B, q.E, gbbe)
+	m.Transconductance(q.B, q.E, q.B, q.C, gbbc)
+	m.CurrentSource(q.B, q.E, p*(ib-gbbe*vbe-gbbc*vbc))
+}
+
+func (q *BJT) currents(m *MNA) (vbe, vbc, ic, ib float64) {
+	vbe = q.Pol * (m.V(q.B) - m.V(q.E))
+	vbc = q.Pol * (m.V(q.B) - m.V(q.C))
+	ic, ib, _, _, _, _ = q.eval(vbe, vbc)
+	return vbe, vbc, q.Pol * ic, q.Pol * ib
+}
+
+func (q *BJT) Current(m *MNA) float64 {
+	_, _, ic, _ := q.currents(m)
+	return ic
+}
+
+func (q *BJT) Report(m *MNA) string {
+	vbe, vbc, ic, ib := q.currents(m)
+	region := "cutoff"
+	switch on := 0.5; {
+	case vbe > on && vbc > on:
+		region = "saturated"
+	case vbe > on:
+		region = "active"
+	case vbc > on:
+		region = "reverse"
+	}
+	return fmt.Sprintf("%-9s vbe=% .4e vce=% .4e ic=% .4e ib=% .4e",
+		region, q.Pol*vbe, q.Pol*(vbe-vbc), ic, ib)
+}
+
+// like the bjt worked in the nmos direction, drain and source swap
+// places when vds goes negative
+type MOSFET struct {
+	ID                    string
+	D, G, S, Bulk         int
+	Pol                   float64
+	VTO, KP, Lambda, W, L float64
+	vgs, vds              float64
+}
+
+func NewMOSFET(name string, d, g, s, b int, md *Model, w, l float64) (*MOSFET, error) {
+	if level := md.Get("level", 1); level != 1 {
+		return nil, fmt.Errorf("%s: only level 1 mosfets, not %v", md.Name, level)
+	}
+	if w == 0 {
+		w = md.Get("w", 100e-6)
+	}
+	if l == 0 {
+		l = md.Get("l", 100e-6)
+	}
+	t := &MOSFET{
+		ID:     name,
+		D:      d,
+		G:      g,
+		S:      s,
+		Bulk:   b,
+		Pol:    1,
+		VTO:    md.Get("vto", 0),
+		KP:     md.Get("kp", 2e-5),
+		Lambda: md.Get("lambda", 0),
+		W:      w,
+		L:      l,
+	}
+	if md.Type == "pmos" {
+		t.Pol = -1
+	}
+	return t, nil
+}
+
+func (t *MOSFET) Name() string {
+	return t.ID
+}
+
+func (t *MOSFET) Setup(m *MNA) {}
+
+func (t *MOSFET) Accept(m *MNA) {}
+
+func (t *MOSFET) vto() float64 {
+	return t.Pol * t.VTO
+}
+
+// drain current and its derivatives for vds >= 0
+func (t *MOSFET) eval(vgs, vds float64) (id, gm, gds float64) {
+	beta := t.KP * t.W / t.L
+	vov := vgs - t.vto()
+	clm := 1 + t.Lambda*vds
+	switch {
+	case vov <= 0:
+		return 0, 0, 0
+	case vds < vov:
+		id = beta * (vov*vds - vds*vds/2)
+		return id * clm, beta * vds * clm, beta*(vov-vds)*clm + id*t.Lambda
+	default:
+		id = beta / 2 * vov * vov
+		return id * clm, beta * vov * clm, id * t.Lambda
+	}
+}
+
+// the terminals in the order the current flows
+func (t *MOSFET) orient(vgs, vds float64) (d, s int, vgs1, vds1 float64) {
+	if vds >= 0 {
+		return t.D, t.S, vgs, vds
+	}
+	return t.S, t.D, vgs - vds, -vds
+}
+
+// keeps a step of vgs or vds within reach of the last one
+func fetlim(vnew, vold, reach float64, limited *bool) float64 {
+	if d := vnew - vold; math.Abs(d) > reach {
+		*limited = true
+		return vold + math.Copysign(reach, d)
+	}
+	return vnew
+}
+
+func (t *MOSFET) Stamp(m *MNA) {
+	p := t.Pol
+	vgs := fetlim(p*(m.V(t.G)-m.V(t.S)), t.vgs, 0.5+math.Abs(t.vgs-t.vto()), &m.Limited)
+	vds := fetlim(p*(m.V(t.D)-m.V(t.S)), t.vds, 1+math.Abs(t.vds), &m.Limited)
+	t.vgs, t.vds = vgs, vds
+
+	d, s, vgs, vds := t.orient(vgs, vds)
+	id, gm, gds := t.eval(vgs, vds)
+	m.Transconductance(d, s, t.G, s, gm)
+	m.Conductance(d, s, gds+gmin)
+	m.CurrentSource(d, s, p*(id-gm*vgs-gds*vds))
+}
+
+func (t *MOSFET) currents(m *MNA) (vgs, vds, id float64) {
+	vgs = t.Pol * (m.V(t.G) - m.V(t.S))
+	vds = t.Pol * (m.V(t.D) - m.V(t.S))
+	_, _, vgs1, vds1 := t.orient(vgs, vds)
+	id, _, _ = t.eval(vgs1, vds1)
+	if vds < 0 {
+		id = -id
+	}
+	return vgs, vds, t.Pol * id
+}
+
+func (t *MOSFET) Current(m *MNA) float64 {
+	_, _, id := t.currents(m)
+	return id
+}
+
+func (t *MOSFET) Report(m *MNA) string {
+	vgs, vds, id := t.currents(m)
+	_, _, vgs1, vds1 := t.orient(vgs, vds)
+	region := "cutoff"
+	switch vov := vgs1 - t.vto(); {
+	case vov <= 0:
+	case vds1 < vov:
+		region = "linear"
+	default:
+		region = "saturated"
+	}
+	return fmt.Sprintf("%-9s vgs=% .4e vds=% .4e id=% .4e", region, t.Pol*vgs, t.Pol*vds, id)
+}
@@ -0,0 +1,460 @@
+// modified nodal analysis, the other way to solve a circuit: one unknown
+// per node voltage plus one per current through a voltage source or an
+// inductor, stamped into a matrix and solved directly. the spanning tree
+// transfer functions give the small signal response, this gives the
+// numbers at a bias point and can step the circuit through time.
+// nonlinear devices are linearized around the last guess and solved
+// again until the guesses settle, newton-raphson
+// go build cspice.go netlist.go mna.go devices.go tran.go noise.go tolerance.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// conductance from every node to ground so a node hanging off
+// a capacitor still has a solution, spice does the same
+const gmin = 1e-12
+
+// when newton-raphson has settled
+const (
+	reltol = 1e-3
+	vntol  = 1e-6
+	abstol = 1e-12
+)
+
+var errNoConvergence = errors.New("no convergence")
+
+type Device interface {
+	Name() string
+	// claims the branch currents the device needs
+	Setup(m *MNA)
+	// adds the device, linearized around m.X, to m.A and m.B
+	Stamp(m *MNA)
+	// the current flowing into the first terminal
+	Current(m *MNA) float64
+	// m.X is taken as the solution at m.Time
+	Accept(m *MNA)
+}
+
+// devices with more to say at the operating point than a current
+type Reporter interface {
+	Report(m *MNA) string
+}
+
+type MNA struct {
+	Circuit *Circuit
+	Rows    map[int]int // node id to its row, ground has none
+	Size    int
+	A       [][]float64
+	B       []float64
+	X       []float64 // the solution, or the guess it is worked out from
+
+	Tran    bool    // the sources follow their waveforms
+	Time    float64 // time being solved for
+	H       float64 // step to it, 0 at dc
+	Euler   bool    // backward euler instead of the trapezoidal rule
+	Scale   float64 // of the sources, stepped up when dc won't converge
+	Limited bool    // a device held back a junction voltage this iteration
+}
+
+// a device between nodes A and B
+type Twoport struct {
+	ID   string
+	A, B int
+}
+
+func (d *Twoport) Name() string {
+	return d.ID
+}
+
+func (d *Twoport) Setup(m *MNA) {}
+
+func (d *Twoport) Accept(m *MNA) {}
+
+type RDevice struct {
+	Twoport
+	R float64
+}
+
+// the energy storing elements remember their voltage and current at
+// the last time point, the companion models work from them
+type CDevice struct {
+	Twoport
+	C    float64
+	v, i float64
+}
+
+type LDevice struct {
+	Twoport
+	L      float64
+	branch int
+	v, i   float64
+}
+
+type VDevice struct {
+	Twoport
+	Src    *Source
+	branch int
+}
+
+type IDevice struct {
+	Twoport
+	Src *Source
+}
+
+// current Gm * (V(C) - V(D)) from A through the device to B
+type GDevice struct {
+	Twoport
+	C, D int
+	Gm   float64
+}
+
+func (d *RDevice) Stamp(m *MNA) {
+	m.Conductance(d.A, d.B, 1/d.R)
+}
+
+func (d *RDevice) Current(m *MNA) float64 {
+	return (m.V(d.A) - m.V(d.B)) / d.R
+}
+
+// open at dc, in time a conductance in parallel with a current source
+func (d *CDevice) Stamp(m *MNA) {
+	if m.H == 0 {
+		return
+	}
+	g, i := d.companion(m)
+	m.Conductance(d.A, d.B, g)
+	m.CurrentSource(d.B, d.A, i)
+}
+
+func (d *CDevice) companion(m *MNA) (g, i float64) {
+	if m.Euler {
+		g = d.C / m.H
+		return g, g * d.v
+	}
+	g = 2 * d.C / m.H
+	return g, g*d.v + d.i
+}
+
+func (d *CDevice) Current(m *MNA) float64 {
+	if m.H == 0 {
+		return 0
+	}
+	g, i := d.companion(m)
+	return g*(m.V(d.A)-m.V(d.B)) - i
+}
+
+func (d *CDevice) Accept(m *MNA) {
+	d.i = d.Current(m)
+	d.v = m.V(d.A) - m.V(d.B)
+}
+
+func (d *LDevice) Setup(m *MNA) {
+	d.branch = m.Branch()
+}
+
+// shorted at dc, in time a resistor in series with a voltage source
+func (d *LDevice) Stamp(m *MNA) {
+	if m.H == 0 {
+		m.Voltage(d.A, d.B, d.branch, 0)
+		return
+	}
+	if m.Euler {
+		r := d.L / m.H
+		m.Voltage(d.A, d.B, d.branch, -r*d.i)
+		m.add(d.branch, d.branch, -r)
+		return
+	}
+	r := 2 * d.L / m.H
+	m.Voltage(d.A, d.B, d.branch, -r*d.i-d.v)
+	m.add(d.branch, d.branch, -r)
+}
+
+func (d *LDevice) Current(m *MNA) float64 {
+	return m.X[d.branch]
+}
+
+func (d *LDevice) Accept(m *MNA) {
+	d.i = m.X[d.branch]
+	d.v = m.V(d.A) - m.V(d.B)
+}
+
+func (d *VDevice) Setup(m *MNA) {
+	d.branch = m.Branch()
+}
+
+func (d *VDevice) Stamp(m *MNA) {
+	m.Voltage(d.A, d.B, d.branch, m.Value(d.Src))
+}
+
+func (d *VDevice) Current(m *MNA) float64 {
+	return m.X[d.branch]
+}
+
+func (d *IDevice) Stamp(m *MNA) {
+	m.CurrentSource(d.A, d.B, m.Value(d.Src))
+}
+
+func (d *IDevice) Current(m *MNA) float64 {
+	return m.Value(d.Src)
+}
+
+func (d *GDevice) Stamp(m *MNA) {
+	m.Transconductance(d.A, d.B, d.C, d.D, d.Gm)
+}
+
+func (d *GDevice) Current(m *MNA) float64 {
+	return d.Gm * (m.V(d.C) - m.V(d.D))
+}
+
+func NewMNA(ci *Circuit) *MNA {
+	m := &MNA{
+		Circuit: ci,
+		Rows:    make(map[int]int),
+		Scale:   1,
+	}
+	for _, n := range ci.Nodes {
+		if n.ID != 0 {
+			m.Rows[n.ID] = m.Branch()
+		}
+	}
+	for _, d := range ci.Devices {
+		d.Setup(m)
+	}
+	m.A = make([][]float64, m.Size)
+	for i := range m.A {
+		m.A[i] = make([]float64, m.Size)
+	}
+	m.B = make([]float64, m.Size)
+	m.X = make([]float64, m.Size)
+	return m
+}
+
+// a source's value at the time being solved for
+func (m *MNA) Value(src *Source) float64 {
+	v := src.DC
+	if m.Tran {
+		v = src.At(m.Time)
+	}
+	return v * m.Scale
+}
+
+// adds an unknown and returns its row
+func (m *MNA) Branch() int {
+	m.Size++
+	return m.Size - 1
+}
+
+func (m *MNA) row(node int) int {
+	r, found := m.Rows[node]
+	if !found {
+		return -1
+	}
+	return r
+}
+
+func (m *MNA) add(i, j int, v float64) {
+	if i >= 0 && j >= 0 {
+		m.A[i][j] += v
+	}
+}
+
+func (m *MNA) rhs(i int, v float64) {
+	if i >= 0 {
+		m.B[i] += v
+	}
+}
+
+func (m *MNA) V(node int) float64 {
+	if r := m.row(node); r >= 0 {
+		return m.X[r]
+	}
+	return 0
+}
+
+func (m *MNA) Conductance(a, b int, g float64) {
+	i, j := m.row(a), m.row(b)
+	m.add(i, i, g)
+	m.add(j, j, g)
+	m.add(i, j, -g)
+	m.add(j, i, -g)
+}
+
+// current i flows from a through the source to b
+func (m *MNA) CurrentSource(a, b int, i float64) {
+	m.rhs(m.row(a), -i)
+	m.rhs(m.row(b), i)
+}
+
+func (m *MNA) Transconductance(a, b, c, d int, gm float64) {
+	i, j := m.row(a), m.row(b)
+	k, l := m.row(c), m.row(d)
+	m.add(i, k, gm)
+	m.add(i, l, -gm)
+	m.add(j, k, -gm)
+	m.add(j, l, gm)
+}
+
+// V(a) - V(b) = v, the current in row br flows from a through the source to b
+func (m *MNA) Voltage(a, b, br int, v float64) {
+	i, j := m.row(a), m.row(b)
+	m.add(i, br, 1)
+	m.add(j, br, -1)
+	m.add(br, i, 1)
+	m.add(br, j, -1)
+	m.B[br] += v
+}
+
+func (m *MNA) load() {
+	for i := range m.A {
+		for j := range m.A[i] {
+			m.A[i][j] = 0
+		}
+		m.B[i] = 0
+	}
+	for _, r := range m.Rows {
+		m.A[r][r] += gmin
+	}
+	for _, d := range m.Circuit.Devices {
+		d.Stamp(m)
+	}
+}
+
+// solves the dc operating point. when newton-raphson gets lost the
+// sources are brought up from zero in steps, each solution the
+// start for the next
+func (m *MNA) Solve() error {
+	m.Scale = 1
+	_, err := m.Newton(100)
+	if err != errNoConvergence {
+		return err
+	}
+
+	for i := range m.X {
+		m.X[i] = 0
+	}
+	for step := 1; step <= 20; step++ {
+		m.Scale = float64(step) / 20
+		if _, err := m.Newton(100); err != nil {
+			return fmt.Errorf("%v with the sources at %.0f%%", err, 100*m.Scale)
+		}
+	}
+	return nil
+}
+
+// iterates from m.X until the solution stops moving, a linear
+// circuit takes two rounds, the second to see nothing changed
+func (m *MNA) Newton(maxiter int) (int, error) {
+	for iter := 1; iter <= maxiter; iter++ {
+		m.Limited = false
+		m.load()
+		x, err := solve(m.A, m.B)
+		if err != nil {
+			return iter, err
+		}
+		done := !m.Limited && m.converged(x)
+		m.X = x
+		if done {
+			return iter, nil
+		}
+	}
+	return maxiter, errNoConvergence
+}
+
+func (m *MNA) converged(x []float64) bool {
+	for i := range x {
+		tol := abstol
+		if i < len(m.Rows) {
+			tol = vntol
+		}
+		if math.Abs(x[i]-m.X[i]) > reltol*math.Max(math.Abs(x[i]), math.Abs(m.X[i]))+tol {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *MNA) Accept() {
+	for _, d := range m.Circuit.Devices {
+		d.Accept(m)
+	}
+}
+
+// gaussian elimination with partial pivoting, a and b are overwritten
+func solve(a [][]float64, b []float64) ([]float64, error) {
+	n := len(b)
+	for k := 0; k < n; k++ {
+		p := k
+		for i := k + 1; i < n; i++ {
+			if math.Abs(a[i][k]) > math.Abs(a[p][k]) {
+				p = i
+			}
+		}
+		if math.Abs(a[p][k]) < 1e-30 {
+			return nil, fmt.Errorf("singular matrix, is there a loop of voltage sources and inductors?")
+		}
+		a[k], a[p] = a[p], a[k]
+		b[k], b[p] = b[p], b[k]
+
+		for i := k + 1; i < n; i++ {
+			f := a[i][k] / a[k][k]
+			if f == 0 {
+				continue
+			}
+			for j := k; j < n; j++ {
+				a[i][j] -= f * a[k][j]
+			}
+			b[i] -= f * b[k]
+		}
+	}
+
+	x := make([]float64, n)
+	for i := n - 1; i >= 0; i-- {
+		s := b[i]
+		for j := i + 1; j < n; j++ {
+			s -= a[i][j] * x[j]
+		}
+		x[i] = s / a[i][i]
+	}
+	return x, nil
+}
+
+// prints the dc solution, capacitors open and inductors shorted
+func (sm *Simulation) doOp(cfg *Analysis) error {
+	m := NewMNA(sm.Circuit)
+	if err := m.Solve(); err != nil {
+		return fmt.Errorf("operating point: %v", err)
+	}
+	m.Print(sm.Out)
+	return nil
+}
+
+func (m *MNA) Print(w io.Writer) {
+	ci := m.Circuit
+	fmt.Fprintf(w, "===== Operating Point =====\n")
+	for _, n := range ci.Nodes {
+		if n.ID != 0 {
+			fmt.Fprintf(w, "%-12s % .6e V\n", "V("+ci.NodeName(n.ID)+")", m.V(n.ID))
+		}
+	}
+	fmt.Fprintf(w, "--------- Current --------\n")
+	for _, d := range ci.Devices {
+		fmt.Fprintf(w, "%-12s % .6e A\n", "I("+d.Name()+")", d.Current(m))
+	}
+	header := false
+	for _, d := range ci.Devices {
+		if r, ok := d.(Reporter); ok {
+			if !header {
+				fmt.Fprintf(w, "--------- Device ---------\n")
+				header = true
+			}
+			fmt.Fprintf(w, "%-12s %s\n", d.Name(), r.Report(m))
+		}
+	}
+	fmt.Fprintf(w, "==========================\n")
+}
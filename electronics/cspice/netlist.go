@@ -0,0 +1,1239 @@
+// reads the part of spice3 netlists cspice can do something with
+// go build cspice.go netlist.go mna.go devices.go tran.go noise.go tolerance.go
+//
+// the first line is the title, * starts a comment line and ; or $ the
+// rest of one, + continues the line before. case does not matter, nodes
+// have names or numbers and 0 or gnd is ground. understood are
+//
+// R C L name n+ n- value [tol=fraction|percent%]
+// V I   name n+ n- [[dc] value] [ac mag] [pulse(...)|sin(...)|pwl(...)]
+// G     name n+ n- nc+ nc- gm
+// D     name anode cathode model [area]
+// Q     name c b e [substrate] model [area]
+// M     name d g s b model [w=value] [l=value]
+// X     name nodes... subckt [param=value ...]
+// .param name=value ...
+// .subckt name nodes... [params: name=value ...] ... .ends
+// .model name d|npn|pnp|nmos|pmos (param=value ...)
+// .include file
+// .op
+// .ac dec|oct|lin points fstart fstop
+// .tran tstep tstop [tstart]
+// .measure tran name max|min|pp|avg|rms v(node) [from=t] [to=t]
+// .measure tran name find v(node) at=t
+// .measure tran name when v(node)=value
+// .noise v(node) source dec|oct|lin points fstart fstop
+// .sens v(node) ac dec|oct|lin points fstart fstop
+// .mc runs ac dec|oct|lin points fstart fstop [seed=n]
+// .print and .plot v(node) or v(node, node) to pick the output
+// .end
+//
+// values take the spice suffixes t g meg k m u n p f and mil, anything
+// after them is a unit and ignored, so 1F is a femtofarad. {expr} is
+// worked out with the parameters in scope and can use + - * / ^,
+// parentheses and a few math functions
+//
+// .ac becomes what LoadNetFile would make, a sweep of the transfer
+// from the source with an ac value, and .tran is solved by nodal
+// analysis, which also writes every node voltage to <netlist>-tran.csv.
+// the plots go to <netlist>-ac.eps, <netlist>-noise.eps and
+// <netlist>-tran.eps. .sens and .mc sweep the transfer from the ac
+// source too and all the analyses share the one output
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func isSpice(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".cir", ".sp", ".spice", ".ckt":
+		return true
+	}
+	return false
+}
+
+type spiceLine struct {
+	file   string
+	num    int
+	fields []string
+}
+
+func (l *spiceLine) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %v", l.file, l.num, fmt.Sprintf(format, args...))
+}
+
+type subckt struct {
+	name   string
+	ports  []string
+	params []string // name=value pairs as fields
+	body   []*spiceLine
+}
+
+// where a line is read: the top level or inside an instance of a
+// subcircuit, whose nodes and element names get the instance's prefix
+type scope struct {
+	prefix string
+	ports  map[string]string
+	params map[string]float64
+	depth  int
+}
+
+type spiceReader struct {
+	ci      *Circuit
+	top     *scope
+	base    string
+	subckts map[string]*subckt
+	models  map[string]*Model
+	cards   []*spiceLine // .model lines, read once the parameters are known
+	nodes   map[string]int
+	named   int
+	outputs int
+	nac     int
+	nnoise  int
+	ntran   int
+}
+
+func (ci *Circuit) LoadSpice(name string) error {
+	lines, title, err := readSpiceLines(name, true, 0)
+	if err != nil {
+		return err
+	}
+
+	ci.IDs = make(map[int]int)
+	ci.Names = make(map[int]string)
+	ci.Title = title
+	ci.NodeByID(0)
+	r := &spiceReader{
+		ci:      ci,
+		base:    strings.TrimSuffix(filepath.Base(name), filepath.Ext(name)),
+		subckts: make(map[string]*subckt),
+		models:  make(map[string]*Model),
+		nodes:   map[string]int{"0": 0, "gnd": 0},
+	}
+
+	top, err := r.collect(lines)
+	if err != nil {
+		return err
+	}
+	r.top = &scope{params: make(map[string]float64)}
+	if err := r.read(r.top, top); err != nil {
+		return err
+	}
+
+	// the first source with an ac value drives the sweeps
+	for _, cfg := range ci.Analyses {
+		if cfg.Type != 'F' && cfg.Type != 'S' && cfg.Type != 'M' {
+			continue
+		}
+		for _, src := range ci.Sources {
+			if src.AC != 0 {
+				cfg.Source = src.Name
+				break
+			}
+		}
+		if cfg.Source == "" {
+			return fmt.Errorf("%s: a sweep without a source with an ac value", name)
+		}
+	}
+
+	needed := false
+	for _, cfg := range ci.Analyses {
+		needed = needed || cfg.Type != 'O'
+	}
+	if r.outputs == 0 && needed {
+		id, found := r.nodes["out"]
+		if !found {
+			return fmt.Errorf("%s: no output, add a .print v(node)", name)
+		}
+		ci.OutputID = [2]int{id, 0}
+	}
+	return nil
+}
+
+// an included file has no title line and its names are
+// relative to the file including it
+func readSpiceLines(name string, hasTitle bool, depth int) ([]*spiceLine, string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	var (
+		lines []*spiceLine
+		title string
+	)
+	sc := bufio.NewScanner(f)
+	for num := 1; sc.Scan(); num++ {
+		text := sc.Text()
+		if num == 1 && hasTitle {
+			title = strings.TrimSpace(text)
+			continue
+		}
+		if strings.HasPrefix(text, "\x1a") {
+			break // dos end of file, old vendor models have them
+		}
+		if i := strings.IndexAny(text, ";$"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if fields := strings.Fields(text); len(fields) > 0 && strings.HasPrefix(strings.ToLower(fields[0]), ".inc") {
+			if len(fields) != 2 || depth > 10 {
+				return nil, "", fmt.Errorf("%s:%d: bad .include", name, num)
+			}
+			file := strings.Trim(fields[1], `"'`)
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(filepath.Dir(name), file)
+			}
+			more, _, err := readSpiceLines(file, false, depth+1)
+			if err != nil {
+				return nil, "", fmt.Errorf("%s:%d: %v", name, num, err)
+			}
+			lines = append(lines, more...)
+			continue
+		}
+
+		text = strings.ToLower(text)
+		if text == "" || text[0] == '*' {
+			continue
+		}
+		if text[0] == '+' {
+			if len(lines) == 0 {
+				return nil, "", fmt.Errorf("%s:%d: continuation without a line", name, num)
+			}
+			l := lines[len(lines)-1]
+			l.fields = append(l.fields, splitSpice(text[1:])...)
+			continue
+		}
+		if fields := splitSpice(text); len(fields) > 0 {
+			lines = append(lines, &spiceLine{name, num, fields})
+		}
+	}
+	return lines, title, sc.Err()
+}
+
+// splits on blanks and commas, parentheses and = are fields of their
+// own and {expressions} and 'expressions' are kept in one piece
+func splitSpice(text string) []string {
+	var (
+		fields []string
+		field  strings.Builder
+	)
+	flush := func() {
+		if field.Len() > 0 {
+			fields = append(fields, field.String())
+			field.Reset()
+		}
+	}
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; c {
+		case ' ', '\t', ',':
+			flush()
+		case '(', ')', '=':
+			flush()
+			fields = append(fields, string(c))
+		case '{', '\'':
+			end := byte('}')
+			if c == '\'' {
+				end = '\''
+			}
+			j := strings.IndexByte(text[i+1:], end)
+			if j < 0 {
+				j = len(text) - i - 1
+			}
+			flush()
+			fields = append(fields, "{"+text[i+1:i+1+j]+"}")
+			i += j + 1
+		default:
+			field.WriteByte(c)
+		}
+	}
+	flush()
+	return fields
+}
+
+// takes the subcircuit definitions and the models out of the lines,
+// models are global wherever they are defined
+func (r *spiceReader) collect(lines []*spiceLine) ([]*spiceLine, error) {
+	var (
+		top []*spiceLine
+		cur *subckt
+		end *spiceLine
+	)
+	for _, l := range lines {
+		switch l.fields[0] {
+		case ".subckt":
+			if cur != nil {
+				return nil, l.errorf(".subckt inside .subckt %s", cur.name)
+			}
+			if len(l.fields) < 2 {
+				return nil, l.errorf(".subckt without a name")
+			}
+			end = l
+			cur = &subckt{name: l.fields[1]}
+			args := l.fields[2:]
+			for i, f := range args {
+				if f == "params:" || (i+1 < len(args) && args[i+1] == "=") {
+					cur.params = args[i:]
+					if f == "params:" {
+						cur.params = args[i+1:]
+					}
+					break
+				}
+				cur.ports = append(cur.ports, f)
+			}
+			r.subckts[cur.name] = cur
+
+		case ".ends":
+			if cur == nil {
+				return nil, l.errorf(".ends without .subckt")
+			}
+			cur = nil
+
+		case ".model":
+			r.cards = append(r.cards, l)
+
+		default:
+			if cur != nil {
+				cur.body = append(cur.body, l)
+			} else {
+				top = append(top, l)
+			}
+		}
+	}
+	if cur != nil {
+		return nil, end.errorf(".subckt %s has no .ends", cur.name)
+	}
+	return top, nil
+}
+
+// .model name type [(] name=value ... [)], a value that doesn't read is
+// skipped, vendor models have all sorts in them
+func (r *spiceReader) model(l *spiceLine) error {
+	f := l.fields
+	if len(f) < 3 {
+		return l.errorf(".model needs a name and a type")
+	}
+	// a type nothing here can use is only an error if a device asks for it
+	md := &Model{Name: f[1], Type: f[2], Params: make(map[string]float64)}
+	for i := 3; i < len(f); i++ {
+		if i+2 < len(f) && f[i+1] == "=" {
+			if v, err := r.value(r.top, f[i+2]); err == nil {
+				md.Params[f[i]] = v
+			}
+			i += 2
+		}
+	}
+	r.models[md.Name] = md
+	return nil
+}
+
+func (r *spiceReader) lookupModel(name string, types ...string) (*Model, error) {
+	md, found := r.models[name]
+	if !found {
+		return nil, fmt.Errorf("unknown model %s", name)
+	}
+	for _, t := range types {
+		if md.Type == t {
+			return md, nil
+		}
+	}
+	return nil, fmt.Errorf("model %s is a %s, not a %s", name, md.Type, strings.Join(types, " or "))
+}
+
+// the parameters first, they hold wherever they are in the deck
+func (r *spiceReader) read(sc *scope, lines []*spiceLine) error {
+	var ps []param
+	for _, l := range lines {
+		if l.fields[0] == ".param" {
+			p, err := splitParams(l.fields[1:])
+			if err != nil {
+				return l.errorf("%v", err)
+			}
+			ps = append(ps, p...)
+		}
+	}
+	if err := r.setParams(sc, sc, ps); err != nil {
+		return fmt.Errorf(".param %v", err)
+	}
+	for _, l := range r.cards {
+		if err := r.model(l); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range lines {
+		if l.fields[0] == ".param" {
+			continue
+		}
+		err := r.line(sc, l.fields)
+		if err == errEnd {
+			break
+		}
+		if err != nil {
+			return l.errorf("%v", err)
+		}
+	}
+	return nil
+}
+
+var errEnd = errors.New(".end")
+
+func (r *spiceReader) line(sc *scope, f []string) error {
+	if f[0][0] == '.' {
+		if sc.depth > 0 && f[0] != ".param" {
+			return fmt.Errorf("%s in a subcircuit", f[0])
+		}
+		return r.control(sc, f)
+	}
+
+	name := sc.prefix + f[0]
+	switch f[0][0] {
+	case 'r', 'l', 'c':
+		if len(f) < 4 {
+			return fmt.Errorf("%s needs two nodes and a value", f[0])
+		}
+		v, err := r.value(sc, f[3])
+		if err != nil {
+			return err
+		}
+		if v == 0 && f[0][0] != 'c' {
+			return fmt.Errorf("%s is zero", f[0])
+		}
+		r.ci.AddComponent(rune(f[0][0]-'a'+'A'), name, r.node(sc, f[1]), r.node(sc, f[2]), v)
+		for i := 4; i+2 < len(f); i++ {
+			if f[i] == "tol" && f[i+1] == "=" {
+				tol, err := r.tolerance(sc, f[i+2])
+				if err != nil {
+					return err
+				}
+				r.ci.SetTolerance(name, tol)
+			}
+		}
+
+	case 'v', 'i':
+		if len(f) < 3 {
+			return fmt.Errorf("%s needs two nodes", f[0])
+		}
+		src, err := r.source(sc, f[3:])
+		if err != nil {
+			return fmt.Errorf("%s: %v", f[0], err)
+		}
+		src.Type = int(f[0][0] - 'a' + 'A')
+		src.Name = name
+		src.Node = [2]int{r.node(sc, f[1]), r.node(sc, f[2])}
+		if src.Node[0] == src.Node[1] {
+			return fmt.Errorf("%s is shorted", f[0])
+		}
+		if src.Type == 'I' {
+			src.Node[0], src.Node[1] = src.Node[1], src.Node[0]
+		}
+		r.ci.AddSource(src)
+
+	case 'g':
+		if len(f) < 6 {
+			return fmt.Errorf("%s needs four nodes and a value", f[0])
+		}
+		gm, err := r.value(sc, f[5])
+		if err != nil {
+			return err
+		}
+		r.ci.AddVCCS(name, r.node(sc, f[3]), r.node(sc, f[4]), r.node(sc, f[1]), r.node(sc, f[2]), gm)
+
+	case 'd':
+		if len(f) < 4 {
+			return fmt.Errorf("%s needs two nodes and a model", f[0])
+		}
+		md, err := r.lookupModel(f[3], "d")
+		if err != nil {
+			return err
+		}
+		area, err := r.area(sc, f[4:])
+		if err != nil {
+			return err
+		}
+		r.ci.Devices = append(r.ci.Devices, NewDiode(name, r.node(sc, f[1]), r.node(sc, f[2]), md, area))
+
+	case 'q':
+		// the substrate node is there if the fifth field isn't a model
+		if len(f) < 5 {
+			return fmt.Errorf("%s needs three nodes and a model", f[0])
+		}
+		m := 4
+		if _, found := r.models[f[4]]; !found && len(f) > 5 {
+			m = 5
+		}
+		md, err := r.lookupModel(f[m], "npn", "pnp")
+		if err != nil {
+			return err
+		}
+		area, err := r.area(sc, f[m+1:])
+		if err != nil {
+			return err
+		}
+		r.ci.Devices = append(r.ci.Devices, NewBJT(name, r.node(sc, f[1]), r.node(sc, f[2]), r.node(sc, f[3]), md, area))
+
+	case 'm':
+		if len(f) < 6 {
+			return fmt.Errorf("%s needs four nodes and a model", f[0])
+		}
+		md, err := r.lookupModel(f[5], "nmos", "pmos")
+		if err != nil {
+			return err
+		}
+		geom := &scope{params: make(map[string]float64)}
+		if err := r.params(sc, geom, f[6:]); err != nil {
+			return err
+		}
+		t, err := NewMOSFET(name, r.node(sc, f[1]), r.node(sc, f[2]), r.node(sc, f[3]), r.node(sc, f[4]), md, geom.params["w"], geom.params["l"])
+		if err != nil {
+			return err
+		}
+		r.ci.Devices = append(r.ci.Devices, t)
+
+	case 'x':
+		return r.instance(sc, f)
+
+	default:
+		return fmt.Errorf("unsupported element %s", f[0])
+	}
+	return nil
+}
+
+func (r *spiceReader) area(sc *scope, f []string) (float64, error) {
+	if len(f) == 0 {
+		return 1, nil
+	}
+	return r.value(sc, f[0])
+}
+
+// [[dc] value] [ac mag [phase]] [pulse(...)|sin(...)|pwl(...)]
+func (r *spiceReader) source(sc *scope, f []string) (*Source, error) {
+	src := &Source{}
+	dc := false
+	for i := 0; i < len(f); i++ {
+		var err error
+		switch f[i] {
+		case "dc":
+			if i+1 >= len(f) {
+				return nil, fmt.Errorf("dc without a value")
+			}
+			i++
+			src.DC, err = r.value(sc, f[i])
+			dc = true
+		case "ac":
+			src.AC = 1
+			if i+1 < len(f) && isValue(f[i+1]) {
+				i++
+				src.AC, err = r.value(sc, f[i])
+			}
+			// the transfer function has a phase of its own
+			if i+1 < len(f) && isValue(f[i+1]) {
+				i++
+			}
+		case "pulse", "sin", "pwl":
+			kind := f[i]
+			var args []string
+			args, i, err = parenArgs(f, i+1)
+			if err != nil {
+				return nil, err
+			}
+			v := make([]float64, len(args))
+			for j := range args {
+				if v[j], err = r.value(sc, args[j]); err != nil {
+					return nil, err
+				}
+			}
+			src.Wave, err = NewWave(kind, v)
+		default:
+			if i != 0 {
+				return nil, fmt.Errorf("unexpected %s", f[i])
+			}
+			src.DC, err = r.value(sc, f[i])
+			dc = true
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the transfer functions see a step from where the wave starts to
+	// where a pulse goes or a pwl ends
+	src.Prev, src.Next = src.DC, src.DC
+	if w := src.Wave; w != nil {
+		src.Prev, src.Next = w.At(0), w.At(0)
+		switch w.Kind {
+		case "pulse":
+			src.Next = w.Args[1]
+		case "pwl":
+			src.Next = w.Args[len(w.Args)-1]
+		}
+		if !dc {
+			src.DC = src.Prev
+		}
+	}
+	return src, nil
+}
+
+// the fields between the parentheses starting at f[i]
+func parenArgs(f []string, i int) ([]string, int, error) {
+	if i >= len(f) || f[i] != "(" {
+		return nil, i, fmt.Errorf("expected (")
+	}
+	for j := i + 1; j < len(f); j++ {
+		if f[j] == ")" {
+			return f[i+1 : j], j, nil
+		}
+	}
+	return nil, i, fmt.Errorf("missing )")
+}
+
+func (r *spiceReader) instance(sc *scope, f []string) error {
+	var (
+		nodes  []string
+		params []string
+	)
+	for i, s := range f[1:] {
+		if i+2 < len(f) && f[i+2] == "=" {
+			params = f[i+1:]
+			break
+		}
+		nodes = append(nodes, s)
+	}
+	if len(nodes) < 1 {
+		return fmt.Errorf("%s has no subcircuit", f[0])
+	}
+	name := nodes[len(nodes)-1]
+	nodes = nodes[:len(nodes)-1]
+	sub, found := r.subckts[name]
+	if !found {
+		return fmt.Errorf("%s: unknown subcircuit %s", f[0], name)
+	}
+	if len(nodes) != len(sub.ports) {
+		return fmt.Errorf("%s: %s has %d nodes, not %d", f[0], name, len(sub.ports), len(nodes))
+	}
+	if sc.depth > 20 {
+		return fmt.Errorf("%s: subcircuits nested too deep", f[0])
+	}
+
+	inner := &scope{
+		prefix: sc.prefix + f[0] + ".",
+		ports:  make(map[string]string),
+		params: make(map[string]float64),
+		depth:  sc.depth + 1,
+	}
+	for i, p := range sub.ports {
+		inner.ports[p] = r.nodeName(sc, nodes[i])
+	}
+	// the defaults see the global parameters,
+	// the ones given to the instance those around the instance
+	for k, v := range r.top.params {
+		inner.params[k] = v
+	}
+	if err := r.params(inner, inner, sub.params); err != nil {
+		return fmt.Errorf("%s: %v", f[0], err)
+	}
+	if err := r.params(sc, inner, params); err != nil {
+		return fmt.Errorf("%s: %v", f[0], err)
+	}
+
+	for _, l := range sub.body {
+		if err := r.line(inner, l.fields); err != nil {
+			return fmt.Errorf("%s: %v", f[0], l.errorf("%v", err))
+		}
+	}
+	return nil
+}
+
+// name = value ..., the values are worked out in from and set in to
+func (r *spiceReader) params(from, to *scope, f []string) error {
+	ps, err := splitParams(f)
+	if err != nil {
+		return err
+	}
+	return r.setParams(from, to, ps)
+}
+
+type param struct {
+	name string
+	expr string
+}
+
+func splitParams(f []string) ([]param, error) {
+	var ps []param
+	for i := 0; i < len(f); {
+		if i+2 >= len(f) || f[i+1] != "=" {
+			return nil, fmt.Errorf("expected name=value at %s", f[i])
+		}
+		// the value runs to the next name=
+		j := i + 3
+		for j < len(f) && !(j+1 < len(f) && f[j+1] == "=") {
+			j++
+		}
+		var expr []string
+		for _, s := range f[i+2 : j] {
+			expr = append(expr, strings.Trim(s, "{}"))
+		}
+		ps = append(ps, param{f[i], strings.Join(expr, " ")})
+		i = j
+	}
+	return ps, nil
+}
+
+// the parameters can use each other in any order, so the ones that
+// can't be worked out yet are tried again until nothing changes
+func (r *spiceReader) setParams(from, to *scope, ps []param) error {
+	for len(ps) > 0 {
+		var (
+			left []param
+			err  error
+		)
+		for _, p := range ps {
+			v, e := r.value(from, "{"+p.expr+"}")
+			if e != nil {
+				left, err = append(left, p), fmt.Errorf("%s: %v", p.name, e)
+				continue
+			}
+			to.params[p.name] = v
+		}
+		if len(left) == len(ps) {
+			return err
+		}
+		ps = left
+	}
+	return nil
+}
+
+func (r *spiceReader) control(sc *scope, f []string) error {
+	ci := r.ci
+	switch f[0] {
+	case ".param":
+		return r.params(sc, sc, f[1:])
+
+	case ".op":
+		ci.Analyses = append(ci.Analyses, &Analysis{Type: 'O'})
+
+	case ".ac":
+		cfg, err := r.sweep(sc, 'F', f[1:])
+		if err != nil {
+			return err
+		}
+		r.nac++
+		cfg.File = r.plotName("ac", r.nac)
+		ci.Analyses = append(ci.Analyses, cfg)
+
+	case ".noise":
+		node, i, err := r.probe(f, 1)
+		if err != nil {
+			return err
+		}
+		if i+1 >= len(f) {
+			return fmt.Errorf(".noise needs a source")
+		}
+		cfg, err := r.sweep(sc, 'N', f[i+2:])
+		if err != nil {
+			return err
+		}
+		if err := r.setOutput(node); err != nil {
+			return err
+		}
+		r.nnoise++
+		cfg.Source = f[i+1]
+		cfg.File = r.plotName("noise", r.nnoise)
+		ci.Analyses = append(ci.Analyses, cfg)
+
+	case ".sens":
+		node, i, err := r.probe(f, 1)
+		if err != nil {
+			return err
+		}
+		if i+1 >= len(f) || f[i+1] != "ac" {
+			return fmt.Errorf(".sens only does ac, v(node) ac and a sweep")
+		}
+		cfg, err := r.sweep(sc, 'S', f[i+2:])
+		if err != nil {
+			return err
+		}
+		if err := r.setOutput(node); err != nil {
+			return err
+		}
+		ci.Analyses = append(ci.Analyses, cfg)
+
+	case ".mc":
+		if len(f) < 3 || f[2] != "ac" {
+			return fmt.Errorf(".mc needs runs, ac and a sweep")
+		}
+		runs, err := r.value(sc, f[1])
+		if err != nil {
+			return err
+		}
+		if runs < 1 || runs != math.Trunc(runs) {
+			return fmt.Errorf("bad number of runs %s", f[1])
+		}
+		rest := f[3:]
+		seed := 1.0
+		if n := len(rest); n > 3 && rest[n-3] == "seed" && rest[n-2] == "=" {
+			if seed, err = r.value(sc, rest[n-1]); err != nil {
+				return err
+			}
+			rest = rest[:n-3]
+		}
+		cfg, err := r.sweep(sc, 'M', rest)
+		if err != nil {
+			return err
+		}
+		cfg.Runs = int(runs)
+		cfg.Seed = int64(seed)
+		ci.Analyses = append(ci.Analyses, cfg)
+
+	case ".tran":
+		if len(f) < 3 {
+			return fmt.Errorf(".tran needs tstep and tstop")
+		}
+		var v [3]float64
+		for i := 1; i < len(f) && i < 4; i++ {
+			var err error
+			if v[i-1], err = r.value(sc, f[i]); err != nil {
+				return err
+			}
+		}
+		if v[1] <= 0 || v[2] >= v[1] {
+			return fmt.Errorf("bad .tran times")
+		}
+		r.ntran++
+		ci.Analyses = append(ci.Analyses, &Analysis{
+			Type:  'T',
+			Start: v[2],
+			End:   v[1],
+			Step:  v[0],
+			File:  r.plotName("tran", r.ntran),
+			MNA:   true,
+		})
+
+	case ".measure", ".meas":
+		return r.measure(sc, f[1:])
+
+	case ".print", ".plot":
+		return r.output(f[1:])
+
+	case ".end":
+		return errEnd
+
+	case ".options", ".option", ".temp", ".width", ".save", ".probe":
+
+	default:
+		fmt.Fprintf(os.Stderr, "cspice: ignoring %s\n", f[0])
+	}
+	return nil
+}
+
+func (r *spiceReader) plotName(kind string, n int) string {
+	if n > 1 {
+		return fmt.Sprintf("%s-%s%d.eps", r.base, kind, n)
+	}
+	return fmt.Sprintf("%s-%s.eps", r.base, kind)
+}
+
+// [ac|tran|dc] v(node) or v(node, node), the first one is the output
+func (r *spiceReader) output(f []string) error {
+	if len(f) > 0 && (f[0] == "ac" || f[0] == "tran" || f[0] == "dc") {
+		f = f[1:]
+	}
+	for i := 0; i < len(f); i++ {
+		node, j, err := r.probe(f, i)
+		if err != nil {
+			return err
+		}
+		i = j
+
+		if r.outputs++; r.outputs > 1 {
+			fmt.Fprintf(os.Stderr, "cspice: only the first output is plotted\n")
+			continue
+		}
+		r.ci.OutputID = node
+	}
+	return nil
+}
+
+// dec|oct|lin points fstart fstop
+func (r *spiceReader) sweep(sc *scope, typ int, f []string) (*Analysis, error) {
+	if len(f) != 4 {
+		return nil, fmt.Errorf("a sweep is dec, oct or lin, points, fstart and fstop")
+	}
+	var v [3]float64
+	for i := range v {
+		var err error
+		if v[i], err = r.value(sc, f[i+1]); err != nil {
+			return nil, err
+		}
+	}
+	cfg := &Analysis{Type: typ, Start: v[1], End: v[2], Step: v[0]}
+	switch f[0] {
+	case "dec":
+	case "oct":
+		cfg.Step *= math.Log2(10)
+	case "lin":
+		cfg.Linear = true
+	default:
+		return nil, fmt.Errorf("unknown sweep %s", f[0])
+	}
+	if cfg.Start <= 0 && !cfg.Linear || cfg.End < cfg.Start || cfg.Step < 1 {
+		return nil, fmt.Errorf("bad sweep")
+	}
+	return cfg, nil
+}
+
+// the transfers are all to the one output
+func (r *spiceReader) setOutput(node [2]int) error {
+	if r.outputs > 0 && r.ci.OutputID != node {
+		return fmt.Errorf("the output is already v(%s)", r.ci.NodeName(r.ci.OutputID[0]))
+	}
+	r.outputs++
+	r.ci.OutputID = node
+	return nil
+}
+
+func (r *spiceReader) tolerance(sc *scope, s string) (float64, error) {
+	scale := 1.0
+	if strings.HasSuffix(s, "%") {
+		s, scale = strings.TrimSuffix(s, "%"), 0.01
+	}
+	v, err := r.value(sc, s)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("bad tolerance %s", s)
+	}
+	return v * scale, nil
+}
+
+// v(node) or v(node, node) at f[i], and where it ends
+func (r *spiceReader) probe(f []string, i int) ([2]int, int, error) {
+	var node [2]int
+	if i >= len(f) || f[i] != "v" {
+		return node, i, fmt.Errorf("can only look at node voltages")
+	}
+	args, j, err := parenArgs(f, i+1)
+	if err != nil {
+		return node, i, err
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return node, i, fmt.Errorf("v() takes one or two nodes")
+	}
+	node[0] = r.node(r.top, args[0])
+	if len(args) == 2 {
+		node[1] = r.node(r.top, args[1])
+	}
+	return node, j, nil
+}
+
+func (r *spiceReader) measure(sc *scope, f []string) error {
+	if len(f) < 4 || f[0] != "tran" {
+		return fmt.Errorf(".measure takes tran, a name and what to measure")
+	}
+	ms := &Measure{Name: f[1], Kind: f[2]}
+	node, i, err := r.probe(f, 3)
+	if err != nil {
+		return err
+	}
+	ms.Node = node
+	rest := f[i+1:]
+	switch ms.Kind {
+	case "when":
+		if len(rest) < 2 || rest[0] != "=" {
+			return fmt.Errorf("when needs v(node)=value")
+		}
+		if ms.Value, err = r.value(sc, rest[1]); err != nil {
+			return err
+		}
+		rest = rest[2:]
+	case "find", "max", "min", "pp", "avg", "rms":
+	default:
+		return fmt.Errorf("unknown measurement %s", ms.Kind)
+	}
+
+	opts := &scope{params: make(map[string]float64)}
+	if err := r.params(sc, opts, rest); err != nil {
+		return err
+	}
+	ms.From, ms.To = opts.params["from"], opts.params["to"]
+	at, found := opts.params["at"]
+	if ms.Kind == "find" && !found {
+		return fmt.Errorf("find needs at=time")
+	}
+	ms.At = at
+	r.ci.Measures = append(r.ci.Measures, ms)
+	return nil
+}
+
+// the node's name once the subcircuit instances are taken off
+func (r *spiceReader) nodeName(sc *scope, name string) string {
+	if outer, found := sc.ports[name]; found {
+		return outer
+	}
+	if name == "0" || name == "gnd" {
+		return "0"
+	}
+	return sc.prefix + name
+}
+
+// numbered nodes keep their number, named ones count down from -1
+// so the two never clash
+func (r *spiceReader) node(sc *scope, name string) int {
+	name = r.nodeName(sc, name)
+	if id, found := r.nodes[name]; found {
+		return id
+	}
+	id, err := strconv.Atoi(name)
+	if err != nil || id <= 0 {
+		r.named--
+		id = r.named
+	}
+	r.nodes[name] = id
+	r.ci.Names[id] = name
+	r.ci.NodeByID(id)
+	return id
+}
+
+func (r *spiceReader) value(sc *scope, s string) (float64, error) {
+	if strings.HasPrefix(s, "{") {
+		e := &spiceExpr{s: strings.TrimSuffix(s[1:], "}"), params: sc.params}
+		return e.parse()
+	}
+	if v, n := spiceNumber(s); n > 0 {
+		return v, nil
+	}
+	return 0, fmt.Errorf("bad value %s", s)
+}
+
+func isValue(s string) bool {
+	_, n := spiceNumber(s)
+	return n > 0 || strings.HasPrefix(s, "{")
+}
+
+// reads a number with its suffix and unit off the front of s,
+// n is how much of s it took
+func spiceNumber(s string) (v float64, n int) {
+	i := 0
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		i++
+	}
+	digits := 0
+	for ; i < len(s) && (isDigit(s[i]) || s[i] == '.'); i++ {
+		if s[i] != '.' {
+			digits++
+		}
+	}
+	if digits == 0 {
+		return 0, 0
+	}
+	if i < len(s) && s[i] == 'e' {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if j < len(s) && isDigit(s[j]) {
+			for i = j; i < len(s) && isDigit(s[i]); i++ {
+			}
+		}
+	}
+	v, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, 0
+	}
+
+	j := i
+	for j < len(s) && isLetter(s[j]) {
+		j++
+	}
+	suffix := s[i:j]
+	switch {
+	case strings.HasPrefix(suffix, "meg"):
+		v *= 1e6
+	case strings.HasPrefix(suffix, "mil"):
+		v *= 25.4e-6
+	case suffix == "":
+	default:
+		switch suffix[0] {
+		case 't':
+			v *= 1e12
+		case 'g':
+			v *= 1e9
+		case 'k':
+			v *= 1e3
+		case 'm':
+			v *= 1e-3
+		case 'u':
+			v *= 1e-6
+		case 'n':
+			v *= 1e-9
+		case 'p':
+			v *= 1e-12
+		case 'f':
+			v *= 1e-15
+		}
+	}
+	return v, j
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || c == '_'
+}
+
+// recursive descent over the text of a {expression}
+type spiceExpr struct {
+	s      string
+	pos    int
+	params map[string]float64
+}
+
+func (e *spiceExpr) parse() (v float64, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("{%s}: %v", e.s, x)
+		}
+	}()
+	v = e.sum()
+	if e.skip(); e.pos < len(e.s) {
+		panic(fmt.Sprintf("unexpected %q", e.s[e.pos:]))
+	}
+	return
+}
+
+func (e *spiceExpr) skip() {
+	for e.pos < len(e.s) && e.s[e.pos] == ' ' {
+		e.pos++
+	}
+}
+
+func (e *spiceExpr) accept(op string) bool {
+	e.skip()
+	if strings.HasPrefix(e.s[e.pos:], op) {
+		e.pos += len(op)
+		return true
+	}
+	return false
+}
+
+func (e *spiceExpr) sum() float64 {
+	v := e.product()
+	for {
+		switch {
+		case e.accept("+"):
+			v += e.product()
+		case e.accept("-"):
+			v -= e.product()
+		default:
+			return v
+		}
+	}
+}
+
+func (e *spiceExpr) product() float64 {
+	v := e.unary()
+	for {
+		switch {
+		case e.accept("*"):
+			v *= e.unary()
+		case e.accept("/"):
+			v /= e.unary()
+		default:
+			return v
+		}
+	}
+}
+
+func (e *spiceExpr) unary() float64 {
+	switch {
+	case e.accept("-"):
+		return -e.unary()
+	case e.accept("+"):
+		return e.unary()
+	}
+	// right associative and tighter than unary minus
+	v := e.atom()
+	if e.accept("**") || e.accept("^") {
+		return math.Pow(v, e.unary())
+	}
+	return v
+}
+
+var spiceFuncs = map[string]func(a []float64) float64{
+	"sqrt":  func(a []float64) float64 { return math.Sqrt(a[0]) },
+	"exp":   func(a []float64) float64 { return math.Exp(a[0]) },
+	"log":   func(a []float64) float64 { return math.Log(a[0]) },
+	"ln":    func(a []float64) float64 { return math.Log(a[0]) },
+	"log10": func(a []float64) float64 { return math.Log10(a[0]) },
+	"abs":   func(a []float64) float64 { return math.Abs(a[0]) },
+	"sin":   func(a []float64) float64 { return math.Sin(a[0]) },
+	"cos":   func(a []float64) float64 { return math.Cos(a[0]) },
+	"pow":   func(a []float64) float64 { return math.Pow(a[0], a[1]) },
+	"min":   func(a []float64) float64 { return math.Min(a[0], a[1]) },
+	"max":   func(a []float64) float64 { return math.Max(a[0], a[1]) },
+}
+
+func (e *spiceExpr) atom() float64 {
+	e.skip()
+	if e.accept("(") {
+		v := e.sum()
+		if !e.accept(")") {
+			panic("missing )")
+		}
+		return v
+	}
+	if v, n := spiceNumber(e.s[e.pos:]); n > 0 {
+		e.pos += n
+		return v
+	}
+
+	start := e.pos
+	for e.pos < len(e.s) && (isLetter(e.s[e.pos]) || e.pos > start && isDigit(e.s[e.pos])) {
+		e.pos++
+	}
+	name := e.s[start:e.pos]
+	if name == "" {
+		panic(fmt.Sprintf("unexpected %q", e.s[e.pos:]))
+	}
+	if fn, found := spiceFuncs[name]; found && e.accept("(") {
+		var args []float64
+		for {
+			args = append(args, e.sum())
+			if !e.accept(",") {
+				break
+			}
+		}
+		if !e.accept(")") {
+			panic("missing )")
+		}
+		if n := 1 + btoi(name == "pow" || name == "min" || name == "max"); len(args) != n {
+			panic(fmt.Sprintf("%s takes %d arguments", name, n))
+		}
+		return fn(args)
+	}
+	if name == "pi" {
+		return math.Pi
+	}
+	v, found := e.params[name]
+	if !found {
+		panic(fmt.Sprintf("unknown parameter %s", name))
+	}
+	return v
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
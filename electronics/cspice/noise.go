@@ -0,0 +1,146 @@
+// noise analysis, the thermal noise of every resistor taken to the
+// output through a transfer function of its own and added up as
+// powers, they are uncorrelated. each resistor is a noise current
+// 4kT/R across it, the voltage sources are quiet and shorted like they
+// are for any transfer. the density is plotted in V/sqrt(Hz) and the
+// noise over the sweep printed, at the output and referred back to the
+// input through the transfer from the source
+// go build cspice.go netlist.go mna.go devices.go tran.go noise.go tolerance.go
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"math/cmplx"
+)
+
+// the resistors are as warm as the devices, see vt
+const noiseTemp = 27
+
+// johnson noise, from ../johnson_noise.go
+// Vn = sqrt(4 * k_b * T * df * R)
+// T temperature (C), df (fmax - fmin) (Hz), R resistance (ohms)
+func JN(T, fmin, fmax, R float64) float64 {
+	const k_b = 1.38064852e-23
+	return math.Sqrt(4 * k_b * (273.15 + T) * (fmax - fmin) * R)
+}
+
+type noiseSource struct {
+	Name string
+	In   float64 // current density, A/sqrt(Hz)
+	Tf   Transfer
+	Out  []float64 // its density at the output at each frequency
+}
+
+func (sm *Simulation) doNoise(cfg *Analysis) error {
+	_, tf, err := sm.sourceTransfer(cfg.Source)
+	if err != nil {
+		return err
+	}
+
+	// the trees of every resistor would bury the ones of the sources
+	w := sm.Log
+	sm.Log = io.Discard
+	ci := sm.Circuit
+	var srcs []*noiseSource
+	for _, d := range ci.Devices {
+		r, ok := d.(*RDevice)
+		if !ok {
+			continue
+		}
+		ns := &noiseSource{
+			Name: r.ID,
+			In:   JN(noiseTemp, 0, 1, r.R) / r.R,
+		}
+		// the trees take the current from a node of its own, the other
+		// side can be one with a voltage source. with sources on both
+		// sides the noise goes into them and never reaches the output
+		a, b := ci.NodeByID(r.A), ci.NodeByID(r.B)
+		if len(a.Equivs) > 0 {
+			a, b = b, a
+		}
+		if len(a.Equivs) == 0 {
+			ns.Tf = sm.findFormula(&Source{Type: 'I', Name: r.ID, Node: [2]int{a.ID, b.ID}})
+		}
+		srcs = append(srcs, ns)
+	}
+	sm.Log = w
+
+	t := cfg.Frequencies()
+	out := make([]float64, len(t))
+	in := make([]float64, len(t))
+	for i, freq := range t {
+		for _, ns := range srcs {
+			v := ns.In * gain(&ns.Tf, freq)
+			ns.Out = append(ns.Out, v)
+			out[i] += v * v
+		}
+		out[i] = math.Sqrt(out[i])
+		in[i] = out[i] / gain(&tf, freq)
+	}
+	sm.plotNoise(t, out, cfg)
+
+	fmt.Fprintf(sm.Out, "===== Noise %.3e to %.3e Hz =====\n", t[0], t[len(t)-1])
+	fmt.Fprintf(sm.Out, "%-12s % .6e V\n", "onoise", integrateNoise(t, out))
+	fmt.Fprintf(sm.Out, "%-12s % .6e V\n", "inoise", integrateNoise(t, in))
+	fmt.Fprintf(sm.Out, "--------- Source ---------\n")
+	for _, ns := range srcs {
+		fmt.Fprintf(sm.Out, "%-12s % .6e V\n", ns.Name, integrateNoise(t, ns.Out))
+	}
+	fmt.Fprintf(sm.Out, "==========================\n")
+	return nil
+}
+
+// |H| at freq, 0 for a transfer that was never worked out
+func gain(tf *Transfer, freq float64) float64 {
+	if tf.Den == nil {
+		return 0
+	}
+	return cmplx.Abs(tf.At(freq))
+}
+
+// the rms voltage of a density over the sweep, the power between two
+// points taken as a f^k through both, which is exact for the flat
+// parts and the 1/f^2 of a rolled off response
+func integrateNoise(t, v []float64) float64 {
+	sum := 0.0
+	for i := 1; i < len(t); i++ {
+		f1, f2 := t[i-1], t[i]
+		p1, p2 := v[i-1]*v[i-1], v[i]*v[i]
+		if f1 <= 0 || p1 <= 0 || p2 <= 0 {
+			sum += (f2 - f1) * (p1 + p2) / 2
+			continue
+		}
+		r := math.Log(f2 / f1)
+		k := math.Log(p2/p1) / r
+		if math.Abs(k+1) < 1e-9 {
+			sum += p1 * f1 * r
+		} else {
+			sum += (p2*f2 - p1*f1) / (k + 1)
+		}
+	}
+	return math.Sqrt(sum)
+}
+
+func (sm *Simulation) plotNoise(t, y []float64, cfg *Analysis) {
+	w := bufio.NewWriter(sm.PlotFile)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "set terminal postscript eps enhanced color solid\n")
+	fmt.Fprintf(w, "set output '%s'\n", cfg.File)
+	fmt.Fprintf(w, "set title 'Output noise'\n")
+	fmt.Fprintf(w, "set xlabel 'Frequency (Hz)'\n")
+	fmt.Fprintf(w, "set ylabel 'Density (V/sqrt(Hz))'\n")
+	fmt.Fprintf(w, "set log xy\n")
+	fmt.Fprintf(w, "plot '-' title '' with line\n")
+
+	for i := range t {
+		fmt.Fprintf(w, "%v %v\n", t[i], y[i])
+	}
+
+	fmt.Fprintf(w, "e\n")
+	fmt.Fprintf(w, "unset log\n")
+}
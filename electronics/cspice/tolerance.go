@@ -0,0 +1,236 @@
+// what the element values do to the frequency response. the gain is
+// the peak of |H| over the sweep and the corner the first frequency
+// past the peak where it is 3dB down, above it or below it when the
+// response doesn't fall above, a highpass. both are worked out again
+// from the trees of the transfer for other values, the trees don't
+// change with the values
+//
+// sensitivity changes each element by a little and prints how much
+// gain and corner move for it, relative to how much the value did, so
+// -1 is a corner that goes down 1% when the value goes up 1%.
+// monte carlo draws every element with a tolerance evenly from its
+// range and prints the spread of gain and corner over the runs
+// go build cspice.go netlist.go mna.go devices.go tran.go noise.go tolerance.go
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"sort"
+)
+
+// the peak gain over the sweep t and the corner frequency, NaN
+// when the response doesn't fall 3dB on either side of the peak
+func response(tf *Transfer, t []float64) (peak, gain, corner float64) {
+	p := 0
+	mag := make([]float64, len(t))
+	for i, freq := range t {
+		mag[i] = cmplx.Abs(tf.At(freq))
+		if mag[i] > mag[p] {
+			p = i
+		}
+	}
+	gain = mag[p]
+	level := gain / math.Sqrt2
+
+	// bisect the crossing between the sweep points around it
+	cross := func(lo, hi float64) float64 {
+		below := cmplx.Abs(tf.At(hi)) < level
+		for i := 0; i < 60; i++ {
+			mid := math.Sqrt(lo * hi)
+			if (cmplx.Abs(tf.At(mid)) < level) == below {
+				hi = mid
+			} else {
+				lo = mid
+			}
+		}
+		return math.Sqrt(lo * hi)
+	}
+	for i := p + 1; i < len(t); i++ {
+		if mag[i] < level {
+			return t[p], gain, cross(t[i-1], t[i])
+		}
+	}
+	for i := p - 1; i >= 0; i-- {
+		if mag[i] < level && t[i] > 0 {
+			return t[p], gain, cross(t[i+1], t[i])
+		}
+	}
+	return t[p], gain, math.NaN()
+}
+
+// the elements by name in the order of the netlist, a vccs is two
+func (ci *Circuit) elementsByName() ([]string, map[string][]*Component) {
+	var names []string
+	m := make(map[string][]*Component)
+	for _, ce := range ci.Elems {
+		cp := ce.Base()
+		if _, found := m[cp.Name]; !found {
+			names = append(names, cp.Name)
+		}
+		m[cp.Name] = append(m[cp.Name], cp)
+	}
+	return names, m
+}
+
+func setValue(cps []*Component, v float64) {
+	for _, cp := range cps {
+		cp.Value = v
+	}
+}
+
+func (sm *Simulation) doSens(cfg *Analysis) error {
+	_, tf, err := sm.sourceTransfer(cfg.Source)
+	if err != nil {
+		return err
+	}
+	t := cfg.Frequencies()
+	peak, gain, corner := response(&tf, t)
+
+	ci := sm.Circuit
+	w := sm.Out
+	fmt.Fprintf(w, "===== Sensitivity to %s =====\n", cfg.Source)
+	fmt.Fprintf(w, "%-12s % .6e at % .6e Hz\n", "gain", gain, peak)
+	fmt.Fprintf(w, "%-12s % .6e Hz\n", "corner", corner)
+	fmt.Fprintf(w, "--------- Element --------\n")
+	fmt.Fprintf(w, "%-12s %-13s %-8s %s\n", "", "value", "gain", "corner")
+
+	// central differences, the trees make every gain a ratio of
+	// polynomials in the values so these are as good as exact
+	const d = 1e-4
+	names, elems := ci.elementsByName()
+	for _, name := range names {
+		cps := elems[name]
+		v := cps[0].Value
+		if v == 0 {
+			continue
+		}
+		var g, c [2]float64
+		for i, f := range []float64{1 - d, 1 + d} {
+			setValue(cps, v*f)
+			tf.Expand()
+			g[i] = cmplx.Abs(tf.At(peak))
+			_, _, c[i] = response(&tf, t)
+		}
+		setValue(cps, v)
+		sg := (g[1] - g[0]) / (2 * d * gain)
+		sc := (c[1] - c[0]) / (2 * d * corner)
+		fmt.Fprintf(w, "%-12s % .6e %s %s\n", name, v, sensitivity(sg), sensitivity(sc))
+	}
+	tf.Expand()
+	fmt.Fprintf(w, "==========================\n")
+	return nil
+}
+
+// without the -0.0000 of what should be no change at all
+func sensitivity(s float64) string {
+	if math.Abs(s) < 5e-5 {
+		s = 0
+	}
+	return fmt.Sprintf("% .4f", s)
+}
+
+type stats struct {
+	n                   int
+	sum, sum2, min, max float64
+	x                   []float64
+}
+
+func (s *stats) add(x float64) {
+	if math.IsNaN(x) {
+		return
+	}
+	if s.n == 0 || x < s.min {
+		s.min = x
+	}
+	if s.n == 0 || x > s.max {
+		s.max = x
+	}
+	s.n++
+	s.sum += x
+	s.sum2 += x * x
+	s.x = append(s.x, x)
+}
+
+func (s *stats) mean() float64 {
+	return s.sum / float64(s.n)
+}
+
+func (s *stats) sigma() float64 {
+	if s.n < 2 {
+		return 0
+	}
+	m := s.mean()
+	return math.Sqrt(math.Max(0, (s.sum2-float64(s.n)*m*m)/float64(s.n-1)))
+}
+
+// the value p of the way up the sorted samples
+func (s *stats) percentile(p float64) float64 {
+	sort.Float64s(s.x)
+	return s.x[int(p*float64(s.n-1)+0.5)]
+}
+
+func (s *stats) print(w io.Writer, name string, nominal float64) {
+	if s.n == 0 {
+		fmt.Fprintf(w, "%-12s nominal % .6e, no runs\n", name, nominal)
+		return
+	}
+	fmt.Fprintf(w, "%-12s nominal % .6e mean % .6e sigma % .6e\n", name, nominal, s.mean(), s.sigma())
+	fmt.Fprintf(w, "%-12s min     % .6e 1%%   % .6e 99%%   % .6e max % .6e\n", "",
+		s.min, s.percentile(0.01), s.percentile(0.99), s.max)
+}
+
+func (sm *Simulation) doMonteCarlo(cfg *Analysis) error {
+	_, tf, err := sm.sourceTransfer(cfg.Source)
+	if err != nil {
+		return err
+	}
+	ci := sm.Circuit
+	if len(ci.Tolerances) == 0 {
+		return fmt.Errorf("monte carlo: no element has a tolerance")
+	}
+	t := cfg.Frequencies()
+	_, gain, corner := response(&tf, t)
+
+	names, elems := ci.elementsByName()
+	nominal := make(map[string]float64)
+	for _, name := range names {
+		if _, found := ci.Tolerances[name]; found {
+			nominal[name] = elems[name][0].Value
+		}
+	}
+	for name := range ci.Tolerances {
+		if _, found := elems[name]; !found {
+			return fmt.Errorf("monte carlo: tolerance for %s, which isn't an element", name)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	var g, c stats
+	for run := 0; run < cfg.Runs; run++ {
+		// in the order of the netlist so a seed gives the same runs
+		for _, name := range names {
+			if tol, found := ci.Tolerances[name]; found {
+				setValue(elems[name], nominal[name]*(1+tol*(2*rng.Float64()-1)))
+			}
+		}
+		tf.Expand()
+		_, rg, rc := response(&tf, t)
+		g.add(20 * math.Log10(rg))
+		c.add(rc)
+	}
+	for name, v := range nominal {
+		setValue(elems[name], v)
+	}
+
+	w := sm.Out
+	fmt.Fprintf(w, "===== Monte Carlo, %d runs =====\n", cfg.Runs)
+	g.print(w, "gain (dB)", 20*math.Log10(gain))
+	c.print(w, "corner (Hz)", corner)
+	fmt.Fprintf(w, "==========================\n")
+	return nil
+}
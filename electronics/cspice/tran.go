@@ -0,0 +1,410 @@
+// transient analysis by nodal analysis, for what the transfer functions
+// can't do: nonlinear devices and sources that do more than one step.
+// trapezoidal companion models, backward euler for the step after a
+// corner of a source, and a time step that grows while a straight line
+// through the last two points predicts the next one well and shrinks
+// when it doesn't or newton-raphson struggles
+// go build cspice.go netlist.go mna.go devices.go tran.go noise.go tolerance.go
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pulse(v1 v2 td tr tf pw per), sin(vo va freq td theta)
+// and pwl(t1 v1 t2 v2 ...)
+type Wave struct {
+	Kind string
+	Args []float64
+}
+
+func NewWave(kind string, args []float64) (*Wave, error) {
+	w := &Wave{Kind: kind}
+	var defaults []float64
+	switch kind {
+	case "pulse":
+		defaults = []float64{0, 0, 0, 0, 0, math.Inf(1), 0}
+	case "sin":
+		defaults = []float64{0, 0, 0, 0, 0}
+	case "pwl":
+		if len(args) < 2 || len(args)%2 != 0 {
+			return nil, fmt.Errorf("pwl needs time and value pairs")
+		}
+		for i := 2; i < len(args); i += 2 {
+			if args[i] < args[i-2] {
+				return nil, fmt.Errorf("pwl times go backwards")
+			}
+		}
+		w.Args = args
+		return w, nil
+	}
+	if len(args) < 2 || len(args) > len(defaults) {
+		return nil, fmt.Errorf("%s takes 2 to %d values", kind, len(defaults))
+	}
+	w.Args = append(args, defaults[len(args):]...)
+	return w, nil
+}
+
+func (w *Wave) At(t float64) float64 {
+	a := w.Args
+	switch w.Kind {
+	case "pulse":
+		v1, v2, td, tr, tf, pw, per := a[0], a[1], a[2], a[3], a[4], a[5], a[6]
+		if t <= td {
+			return v1
+		}
+		t -= td
+		if per > 0 {
+			t = math.Mod(t, per)
+		}
+		switch {
+		case t < tr:
+			return v1 + (v2-v1)*t/tr
+		case t <= tr+pw:
+			return v2
+		case t < tr+pw+tf:
+			return v2 + (v1-v2)*(t-tr-pw)/tf
+		}
+		return v1
+
+	case "sin":
+		vo, va, freq, td, theta := a[0], a[1], a[2], a[3], a[4]
+		if t <= td {
+			return vo
+		}
+		t -= td
+		return vo + va*math.Exp(-t*theta)*math.Sin(2*math.Pi*freq*t)
+	}
+
+	if t <= a[0] {
+		return a[1]
+	}
+	for i := 2; i < len(a); i += 2 {
+		if t <= a[i] {
+			return a[i-1] + (a[i+1]-a[i-1])*(t-a[i-2])/(a[i]-a[i-2])
+		}
+	}
+	return a[len(a)-1]
+}
+
+// the next corner after t, where the solver should land and start afresh
+func (w *Wave) Next(t float64) float64 {
+	eps := 1e-12 * math.Max(math.Abs(t), 1e-9)
+	next := math.Inf(1)
+	a := w.Args
+	switch w.Kind {
+	case "pulse":
+		td, tr, tf, pw, per := a[2], a[3], a[4], a[5], a[6]
+		base := td
+		if per > 0 && t > td {
+			base += math.Floor((t-td)/per) * per
+		}
+		for _, b := range []float64{base, base + per} {
+			for _, off := range []float64{0, tr, tr + pw, tr + pw + tf} {
+				if b+off > t+eps && b+off < next {
+					next = b + off
+				}
+			}
+			if per <= 0 {
+				break
+			}
+		}
+	case "sin":
+		if a[3] > t+eps {
+			next = a[3]
+		}
+	case "pwl":
+		for i := 0; i < len(a); i += 2 {
+			if a[i] > t+eps {
+				return a[i]
+			}
+		}
+	}
+	return next
+}
+
+// a source without a waveform steps from Prev to Next at 0
+func (s *Source) At(t float64) float64 {
+	if s.Wave != nil {
+		return s.Wave.At(t)
+	}
+	if t <= 0 {
+		return s.Prev
+	}
+	return s.Next
+}
+
+// .measure tran name kind v(node[, node]) ...
+// max min pp avg rms over [From, To], find the value at At
+// and when the time the voltage first crosses Value
+type Measure struct {
+	Name   string
+	Kind   string
+	Node   [2]int
+	From   float64
+	To     float64
+	At     float64
+	Value  float64
+	Result float64
+}
+
+type waveform struct {
+	t []float64
+	x [][]float64
+}
+
+func (sm *Simulation) doTransient(cfg *Analysis) error {
+	ci := sm.Circuit
+	m := NewMNA(ci)
+	m.Tran = true
+	if err := m.Solve(); err != nil {
+		return fmt.Errorf("transient: initial point: %v", err)
+	}
+	m.Accept()
+
+	tstop := cfg.End
+	hmax := tstop / 50
+	if cfg.Step > 0 {
+		hmax = math.Min(hmax, cfg.Step)
+	}
+	hmin := tstop * 1e-12
+	h := hmax / 20
+
+	var (
+		wf     waveform
+		xprev  []float64
+		hprev  float64
+		t      float64
+		corner = true
+	)
+	record := func() {
+		if t >= cfg.Start {
+			wf.t = append(wf.t, t)
+			wf.x = append(wf.x, append([]float64(nil), m.X[:len(m.Rows)]...))
+		}
+	}
+	record()
+
+	for t < tstop*(1-1e-12) {
+		next := sm.nextCorner(t, tstop)
+		if t < cfg.Start*(1-1e-12) {
+			next = math.Min(next, cfg.Start) // so the plot starts on time
+		}
+		if t+h > next || next-(t+h) < hmin {
+			h = next - t
+		}
+		m.Time, m.H, m.Euler = t+h, h, corner
+		x0 := append([]float64(nil), m.X...)
+
+		iters, err := m.Newton(50)
+		ratio := 0.0
+		if err == nil && !corner && xprev != nil {
+			ratio = m.lteRatio(x0, xprev, h/hprev)
+		}
+		if err == errNoConvergence || ratio > 1 {
+			copy(m.X, x0)
+			if err != nil {
+				h /= 8
+			} else {
+				h /= 2
+			}
+			if h < hmin {
+				return fmt.Errorf("transient: time step too small at t=%g", t)
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("transient: t=%g: %v", t+h, err)
+		}
+
+		m.Accept()
+		t += h
+		record()
+		xprev, hprev = x0, h
+
+		corner = t >= next*(1-1e-12)
+		switch {
+		case corner:
+			h = math.Min(h, hmax/20)
+		case iters > 10:
+			h /= 2
+		case ratio < 0.25:
+			h *= 2
+		}
+		h = math.Min(h, hmax)
+	}
+
+	var y []float64
+	for i := range wf.t {
+		y = append(y, wf.v(i, ci.OutputID, m))
+	}
+	sm.plotTime(wf.t, y, cfg)
+	for _, ms := range ci.Measures {
+		if err := ms.measure(&wf, m); err != nil {
+			return err
+		}
+		fmt.Fprintf(sm.Out, "%-12s = % .6e\n", ms.Name, ms.Result)
+	}
+	if sm.CSV {
+		return sm.writeCSV(cfg, &wf, m)
+	}
+	return nil
+}
+
+func (sm *Simulation) nextCorner(t, tstop float64) float64 {
+	next := tstop
+	for _, src := range sm.Circuit.Sources {
+		if src.Wave != nil {
+			next = math.Min(next, src.Wave.Next(t))
+		}
+	}
+	return next
+}
+
+// how far the node voltages are from the line through the last two
+// points, against what is tolerated
+func (m *MNA) lteRatio(x0, xprev []float64, r float64) float64 {
+	worst := 0.0
+	for i := 0; i < len(m.Rows); i++ {
+		predicted := x0[i] + (x0[i]-xprev[i])*r
+		tol := 1e-3*math.Abs(m.X[i]) + 1e-3
+		worst = math.Max(worst, math.Abs(m.X[i]-predicted)/tol)
+	}
+	return worst
+}
+
+func (wf *waveform) v(i int, node [2]int, m *MNA) float64 {
+	v := 0.0
+	if r := m.row(node[0]); r >= 0 {
+		v += wf.x[i][r]
+	}
+	if r := m.row(node[1]); r >= 0 {
+		v -= wf.x[i][r]
+	}
+	return v
+}
+
+// interpolated at t
+func (wf *waveform) at(t float64, node [2]int, m *MNA) float64 {
+	n := len(wf.t)
+	if t <= wf.t[0] {
+		return wf.v(0, node, m)
+	}
+	for i := 1; i < n; i++ {
+		if t <= wf.t[i] {
+			v0, v1 := wf.v(i-1, node, m), wf.v(i, node, m)
+			return v0 + (v1-v0)*(t-wf.t[i-1])/(wf.t[i]-wf.t[i-1])
+		}
+	}
+	return wf.v(n-1, node, m)
+}
+
+func (ms *Measure) measure(wf *waveform, m *MNA) error {
+	if len(wf.t) == 0 {
+		return fmt.Errorf(".measure %s: no time points", ms.Name)
+	}
+	from, to := ms.From, ms.To
+	if to <= from {
+		to = wf.t[len(wf.t)-1]
+	}
+	switch ms.Kind {
+	case "find":
+		ms.Result = wf.at(ms.At, ms.Node, m)
+		return nil
+
+	case "when":
+		prev := wf.v(0, ms.Node, m) - ms.Value
+		for i := 1; i < len(wf.t); i++ {
+			cur := wf.v(i, ms.Node, m) - ms.Value
+			if prev == 0 {
+				ms.Result = wf.t[i-1]
+				return nil
+			}
+			if prev*cur < 0 {
+				ms.Result = wf.t[i-1] + (wf.t[i]-wf.t[i-1])*prev/(prev-cur)
+				return nil
+			}
+			prev = cur
+		}
+		return fmt.Errorf(".measure %s: never crosses %g", ms.Name, ms.Value)
+	}
+
+	// the points in the window with its ends interpolated
+	ts := []float64{from}
+	vs := []float64{wf.at(from, ms.Node, m)}
+	for i, t := range wf.t {
+		if t > from && t < to {
+			ts = append(ts, t)
+			vs = append(vs, wf.v(i, ms.Node, m))
+		}
+	}
+	ts = append(ts, to)
+	vs = append(vs, wf.at(to, ms.Node, m))
+
+	lo, hi := math.Inf(1), math.Inf(-1)
+	area, square := 0.0, 0.0
+	for i, v := range vs {
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+		if i > 0 {
+			dt := ts[i] - ts[i-1]
+			area += dt * (v + vs[i-1]) / 2
+			square += dt * (v*v + vs[i-1]*vs[i-1]) / 2
+		}
+	}
+	switch ms.Kind {
+	case "max":
+		ms.Result = hi
+	case "min":
+		ms.Result = lo
+	case "pp":
+		ms.Result = hi - lo
+	case "avg":
+		ms.Result = area / (to - from)
+	case "rms":
+		ms.Result = math.Sqrt(square / (to - from))
+	}
+	return nil
+}
+
+// every node voltage at every time point, next to the plot
+func (sm *Simulation) writeCSV(cfg *Analysis, wf *waveform, m *MNA) error {
+	name := strings.TrimSuffix(cfg.File, filepath.Ext(cfg.File)) + ".csv"
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	writeCSV(w, wf, m)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeCSV(w io.Writer, wf *waveform, m *MNA) {
+	ci := m.Circuit
+	var nodes []int
+	fmt.Fprintf(w, "time")
+	for _, n := range ci.Nodes {
+		if n.ID != 0 {
+			nodes = append(nodes, n.ID)
+			fmt.Fprintf(w, ",v(%s)", ci.NodeName(n.ID))
+		}
+	}
+	fmt.Fprintf(w, "\n")
+	for i, t := range wf.t {
+		fmt.Fprintf(w, "%v", t)
+		for _, n := range nodes {
+			fmt.Fprintf(w, ",%v", wf.v(i, [2]int{n, 0}, m))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
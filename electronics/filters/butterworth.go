@@ -3,18 +3,195 @@
 // https://www.ece.uic.edu/~jmorisak/blpf.html
 // https://www.egr.msu.edu/classes/ece480/capstone/fall11/group02/web/Documents/How%20to%20Design%2010%20kHz%20filter-Vadim.pdf
 // https://github.com/LRDPRDX/ButterworthRooFit
+// go build butterworth.go iir.go fir.go export.go
+//
+// designs a digital filter and writes its coefficients, second order
+// sections for the iir types and taps for the fir ones, the report on
+// stability and on what rounding them to float32, q15 and q31 does
+// goes to stderr
+//
+//	butterworth -type ellip -f 1000 -stop 1500 -rp 0.5 -rs 60 -format q15
+//	butterworth -type pm -band bp -f 2000,4000 -stop 1500,4500 -rs 70
+//
+// the passband edge is where the response is 3dB down for butter and
+// bessel and where the ripple ends for the others. without -n the
+// order or the taps are the fewest that meet -rp and -rs at -stop.
+// when the design misses -rp or -rs the report says so and the exit
+// status is 1, the coefficients are still written. -curves writes the
+// normalized butterworth curves as before
 package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"math/cmplx"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
+var (
+	ftype  = flag.String("type", "butter", "butter, cheby1, cheby2, ellip, bessel, fir (windowed sinc) or pm (parks-mcclellan)")
+	fband  = flag.String("band", "lp", "lp, hp, bp or bs")
+	order  = flag.Int("n", 0, "order of an iir, taps of a fir, 0 to work it out from -stop")
+	fs     = flag.Float64("fs", 48000, "sample rate in Hz")
+	pass   = flag.String("f", "1000", "passband edge in Hz, two comma separated for bp and bs")
+	stop   = flag.String("stop", "", "stopband edge in Hz, two comma separated for bp and bs")
+	rp     = flag.Float64("rp", 1, "passband ripple in dB")
+	rs     = flag.Float64("rs", 60, "stopband attenuation in dB")
+	win    = flag.String("window", "kaiser", "window of a fir: rect, hann, hamming, blackman or kaiser")
+	format = flag.String("format", "c", "c, q15, q31 or go")
+	name   = flag.String("name", "filter", "name of the coefficient array")
+	output = flag.String("o", "", "write the coefficients to this file instead of stdout")
+	curves = flag.Bool("curves", false, "write the normalized butterworth curves instead")
+)
+
+type spec struct {
+	Type   string
+	Band   string
+	Order  int
+	Fs     float64
+	Pass   []float64
+	Stop   []float64
+	Rp, Rs float64
+	Window string
+}
+
 func main() {
+	log.SetFlags(0)
+	log.SetPrefix("butterworth: ")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 0 {
+		usage()
+	}
+	if *curves {
+		dumpcurves()
+		return
+	}
+
+	sp, err := parseSpec()
+	ck(err)
+	d := &design{spec: sp}
+	switch sp.Type {
+	case "fir", "pm":
+		d.taps, err = designFIR(sp)
+	default:
+		d.sos, err = designIIR(sp)
+	}
+	ck(err)
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f := create(*output)
+		defer f.Close()
+		w = f
+	}
+	b := bufio.NewWriter(w)
+	ck(export(b, d, *format, *name))
+	ck(b.Flush())
+	if !report(os.Stderr, d) {
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: butterworth [options]")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func ck(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func parseSpec() (*spec, error) {
+	sp := &spec{
+		Type:   *ftype,
+		Band:   *fband,
+		Order:  *order,
+		Fs:     *fs,
+		Rp:     *rp,
+		Rs:     *rs,
+		Window: *win,
+	}
+	if !regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`).MatchString(*name) {
+		return nil, fmt.Errorf("%q is not a name for an array", *name)
+	}
+	if sp.Fs <= 0 || sp.Rp <= 0 || sp.Rs <= 0 || sp.Order < 0 {
+		return nil, fmt.Errorf("the sample rate, ripple, attenuation and order can't be negative")
+	}
+	if sp.Rs <= sp.Rp {
+		return nil, fmt.Errorf("the stopband has to be further down than the passband ripple")
+	}
+	n := 1
+	switch sp.Band {
+	case "lp", "hp":
+	case "bp", "bs":
+		n = 2
+	default:
+		return nil, fmt.Errorf("unknown band %s", sp.Band)
+	}
+
+	var err error
+	if sp.Pass, err = edges(*pass, n, sp.Fs); err != nil {
+		return nil, err
+	}
+	if *stop != "" {
+		if sp.Stop, err = edges(*stop, n, sp.Fs); err != nil {
+			return nil, err
+		}
+		if !sp.outside() {
+			return nil, fmt.Errorf("the stopband edges have to be outside the passband for a %s", sp.Band)
+		}
+	}
+	return sp, nil
+}
+
+// n rising frequencies between 0 and half the sample rate
+func edges(s string, n int, fs float64) ([]float64, error) {
+	var f []float64
+	for _, t := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad frequency %q", t)
+		}
+		if v <= 0 || v >= fs/2 {
+			return nil, fmt.Errorf("%g Hz is not between 0 and half the sample rate", v)
+		}
+		if len(f) > 0 && v <= f[len(f)-1] {
+			return nil, fmt.Errorf("the edges in %q have to rise", s)
+		}
+		f = append(f, v)
+	}
+	if len(f) != n {
+		return nil, fmt.Errorf("%q has to be %d edges", s, n)
+	}
+	return f, nil
+}
+
+// the transitions don't overlap the passband
+func (sp *spec) outside() bool {
+	p, s := sp.Pass, sp.Stop
+	switch sp.Band {
+	case "lp":
+		return s[0] > p[0]
+	case "hp":
+		return s[0] < p[0]
+	case "bp":
+		return s[0] < p[0] && s[1] > p[1]
+	}
+	return s[0] > p[0] && s[1] < p[1]
+}
+
+func dumpcurves() {
 	dumpfpr("normalized", 16, 0, 2, 1e-3)
 	dumpgain("normalized", 16)
 	dumpimp("impulse_response.txt", 8)
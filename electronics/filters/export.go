@@ -0,0 +1,414 @@
+// the coefficients as c arrays in float or q15/q31 fixed point, or
+// as a go slice, and the report on them: the sections with their pole
+// radius and how high the response gets after each, the passband and
+// stopband of the design, and the same again with the coefficients
+// rounded to float32, q15 and q31 to see whether they still hold up.
+// the fixed point coefficients share one shift, the number of bits
+// they were moved right so the largest fits, like the postShift of
+// the cmsis biquads
+// go build butterworth.go iir.go fir.go export.go
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/cmplx"
+	"strconv"
+	"strings"
+)
+
+type design struct {
+	*spec
+	sos  []biquad // for the iir types
+	taps []float64
+}
+
+func (d *design) iir() bool {
+	return d.taps == nil
+}
+
+func (d *design) title() string {
+	names := map[string]string{
+		"butter": "butterworth",
+		"cheby1": "chebyshev type 1",
+		"cheby2": "chebyshev type 2",
+		"ellip":  "elliptic",
+		"bessel": "bessel",
+		"fir":    d.Window + " windowed fir",
+		"pm":     "parks-mcclellan fir",
+	}
+	bands := map[string]string{
+		"lp": "lowpass",
+		"hp": "highpass",
+		"bp": "bandpass",
+		"bs": "bandstop",
+	}
+	hz := func(f []float64) string {
+		var s []string
+		for _, v := range f {
+			s = append(s, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+		return strings.Join(s, " to ") + " Hz"
+	}
+
+	t := names[d.Type] + " " + bands[d.Band]
+	if d.iir() {
+		t += fmt.Sprintf(", order %d", d.Order)
+	} else {
+		t += fmt.Sprintf(", %d taps", len(d.taps))
+	}
+	switch d.Type {
+	case "cheby1", "ellip", "pm":
+		t += fmt.Sprintf(", %g dB ripple", d.Rp)
+	}
+	t += ", pass " + hz(d.Pass)
+	if d.Stop != nil {
+		t += ", stop " + hz(d.Stop)
+		switch d.Type {
+		case "cheby2", "ellip", "pm", "fir":
+			t += fmt.Sprintf(" %g dB down", d.Rs)
+		}
+	}
+	return t + fmt.Sprintf(", fs %g Hz", d.Fs)
+}
+
+// b0 b1 b2 a1 a2 of every section or the taps, in the order exported
+func (d *design) coefs() []float64 {
+	if !d.iir() {
+		return d.taps
+	}
+	var c []float64
+	for _, q := range d.sos {
+		c = append(c, q.b[0], q.b[1], q.b[2], q.a[1], q.a[2])
+	}
+	return c
+}
+
+// the same design with other coefficients
+func (d *design) with(c []float64) *design {
+	e := &design{spec: d.spec}
+	if !d.iir() {
+		e.taps = c
+		return e
+	}
+	for i := 0; i < len(c); i += 5 {
+		e.sos = append(e.sos, biquad{
+			b: [3]float64{c[i], c[i+1], c[i+2]},
+			a: [3]float64{1, c[i+3], c[i+4]},
+		})
+	}
+	return e
+}
+
+// the coefficients in bits wide fixed point and how many bits they
+// had to be moved right to fit
+func quantize(c []float64, bits int) (q []int64, shift int) {
+	max := 0.0
+	for _, v := range c {
+		max = math.Max(max, math.Abs(v))
+	}
+	top := int64(1)<<(bits-1) - 1
+	for math.Round(max*math.Ldexp(1, bits-1-shift)) > float64(top) {
+		shift++
+	}
+	for _, v := range c {
+		q = append(q, int64(math.Round(v*math.Ldexp(1, bits-1-shift))))
+	}
+	return q, shift
+}
+
+// the values the fixed point coefficients stand for
+func dequantize(q []int64, bits, shift int) []float64 {
+	var c []float64
+	for _, v := range q {
+		c = append(c, math.Ldexp(float64(v), shift+1-bits))
+	}
+	return c
+}
+
+// |H| at n+1 frequencies from 0 to half the sample rate
+func magnitudes(sos []biquad, taps []float64, n int) []float64 {
+	m := make([]float64, n+1)
+	for i := range m {
+		m[i] = cmplx.Abs(response(sos, taps, 0.5*float64(i)/float64(n)))
+	}
+	return m
+}
+
+// H at f, a fraction of the sample rate
+func response(sos []biquad, taps []float64, f float64) complex128 {
+	if taps != nil {
+		return firAt(taps, f)
+	}
+	h := complex(1, 0)
+	for i := range sos {
+		h *= sos[i].at(f)
+	}
+	return h
+}
+
+func (d *design) at(f float64) complex128 {
+	return response(d.sos, d.taps, f/d.Fs)
+}
+
+func db(h complex128) float64 {
+	return 20 * math.Log10(cmplx.Abs(h))
+}
+
+// the passbands and stopbands in hz, no stopbands without -stop
+func (d *design) masks() (pass, stop [][2]float64) {
+	p, s, ny := d.Pass, d.Stop, d.Fs/2
+	switch d.Band {
+	case "lp":
+		pass = [][2]float64{{0, p[0]}}
+		if s != nil {
+			stop = [][2]float64{{s[0], ny}}
+		}
+	case "hp":
+		pass = [][2]float64{{p[0], ny}}
+		if s != nil {
+			stop = [][2]float64{{0, s[0]}}
+		}
+	case "bp":
+		pass = [][2]float64{{p[0], p[1]}}
+		if s != nil {
+			stop = [][2]float64{{0, s[0]}, {s[1], ny}}
+		}
+	case "bs":
+		pass = [][2]float64{{0, p[0]}, {p[1], ny}}
+		if s != nil {
+			stop = [][2]float64{{s[0], s[1]}}
+		}
+	}
+	return
+}
+
+// the response in db at points through the bands
+func (d *design) sweep(bands [][2]float64) []float64 {
+	var r []float64
+	for _, b := range bands {
+		for i := 0; i <= 1000; i++ {
+			r = append(r, db(d.at(b[0]+(b[1]-b[0])*float64(i)/1000)))
+		}
+	}
+	return r
+}
+
+func minmax(x []float64) (lo, hi float64) {
+	lo, hi = math.Inf(1), math.Inf(-1)
+	for _, v := range x {
+		lo = math.Min(lo, v)
+		hi = math.Max(hi, v)
+	}
+	return
+}
+
+func (d *design) radius() float64 {
+	r := 0.0
+	for i := range d.sos {
+		r = math.Max(r, d.sos[i].radius())
+	}
+	return r
+}
+
+// how the design falls short of -rp and -rs, the passband of butter
+// and bessel is 3dB down at its edge. the fir ripple is either side of 1
+func (d *design) misses() []string {
+	const slack = 0.005 // db, for the sweep between the points
+	var m []string
+	pass, stop := d.masks()
+	lo, hi := minmax(d.sweep(pass))
+	switch {
+	case d.Type == "butter" || d.Type == "bessel":
+		if lo < -3.0103-slack {
+			m = append(m, fmt.Sprintf("passband %.4f dB, more than 3dB down", lo))
+		}
+	case !d.iir():
+		if hi-lo > d.Rp+slack {
+			m = append(m, fmt.Sprintf("passband ripple %.4f dB, more than %g", hi-lo, d.Rp))
+		}
+	case lo < -d.Rp-slack:
+		m = append(m, fmt.Sprintf("passband %.4f dB, more than %g down", lo, d.Rp))
+	}
+	if stop != nil {
+		if _, top := minmax(d.sweep(stop)); -top < d.Rs-slack {
+			m = append(m, fmt.Sprintf("stopband %.2f dB down, less than %g", -top, d.Rs))
+		}
+	}
+	return m
+}
+
+// false when the design misses the spec
+func report(w io.Writer, d *design) bool {
+	fmt.Fprintln(w, d.title())
+	if d.iir() {
+		fmt.Fprintf(w, "%-3s %14s %14s %14s %14s %14s %9s %9s\n",
+			"", "b0", "b1", "b2", "a1", "a2", "radius", "peak dB")
+		for i, q := range d.sos {
+			peak := 0.0
+			for _, v := range magnitudes(d.sos[:i+1], nil, 1024) {
+				peak = math.Max(peak, v)
+			}
+			fmt.Fprintf(w, "%-3d % 14.7e % 14.7e % 14.7e % 14.7e % 14.7e %9.6f %9.3f\n",
+				i+1, q.b[0], q.b[1], q.b[2], q.a[1], q.a[2], q.radius(), 20*math.Log10(peak))
+		}
+		if r := d.radius(); r < 1 {
+			fmt.Fprintf(w, "stable, the largest pole radius is %.6f\n", r)
+		} else {
+			fmt.Fprintf(w, "UNSTABLE, a pole radius of %.6f\n", r)
+		}
+	} else {
+		fmt.Fprintf(w, "fir, stable and linear phase, a delay of %d samples\n", len(d.taps)/2)
+	}
+
+	pass, stop := d.masks()
+	pdb := d.sweep(pass)
+	lo, hi := minmax(pdb)
+	fmt.Fprintf(w, "passband %.4f to %.4f dB\n", lo, hi)
+	var sdb []float64
+	if stop != nil {
+		sdb = d.sweep(stop)
+		_, top := minmax(sdb)
+		fmt.Fprintf(w, "stopband %.2f dB down\n", -top)
+	}
+
+	c := d.coefs()
+	check := func(name string, q []float64) {
+		e := d.with(q)
+		cerr := 0.0
+		for i := range c {
+			cerr = math.Max(cerr, math.Abs(q[i]-c[i]))
+		}
+		fmt.Fprintf(w, "%-16s error %.1e", name, cerr)
+		if e.iir() {
+			r := e.radius()
+			fmt.Fprintf(w, ", radius %.6f", r)
+			if r >= 1 {
+				fmt.Fprintf(w, " UNSTABLE\n")
+				return
+			}
+		}
+		dev := 0.0
+		for i, v := range e.sweep(pass) {
+			dev = math.Max(dev, math.Abs(v-pdb[i]))
+		}
+		if math.IsInf(dev, 0) || math.IsNaN(dev) {
+			fmt.Fprintf(w, ", the passband is gone, coefficients rounded to 0\n")
+			return
+		}
+		fmt.Fprintf(w, ", passband within %.4f dB", dev)
+		if stop != nil {
+			_, top := minmax(e.sweep(stop))
+			fmt.Fprintf(w, ", stopband %.2f dB down", -top)
+		}
+		fmt.Fprintln(w)
+	}
+
+	f32 := make([]float64, len(c))
+	for i, v := range c {
+		f32[i] = float64(float32(v))
+	}
+	check("float32", f32)
+	for _, bits := range []int{16, 32} {
+		q, shift := quantize(c, bits)
+		check(fmt.Sprintf("q%d shift %d", bits-1, shift), dequantize(q, bits, shift))
+	}
+
+	m := d.misses()
+	for _, s := range m {
+		fmt.Fprintf(w, "MISSES the spec: %s\n", s)
+	}
+	return len(m) == 0
+}
+
+// a c float literal that reads back as the float32
+func cfloat(v float64) string {
+	s := strconv.FormatFloat(float64(float32(v)), 'g', -1, 32)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s + "f"
+}
+
+func export(w io.Writer, d *design, format, name string) error {
+	c := d.coefs()
+	up := strings.ToUpper(name)
+	var (
+		vals []string
+		ctyp string
+	)
+	switch format {
+	case "c":
+		ctyp = "float"
+		for _, v := range c {
+			vals = append(vals, cfloat(v))
+		}
+	case "q15", "q31":
+		bits := 16
+		if format == "q31" {
+			bits = 32
+		}
+		q, shift := quantize(c, bits)
+		ctyp = fmt.Sprintf("int%d_t", bits)
+		for _, v := range q {
+			vals = append(vals, strconv.FormatInt(v, 10))
+		}
+		fmt.Fprintf(w, "/* %s */\n", d.title())
+		fmt.Fprintf(w, "/* %s, the values are v / 2^(%d - %s_SHIFT) */\n", format, bits-1, up)
+		fmt.Fprintf(w, "#define %s_SHIFT %d\n", up, shift)
+	case "go":
+		for _, v := range c {
+			vals = append(vals, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+	default:
+		return fmt.Errorf("unknown format %s", format)
+	}
+
+	if format == "go" {
+		fmt.Fprintf(w, "// %s\n", d.title())
+		if d.iir() {
+			fmt.Fprintf(w, "// b0, b1, b2, a1, a2 of y = b0 x0 + b1 x1 + b2 x2 - a1 y1 - a2 y2\n")
+			fmt.Fprintf(w, "var %s = [][5]float64{\n", name)
+			rows(w, vals, 5, "{", "},")
+		} else {
+			fmt.Fprintf(w, "var %s = []float64{\n", name)
+			rows(w, vals, 6, "", "")
+		}
+		fmt.Fprintf(w, "}\n")
+		return nil
+	}
+
+	if format == "c" {
+		fmt.Fprintf(w, "/* %s */\n", d.title())
+	}
+	if d.iir() {
+		fmt.Fprintf(w, "/* b0, b1, b2, a1, a2 of y = b0 x0 + b1 x1 + b2 x2 - a1 y1 - a2 y2, cmsis wants a1 and a2 negated */\n")
+		fmt.Fprintf(w, "#define %s_SECTIONS %d\n", up, len(d.sos))
+		fmt.Fprintf(w, "static const %s %s[%s_SECTIONS][5] = {\n", ctyp, name, up)
+		rows(w, vals, 5, "{", "},")
+	} else {
+		fmt.Fprintf(w, "#define %s_TAPS %d\n", up, len(d.taps))
+		fmt.Fprintf(w, "static const %s %s[%s_TAPS] = {\n", ctyp, name, up)
+		rows(w, vals, 6, "", "")
+	}
+	fmt.Fprintf(w, "};\n")
+	return nil
+}
+
+// the values n to a line between open and close, a comma after each
+// when there is no close
+func rows(w io.Writer, vals []string, n int, open, close string) {
+	for i := 0; i < len(vals); i += n {
+		j := i + n
+		if j > len(vals) {
+			j = len(vals)
+		}
+		if close != "" {
+			fmt.Fprintf(w, "\t%s%s%s\n", open, strings.Join(vals[i:j], ", "), close)
+		} else {
+			fmt.Fprintf(w, "\t%s,\n", strings.Join(vals[i:j], ", "))
+		}
+	}
+}
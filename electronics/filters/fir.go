@@ -0,0 +1,404 @@
+// fir design, always an odd number of taps symmetric about the middle
+// one so the phase is linear and every band type works. the windowed
+// sinc is the ideal response cut to length and tapered, parks-mcclellan
+// moves the extremal frequencies of the error around until it ripples
+// evenly, the weights make the ripple in each band what rp and rs ask
+// https://en.wikipedia.org/wiki/Parks%E2%80%93McClellan_filter_design_algorithm
+// https://www.iowahills.com/A7ExampleCodePage.html
+// go build butterworth.go iir.go fir.go export.go
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+)
+
+// a band of the desired response, the edges a fraction of the sample rate
+type band struct {
+	lo, hi float64
+	gain   float64
+	weight float64
+}
+
+// the ripples rp and rs allow as amplitudes
+func ripples(rp, rs float64) (dp, ds float64) {
+	g := math.Pow(10, rp/20)
+	return (g - 1) / (g + 1), math.Pow(10, -rs/20)
+}
+
+// the narrowest transition between a passband and a stopband edge in
+// hz, for working out how many taps it takes
+func (sp *spec) transition() float64 {
+	t := math.Inf(1)
+	for i := range sp.Pass {
+		t = math.Min(t, math.Abs(sp.Stop[i]-sp.Pass[i]))
+	}
+	return t
+}
+
+// the bands of the response, the transitions left out
+func (sp *spec) bands() []band {
+	dp, ds := ripples(sp.Rp, sp.Rs)
+	pass := band{gain: 1, weight: 1}
+	stop := band{gain: 0, weight: dp / ds}
+	p := make([]float64, len(sp.Pass))
+	s := make([]float64, len(sp.Stop))
+	for i := range p {
+		p[i] = sp.Pass[i] / sp.Fs
+		s[i] = sp.Stop[i] / sp.Fs
+	}
+
+	var b []band
+	add := func(t band, lo, hi float64) {
+		t.lo, t.hi = lo, hi
+		b = append(b, t)
+	}
+	switch sp.Band {
+	case "lp":
+		add(pass, 0, p[0])
+		add(stop, s[0], 0.5)
+	case "hp":
+		add(stop, 0, s[0])
+		add(pass, p[0], 0.5)
+	case "bp":
+		add(stop, 0, s[0])
+		add(pass, p[0], p[1])
+		add(stop, s[1], 0.5)
+	case "bs":
+		add(pass, 0, p[0])
+		add(stop, s[0], s[1])
+		add(pass, p[1], 0.5)
+	}
+	return b
+}
+
+// the estimates for the taps are close but not always enough, an
+// estimate is grown until the design meets the spec
+func designFIR(sp *spec) ([]float64, error) {
+	if sp.Order != 0 {
+		return firTaps(sp)
+	}
+	for {
+		h, err := firTaps(sp)
+		if err != nil {
+			return nil, err
+		}
+		d := &design{spec: sp, taps: h}
+		if len(d.misses()) == 0 || sp.Order+2 > 4095 {
+			return h, nil
+		}
+		sp.Order += 2
+	}
+}
+
+func firTaps(sp *spec) ([]float64, error) {
+	if sp.Order == 0 {
+		if sp.Stop == nil || (sp.Type == "fir" && sp.Window != "kaiser") {
+			return nil, fmt.Errorf("give the taps with -n, only kaiser and pm work them out from -stop")
+		}
+		df := sp.transition() / sp.Fs
+		if sp.Type == "fir" {
+			// kaiser's estimate
+			sp.Order = int(math.Ceil((sp.Rs-8)/(2.285*2*math.Pi*df))) + 1
+		} else {
+			// and the one for equiripple
+			dp, ds := ripples(sp.Rp, sp.Rs)
+			sp.Order = int(math.Ceil((-20*math.Log10(math.Sqrt(dp*ds))-13)/(14.6*df))) + 1
+		}
+	}
+	if sp.Order%2 == 0 {
+		sp.Order++
+	}
+	if sp.Order < 3 || sp.Order > 4095 {
+		return nil, fmt.Errorf("%d taps out of range", sp.Order)
+	}
+	if sp.Type == "pm" {
+		if sp.Stop == nil {
+			return nil, fmt.Errorf("parks-mcclellan needs the stopband edges with -stop")
+		}
+		return remez(sp.Order, sp.bands())
+	}
+	return windowed(sp)
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// the ideal lowpass to fc, a fraction of the sample rate
+func idealLP(n int, fc float64) []float64 {
+	h := make([]float64, n)
+	m := n / 2
+	for i := range h {
+		h[i] = 2 * fc * sinc(2*fc*float64(i-m))
+	}
+	return h
+}
+
+// H at f, a fraction of the sample rate
+func firAt(h []float64, f float64) complex128 {
+	var s complex128
+	for i, v := range h {
+		s += complex(v, 0) * cmplx.Exp(complex(0, -2*math.Pi*f*float64(i)))
+	}
+	return s
+}
+
+// zeroth order modified bessel function of the first kind
+func besselI0(x float64) float64 {
+	s, t := 1.0, 1.0
+	for k := 1; k < 100 && t > 1e-17*s; k++ {
+		t *= (x / (2 * float64(k))) * (x / (2 * float64(k)))
+		s += t
+	}
+	return s
+}
+
+func window(name string, n int, rs float64) ([]float64, error) {
+	w := make([]float64, n)
+	beta := 0.0
+	switch {
+	case rs > 50:
+		beta = 0.1102 * (rs - 8.7)
+	case rs >= 21:
+		beta = 0.5842*math.Pow(rs-21, 0.4) + 0.07886*(rs-21)
+	}
+	for i := range w {
+		x := 2 * math.Pi * float64(i) / float64(n-1)
+		switch name {
+		case "rect":
+			w[i] = 1
+		case "hann":
+			w[i] = 0.5 - 0.5*math.Cos(x)
+		case "hamming":
+			w[i] = 0.54 - 0.46*math.Cos(x)
+		case "blackman":
+			w[i] = 0.42 - 0.5*math.Cos(x) + 0.08*math.Cos(2*x)
+		case "kaiser":
+			r := 2*float64(i)/float64(n-1) - 1
+			w[i] = besselI0(beta*math.Sqrt(1-r*r)) / besselI0(beta)
+		default:
+			return nil, fmt.Errorf("unknown window %s", name)
+		}
+	}
+	return w, nil
+}
+
+// the cutoffs halfway through the transitions, at the edges given
+// when there is no stopband, and the gain made 1 in the middle of
+// the passband
+func windowed(sp *spec) ([]float64, error) {
+	n := sp.Order
+	fc := make([]float64, len(sp.Pass))
+	for i := range fc {
+		fc[i] = sp.Pass[i]
+		if sp.Stop != nil {
+			fc[i] = (sp.Pass[i] + sp.Stop[i]) / 2
+		}
+		fc[i] /= sp.Fs
+	}
+
+	var h []float64
+	mid := 0.0
+	switch sp.Band {
+	case "lp", "hp":
+		h = idealLP(n, fc[0])
+		if sp.Band == "hp" {
+			mid = 0.5
+		}
+	case "bp", "bs":
+		h = idealLP(n, fc[1])
+		for i, v := range idealLP(n, fc[0]) {
+			h[i] -= v
+		}
+		if sp.Band == "bp" {
+			mid = (fc[0] + fc[1]) / 2
+		}
+	}
+	if sp.Band == "hp" || sp.Band == "bs" {
+		for i := range h {
+			h[i] = -h[i]
+		}
+		h[n/2]++
+	}
+
+	w, err := window(sp.Window, n, sp.Rs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range h {
+		h[i] *= w[i]
+	}
+	g := cmplx.Abs(firAt(h, mid))
+	for i := range h {
+		h[i] /= g
+	}
+	return h, nil
+}
+
+// the weighted chebyshev approximation of the bands by a cosine
+// series of (n+1)/2 terms, the remez exchange
+func remez(n int, bands []band) ([]float64, error) {
+	r := (n + 1) / 2
+
+	// a dense grid over the bands, 16 points a term
+	var grid, des, wt []float64
+	var edges []int
+	step := 0.5 / float64(16*r)
+	for _, b := range bands {
+		m := int(math.Ceil((b.hi - b.lo) / step))
+		if m < 1 {
+			m = 1
+		}
+		edges = append(edges, len(grid))
+		for i := 0; i <= m; i++ {
+			grid = append(grid, b.lo+(b.hi-b.lo)*float64(i)/float64(m))
+			des = append(des, b.gain)
+			wt = append(wt, b.weight)
+		}
+	}
+	edges = append(edges, len(grid))
+	if len(grid) < r+1 {
+		return nil, fmt.Errorf("remez: the bands are too narrow for %d taps", n)
+	}
+	x := make([]float64, len(grid))
+	for i, f := range grid {
+		x[i] = math.Cos(2 * math.Pi * f)
+	}
+
+	ext := make([]int, r+1)
+	for i := range ext {
+		ext[i] = i * (len(grid) - 1) / r
+	}
+	e := make([]float64, len(grid))
+	var interp func(float64) float64
+	for iter := 0; iter < 100; iter++ {
+		xs := make([]float64, r+1)
+		for i, j := range ext {
+			xs[i] = x[j]
+		}
+
+		// the ripple that makes the error alternate over the extremals
+		b := baryWeights(xs)
+		num, den := 0.0, 0.0
+		sign := 1.0
+		for k, j := range ext {
+			num += b[k] * des[j]
+			den += sign * b[k] / wt[j]
+			sign = -sign
+		}
+		delta := num / den
+
+		c := make([]float64, r)
+		sign = 1.0
+		for k := range c {
+			c[k] = des[ext[k]] - sign*delta/wt[ext[k]]
+			sign = -sign
+		}
+		bi := baryWeights(xs[:r])
+		interp = func(v float64) float64 {
+			num, den := 0.0, 0.0
+			for k := range c {
+				d := v - xs[k]
+				if d == 0 {
+					return c[k]
+				}
+				t := bi[k] / d
+				num += t * c[k]
+				den += t
+			}
+			return num / den
+		}
+
+		emax := 0.0
+		for j := range grid {
+			e[j] = wt[j] * (des[j] - interp(x[j]))
+			emax = math.Max(emax, math.Abs(e[j]))
+		}
+		next := extremals(e, edges, r+1)
+		if next == nil {
+			return nil, fmt.Errorf("remez: lost the extremals, try other taps or edges")
+		}
+		ext = next
+		if emax-math.Abs(delta) <= 1e-9*emax {
+			break
+		}
+	}
+
+	// the taps from the response sampled n times around the circle
+	m := n / 2
+	a := make([]float64, m+1)
+	for j := range a {
+		a[j] = interp(math.Cos(2 * math.Pi * float64(j) / float64(n)))
+	}
+	h := make([]float64, n)
+	for k := 0; k <= m; k++ {
+		s := a[0]
+		for j := 1; j <= m; j++ {
+			s += 2 * a[j] * math.Cos(2*math.Pi*float64(j*k)/float64(n))
+		}
+		h[m+k] = s / float64(n)
+		h[m-k] = h[m+k]
+	}
+	return h, nil
+}
+
+// the weights of the barycentric lagrange interpolation through x,
+// the differences doubled so the products stay in range
+func baryWeights(x []float64) []float64 {
+	w := make([]float64, len(x))
+	for k := range x {
+		p := 1.0
+		for i := range x {
+			if i != k {
+				p *= 2 * (x[k] - x[i])
+			}
+		}
+		w[k] = 1 / p
+	}
+	return w
+}
+
+// the local extremes of the error within each band, neighbours of
+// the same sign merged into the larger, then the smaller end dropped
+// until there are as many as asked for, nil when there are too few
+func extremals(e []float64, edges []int, want int) []int {
+	var ext []int
+	for b := 0; b+1 < len(edges); b++ {
+		lo, hi := edges[b], edges[b+1]-1
+		for j := lo; j <= hi; j++ {
+			if e[j] == 0 {
+				continue
+			}
+			up := e[j] > 0
+			left := j == lo || (up && e[j] >= e[j-1]) || (!up && e[j] <= e[j-1])
+			right := j == hi || (up && e[j] > e[j+1]) || (!up && e[j] < e[j+1])
+			if !left || !right {
+				continue
+			}
+			if k := len(ext) - 1; k >= 0 && (e[ext[k]] > 0) == up {
+				if math.Abs(e[j]) > math.Abs(e[ext[k]]) {
+					ext[k] = j
+				}
+				continue
+			}
+			ext = append(ext, j)
+		}
+	}
+	for len(ext) > want {
+		if math.Abs(e[ext[0]]) < math.Abs(e[ext[len(ext)-1]]) {
+			ext = ext[1:]
+		} else {
+			ext = ext[:len(ext)-1]
+		}
+	}
+	if len(ext) < want {
+		return nil
+	}
+	return ext
+}
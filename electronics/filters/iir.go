@@ -0,0 +1,557 @@
+// iir design. the analog prototypes are zeros, poles and a gain with
+// the band edge at 1 rad/s, moved to the band by the usual
+// substitutions, taken to z by the bilinear transform with the edges
+// prewarped, and paired into second order sections
+// https://www.dsprelated.com/freebooks/filters/Bilinear_Transformation.html
+// https://www.ece.rutgers.edu/~orfanidi/ece521/notes.pdf (elliptic)
+// go build butterworth.go iir.go fir.go export.go
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+	"sort"
+)
+
+type zpk struct {
+	z, p []complex128
+	k    float64
+}
+
+// b0 + b1 z^-1 + b2 z^-2 over 1 + a1 z^-1 + a2 z^-2, a[0] is always 1
+type biquad struct {
+	b, a [3]float64
+}
+
+func prod(r []complex128, s complex128) complex128 {
+	x := complex(1, 0)
+	for _, v := range r {
+		x *= s - v
+	}
+	return x
+}
+
+// poles evenly around the left half of the unit circle, -3dB at 1
+func butterap(n int) zpk {
+	f := zpk{k: 1}
+	for k := 1; k <= n; k++ {
+		x := math.Pi * float64(2*k+n-1) / float64(2*n)
+		f.p = append(f.p, cmplx.Exp(complex(0, x)))
+	}
+	return f
+}
+
+// ripple of rp db up to 1, the poles on an ellipse
+func cheb1ap(n int, rp float64) zpk {
+	eps := math.Sqrt(math.Pow(10, rp/10) - 1)
+	mu := math.Asinh(1/eps) / float64(n)
+	var f zpk
+	for k := 1; k <= n; k++ {
+		th := math.Pi * float64(2*k-1) / float64(2*n)
+		f.p = append(f.p, complex(-math.Sinh(mu)*math.Sin(th), math.Cosh(mu)*math.Cos(th)))
+	}
+	f.k = real(prod(f.p, 0))
+	if n%2 == 0 {
+		f.k /= math.Sqrt(1 + eps*eps)
+	}
+	return f
+}
+
+// flat passband, rs db down from 1 on with zeros on the jw axis,
+// the poles are the chebyshev ones turned inside out
+func cheb2ap(n int, rs float64) zpk {
+	eps := 1 / math.Sqrt(math.Pow(10, rs/10)-1)
+	mu := math.Asinh(1/eps) / float64(n)
+	var f zpk
+	for k := 1; k <= n; k++ {
+		th := math.Pi * float64(2*k-1) / float64(2*n)
+		f.p = append(f.p, 1/complex(-math.Sinh(mu)*math.Sin(th), math.Cosh(mu)*math.Cos(th)))
+		if 2*k-1 != n {
+			f.z = append(f.z, complex(0, 1/math.Cos(th)))
+		}
+	}
+	f.k = real(prod(f.p, 0) / prod(f.z, 0))
+	return f
+}
+
+// the descending landen sequence of the modulus k
+func landen(k float64) []float64 {
+	var v []float64
+	for k > 1e-15 && len(v) < 20 {
+		kp := math.Sqrt(1 - k*k)
+		k = (k / (1 + kp)) * (k / (1 + kp))
+		v = append(v, k)
+	}
+	return v
+}
+
+// complete elliptic integral of the first kind
+func ellipk(k float64) float64 {
+	K := math.Pi / 2
+	for _, v := range landen(k) {
+		K *= 1 + v
+	}
+	return K
+}
+
+// the jacobi cd and sn with the argument in quarter periods, cd(uK, k)
+func cde(u complex128, k float64) complex128 {
+	return ascend(cmplx.Cos(u*math.Pi/2), k)
+}
+
+func sne(u complex128, k float64) complex128 {
+	return ascend(cmplx.Sin(u*math.Pi/2), k)
+}
+
+func ascend(w complex128, k float64) complex128 {
+	v := landen(k)
+	for i := len(v) - 1; i >= 0; i-- {
+		c := complex(v[i], 0)
+		w = (1 + c) * w / (1 + c*w*w)
+	}
+	return w
+}
+
+// the inverses, also in quarter periods
+func acde(w complex128, k float64) complex128 {
+	v := landen(k)
+	for i := range v {
+		v1 := k
+		if i > 0 {
+			v1 = v[i-1]
+		}
+		w = w / (1 + cmplx.Sqrt(1-w*w*complex(v1*v1, 0))) * complex(2/(1+v[i]), 0)
+	}
+	return 2 / math.Pi * cmplx.Acos(w)
+}
+
+func asne(w complex128, k float64) complex128 {
+	return 1 - acde(w, k)
+}
+
+// the modulus an elliptic filter of order n gets from k1
+func ellipdeg(n int, k1 float64) float64 {
+	k1p := math.Sqrt(1 - k1*k1)
+	x := 1.0
+	for i := 1; i <= n/2; i++ {
+		x *= real(sne(complex(float64(2*i-1)/float64(n), 0), k1p))
+	}
+	kp := math.Pow(k1p, float64(n)) * math.Pow(x, 4)
+	return math.Sqrt(1 - kp*kp)
+}
+
+// equiripple in both bands, rp db up to 1 and rs db down from 1/k on
+func ellipap(n int, rp, rs float64) zpk {
+	ep := math.Sqrt(math.Pow(10, rp/10) - 1)
+	es := math.Sqrt(math.Pow(10, rs/10) - 1)
+	k1 := ep / es
+	k := ellipdeg(n, k1)
+	v0 := real(-1i * asne(complex(0, 1/ep), k1) / complex(float64(n), 0))
+
+	var f zpk
+	for i := 1; i <= n/2; i++ {
+		u := complex(float64(2*i-1)/float64(n), 0)
+		z := 1i / (complex(k, 0) * cde(u, k))
+		p := 1i * cde(u-complex(0, v0), k)
+		f.z = append(f.z, z, cmplx.Conj(z))
+		f.p = append(f.p, p, cmplx.Conj(p))
+	}
+	if n%2 == 1 {
+		f.p = append(f.p, complex(real(1i*sne(complex(0, v0), k)), 0))
+	}
+	f.k = real(prod(f.p, 0) / prod(f.z, 0))
+	if n%2 == 0 {
+		f.k /= math.Sqrt(1 + ep*ep)
+	}
+	return f
+}
+
+// the flattest group delay, the reverse bessel polynomial scaled
+// to be 3dB down at 1 like the butterworth
+func besselap(n int) zpk {
+	// a_k = (2n-k)! / (2^(n-k) k! (n-k)!), a_n is 1
+	a := make([]float64, n+1)
+	for k := 0; k <= n; k++ {
+		l1, _ := math.Lgamma(float64(2*n - k + 1))
+		l2, _ := math.Lgamma(float64(k + 1))
+		l3, _ := math.Lgamma(float64(n - k + 1))
+		a[k] = math.Exp(l1 - l2 - l3 - float64(n-k)*math.Ln2)
+	}
+	f := zpk{p: polyRoots(a)}
+	h := func(w float64) float64 {
+		return cmplx.Abs(prod(f.p, 0) / prod(f.p, complex(0, w)))
+	}
+	lo, hi := 1e-3, 1e3
+	for i := 0; i < 100; i++ {
+		mid := math.Sqrt(lo * hi)
+		if h(mid) > 1/math.Sqrt2 {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	for i := range f.p {
+		f.p[i] /= complex(lo, 0)
+	}
+	f.k = real(prod(f.p, 0))
+	return f
+}
+
+// the roots of a[0] + a[1] x + ... + x^n, durand-kerner
+func polyRoots(a []float64) []complex128 {
+	n := len(a) - 1
+	eval := func(x complex128) complex128 {
+		y := complex(0, 0)
+		for i := n; i >= 0; i-- {
+			y = y*x + complex(a[i], 0)
+		}
+		return y
+	}
+	// start on a circle about as big as the roots
+	r := math.Pow(math.Abs(a[0]), 1/float64(n))
+	x := make([]complex128, n)
+	for i := range x {
+		x[i] = cmplx.Rect(r, 2*math.Pi*float64(i)/float64(n)+0.4)
+	}
+	for iter := 0; iter < 1000; iter++ {
+		moved := 0.0
+		for i := range x {
+			d := complex(1, 0)
+			for j := range x {
+				if j != i {
+					d *= x[i] - x[j]
+				}
+			}
+			dx := eval(x[i]) / d
+			x[i] -= dx
+			moved = math.Max(moved, cmplx.Abs(dx)/cmplx.Abs(x[i]))
+		}
+		if moved < 1e-15 {
+			break
+		}
+	}
+	// the real ones exactly real so they pair up
+	for i := range x {
+		if math.Abs(imag(x[i])) < 1e-9*cmplx.Abs(x[i]) {
+			x[i] = complex(real(x[i]), 0)
+		}
+	}
+	return x
+}
+
+func (f zpk) lp2lp(wc float64) zpk {
+	g := zpk{k: f.k * math.Pow(wc, float64(len(f.p)-len(f.z)))}
+	for _, z := range f.z {
+		g.z = append(g.z, z*complex(wc, 0))
+	}
+	for _, p := range f.p {
+		g.p = append(g.p, p*complex(wc, 0))
+	}
+	return g
+}
+
+// s -> wc/s, the zeros at infinity come to 0
+func (f zpk) lp2hp(wc float64) zpk {
+	g := zpk{k: f.k * real(prod(f.z, 0)/prod(f.p, 0))}
+	w := complex(wc, 0)
+	for _, z := range f.z {
+		g.z = append(g.z, w/z)
+	}
+	for _, p := range f.p {
+		g.p = append(g.p, w/p)
+	}
+	for i := len(f.z); i < len(f.p); i++ {
+		g.z = append(g.z, 0)
+	}
+	return g
+}
+
+// s -> (s^2 + w0^2) / (s bw), every root becomes two
+func (f zpk) lp2bp(w0, bw float64) zpk {
+	g := zpk{k: f.k * math.Pow(bw, float64(len(f.p)-len(f.z)))}
+	split := func(r complex128) (complex128, complex128) {
+		h := r * complex(bw/2, 0)
+		d := cmplx.Sqrt(h*h - complex(w0*w0, 0))
+		return h + d, h - d
+	}
+	for _, z := range f.z {
+		a, b := split(z)
+		g.z = append(g.z, a, b)
+	}
+	for _, p := range f.p {
+		a, b := split(p)
+		g.p = append(g.p, a, b)
+	}
+	for i := len(f.z); i < len(f.p); i++ {
+		g.z = append(g.z, 0)
+	}
+	return g
+}
+
+// s -> s bw / (s^2 + w0^2), the zeros at infinity come to +-j w0
+func (f zpk) lp2bs(w0, bw float64) zpk {
+	g := zpk{k: f.k * real(prod(f.z, 0)/prod(f.p, 0))}
+	split := func(r complex128) (complex128, complex128) {
+		h := complex(bw/2, 0) / r
+		d := cmplx.Sqrt(h*h - complex(w0*w0, 0))
+		return h + d, h - d
+	}
+	for _, z := range f.z {
+		a, b := split(z)
+		g.z = append(g.z, a, b)
+	}
+	for _, p := range f.p {
+		a, b := split(p)
+		g.p = append(g.p, a, b)
+	}
+	for i := len(f.z); i < len(f.p); i++ {
+		g.z = append(g.z, complex(0, w0), complex(0, -w0))
+	}
+	return g
+}
+
+// s = 2 fs (z - 1) / (z + 1), the zeros at infinity come to -1
+func (f zpk) bilinear(fs float64) zpk {
+	fs2 := complex(2*fs, 0)
+	g := zpk{k: f.k * real(prod(f.z, fs2)/prod(f.p, fs2))}
+	for _, z := range f.z {
+		g.z = append(g.z, (fs2+z)/(fs2-z))
+	}
+	for _, p := range f.p {
+		g.p = append(g.p, (fs2+p)/(fs2-p))
+	}
+	for i := len(f.z); i < len(f.p); i++ {
+		g.z = append(g.z, -1)
+	}
+	return g
+}
+
+// where an edge at f hz ends up on the analog side of the bilinear transform
+func prewarp(f, fs float64) float64 {
+	return 2 * fs * math.Tan(math.Pi*f/fs)
+}
+
+// the conjugate pairs by their upper half and the real roots two at
+// a time, a last odd one alone
+func groups(r []complex128) [][]complex128 {
+	var (
+		g     [][]complex128
+		reals []float64
+	)
+	for _, v := range r {
+		switch {
+		case imag(v) > 1e-12*math.Max(1, cmplx.Abs(v)):
+			g = append(g, []complex128{v, cmplx.Conj(v)})
+		case imag(v) >= -1e-12*math.Max(1, cmplx.Abs(v)):
+			reals = append(reals, real(v))
+		}
+	}
+	sort.Float64s(reals)
+	for i := 0; i < len(reals); i += 2 {
+		if i+1 < len(reals) {
+			g = append(g, []complex128{complex(reals[i], 0), complex(reals[i+1], 0)})
+		} else {
+			g = append(g, []complex128{complex(reals[i], 0)})
+		}
+	}
+	return g
+}
+
+func poly(r []complex128) [3]float64 {
+	switch len(r) {
+	case 1:
+		return [3]float64{1, -real(r[0]), 0}
+	case 2:
+		return [3]float64{1, -real(r[0] + r[1]), real(r[0] * r[1])}
+	}
+	return [3]float64{1, 0, 0}
+}
+
+// each pair of poles gets the nearest zeros left, the poles nearest
+// the unit circle choosing first and ending up last in the cascade,
+// the gain is spread so no section before the last has a peak over 1
+func (f zpk) sos() ([]biquad, error) {
+	pg, zg := groups(f.p), groups(f.z)
+	if len(pg) != len(zg) || 2*len(pg) < len(f.p) {
+		return nil, fmt.Errorf("the poles and zeros don't pair up")
+	}
+	sort.Slice(pg, func(i, j int) bool {
+		return cmplx.Abs(pg[i][0]) < cmplx.Abs(pg[j][0])
+	})
+
+	s := make([]biquad, len(pg))
+	for i := len(pg) - 1; i >= 0; i-- {
+		best := 0
+		for j := range zg {
+			if cmplx.Abs(zg[j][0]-pg[i][0]) < cmplx.Abs(zg[best][0]-pg[i][0]) {
+				best = j
+			}
+		}
+		s[i] = biquad{b: poly(zg[best]), a: poly(pg[i])}
+		zg = append(zg[:best], zg[best+1:]...)
+	}
+
+	for i := range s[0].b {
+		s[0].b[i] *= f.k
+	}
+	for i := 0; i+1 < len(s); i++ {
+		peak := 0.0
+		for _, v := range magnitudes(s[:i+1], nil, 1024) {
+			peak = math.Max(peak, v)
+		}
+		if peak == 0 {
+			continue
+		}
+		for j := range s[i].b {
+			s[i].b[j] /= peak
+			s[i+1].b[j] *= peak
+		}
+	}
+	return s, nil
+}
+
+// H at f, a fraction of the sample rate
+func (q *biquad) at(f float64) complex128 {
+	z1 := cmplx.Exp(complex(0, -2*math.Pi*f))
+	z2 := z1 * z1
+	num := complex(q.b[0], 0) + complex(q.b[1], 0)*z1 + complex(q.b[2], 0)*z2
+	den := complex(q.a[0], 0) + complex(q.a[1], 0)*z1 + complex(q.a[2], 0)*z2
+	return num / den
+}
+
+// the largest distance of a pole from the origin
+func (q *biquad) radius() float64 {
+	a1, a2 := q.a[1], q.a[2]
+	d := cmplx.Sqrt(complex(a1*a1-4*a2, 0))
+	return math.Max(cmplx.Abs((complex(-a1, 0)+d)/2), cmplx.Abs((complex(-a1, 0)-d)/2))
+}
+
+// the analog prototype of the spec with its band edge at 1
+func prototype(sp *spec) (zpk, error) {
+	n := sp.Order
+	switch sp.Type {
+	case "butter":
+		return butterap(n), nil
+	case "cheby1":
+		return cheb1ap(n, sp.Rp), nil
+	case "cheby2":
+		return cheb2ap(n, sp.Rs), nil
+	case "ellip":
+		return ellipap(n, sp.Rp, sp.Rs), nil
+	case "bessel":
+		if n > 20 {
+			return zpk{}, fmt.Errorf("bessel only up to order 20")
+		}
+		return besselap(n), nil
+	}
+	return zpk{}, fmt.Errorf("unknown filter type %s", sp.Type)
+}
+
+// where the prototype's 1 goes on the prewarped axis. that is the
+// passband edge except for cheby2, whose 1 is the start of its
+// stopband: it is moved out so the passband edges are rp down, both
+// of them when the stopband edges aren't symmetric, like cheb2ord
+func (sp *spec) natural(w []float64) []float64 {
+	if sp.Type != "cheby2" {
+		return w
+	}
+	gs := math.Pow(10, sp.Rs/10) - 1
+	gp := math.Pow(10, sp.Rp/10) - 1
+	// where the prototype is rp down
+	wp := 1 / math.Cosh(math.Acosh(math.Sqrt(gs/gp))/float64(sp.Order))
+	switch sp.Band {
+	case "lp":
+		return []float64{w[0] / wp}
+	case "hp":
+		return []float64{w[0] * wp}
+	}
+	bw := (w[1] - w[0]) / wp
+	if sp.Band == "bs" {
+		bw = (w[1] - w[0]) * wp
+	}
+	lo := -bw/2 + math.Sqrt(bw*bw/4+w[0]*w[1])
+	return []float64{lo, w[0] * w[1] / lo}
+}
+
+func designIIR(sp *spec) ([]biquad, error) {
+	if sp.Order == 0 {
+		n, err := sp.iirOrder()
+		if err != nil {
+			return nil, err
+		}
+		sp.Order = n
+	}
+	if sp.Order < 1 || sp.Order > 40 {
+		return nil, fmt.Errorf("order %d out of range", sp.Order)
+	}
+	f, err := prototype(sp)
+	if err != nil {
+		return nil, err
+	}
+	w := make([]float64, len(sp.Pass))
+	for i, f := range sp.Pass {
+		w[i] = prewarp(f, sp.Fs)
+	}
+	w = sp.natural(w)
+	switch sp.Band {
+	case "lp":
+		f = f.lp2lp(w[0])
+	case "hp":
+		f = f.lp2hp(w[0])
+	case "bp":
+		f = f.lp2bp(math.Sqrt(w[0]*w[1]), w[1]-w[0])
+	case "bs":
+		f = f.lp2bs(math.Sqrt(w[0]*w[1]), w[1]-w[0])
+	}
+	return f.bilinear(sp.Fs).sos()
+}
+
+// how much narrower than the passband the stopband starts, for the
+// lowpass prototype, from the prewarped edges
+func (sp *spec) selectivity() float64 {
+	w := func(f float64) float64 {
+		return math.Tan(math.Pi * f / sp.Fs)
+	}
+	p, s := sp.Pass, sp.Stop
+	switch sp.Band {
+	case "lp":
+		return w(s[0]) / w(p[0])
+	case "hp":
+		return w(p[0]) / w(s[0])
+	}
+	w0 := w(p[0]) * w(p[1])
+	bw := w(p[1]) - w(p[0])
+	r := math.Inf(1)
+	for _, f := range s {
+		ws := w(f)
+		if sp.Band == "bp" {
+			r = math.Min(r, math.Abs((ws*ws-w0)/(ws*bw)))
+		} else {
+			r = math.Min(r, math.Abs(ws*bw/(w0-ws*ws)))
+		}
+	}
+	return r
+}
+
+// the lowest order that has rs db of attenuation from the stopband edge on
+func (sp *spec) iirOrder() (int, error) {
+	if sp.Stop == nil {
+		return 0, fmt.Errorf("give an order with -n or a stopband edge with -stop")
+	}
+	ws := sp.selectivity()
+	d := (math.Pow(10, sp.Rs/10) - 1) / (math.Pow(10, sp.Rp/10) - 1)
+	switch sp.Type {
+	case "butter":
+		// the passband edge is where it is 3dB down
+		return int(bord(-sp.Rs, ws, 1, 'l')), nil
+	case "cheby1", "cheby2":
+		return int(math.Ceil(math.Acosh(math.Sqrt(d)) / math.Acosh(ws))), nil
+	case "ellip":
+		k, k1 := 1/ws, 1/math.Sqrt(d)
+		n := ellipk(k) * ellipk(math.Sqrt(1-k1*k1)) / (ellipk(math.Sqrt(1-k*k)) * ellipk(k1))
+		return int(math.Ceil(n - 1e-9)), nil
+	}
+	return 0, fmt.Errorf("%s needs its order given with -n", sp.Type)
+}
@@ -1,15 +1,593 @@
+// picks standard parts for a target: a resistance, the ratio of a
+// divider, the time constant of an rc or the resonance of an lc. each
+// value can be a network of parts in series and parallel, up to -n of
+// them in all, and the best few for every part count are printed with
+// their error and the worst case over the tolerances of the parts
+//
+//	resistor r 4k7
+//	resistor -e e96 -n 3 div 3.3/5
+//	resistor rc 1ms
+//	resistor -ce e12 lc 455kHz
+//
+// values take the spice suffixes p n u m k meg, or M for mega, also in
+// the middle like 4k7 and 4R7, and a unit after them is ignored. a
+// divider's ratio is what is left at the bottom, 0.66 or 3.3/5. a
+// target beyond what the parts can make still lists the nearest but
+// exits with 1, see -min, -max and -n.
+// without arguments it runs the series and parallel examples
 package main
 
 import (
+	"flag"
 	"fmt"
+	"log"
+	"math"
 	"math/rand"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 )
 
+var (
+	eseries = flag.String("e", "e24", "resistor series: e6, e12, e24 or e96")
+	cseries = flag.String("ce", "e6", "capacitor series")
+	lseries = flag.String("le", "e12", "inductor series")
+	maxn    = flag.Int("n", 2, "most parts in a solution, up to 4")
+	tol     = flag.Float64("tol", 0, "resistor tolerance in %, 0 for the usual one of the series")
+	ctol    = flag.Float64("ctol", 10, "capacitor tolerance in %")
+	ltol    = flag.Float64("ltol", 10, "inductor tolerance in %")
+	rmin    = flag.String("min", "10", "smallest resistor to use")
+	rmax    = flag.String("max", "1M", "largest resistor to use")
+	total   = flag.String("total", "10k", "about what a divider should add up to")
+	keep    = flag.Int("k", 3, "solutions to show for each number of parts")
+	worst   = flag.Bool("worst", false, "rank by the worst case over the tolerances instead of the nominal error")
+)
+
+// the decade values of the series, e24 and e96 are not quite
+// geometric so they are listed
+var eseriesValues = map[string][]float64{
+	"e6":  {1.0, 1.5, 2.2, 3.3, 4.7, 6.8},
+	"e12": {1.0, 1.2, 1.5, 1.8, 2.2, 2.7, 3.3, 3.9, 4.7, 5.6, 6.8, 8.2},
+	"e24": {1.0, 1.1, 1.2, 1.3, 1.5, 1.6, 1.8, 2.0, 2.2, 2.4, 2.7, 3.0,
+		3.3, 3.6, 3.9, 4.3, 4.7, 5.1, 5.6, 6.2, 6.8, 7.5, 8.2, 9.1},
+	"e96": {1.00, 1.02, 1.05, 1.07, 1.10, 1.13, 1.15, 1.18, 1.21, 1.24, 1.27, 1.30,
+		1.33, 1.37, 1.40, 1.43, 1.47, 1.50, 1.54, 1.58, 1.62, 1.65, 1.69, 1.74,
+		1.78, 1.82, 1.87, 1.91, 1.96, 2.00, 2.05, 2.10, 2.15, 2.21, 2.26, 2.32,
+		2.37, 2.43, 2.49, 2.55, 2.61, 2.67, 2.74, 2.80, 2.87, 2.94, 3.01, 3.09,
+		3.16, 3.24, 3.32, 3.40, 3.48, 3.57, 3.65, 3.74, 3.83, 3.92, 4.02, 4.12,
+		4.22, 4.32, 4.42, 4.53, 4.64, 4.75, 4.87, 4.99, 5.11, 5.23, 5.36, 5.49,
+		5.62, 5.76, 5.90, 6.04, 6.19, 6.34, 6.49, 6.65, 6.81, 6.98, 7.15, 7.32,
+		7.50, 7.68, 7.87, 8.06, 8.25, 8.45, 8.66, 8.87, 9.09, 9.31, 9.53, 9.76},
+}
+
+// what parts of the series usually come as, in %
+var eseriesTolerance = map[string]float64{
+	"e6":  20,
+	"e12": 10,
+	"e24": 5,
+	"e96": 1,
+}
+
 func main() {
-	rand.Seed(time.Now().UnixNano())
-	testvoltdiv()
-	testparallel()
+	log.SetFlags(0)
+	log.SetPrefix("resistor: ")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		rand.Seed(time.Now().UnixNano())
+		testvoltdiv()
+		testparallel()
+		return
+	}
+	if flag.NArg() != 2 {
+		usage()
+	}
+	if *maxn < 1 || *maxn > 4 {
+		log.Fatal("-n has to be 1 to 4")
+	}
+	if *keep < 1 {
+		log.Fatal("-k has to be at least 1")
+	}
+
+	var (
+		s   *solver
+		err error
+	)
+	switch mode := flag.Arg(0); mode {
+	case "r":
+		s, err = solveR(flag.Arg(1))
+	case "div":
+		s, err = solveDiv(flag.Arg(1))
+	case "rc":
+		s, err = solveRC(flag.Arg(1))
+	case "lc":
+		s, err = solveLC(flag.Arg(1))
+	default:
+		usage()
+	}
+	ck(err)
+	s.print()
+	switch {
+	case !s.over:
+		log.Fatalf("%s is more than the parts can make", flag.Arg(1))
+	case !s.under:
+		log.Fatalf("%s is less than the parts can make", flag.Arg(1))
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: resistor [options] r|div|rc|lc target")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func ck(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+var valueRE = regexp.MustCompile(`^([0-9]*\.?[0-9]+(?:[eE][-+]?[0-9]+)?)(meg|Meg|MEG|[pnuµmkKMGR])?([0-9]*)(ohms?|Ω|s|Hz|hz|F|H)?$`)
+
+// 4.7k, 4k7, 4R7, 10meg, 1ms, 455kHz
+func parseValue(s string) (float64, error) {
+	m := valueRE.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("bad value %q", s)
+	}
+	num := m[1]
+	if m[3] != "" {
+		if m[2] == "" || strings.Contains(num, ".") || strings.ContainsAny(num, "eE") {
+			return 0, fmt.Errorf("bad value %q", s)
+		}
+		num += "." + m[3]
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad value %q", s)
+	}
+	mul := map[string]float64{
+		"p": 1e-12, "n": 1e-9, "u": 1e-6, "µ": 1e-6, "m": 1e-3,
+		"k": 1e3, "K": 1e3, "meg": 1e6, "Meg": 1e6, "MEG": 1e6, "M": 1e6, "G": 1e9,
+	}
+	if f, ok := mul[m[2]]; ok {
+		v *= f
+	}
+	if v <= 0 {
+		return 0, fmt.Errorf("%q has to be more than 0", s)
+	}
+	return v, nil
+}
+
+// 4.7k, 10u, 1.02M
+func si(v float64) string {
+	prefix := []string{"p", "n", "u", "m", "", "k", "M", "G"}
+	e := int(math.Floor(math.Log10(v) / 3))
+	if e < -4 {
+		e = -4
+	}
+	if e > 3 {
+		e = 3
+	}
+	x := v / math.Pow(10, float64(3*e))
+	// 999.96 rounds up to the next prefix
+	if x >= 999.95 && e < 3 {
+		e++
+		x /= 1000
+	}
+	return trim(x) + prefix[e+4]
+}
+
+// four significant figures without the zeros at the end
+func trim(x float64) string {
+	s := strconv.FormatFloat(x, 'f', 3-int(math.Floor(math.Log10(x))), 64)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
+
+// a part, or two networks in series or parallel
+type net struct {
+	v    float64
+	n    int
+	op   byte // 0 for a part, 's' series, 'p' parallel
+	a, b *net
+}
+
+// the parts of a chain in series or parallel largest first, so the
+// same network always reads the same
+func (x *net) String() string {
+	if x.op == 0 {
+		return si(x.v)
+	}
+	var terms []*net
+	var flat func(y *net)
+	flat = func(y *net) {
+		if y.op == x.op {
+			flat(y.a)
+			flat(y.b)
+		} else {
+			terms = append(terms, y)
+		}
+	}
+	flat(x)
+	sort.SliceStable(terms, func(i, j int) bool { return terms[i].v > terms[j].v })
+	var s []string
+	for _, y := range terms {
+		if y.op != 0 {
+			s = append(s, "("+y.String()+")")
+		} else {
+			s = append(s, y.String())
+		}
+	}
+	if x.op == 'p' {
+		return strings.Join(s, " || ")
+	}
+	return strings.Join(s, " + ")
+}
+
+// every network of one and two parts of a kind, sorted by value
+type library struct {
+	kind byte // 'R', 'C' or 'L'
+	nets [3][]*net
+}
+
+// the value of a and b together, capacitors add in parallel
+func combine(kind, op byte, a, b *net) *net {
+	x := &net{n: a.n + b.n, op: op, a: a, b: b}
+	if (op == 's') == (kind != 'C') {
+		x.v = a.v + b.v
+	} else {
+		x.v = a.v * b.v / (a.v + b.v)
+	}
+	return x
+}
+
+func newLibrary(kind byte, series string, lo, hi float64) (*library, error) {
+	base, ok := eseriesValues[series]
+	if !ok {
+		return nil, fmt.Errorf("unknown series %s", series)
+	}
+	l := &library{kind: kind}
+	for d := math.Floor(math.Log10(lo)) - 1; d <= math.Log10(hi)+1; d++ {
+		for _, b := range base {
+			// rounded so 4.7 * 1e3 is 4700 and not 4700.000000000001
+			v, _ := strconv.ParseFloat(strconv.FormatFloat(b, 'f', 2, 64)+"e"+strconv.Itoa(int(d)), 64)
+			if v >= lo*(1-1e-9) && v <= hi*(1+1e-9) {
+				l.nets[1] = append(l.nets[1], &net{v: v, n: 1})
+			}
+		}
+	}
+	if len(l.nets[1]) == 0 {
+		return nil, fmt.Errorf("no %s values between %s and %s", series, si(lo), si(hi))
+	}
+	p := l.nets[1]
+	for i := range p {
+		for j := i; j < len(p); j++ {
+			l.nets[2] = append(l.nets[2], combine(kind, 's', p[j], p[i]), combine(kind, 'p', p[j], p[i]))
+		}
+	}
+	for _, n := range l.nets[1:] {
+		sort.Slice(n, func(i, j int) bool { return n[i].v < n[j].v })
+	}
+	return l, nil
+}
+
+// the networks of up to n parts, at most two, either side of x
+func (l *library) near(x float64, n int, f func(*net)) {
+	for k := 1; k <= n && k <= 2; k++ {
+		list := l.nets[k]
+		i := sort.Search(len(list), func(i int) bool { return list[i].v >= x })
+		if i > 0 {
+			f(list[i-1])
+		}
+		if i < len(list) {
+			f(list[i])
+		}
+	}
+}
+
+// every network of up to n parts, at most two
+func (l *library) each(n int, f func(*net)) {
+	for k := 1; k <= n && k <= 2; k++ {
+		for _, x := range l.nets[k] {
+			f(x)
+		}
+	}
+}
+
+type solution struct {
+	v      float64
+	parts  int
+	err    float64 // relative to the target
+	lo, hi float64 // the same with the parts at the ends of their tolerances
+	tie    float64 // smaller is better when the rest is the same
+	desc   string
+}
+
+func (s *solution) score() float64 {
+	if *worst {
+		return math.Max(math.Abs(s.lo), math.Abs(s.hi))
+	}
+	return math.Abs(s.err)
+}
+
+func (s *solution) better(t *solution) bool {
+	a, b := s.score(), t.score()
+	if math.Abs(a-b) > 1e-12 {
+		return a < b
+	}
+	return s.tie < t.tie
+}
+
+// the best few solutions for each number of parts
+type solver struct {
+	title  string
+	target float64
+	format func(float64) string
+	best   [5][]*solution
+	// whether anything came out below or above the target, when one
+	// of them didn't the target is out of reach
+	under, over bool
+}
+
+// the description is only made for the solutions that make it in
+func (s *solver) add(c *solution, desc func() string) {
+	list := s.best[c.parts]
+	if len(list) == *keep && !c.better(list[len(list)-1]) {
+		return
+	}
+	c.desc = desc()
+	for _, x := range list {
+		if x.desc == c.desc {
+			return
+		}
+	}
+	i := sort.Search(len(list), func(i int) bool { return c.better(list[i]) })
+	list = append(list, nil)
+	copy(list[i+1:], list[i:])
+	list[i] = c
+	if len(list) > *keep {
+		list = list[:*keep]
+	}
+	s.best[c.parts] = list
+}
+
+func (s *solver) print() {
+	fmt.Println(s.title)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintf(w, "parts\tvalue\terror\tworst case\tparts used\n")
+	// more parts only where they do better than fewer
+	best := math.Inf(1)
+	for n, list := range s.best {
+		for _, c := range list {
+			if c.score() > best-1e-12 {
+				continue
+			}
+			fmt.Fprintf(w, "%d\t%s\t%+.3f%%\t%+.2f%% to %+.2f%%\t%s\n",
+				n, s.format(c.v), 100*c.err, 100*c.lo, 100*c.hi, c.desc)
+		}
+		if len(list) > 0 {
+			best = math.Min(best, list[0].score())
+		}
+	}
+}
+
+func (s *solver) solution(v float64, parts int, lo, hi float64) *solution {
+	s.under = s.under || v <= s.target
+	s.over = s.over || v >= s.target
+	return &solution{
+		v:     v,
+		parts: parts,
+		err:   v/s.target - 1,
+		lo:    lo/s.target - 1,
+		hi:    hi/s.target - 1,
+	}
+}
+
+func resistors() (*library, float64, error) {
+	lo, err := parseValue(*rmin)
+	if err != nil {
+		return nil, 0, err
+	}
+	hi, err := parseValue(*rmax)
+	if err != nil {
+		return nil, 0, err
+	}
+	l, err := newLibrary('R', *eseries, lo, hi)
+	if err != nil {
+		return nil, 0, err
+	}
+	t := *tol
+	if t == 0 {
+		t = eseriesTolerance[*eseries]
+	}
+	return l, t / 100, nil
+}
+
+// a network of up to four parts, as one or two parts or as two
+// networks of them in series or parallel, which is every arrangement
+// of three and the pairs of pairs of four
+func solveR(arg string) (*solver, error) {
+	target, err := parseValue(arg)
+	if err != nil {
+		return nil, err
+	}
+	l, t, err := resistors()
+	if err != nil {
+		return nil, err
+	}
+	s := &solver{
+		title:  fmt.Sprintf("%s from %s resistors at %g%%", si(target), *eseries, 100*t),
+		target: target,
+		format: si,
+	}
+	try := func(x *net) {
+		s.add(s.solution(x.v, x.n, x.v*(1-t), x.v*(1+t)), x.String)
+	}
+	l.near(target, *maxn, try)
+	if *maxn < 3 {
+		return s, nil
+	}
+	l.each(*maxn-1, func(a *net) {
+		rest := *maxn - a.n
+		if a.v < target {
+			l.near(target-a.v, rest, func(b *net) {
+				try(combine('R', 's', a, b))
+			})
+		}
+		if a.v > target {
+			l.near(a.v*target/(a.v-target), rest, func(b *net) {
+				try(combine('R', 'p', a, b))
+			})
+		}
+	})
+	return s, nil
+}
+
+// r1 on top and r2 at the bottom, the ratio r2 / (r1 + r2)
+func solveDiv(arg string) (*solver, error) {
+	var ratio float64
+	if i := strings.Index(arg, "/"); i >= 0 {
+		a, err := parseValue(arg[:i])
+		if err != nil {
+			return nil, err
+		}
+		b, err := parseValue(arg[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		ratio = a / b
+	} else {
+		v, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad ratio %q", arg)
+		}
+		ratio = v
+	}
+	if ratio <= 0 || ratio >= 1 {
+		return nil, fmt.Errorf("the ratio of a divider is between 0 and 1")
+	}
+	if *maxn < 2 {
+		return nil, fmt.Errorf("a divider takes at least two parts")
+	}
+	rt, err := parseValue(*total)
+	if err != nil {
+		return nil, err
+	}
+	l, t, err := resistors()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &solver{
+		title:  fmt.Sprintf("divider of %.5f from %s resistors at %g%%, about %s", ratio, *eseries, 100*t, si(rt)),
+		target: ratio,
+		format: func(v float64) string { return strconv.FormatFloat(v, 'f', 5, 64) },
+	}
+	l.each(*maxn-1, func(r2 *net) {
+		l.near(r2.v*(1-ratio)/ratio, *maxn-r2.n, func(r1 *net) {
+			v := r2.v / (r1.v + r2.v)
+			lo := r2.v * (1 - t) / (r1.v*(1+t) + r2.v*(1-t))
+			hi := r2.v * (1 + t) / (r1.v*(1-t) + r2.v*(1+t))
+			c := s.solution(v, r1.n+r2.n, lo, hi)
+			c.tie = math.Abs(math.Log((r1.v + r2.v) / rt))
+			s.add(c, func() string {
+				return "r1 " + r1.String() + ", r2 " + r2.String()
+			})
+		})
+	})
+	return s, nil
+}
+
+// capacitors from 10p to 100u and inductors from 10n to 100m
+func capacitors() (*library, error) {
+	return newLibrary('C', *cseries, 10e-12, 100e-6)
+}
+
+func inductors() (*library, error) {
+	return newLibrary('L', *lseries, 10e-9, 100e-3)
+}
+
+// tau = r c
+func solveRC(arg string) (*solver, error) {
+	target, err := parseValue(arg)
+	if err != nil {
+		return nil, err
+	}
+	if *maxn < 2 {
+		return nil, fmt.Errorf("an rc takes at least two parts")
+	}
+	rl, tr, err := resistors()
+	if err != nil {
+		return nil, err
+	}
+	cl, err := capacitors()
+	if err != nil {
+		return nil, err
+	}
+	tc := *ctol / 100
+
+	s := &solver{
+		title: fmt.Sprintf("rc of %ss from %s resistors at %g%% and %s capacitors at %g%%",
+			si(target), *eseries, 100*tr, *cseries, 100*tc),
+		target: target,
+		format: func(v float64) string { return si(v) + "s" },
+	}
+	cl.each(*maxn-1, func(c *net) {
+		rl.near(target/c.v, *maxn-c.n, func(r *net) {
+			v := r.v * c.v
+			x := s.solution(v, r.n+c.n, v*(1-tr)*(1-tc), v*(1+tr)*(1+tc))
+			s.add(x, func() string {
+				return "r " + r.String() + ", c " + c.String()
+			})
+		})
+	})
+	return s, nil
+}
+
+// f = 1 / (2 pi sqrt(l c))
+func solveLC(arg string) (*solver, error) {
+	target, err := parseValue(arg)
+	if err != nil {
+		return nil, err
+	}
+	if *maxn < 2 {
+		return nil, fmt.Errorf("an lc takes at least two parts")
+	}
+	ll, err := inductors()
+	if err != nil {
+		return nil, err
+	}
+	cl, err := capacitors()
+	if err != nil {
+		return nil, err
+	}
+	tl, tc := *ltol/100, *ctol/100
+
+	s := &solver{
+		title: fmt.Sprintf("lc of %sHz from %s inductors at %g%% and %s capacitors at %g%%",
+			si(target), *lseries, 100*tl, *cseries, 100*tc),
+		target: target,
+		format: func(v float64) string { return si(v) + "Hz" },
+	}
+	w := 2 * math.Pi * target
+	cl.each(*maxn-1, func(c *net) {
+		ll.near(1/(w*w*c.v), *maxn-c.n, func(l *net) {
+			v := 1 / (2 * math.Pi * math.Sqrt(l.v*c.v))
+			x := s.solution(v, l.n+c.n, v/math.Sqrt((1+tl)*(1+tc)), v/math.Sqrt((1-tl)*(1-tc)))
+			s.add(x, func() string {
+				return "l " + l.String() + ", c " + c.String()
+			})
+		})
+	})
+	return s, nil
 }
 
 func testvoltdiv() {
@@ -1,94 +1,278 @@
-// translates bf to c
+// translates bf to c, or to go with -go
+// go build bf-to-c.go bfir.go
+// the generated code follows the same cell size, overflow, eof
+// and tape growth options as the interpreter
 
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"go/format"
+	"log"
 	"os"
 	"strings"
 )
 
+var (
+	conf  Config
+	goOut = flag.Bool("go", false, "generate go instead of c")
+)
+
 func main() {
+	log.SetFlags(0)
+	log.SetPrefix("bf-to-c: ")
+	conf.AddFlags()
+	flag.Usage = usage
 	flag.Parse()
-	if flag.NArg() < 1 {
-		die("usage: <file>")
+	if flag.NArg() != 1 {
+		usage()
 	}
+	ck(conf.Check())
 
-	run(flag.Arg(0))
-}
+	src, err := os.ReadFile(flag.Arg(0))
+	ck(err)
+	prog, err := Compile(flag.Arg(0), src, &conf)
+	ck(err)
 
-func run(fn string) {
-	const accepted = "><.+-,[]"
+	w := bufio.NewWriter(os.Stdout)
+	if *goOut {
+		// easier to emit it roughly and let gofmt lay it out
+		var b bytes.Buffer
+		bw := bufio.NewWriter(&b)
+		genGo(bw, prog, &conf)
+		bw.Flush()
+		src, err := format.Source(b.Bytes())
+		ck(err)
+		w.Write(src)
+	} else {
+		genC(w, prog, &conf)
+	}
+	ck(w.Flush())
+}
 
-	code, err := ioutil.ReadFile(fn)
+func ck(err error) {
 	if err != nil {
-		die("%v", err)
+		log.Fatal(err)
 	}
+}
 
-	fmt.Println(`
-#include <stdio.h>
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: bf-to-c [options] file")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+// the generated programs index the tape with p and call
+// grow when an index falls off either end
+const cHeader = `#include <stdio.h>
 #include <stdlib.h>
+#include <string.h>
+#include <stdint.h>
+
+typedef uint%[1]d_t cell;
 
-unsigned char *ip;
-unsigned char mem[30000];
+static cell *tape;
+static long len = %[2]d, origin, p;
+
+static void die(const char *msg) {
+	fflush(stdout);
+	fprintf(stderr, "%%s\n", msg);
+	exit(1);
+}
+
+static long grow(long i) {
+	if (i >= len && %[3]d) {
+		long n = 2*len > i+1 ? 2*len : i+1;
+		tape = realloc(tape, n*sizeof(cell));
+		if (!tape)
+			die("out of memory");
+		memset(tape+len, 0, (n-len)*sizeof(cell));
+		len = n;
+	} else if (i < 0 && %[4]d) {
+		long n = len > -i ? len : -i;
+		cell *t = calloc(len+n, sizeof(cell));
+		if (!t)
+			die("out of memory");
+		memcpy(t+n, tape, len*sizeof(cell));
+		free(tape);
+		tape = t;
+		len += n;
+		origin += n;
+		p += n;
+		i += n;
+	} else
+		die(i < 0 ? "moved left of the start of the tape" : "moved past the end of the tape");
+	return i;
+}
+
+#define AT(i) ((i) < 0 || (i) >= len ? grow(i) : (i))
+
+static void add(long i, long long n) {
+	long long v = (long long)tape[i] + n;
+	if (%[5]d && (v < 0 || v > %[6]dLL))
+		die("cell overflowed");
+	tape[i] = (cell)v;
+}
 
 int main(void) {
-	ip = mem;
-`)
+	int c;
+	long i;
+
+	(void)c;
+	(void)i;
+	tape = calloc(len, sizeof(cell));
+	if (!tape)
+		die("out of memory");
+`
+
+func genC(w *bufio.Writer, p *Prog, c *Config) {
+	fmt.Fprintf(w, cHeader, c.Bits, c.Tape, b2i(c.Grow != "none"), b2i(c.Grow == "both"),
+		b2i(c.Overflow == "error"), c.Max())
 
 	tabs := 1
-	for i := 0; i < len(code); i++ {
-		c := code[i]
-		if strings.ContainsRune(accepted, rune(c)) {
-			if c == ']' {
-				tabs--
+	for _, ins := range p.Ins {
+		if ins.Op == Close {
+			tabs--
+		}
+		w.WriteString(strings.Repeat("\t", tabs))
+		switch ins.Op {
+		case Add:
+			fmt.Fprintf(w, "add(p, %d);\n", ins.Arg)
+		case Move:
+			fmt.Fprintf(w, "p = AT(p %+d);\n", ins.Arg)
+		case Out:
+			w.WriteString("putchar((unsigned char)tape[p]);\n")
+		case In:
+			w.WriteString("fflush(stdout);\n")
+			w.WriteString(strings.Repeat("\t", tabs))
+			switch c.EOF {
+			case "zero":
+				w.WriteString("tape[p] = (c = getchar()) == EOF ? 0 : c;\n")
+			case "max":
+				w.WriteString("tape[p] = (c = getchar()) == EOF ? (cell)-1 : c;\n")
+			default:
+				w.WriteString("if ((c = getchar()) != EOF) tape[p] = c;\n")
 			}
+		case Open:
+			w.WriteString("while (tape[p]) {\n")
+			tabs++
+		case Close:
+			w.WriteString("}\n")
+		case Clear:
+			w.WriteString("tape[p] = 0;\n")
+		case Scan:
+			fmt.Fprintf(w, "while (tape[p]) p = AT(p %+d);\n", ins.Arg)
+		case Mul:
+			fmt.Fprintf(w, "if (tape[p]) { i = AT(p %+d); add(i, (long long)tape[p] * %d); }\n", ins.Off, ins.Arg)
+		}
+	}
+	w.WriteString("\tfflush(stdout);\n\treturn 0;\n}\n")
+}
 
-			if tabs <= 0 {
-				die("unmatched [")
-			}
+const goHeader = `package main
 
-			fmt.Printf(strings.Repeat("\t", tabs))
-		}
+import (
+	"bufio"
+	"fmt"
+	"os"
+)
 
-		switch c {
-		case '>':
-			fmt.Println("ip++;")
+type cell = uint%[1]d
 
-		case '<':
-			fmt.Println("ip--;")
+var (
+	tape   = make([]cell, %[2]d)
+	p      int
+	origin int
+	in     = bufio.NewReader(os.Stdin)
+	out    = bufio.NewWriter(os.Stdout)
+)
 
-		case '.':
-			fmt.Println("putchar(*ip);")
+func die(msg string) {
+	out.Flush()
+	fmt.Fprintln(os.Stderr, msg)
+	os.Exit(1)
+}
 
-		case '+':
-			fmt.Println("(*ip)++;")
+func at(i int) int {
+	if i >= 0 && i < len(tape) {
+		return i
+	}
+	switch {
+	case i >= len(tape) && %[3]t:
+		t := make([]cell, max(2*len(tape), i+1))
+		copy(t, tape)
+		tape = t
+	case i < 0 && %[4]t:
+		n := max(len(tape), -i)
+		t := make([]cell, len(tape)+n)
+		copy(t[n:], tape)
+		tape = t
+		origin += n
+		p += n
+		i += n
+	case i < 0:
+		die("moved left of the start of the tape")
+	default:
+		die("moved past the end of the tape")
+	}
+	return i
+}
 
-		case '-':
-			fmt.Println("(*ip)--;")
+func add(i int, n int64) {
+	v := int64(tape[i]) + n
+	if %[5]t && (v < 0 || v > %[6]d) {
+		die("cell overflowed")
+	}
+	tape[i] = cell(v)
+}
 
-		case ',':
-			fmt.Println("*ip = getchar();")
+func main() {
+	defer out.Flush()
+`
 
-		case '[':
-			fmt.Println("while (*ip) {")
-			tabs++
+func genGo(w *bufio.Writer, p *Prog, c *Config) {
+	fmt.Fprintf(w, goHeader, c.Bits, c.Tape, c.Grow != "none", c.Grow == "both",
+		c.Overflow == "error", c.Max())
 
-		case ']':
-			fmt.Println("}")
+	for _, ins := range p.Ins {
+		switch ins.Op {
+		case Add:
+			fmt.Fprintf(w, "add(p, %d)\n", ins.Arg)
+		case Move:
+			fmt.Fprintf(w, "p = at(p %+d)\n", ins.Arg)
+		case Out:
+			w.WriteString("out.WriteByte(byte(tape[p]))\n")
+		case In:
+			w.WriteString("out.Flush()\n")
+			switch c.EOF {
+			case "zero":
+				w.WriteString("if c, err := in.ReadByte(); err == nil { tape[p] = cell(c) } else { tape[p] = 0 }\n")
+			case "max":
+				w.WriteString("if c, err := in.ReadByte(); err == nil { tape[p] = cell(c) } else { tape[p] = ^cell(0) }\n")
+			default:
+				w.WriteString("if c, err := in.ReadByte(); err == nil { tape[p] = cell(c) }\n")
+			}
+		case Open:
+			w.WriteString("for tape[p] != 0 {\n")
+		case Close:
+			w.WriteString("}\n")
+		case Clear:
+			w.WriteString("tape[p] = 0\n")
+		case Scan:
+			fmt.Fprintf(w, "for tape[p] != 0 { p = at(p %+d) }\n", ins.Arg)
+		case Mul:
+			fmt.Fprintf(w, "if v := tape[p]; v != 0 { i := at(p %+d); add(i, int64(v)*%d) }\n", ins.Off, ins.Arg)
 		}
 	}
-
-	fmt.Println(`
-	return 0;
-}
-`)
-
+	w.WriteString("}\n")
 }
 
-func die(format string, args ...interface{}) {
-	fmt.Printf(format+"\n", args...)
-	os.Exit(1)
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
@@ -1,100 +1,433 @@
 // a bf interpreter
+// go build bf.go bfir.go
+// the source is compiled to a small ir first, runs of +-<> are folded and
+// the usual clear, scan and multiply loops become single instructions.
+// -d runs it under a debugger, # in the source stops there like a breakpoint
 
 package main
 
 import (
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"log"
 	"os"
+	"strconv"
+	"strings"
 )
 
-const (
-	MemSize = 500000
+var (
+	conf    Config
+	debug   = flag.Bool("d", false, "run under the debugger")
+	list    = flag.Bool("l", false, "list the compiled program and exit")
+	input   = flag.String("i", "", "read program input from this file")
+	profile = flag.Bool("s", false, "print instruction counts when done")
 )
 
 func main() {
+	log.SetFlags(0)
+	log.SetPrefix("bf: ")
+	conf.AddFlags()
+	flag.Usage = usage
 	flag.Parse()
-	if flag.NArg() < 1 {
-		die("usage: <file>")
+	if flag.NArg() != 1 {
+		usage()
 	}
+	ck(conf.Check())
+	conf.Debug = *debug
 
-	run(flag.Arg(0))
+	src, err := os.ReadFile(flag.Arg(0))
+	ck(err)
+	prog, err := Compile(flag.Arg(0), src, &conf)
+	ck(err)
+
+	if *list {
+		for i := range prog.Ins {
+			fmt.Println(prog.Disasm(i))
+		}
+		return
+	}
+
+	in := io.Reader(os.Stdin)
+	if *input != "" {
+		f, err := os.Open(*input)
+		ck(err)
+		defer f.Close()
+		in = f
+	}
+	m := NewMachine(prog, &conf, in, os.Stdout)
+	if *profile {
+		m.Count = make([]int64, len(prog.Ins))
+	}
+	if *debug {
+		err = NewDebugger(m).Run()
+	} else {
+		err = m.Exec(-1)
+	}
+	m.out.Flush()
+	if *profile {
+		m.printProfile()
+	}
+	ck(err)
 }
 
-func run(fn string) {
-	code, err := ioutil.ReadFile(fn)
+func ck(err error) {
 	if err != nil {
-		die("%v", err)
+		log.Fatal(err)
 	}
+}
 
-	ip := 0
-	mem := make([]byte, MemSize)
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: bf [options] file")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
 
-	for i := 0; i < len(code); i++ {
-		switch code[i] {
-		case '>':
-			if ip++; ip > len(mem) {
-				nmem := make([]byte, len(mem)*2)
-				copy(nmem, mem)
-				mem = nmem
-			}
+type Machine struct {
+	*Prog
+	conf   *Config
+	Tape   []uint32
+	P      int
+	Origin int // index of the starting cell, moves when the tape grows left
+	PC     int
+	Steps  int64
+	Count  []int64
+	Breaks []bool
+	mask   uint32
+	in     *bufio.Reader
+	out    *bufio.Writer
+}
+
+// why Exec came back early
+var (
+	errBreak = errors.New("breakpoint")
+	errLimit = errors.New("step limit")
+)
+
+func NewMachine(p *Prog, c *Config, r io.Reader, w io.Writer) *Machine {
+	m := &Machine{
+		Prog:   p,
+		conf:   c,
+		Tape:   make([]uint32, c.Tape),
+		Breaks: make([]bool, len(p.Ins)),
+		mask:   uint32(c.Max()),
+		in:     bufio.NewReader(r),
+		out:    bufio.NewWriter(w),
+	}
+	for i, ins := range p.Ins {
+		m.Breaks[i] = ins.Op == Break
+	}
+	return m
+}
+
+// runs n instructions, or to the end when n < 0. stops before a breakpoint,
+// unless it is the first instruction so a continue can get past it
+func (m *Machine) Exec(n int64) error {
+	ins := m.Ins
+	for first := true; m.PC < len(ins); first = false {
+		if n == 0 {
+			return errLimit
+		}
+		if m.Breaks[m.PC] && !first {
+			return errBreak
+		}
+		n--
+		m.Steps++
+		if m.Count != nil {
+			m.Count[m.PC]++
+		}
 
-		case '<':
-			if ip--; ip < 0 {
-				nmem := make([]byte, len(mem)*2)
-				copy(nmem[len(mem):], mem)
-				ip = len(mem) - 1
+		in := &ins[m.PC]
+		switch in.Op {
+		case Add:
+			if err := m.add(m.P, int64(in.Arg)); err != nil {
+				return err
 			}
+		case Move:
+			m.P += in.Arg
+			if m.P < 0 || m.P >= len(m.Tape) {
+				if _, err := m.grow(m.P); err != nil {
+					return err
+				}
+			}
+		case Out:
+			m.out.WriteByte(byte(m.Tape[m.P]))
+		case In:
+			m.out.Flush()
+			c, err := m.in.ReadByte()
+			switch {
+			case err == nil:
+				m.Tape[m.P] = uint32(c)
+			case err != io.EOF:
+				return err
+			case m.conf.EOF == "zero":
+				m.Tape[m.P] = 0
+			case m.conf.EOF == "max":
+				m.Tape[m.P] = m.mask
+			}
+		case Open:
+			if m.Tape[m.P] == 0 {
+				m.PC = in.Arg
+			}
+		case Close:
+			if m.Tape[m.P] != 0 {
+				m.PC = in.Arg
+			}
+		case Clear:
+			m.Tape[m.P] = 0
+		case Scan:
+			for m.Tape[m.P] != 0 {
+				m.P += in.Arg
+				if m.P < 0 || m.P >= len(m.Tape) {
+					if _, err := m.grow(m.P); err != nil {
+						return err
+					}
+				}
+			}
+		case Mul:
+			if v := m.Tape[m.P]; v != 0 {
+				i := m.P + in.Off
+				if i < 0 || i >= len(m.Tape) {
+					var err error
+					if i, err = m.grow(i); err != nil {
+						return err
+					}
+				}
+				if err := m.add(i, int64(v)*int64(in.Arg)); err != nil {
+					return err
+				}
+			}
+		case Break:
+		}
+		m.PC++
+	}
+	return nil
+}
+
+func (m *Machine) add(i int, n int64) error {
+	v := int64(m.Tape[i]) + n
+	if m.conf.Overflow == "error" && (v < 0 || v > int64(m.mask)) {
+		return fmt.Errorf("%s: cell %d overflowed", m.Where(m.Ins[m.PC].Pos), i-m.Origin)
+	}
+	m.Tape[i] = uint32(v) & m.mask
+	return nil
+}
+
+// makes room for cell i, returns where it ended up
+func (m *Machine) grow(i int) (int, error) {
+	where := m.Where(m.Ins[m.PC].Pos)
+	switch {
+	case i >= len(m.Tape) && m.conf.Grow != "none":
+		t := make([]uint32, max(2*len(m.Tape), i+1))
+		copy(t, m.Tape)
+		m.Tape = t
+	case i < 0 && m.conf.Grow == "both":
+		n := max(len(m.Tape), -i)
+		t := make([]uint32, len(m.Tape)+n)
+		copy(t[n:], m.Tape)
+		m.Tape = t
+		m.P += n
+		m.Origin += n
+		i += n
+	case i < 0:
+		return i, fmt.Errorf("%s: moved left of the start of the tape", where)
+	default:
+		return i, fmt.Errorf("%s: moved past the end of the tape", where)
+	}
+	return i, nil
+}
 
-		case '.':
-			fmt.Printf("%c", mem[ip])
+func (m *Machine) printProfile() {
+	fmt.Fprintf(os.Stderr, "%d instructions executed\n", m.Steps)
+	for i, n := range m.Count {
+		fmt.Fprintf(os.Stderr, "%12d %s\n", n, m.Disasm(i))
+	}
+}
 
-		case '+':
-			mem[ip]++
+type Debugger struct {
+	*Machine
+	cmd *bufio.Scanner
+}
 
-		case '-':
-			mem[ip]--
+// commands come from the terminal so stdin is left for the program
+func NewDebugger(m *Machine) *Debugger {
+	r := io.Reader(os.Stdin)
+	if tty, err := os.Open("/dev/tty"); err == nil {
+		r = tty
+	}
+	return &Debugger{Machine: m, cmd: bufio.NewScanner(r)}
+}
 
-		case ',':
-			var r rune
-			fmt.Scanf("%v", &r)
-			mem[ip] = byte(r)
+const debugHelp = `s [n]          step n instructions
+c              continue to the next breakpoint
+b              list breakpoints
+b line:col     break at the first instruction at or after a source position
+b @n           break at instruction n
+d @n           delete the breakpoint at instruction n
+t [from [to]]  dump tape cells, numbered from the starting cell
+r              show the registers
+l [n]          list the program around the pc, or around instruction n
+q              quit`
 
-		case '[':
-			if mem[ip] == 0 {
-				for p := 1; p > 0; {
-					if i++; i >= len(code) {
-						die("unmatched ]")
-					}
+func (d *Debugger) Run() error {
+	d.where()
+	for {
+		d.out.Flush()
+		fmt.Fprint(os.Stderr, "(bf) ")
+		if !d.cmd.Scan() {
+			return d.cmd.Err()
+		}
+		args := strings.Fields(d.cmd.Text())
+		if len(args) == 0 {
+			args = []string{"s"}
+		}
 
-					if code[i] == '[' {
-						p++
-					} else if code[i] == ']' {
-						p--
-					}
-				}
+		var err error
+		switch args[0] {
+		case "s", "step":
+			n := int64(1)
+			if len(args) > 1 {
+				n, _ = strconv.ParseInt(args[1], 0, 64)
+			}
+			err = d.Exec(n)
+		case "c", "cont":
+			err = d.Exec(-1)
+		case "b", "break":
+			d.setBreak(args[1:], true)
+			continue
+		case "d", "delete":
+			d.setBreak(args[1:], false)
+			continue
+		case "t", "tape":
+			d.dump(args[1:])
+			continue
+		case "r", "regs":
+			d.regs()
+			continue
+		case "l", "list":
+			pc := d.PC
+			if len(args) > 1 {
+				pc, _ = strconv.Atoi(strings.TrimPrefix(args[1], "@"))
 			}
+			d.list(pc)
+			continue
+		case "q", "quit":
+			return nil
+		case "h", "help", "?":
+			fmt.Fprintln(os.Stderr, debugHelp)
+			continue
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command %q, h for help\n", args[0])
+			continue
+		}
 
-		case ']':
-			if mem[ip] != 0 {
-				for p := 1; p > 0; {
-					if i--; i < 0 {
-						die("unmatched [")
-					}
+		d.out.Flush()
+		switch err {
+		case nil:
+			fmt.Fprintf(os.Stderr, "\nprogram finished after %d steps\n", d.Steps)
+			return nil
+		case errBreak, errLimit:
+			d.where()
+		default:
+			return err
+		}
+	}
+}
 
-					if code[i] == ']' {
-						p++
-					} else if code[i] == '[' {
-						p--
-					}
-				}
+func (d *Debugger) where() {
+	if d.PC >= len(d.Ins) {
+		fmt.Fprintln(os.Stderr, "at end of program")
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s\n%s\n", d.Where(d.Ins[d.PC].Pos), d.Disasm(d.PC))
+}
+
+func (d *Debugger) regs() {
+	fmt.Fprintf(os.Stderr, "pc %d  ptr %d  cell %d  steps %d  tape %d cells\n",
+		d.PC, d.P-d.Origin, d.Tape[d.P], d.Steps, len(d.Tape))
+}
+
+func (d *Debugger) setBreak(args []string, on bool) {
+	if len(args) == 0 {
+		for i, b := range d.Breaks {
+			if b {
+				fmt.Fprintf(os.Stderr, "%s  %s\n", d.Disasm(i), d.Where(d.Ins[i].Pos))
+			}
+		}
+		return
+	}
+
+	pc := -1
+	if n, err := strconv.Atoi(strings.TrimPrefix(args[0], "@")); err == nil && strings.HasPrefix(args[0], "@") {
+		pc = n
+	} else if line, col, ok := strings.Cut(args[0], ":"); ok {
+		l, _ := strconv.Atoi(line)
+		c, _ := strconv.Atoi(col)
+		off := d.offset(l, c)
+		for i, ins := range d.Ins {
+			if ins.End > off {
+				pc = i
+				break
 			}
 		}
 	}
+	if pc < 0 || pc >= len(d.Ins) {
+		fmt.Fprintf(os.Stderr, "no instruction at %s\n", args[0])
+		return
+	}
+	d.Breaks[pc] = on
+	if on {
+		fmt.Fprintf(os.Stderr, "breakpoint at %s\n", d.Disasm(pc))
+	}
+}
+
+// source offset of a line and column
+func (d *Debugger) offset(line, col int) int {
+	off := 0
+	for l := 1; l < line && off < len(d.Src); off++ {
+		if d.Src[off] == '\n' {
+			l++
+		}
+	}
+	return off + col - 1
 }
 
-func die(format string, args ...interface{}) {
-	fmt.Printf(format+"\n", args...)
-	os.Exit(1)
+func (d *Debugger) dump(args []string) {
+	from, to := d.P-d.Origin-8, d.P-d.Origin+8
+	if len(args) > 0 {
+		from, _ = strconv.Atoi(args[0])
+		to = from + 16
+	}
+	if len(args) > 1 {
+		to, _ = strconv.Atoi(args[1])
+	}
+	from = max(from, -d.Origin)
+	to = min(to, len(d.Tape)-d.Origin-1)
+	for i := from; i <= to; i++ {
+		v := d.Tape[i+d.Origin]
+		mark := " "
+		if i+d.Origin == d.P {
+			mark = ">"
+		}
+		ch := ""
+		if v >= 0x20 && v < 0x7f {
+			ch = fmt.Sprintf("%q", rune(v))
+		}
+		fmt.Fprintln(os.Stderr, strings.TrimRight(fmt.Sprintf("%s%6d  %10d  %s", mark, i, v, ch), " "))
+	}
+}
+
+func (d *Debugger) list(pc int) {
+	for i := max(pc-5, 0); i < min(pc+6, len(d.Ins)); i++ {
+		mark := "  "
+		if i == d.PC {
+			mark = "=>"
+		}
+		if d.Breaks[i] {
+			mark = mark[:1] + "*"
+		}
+		fmt.Fprintf(os.Stderr, "%s%s\n", mark, d.Disasm(i))
+	}
 }
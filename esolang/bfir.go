@@ -0,0 +1,277 @@
+// the bf front end shared by the interpreter and the compiler
+// go build bf.go bfir.go
+// go build bf-to-c.go bfir.go
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+type Op uint8
+
+const (
+	Add   Op = iota // cell += Arg
+	Move            // p += Arg
+	Out             // write cell
+	In              // read cell
+	Open            // if cell == 0, go past the matching Close at Arg
+	Close           // if cell != 0, go back past the matching Open at Arg
+	Clear           // cell = 0, from [-]
+	Scan            // move by Arg until cell == 0, from [>] and [<<]
+	Mul             // cell[p+Off] += cell*Arg, from [->+++<]
+	Break           // a # in the source, stops in the debugger
+)
+
+func (o Op) String() string {
+	switch o {
+	case Add:
+		return "add"
+	case Move:
+		return "move"
+	case Out:
+		return "out"
+	case In:
+		return "in"
+	case Open:
+		return "open"
+	case Close:
+		return "close"
+	case Clear:
+		return "clear"
+	case Scan:
+		return "scan"
+	case Mul:
+		return "mul"
+	case Break:
+		return "break"
+	}
+	return fmt.Sprintf("op(%d)", int(o))
+}
+
+// Pos and End are the byte offsets of the source the instruction came from
+type Ins struct {
+	Op  Op
+	Arg int
+	Off int
+	Pos int
+	End int
+}
+
+type Prog struct {
+	Name string
+	Src  []byte
+	Ins  []Ins
+}
+
+// how the cells behave, shared by the interpreter and the generated code
+type Config struct {
+	Bits     int    // 8, 16 or 32
+	Overflow string // wrap or error
+	EOF      string // zero, max or keep
+	Tape     int    // initial tape size
+	Grow     string // both, right or none
+	Opt      int    // 0 keeps every command, 1 folds runs, 2 also rewrites idioms
+	Debug    bool   // keep # as a breakpoint
+}
+
+func (c *Config) AddFlags() {
+	flag.IntVar(&c.Bits, "b", 8, "cell size in bits: 8, 16 or 32")
+	flag.StringVar(&c.Overflow, "overflow", "wrap", "cell overflow: wrap or error")
+	flag.StringVar(&c.EOF, "eof", "zero", "what , stores at end of input: zero, max or keep")
+	flag.IntVar(&c.Tape, "tape", 30000, "initial tape size")
+	flag.StringVar(&c.Grow, "grow", "both", "tape growth: both, right or none")
+	flag.IntVar(&c.Opt, "O", 2, "optimization level: 0, 1 or 2")
+}
+
+func (c *Config) Check() error {
+	switch {
+	case c.Bits != 8 && c.Bits != 16 && c.Bits != 32:
+		return fmt.Errorf("unsupported cell size %d", c.Bits)
+	case c.Overflow != "wrap" && c.Overflow != "error":
+		return fmt.Errorf("unknown overflow mode %q", c.Overflow)
+	case c.EOF != "zero" && c.EOF != "max" && c.EOF != "keep":
+		return fmt.Errorf("unknown eof mode %q", c.EOF)
+	case c.Grow != "both" && c.Grow != "right" && c.Grow != "none":
+		return fmt.Errorf("unknown tape growth %q", c.Grow)
+	case c.Tape < 1:
+		return fmt.Errorf("tape size must be positive")
+	}
+	return nil
+}
+
+func (c *Config) Max() uint64 {
+	return 1<<uint(c.Bits) - 1
+}
+
+func Compile(name string, src []byte, c *Config) (*Prog, error) {
+	p := &Prog{Name: name, Src: src}
+	var open []int
+	for i := 0; i < len(src); i++ {
+		ins := Ins{Pos: i, End: i + 1}
+		switch src[i] {
+		case '+', '-', '>', '<':
+			ins.Op, ins.Arg = Add, 1
+			if src[i] == '>' || src[i] == '<' {
+				ins.Op = Move
+			}
+			if src[i] == '-' || src[i] == '<' {
+				ins.Arg = -1
+			}
+			// fold the run, skipping comments in between
+			for c.Opt > 0 && i+1 < len(src) {
+				d := fold(ins.Op, src[i+1])
+				if d == 0 && strings.IndexByte("+-<>.,[]#", src[i+1]) >= 0 {
+					break
+				}
+				i++
+				ins.Arg += d
+				if d != 0 {
+					ins.End = i + 1
+				}
+			}
+			if ins.Arg == 0 && c.Opt > 0 {
+				continue
+			}
+		case '.':
+			ins.Op = Out
+		case ',':
+			ins.Op = In
+		case '#':
+			if !c.Debug {
+				continue
+			}
+			ins.Op = Break
+		case '[':
+			ins.Op = Open
+			open = append(open, len(p.Ins))
+		case ']':
+			if len(open) == 0 {
+				return nil, fmt.Errorf("%s: unmatched ]", p.Where(i))
+			}
+			start := open[len(open)-1]
+			open = open[:len(open)-1]
+			if c.Opt > 1 && p.idiom(start, i, c) {
+				continue
+			}
+			ins.Op = Close
+		default:
+			continue
+		}
+		p.Ins = append(p.Ins, ins)
+	}
+	if len(open) > 0 {
+		return nil, fmt.Errorf("%s: unmatched [", p.Where(p.Ins[open[len(open)-1]].Pos))
+	}
+	p.link()
+	return p, nil
+}
+
+func fold(op Op, ch byte) int {
+	switch {
+	case op == Add && ch == '+', op == Move && ch == '>':
+		return 1
+	case op == Add && ch == '-', op == Move && ch == '<':
+		return -1
+	}
+	return 0
+}
+
+// replaces the loop starting at instruction start and ending at source
+// offset end with a cheaper equivalent if it is one of the common idioms
+func (p *Prog) idiom(start, end int, c *Config) bool {
+	body := p.Ins[start+1:]
+	pos := p.Ins[start].Pos
+	var repl []Ins
+
+	switch {
+	// [-] clears the cell, [+] only does without overflow checks
+	case len(body) == 1 && body[0].Op == Add && body[0].Arg == -1,
+		len(body) == 1 && body[0].Op == Add && body[0].Arg == 1 && c.Overflow == "wrap":
+		repl = []Ins{{Op: Clear}}
+
+	case len(body) == 1 && body[0].Op == Move:
+		repl = []Ins{{Op: Scan, Arg: body[0].Arg}}
+
+	default:
+		// a balanced loop of adds and moves that takes one from the
+		// counter each time around multiplies it into the other cells
+		off := 0
+		delta := map[int]int{}
+		var order []int
+		for _, ins := range body {
+			switch ins.Op {
+			case Add:
+				if _, ok := delta[off]; !ok {
+					order = append(order, off)
+				}
+				delta[off] += ins.Arg
+			case Move:
+				off += ins.Arg
+			default:
+				return false
+			}
+		}
+		if off != 0 || delta[0] != -1 {
+			return false
+		}
+		for _, o := range order {
+			if o != 0 && delta[o] != 0 {
+				repl = append(repl, Ins{Op: Mul, Off: o, Arg: delta[o]})
+			}
+		}
+		repl = append(repl, Ins{Op: Clear})
+	}
+
+	for i := range repl {
+		repl[i].Pos, repl[i].End = pos, end+1
+	}
+	p.Ins = append(p.Ins[:start], repl...)
+	return true
+}
+
+// points every bracket at its partner, done last since
+// the idioms move instructions around
+func (p *Prog) link() {
+	var open []int
+	for i := range p.Ins {
+		switch p.Ins[i].Op {
+		case Open:
+			open = append(open, i)
+		case Close:
+			j := open[len(open)-1]
+			open = open[:len(open)-1]
+			p.Ins[i].Arg, p.Ins[j].Arg = j, i
+		}
+	}
+}
+
+// line:col of a source offset
+func (p *Prog) Where(off int) string {
+	line, col := 1, 1
+	for _, ch := range p.Src[:min(off, len(p.Src))] {
+		col++
+		if ch == '\n' {
+			line, col = line+1, 1
+		}
+	}
+	return fmt.Sprintf("%s:%d:%d", p.Name, line, col)
+}
+
+func (p *Prog) Disasm(i int) string {
+	ins := p.Ins[i]
+	s := fmt.Sprintf("%5d  %-6s", i, ins.Op)
+	switch ins.Op {
+	case Add, Move, Scan, Open, Close:
+		s += fmt.Sprintf(" %d", ins.Arg)
+	case Mul:
+		s += fmt.Sprintf(" [%+d] += %d", ins.Off, ins.Arg)
+	}
+	src := strings.Join(strings.Fields(string(p.Src[ins.Pos:ins.End])), "")
+	if len(src) > 24 {
+		src = src[:21] + "..."
+	}
+	return fmt.Sprintf("%-28s %s", s, src)
+}
@@ -0,0 +1,120 @@
+// step and time limits, program input and an instruction profile,
+// shared by interpreters that run one instruction at a time
+// go build malbolge.go esolimit.go
+// go build s4.go esolimit.go
+// go build whitespace.go asm.go debug.go ../esolimit.go, in whitespace
+// the flags are the same for all of them so esorun can drive them,
+// and a program stopped by a limit exits with status 3
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+const exitLimit = 3
+
+type Stepper interface {
+	// runs one instruction
+	Step() (halted bool, err error)
+	// names the instruction Step is about to run
+	Op() string
+}
+
+type Limits struct {
+	Steps   int64
+	Timeout time.Duration
+	Input   string
+	Prof    bool
+
+	steps int64
+	prof  map[string]int64
+}
+
+func (l *Limits) AddFlags(fs *flag.FlagSet) {
+	fs.Int64Var(&l.Steps, "limit", 0, "stop after this many steps, 0 for no limit")
+	fs.DurationVar(&l.Timeout, "timeout", 0, "stop after this long, 0 for no limit")
+	fs.StringVar(&l.Input, "i", "", "read program input from this file")
+	fs.BoolVar(&l.Prof, "prof", false, "count the instructions run and print them at the end")
+}
+
+type LimitError struct {
+	What  string
+	Steps int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s after %d steps", e.What, e.Steps)
+}
+
+// the program input, stdin unless -i gave a file
+func (l *Limits) Stdin() (io.Reader, error) {
+	if l.Input == "" {
+		return bufio.NewReader(os.Stdin), nil
+	}
+	f, err := os.Open(l.Input)
+	if err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(f), nil
+}
+
+// steps m until it halts, fails or runs into a limit. the clock is
+// only looked at every so often as it costs more than a step
+func (l *Limits) Run(m Stepper) error {
+	var deadline time.Time
+	if l.Timeout > 0 {
+		deadline = time.Now().Add(l.Timeout)
+	}
+	l.steps = 0
+	if l.Prof {
+		l.prof = make(map[string]int64)
+	}
+	for {
+		if l.Steps > 0 && l.steps >= l.Steps {
+			return &LimitError{"step limit reached", l.steps}
+		}
+		if l.steps&1023 == 0 && !deadline.IsZero() && time.Now().After(deadline) {
+			return &LimitError{"timed out", l.steps}
+		}
+		if l.prof != nil {
+			l.prof[m.Op()]++
+		}
+		l.steps++
+		halted, err := m.Step()
+		if err != nil {
+			return err
+		}
+		if halted {
+			return nil
+		}
+	}
+}
+
+// prints the profile, most run instructions first
+func (l *Limits) Report(w io.Writer) {
+	if !l.Prof {
+		return
+	}
+	var ops []string
+	for op := range l.prof {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if l.prof[ops[i]] != l.prof[ops[j]] {
+			return l.prof[ops[i]] > l.prof[ops[j]]
+		}
+		return ops[i] < ops[j]
+	})
+	fmt.Fprintf(w, "%12d steps\n", l.steps)
+	for _, op := range ops {
+		n := l.prof[op]
+		fmt.Fprintf(w, "%12d %6.2f%%  %s\n", n, 100*float64(n)/float64(l.steps), op)
+	}
+}
@@ -0,0 +1,275 @@
+// runs esoteric programs under limits, for grading them
+// go build esorun.go
+// esorun -lang malbolge prog.mb
+// the interpreters run as their own processes, found next to esorun or
+// in $PATH, so a program that crashes or eats memory takes only its own
+// interpreter down. the language is picked from the file extension if
+// there is no -lang. input comes from -i or -input, and with -check from
+// the .in file next to the program, what it prints is compared to the
+// .out file:
+// esorun -check -timeout 5s -limit 100000000 submissions/*.ws
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	lang    = flag.String("lang", "", "language of the programs, "+strings.Join(langNames(), ", "))
+	bindir  = flag.String("bin", "", "directory holding the interpreters")
+	limit   = flag.Int64("limit", 0, "stop a program after this many steps, 0 for no limit")
+	timeout = flag.Duration("timeout", 10*time.Second, "stop a program after this long, 0 for no limit")
+	infile  = flag.String("i", "", "read program input from this file")
+	input   = flag.String("input", "", "program input, \\n and the like are understood")
+	maxout  = flag.Int("maxout", 1<<20, "stop a program once it printed this many bytes")
+	prof    = flag.Bool("prof", false, "print an instruction profile")
+	check   = flag.Bool("check", false, "compare what the programs print to their .out files")
+	update  = flag.Bool("update", false, "with -check, rewrite the .out files")
+)
+
+type language struct {
+	bin  string
+	exts []string
+}
+
+// all the interpreters take -limit, -timeout and -prof and
+// exit with status 3 when a limit stopped them
+var langs = map[string]language{
+	"malbolge":   {"malbolge", []string{".mb", ".mal"}},
+	"s4":         {"s4", []string{".4", ".s4"}},
+	"whitespace": {"whitespace", []string{".ws", ".wsa"}},
+}
+
+const exitLimit = 3
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("esorun: ")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+	}
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if given["i"] && given["input"] {
+		log.Fatal("-i and -input both give the input")
+	}
+
+	status := 0
+	for _, name := range flag.Args() {
+		r, err := runFile(name, given)
+		switch {
+		case err != nil && *check:
+			fmt.Printf("FAIL %s: %v\n", name, err)
+			status = 1
+		case err != nil:
+			log.Printf("%s: %v", name, err)
+			status = 1
+		case *check:
+			fmt.Printf("ok   %s  %.2fs\n", name, r.elapsed.Seconds())
+		}
+	}
+	os.Exit(status)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: esorun [options] file ...")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func langNames() []string {
+	var names []string
+	for name := range langs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func langOf(name string) (language, error) {
+	if *lang != "" {
+		l, ok := langs[*lang]
+		if !ok {
+			return l, fmt.Errorf("unknown language %s", *lang)
+		}
+		return l, nil
+	}
+	ext := filepath.Ext(name)
+	for _, l := range langs {
+		for _, e := range l.exts {
+			if e == ext {
+				return l, nil
+			}
+		}
+	}
+	return language{}, fmt.Errorf("no language for %s files, use -lang", ext)
+}
+
+// next to esorun first, so a class can ship its own builds
+func interpreter(bin string) (string, error) {
+	if *bindir != "" {
+		return filepath.Join(*bindir, bin), nil
+	}
+	if self, err := os.Executable(); err == nil {
+		path := filepath.Join(filepath.Dir(self), bin)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return exec.LookPath(bin)
+}
+
+type result struct {
+	out     []byte
+	elapsed time.Duration
+}
+
+func runFile(name string, given map[string]bool) (*result, error) {
+	l, err := langOf(name)
+	if err != nil {
+		return nil, err
+	}
+	bin, err := interpreter(l.bin)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdin io.Reader = os.Stdin
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	switch {
+	case given["input"]:
+		stdin = strings.NewReader(unescape(*input))
+	case given["i"]:
+		f, err := os.Open(*infile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		stdin = f
+	case *check:
+		// programs being checked never wait on the terminal
+		in, err := os.ReadFile(base + ".in")
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		stdin = bytes.NewReader(in)
+	}
+
+	r, err := run(bin, name, stdin)
+	if err != nil || !*check {
+		return r, err
+	}
+
+	if *update {
+		return r, os.WriteFile(base+".out", r.out, 0644)
+	}
+	want, err := os.ReadFile(base + ".out")
+	if err != nil {
+		return r, err
+	}
+	if !bytes.Equal(r.out, want) {
+		return r, fmt.Errorf("output differs from %s.out at byte %d", base, mismatch(r.out, want))
+	}
+	return r, nil
+}
+
+var errOutput = errors.New("output limit reached")
+
+// holds on to the output, or passes it on when not checking,
+// and stops the program once it printed too much
+type capture struct {
+	buf    bytes.Buffer
+	w      io.Writer
+	n      int
+	cancel context.CancelFunc
+	full   bool
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	var err error
+	if c.n+len(p) > *maxout {
+		p = p[:*maxout-c.n]
+		c.full = true
+		c.cancel()
+		err = errOutput
+	}
+	c.n += len(p)
+	w := c.w
+	if w == nil {
+		w = &c.buf
+	}
+	if _, werr := w.Write(p); werr != nil {
+		return len(p), werr
+	}
+	return len(p), err
+}
+
+func run(bin, name string, stdin io.Reader) (*result, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the interpreter stops itself at the timeout and says how
+	// far it got, this is for when it does not
+	if *timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *timeout+time.Second)
+		defer cancel()
+	}
+
+	args := []string{fmt.Sprintf("-limit=%d", *limit), fmt.Sprintf("-timeout=%v", *timeout)}
+	if *prof {
+		args = append(args, "-prof")
+	}
+	cmd := exec.CommandContext(ctx, bin, append(args, name)...)
+	out := &capture{cancel: cancel}
+	if !*check {
+		out.w = os.Stdout
+	}
+	cmd.Stdin = stdin
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	r := &result{out: out.buf.Bytes(), elapsed: time.Since(start)}
+
+	var exit *exec.ExitError
+	switch {
+	case out.full:
+		return r, errOutput
+	case ctx.Err() == context.DeadlineExceeded:
+		return r, fmt.Errorf("killed after %v", r.elapsed.Round(time.Millisecond))
+	case errors.As(err, &exit) && exit.ExitCode() == exitLimit:
+		return r, errors.New("stopped by a limit")
+	case errors.As(err, &exit):
+		return r, fmt.Errorf("%s exited with status %d", filepath.Base(bin), exit.ExitCode())
+	}
+	return r, err
+}
+
+// understands the escapes a shell makes awkward
+func unescape(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\r`, "\r", `\\`, `\`).Replace(s)
+}
+
+func mismatch(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
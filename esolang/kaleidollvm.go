@@ -0,0 +1,410 @@
+//go:build llvm
+
+// the llvm backend for kaleidoscope, needs the llvm go bindings
+// go build -tags llvm kaleidoscope.go kaleidovm.go kaleidollvm.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"llvm.org/llvm/bindings/go/llvm"
+)
+
+func init() {
+	backends["llvm"] = func(out io.Writer) Backend {
+		llvm.LinkInInterpreter()
+		llvm.InitializeAllTargets()
+		llvm.InitializeAllAsmPrinters()
+		llvm.InitializeAllAsmParsers()
+		return NewCG()
+	}
+}
+
+func errv(msg string) llvm.Value {
+	fmt.Fprintln(os.Stderr, msg)
+	return llvm.Value{}
+}
+
+// the nodes get a Gen method for this backend next to their Emit
+type llvmExpr interface {
+	Gen(*CG) llvm.Value
+}
+
+func (cg *CG) gen(e Expr) llvm.Value {
+	return e.(llvmExpr).Gen(cg)
+}
+
+func (cg *CG) Def(fn *FuncDecl) error {
+	ir := fn.Gen(cg)
+	if ir.IsNil() {
+		return errors.New("Code generation failed for " + fn.Proto.Name)
+	}
+	if *dump {
+		fmt.Fprint(os.Stderr, "Read function definition:")
+		ir.Dump()
+	}
+	cg.Init()
+	return nil
+}
+
+func (cg *CG) Extern(proto *ProtoDecl) error {
+	ir := proto.Gen(cg)
+	if ir.IsNil() {
+		return errors.New("Code generation failed for extern " + proto.Name)
+	}
+	if *dump {
+		fmt.Fprint(os.Stderr, "Read extern: ")
+		ir.Dump()
+	}
+	cg.Protos[proto.Name] = proto
+	return nil
+}
+
+func (cg *CG) Eval(fn *FuncDecl) (float64, error) {
+	ir := fn.Gen(cg)
+	if ir.IsNil() {
+		return 0, errors.New("Code generation failed for top level expression")
+	}
+	if *dump {
+		ir.Dump()
+	}
+	ret := cg.EE.RunFunction(ir, []llvm.GenericValue{})
+	cg.Init()
+	return ret.Float(llvm.DoubleType()), nil
+}
+
+func (n *NumberExpr) Gen(cg *CG) llvm.Value {
+	return llvm.ConstFloat(cg.DoubleType(), n.Value)
+}
+
+func (n *VariableExpr) Gen(cg *CG) llvm.Value {
+	v := cg.NamedValues[n.Name]
+	if v.IsNil() {
+		return errv("Unknown variable name")
+	}
+	return cg.CreateLoad(v, n.Name)
+}
+
+func (n *IfExpr) Gen(cg *CG) llvm.Value {
+	condv := cg.gen(n.Cond)
+	if condv.IsNil() {
+		return errv("Code generation failed for if expression")
+	}
+	condv = cg.CreateFCmp(llvm.FloatONE, condv, llvm.ConstFloat(cg.DoubleType(), 0), "ifcond")
+
+	fun := cg.GetInsertBlock().Parent()
+	thenBB := cg.AddBasicBlock(fun, "then")
+	elseBB := cg.AddBasicBlock(fun, "else")
+	mergeBB := cg.AddBasicBlock(fun, "merge")
+	cg.CreateCondBr(condv, thenBB, elseBB)
+
+	cg.SetInsertPointAtEnd(thenBB)
+	thenv := cg.gen(n.Then)
+	if thenv.IsNil() {
+		return errv("Code generation failed for then expression")
+	}
+	cg.CreateBr(mergeBB)
+	thenBB = cg.GetInsertBlock()
+
+	cg.SetInsertPointAtEnd(elseBB)
+	elsev := cg.gen(n.Else)
+	if elsev.IsNil() {
+		return errv("Code generation failed for else expression")
+	}
+
+	cg.CreateBr(mergeBB)
+	elseBB = cg.GetInsertBlock()
+
+	cg.SetInsertPointAtEnd(mergeBB)
+	pn := cg.CreatePHI(cg.DoubleType(), "iftmp")
+	pn.AddIncoming([]llvm.Value{thenv}, []llvm.BasicBlock{thenBB})
+	pn.AddIncoming([]llvm.Value{elsev}, []llvm.BasicBlock{elseBB})
+
+	return pn
+}
+
+func (n *UnaryExpr) Gen(cg *CG) llvm.Value {
+	v := cg.gen(n.Operand)
+	if v.IsNil() {
+		return llvm.Value{}
+	}
+
+	f := cg.GetFunction("unary" + string(n.Op))
+	if f.IsNil() {
+		return errv("Unknown unary operator")
+	}
+	return cg.CreateCall(f, []llvm.Value{v}, "unop")
+}
+
+func (n *BinaryExpr) Gen(cg *CG) llvm.Value {
+	if n.Op == '=' {
+		lhse, _ := n.Lhs.(*VariableExpr)
+		if lhse == nil {
+			return errv("Destination of '=' must be a variable")
+		}
+
+		val := cg.gen(n.Rhs)
+		if val.IsNil() {
+			return llvm.Value{}
+		}
+
+		variable := cg.NamedValues[lhse.Name]
+		if variable.IsNil() {
+			return errv("Unknown variable name")
+		}
+
+		cg.CreateStore(val, variable)
+		return val
+	}
+
+	l := cg.gen(n.Lhs)
+	r := cg.gen(n.Rhs)
+	if l.IsNil() || r.IsNil() {
+		return llvm.Value{}
+	}
+
+	switch n.Op {
+	case '+':
+		return cg.CreateFAdd(l, r, "addtmp")
+	case '-':
+		return cg.CreateFSub(l, r, "subtmp")
+	case '*':
+		return cg.CreateFMul(l, r, "multmp")
+	case '<':
+		l = cg.CreateFCmp(llvm.FloatULT, l, r, "cmptmp")
+		return cg.CreateUIToFP(l, cg.DoubleType(), "booltmp")
+	}
+
+	f := cg.GetFunction("binary" + string(n.Op))
+	if f.IsNil() {
+		return errv("Unknown binary operator")
+	}
+
+	return cg.CreateCall(f, []llvm.Value{l, r}, "binop")
+}
+
+func (n *VarExpr) Gen(cg *CG) llvm.Value {
+	fun := cg.GetInsertBlock().Parent()
+
+	var oldBindingNames []string
+	var oldBindingValues []llvm.Value
+	for _, v := range n.Vars {
+		var initVal llvm.Value
+		if v.Init != nil {
+			initVal = cg.gen(v.Init)
+			if initVal.IsNil() {
+				return llvm.Value{}
+			}
+		} else {
+			initVal = llvm.ConstFloat(cg.DoubleType(), 0)
+		}
+
+		alloca := createEntryBlockAlloca(fun, v.Name)
+		cg.CreateStore(initVal, alloca)
+
+		oldBindingNames = append(oldBindingNames, v.Name)
+		oldBindingValues = append(oldBindingValues, cg.NamedValues[v.Name])
+		cg.NamedValues[v.Name] = alloca
+	}
+
+	bodyVal := cg.gen(n.Body)
+	if bodyVal.IsNil() {
+		return llvm.Value{}
+	}
+
+	for i := len(oldBindingNames) - 1; i >= 0; i-- {
+		cg.NamedValues[oldBindingNames[i]] = oldBindingValues[i]
+	}
+
+	return bodyVal
+}
+
+func (n *ForExpr) Gen(cg *CG) llvm.Value {
+	startVal := cg.gen(n.Start)
+	if startVal.IsNil() {
+		return errv("Code generation failed for start expression")
+	}
+
+	fun := cg.GetInsertBlock().Parent()
+	alloca := createEntryBlockAlloca(fun, n.Var)
+	cg.CreateStore(startVal, alloca)
+
+	loopBB := llvm.AddBasicBlock(fun, "loop")
+	cg.CreateBr(loopBB)
+	cg.SetInsertPointAtEnd(loopBB)
+
+	oldVal := cg.NamedValues[n.Var]
+	cg.NamedValues[n.Var] = alloca
+
+	if cg.gen(n.Body).IsNil() {
+		return llvm.Value{}
+	}
+
+	var stepVal llvm.Value
+	if n.Step != nil {
+		stepVal = cg.gen(n.Step)
+		if stepVal.IsNil() {
+			return llvm.ConstNull(llvm.DoubleType())
+		}
+	} else {
+		stepVal = llvm.ConstFloat(llvm.DoubleType(), 1)
+	}
+
+	endVal := cg.gen(n.End)
+	if endVal.IsNil() {
+		return llvm.Value{}
+	}
+
+	curVar := cg.CreateLoad(alloca, n.Var)
+	nextVar := cg.CreateFAdd(curVar, stepVal, "nextvar")
+	cg.CreateStore(nextVar, alloca)
+
+	endVal = cg.CreateFCmp(llvm.FloatONE, endVal, llvm.ConstFloat(llvm.DoubleType(), 0), "loopcond")
+	afterBB := cg.AddBasicBlock(fun, "afterloop")
+
+	cg.CreateCondBr(endVal, loopBB, afterBB)
+
+	cg.SetInsertPointAtEnd(afterBB)
+
+	if !oldVal.IsNil() {
+		cg.NamedValues[n.Var] = oldVal
+	} else {
+		delete(cg.NamedValues, n.Var)
+	}
+
+	return llvm.ConstFloat(llvm.DoubleType(), 0)
+}
+
+func (n *CallExpr) Gen(cg *CG) llvm.Value {
+	callee := cg.GetFunction(n.Callee)
+	if callee.IsNil() {
+		return errv("Unknown function referenced: " + n.Callee)
+	}
+
+	if callee.ParamsCount() != len(n.Args) {
+		return errv("Incorrect number of arguments passed")
+	}
+
+	args := []llvm.Value{}
+	for _, arg := range n.Args {
+		args = append(args, cg.gen(arg))
+		if args[len(args)-1].IsNil() {
+			return errv("An argument was nil")
+		}
+	}
+	return cg.CreateCall(callee, args, "calltmp")
+}
+
+func (n *ProtoDecl) Gen(cg *CG) llvm.Value {
+	var args []llvm.Type
+	for range n.Args {
+		args = append(args, llvm.DoubleType())
+	}
+	typ := llvm.FunctionType(llvm.DoubleType(), args, false)
+	fun := llvm.AddFunction(cg.Mod, n.Name, typ)
+
+	if fun.BasicBlocksCount() != 0 {
+		return errv("redefinition of function: " + n.Name)
+	}
+
+	if fun.ParamsCount() != len(n.Args) {
+		return errv("redefinition of function with different number of args")
+	}
+
+	for i, param := range fun.Params() {
+		param.SetName(n.Args[i])
+	}
+
+	return fun
+}
+
+func (n *FuncDecl) Gen(cg *CG) llvm.Value {
+	cg.Protos[n.Proto.Name] = n.Proto
+	fun := cg.GetFunction(n.Proto.Name)
+	if fun.IsNil() {
+		return errv("Prototype is missing")
+	}
+
+	bb := llvm.AddBasicBlock(fun, "entry")
+	cg.SetInsertPointAtEnd(bb)
+
+	cg.NamedValues = make(map[string]llvm.Value)
+
+	args := fun.Params()
+	for i := range args {
+		alloca := createEntryBlockAlloca(fun, n.Proto.Args[i])
+		cg.CreateStore(args[i], alloca)
+		cg.NamedValues[n.Proto.Args[i]] = alloca
+	}
+
+	retVal := cg.gen(n.Body)
+	if !retVal.IsNil() {
+		cg.CreateRet(retVal)
+		llvm.VerifyFunction(fun, llvm.PrintMessageAction)
+		cg.Fpm.RunFunc(fun)
+		return fun
+	}
+
+	fun.EraseFromParentAsFunction()
+	return llvm.Value{}
+}
+
+type CG struct {
+	llvm.Context
+	llvm.Builder
+	EE          llvm.ExecutionEngine
+	Mod         llvm.Module
+	Fpm         llvm.PassManager
+	NamedValues map[string]llvm.Value
+	Protos      map[string]*ProtoDecl
+}
+
+func NewCG() *CG {
+	cg := &CG{
+		Context:     llvm.GlobalContext(),
+		Builder:     llvm.NewBuilder(),
+		Mod:         llvm.NewModule("kaleidoscope"),
+		NamedValues: make(map[string]llvm.Value),
+		Protos:      make(map[string]*ProtoDecl),
+	}
+	cg.Init()
+	return cg
+}
+
+func (c *CG) Init() {
+	var err error
+	c.Mod = c.NewModule("kaleidoscope")
+	c.EE, err = llvm.NewInterpreter(c.Mod)
+	ck(err)
+	c.Fpm = llvm.NewFunctionPassManagerForModule(c.Mod)
+
+	c.Fpm.Add(c.EE.TargetData())
+	c.Fpm.AddInstructionCombiningPass()
+	c.Fpm.AddReassociatePass()
+	c.Fpm.AddGVNPass()
+	c.Fpm.AddCFGSimplificationPass()
+	c.Fpm.InitializeFunc()
+}
+
+func (cg *CG) GetFunction(name string) llvm.Value {
+	f := cg.Mod.NamedFunction(name)
+	if !f.IsNil() {
+		return f
+	}
+
+	fi, found := cg.Protos[name]
+	if found {
+		return fi.Gen(cg)
+	}
+
+	return llvm.Value{}
+}
+
+func createEntryBlockAlloca(f llvm.Value, name string) llvm.Value {
+	b := llvm.NewBuilder()
+	b.SetInsertPoint(f.EntryBasicBlock(), f.EntryBasicBlock().FirstInstruction())
+	return b.CreateAlloca(llvm.DoubleType(), name)
+}
@@ -1,28 +1,86 @@
 // ported from llvm kaleidoscope
+// go build kaleidoscope.go kaleidovm.go
+// compiles to bytecode for a small stack machine, the llvm code generator
+// needs the llvm go bindings and is built with
+// go build -tags llvm kaleidoscope.go kaleidovm.go kaleidollvm.go
+// and picked with -backend llvm.
+// with no files it is a repl on stdin. -check runs the files and compares
+// what they print to the .out file next to them:
+// kaleidoscope -check kaleidoscope/*.k
 package main
 
 import (
 	"bufio"
+	"bytes"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"unicode"
 	"unicode/utf8"
+)
 
-	"llvm.org/llvm/bindings/go/llvm"
+var (
+	backend = flag.String("backend", "vm", "code generator, vm or llvm")
+	dump    = flag.Bool("d", false, "dump the code generated for each function")
+	check   = flag.Bool("check", false, "run the files and compare their output to the .out files")
+	update  = flag.Bool("update", false, "with -check, rewrite the .out files")
 )
 
+// code generators register themselves here
+var backends = map[string]func(out io.Writer) Backend{
+	"vm": func(out io.Writer) Backend { return NewVM(out) },
+}
+
+type Backend interface {
+	Def(fn *FuncDecl) error
+	Extern(proto *ProtoDecl) error
+	Eval(fn *FuncDecl) (float64, error)
+}
+
 func main() {
 	log.SetFlags(0)
-	llvm.LinkInInterpreter()
-	llvm.InitializeAllTargets()
-	llvm.InitializeAllAsmPrinters()
-	llvm.InitializeAllAsmParsers()
+	log.SetPrefix("kaleidoscope: ")
+	flag.Usage = usage
+	flag.Parse()
+	newBackend := backends[*backend]
+	if newBackend == nil {
+		var names []string
+		for name := range backends {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		log.Fatalf("no %s backend, this one was built with %s", *backend, strings.Join(names, ", "))
+	}
+
+	if *check {
+		os.Exit(runChecks(flag.Args(), newBackend))
+	}
 
-	parser := NewParser(os.Stdin)
-	parser.Main()
+	be := newBackend(os.Stdout)
+	if flag.NArg() == 0 {
+		parser := NewParser(os.Stdin, be)
+		fi, err := os.Stdin.Stat()
+		parser.Prompt = err == nil && fi.Mode()&os.ModeCharDevice != 0
+		parser.Main()
+		return
+	}
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		ck(err)
+		NewParser(f, be).Main()
+		f.Close()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: kaleidoscope [options] [file ...]")
+	flag.PrintDefaults()
+	os.Exit(2)
 }
 
 func ck(err error) {
@@ -31,18 +89,48 @@ func ck(err error) {
 	}
 }
 
-func errv(msg string) llvm.Value {
-	fmt.Fprintln(os.Stderr, msg)
-	return llvm.Value{}
+func runChecks(files []string, newBackend func(io.Writer) Backend) int {
+	status := 0
+	for _, name := range files {
+		err := checkProg(name, newBackend)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", name, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("ok   %s\n", name)
+	}
+	return status
 }
 
-func errp(msg string) *ProtoDecl {
-	fmt.Fprintln(os.Stderr, msg)
-	return nil
-}
+// errors are part of the output so the checks can cover them too
+func checkProg(name string, newBackend func(io.Writer) Backend) error {
+	src, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	p := NewParser(bytes.NewReader(src), newBackend(&out))
+	p.Out, p.Err = &out, &out
+	p.Main()
 
-func errx(msg string) Expr {
-	fmt.Fprintln(os.Stderr, msg)
+	base := strings.TrimSuffix(name, ".k")
+	if *update {
+		return os.WriteFile(base+".out", out.Bytes(), 0644)
+	}
+	want, err := os.ReadFile(base + ".out")
+	if err != nil {
+		return err
+	}
+	got := out.Bytes()
+	if !bytes.Equal(got, want) {
+		n := 0
+		for n < len(got) && n < len(want) && got[n] == want[n] {
+			n++
+		}
+		line := bytes.Count(want[:n], []byte("\n")) + 1
+		return fmt.Errorf("output differs from %s.out at line %d", base, line)
+	}
 	return nil
 }
 
@@ -93,10 +181,12 @@ func (l *Lexer) Next() rune {
 	}
 
 	if unicode.IsLetter(l.ch) {
-		l.Ident = string(l.ch)
+		var id []rune
 		for isAlnum(l.ch) {
+			id = append(id, l.ch)
 			l.ch = l.getch()
 		}
+		l.Ident = string(id)
 
 		switch l.Ident {
 		case "def":
@@ -160,16 +250,19 @@ func (l *Lexer) Next() rune {
 }
 
 type Parser struct {
-	lex  *Lexer
-	tok  rune
-	cg   *CG
-	Prec map[rune]int
+	lex    *Lexer
+	tok    rune
+	be     Backend
+	Prec   map[rune]int
+	Out    io.Writer
+	Err    io.Writer
+	Prompt bool
 }
 
-func NewParser(r io.Reader) *Parser {
+func NewParser(r io.Reader, be Backend) *Parser {
 	return &Parser{
 		lex: NewLexer(r),
-		cg:  NewCG(),
+		be:  be,
 		Prec: map[rune]int{
 			'=': 2,
 			'<': 10,
@@ -177,17 +270,21 @@ func NewParser(r io.Reader) *Parser {
 			'-': 20,
 			'*': 40,
 		},
+		Out: os.Stdout,
+		Err: os.Stderr,
 	}
 }
 
 func (p *Parser) Main() {
-	fmt.Fprint(os.Stderr, "ready> ")
+	p.prompt()
 	p.next()
 
 	for {
 		switch p.tok {
 		case EOF:
-			fmt.Fprintln(os.Stderr)
+			if p.Prompt {
+				fmt.Fprintln(os.Stderr)
+			}
 			return
 		case ';':
 			p.next()
@@ -198,10 +295,26 @@ func (p *Parser) Main() {
 		default:
 			p.handleTop()
 		}
+		p.prompt()
+	}
+}
+
+func (p *Parser) prompt() {
+	if p.Prompt {
 		fmt.Fprint(os.Stderr, "ready> ")
 	}
 }
 
+func (p *Parser) errx(msg string) Expr {
+	fmt.Fprintln(p.Err, msg)
+	return nil
+}
+
+func (p *Parser) errp(msg string) *ProtoDecl {
+	fmt.Fprintln(p.Err, msg)
+	return nil
+}
+
 func (p *Parser) next() rune {
 	p.tok = p.lex.Next()
 	return p.tok
@@ -215,40 +328,43 @@ func (p *Parser) precedence() int {
 }
 
 func (p *Parser) handleDef() {
-	if fn := p.parseDef(); fn != nil {
-		if ir := fn.Gen(p, p.cg); !ir.IsNil() {
-			fmt.Fprint(os.Stderr, "Read function definition:")
-			ir.Dump()
-			p.cg.Init()
-		}
-	} else {
+	fn := p.parseDef()
+	if fn == nil {
 		p.next()
+		return
+	}
+	if err := p.be.Def(fn); err != nil {
+		fmt.Fprintln(p.Err, err)
+		return
+	}
+	if fn.Proto.IsBinaryOp() {
+		p.Prec[fn.Proto.OperatorName()] = fn.Proto.Precedence
 	}
 }
 
 func (p *Parser) handleExtern() {
-	if proto := p.parseExtern(); proto != nil {
-		if ir := proto.Gen(p.cg); !ir.IsNil() {
-			fmt.Fprint(os.Stderr, "Read extern: ")
-			ir.Dump()
-			p.cg.Protos[proto.Name] = proto
-		}
-	} else {
+	proto := p.parseExtern()
+	if proto == nil {
 		p.next()
+		return
+	}
+	if err := p.be.Extern(proto); err != nil {
+		fmt.Fprintln(p.Err, err)
 	}
 }
 
 func (p *Parser) handleTop() {
-	if fn := p.parseTop(); fn != nil {
-		if ir := fn.Gen(p, p.cg); !ir.IsNil() {
-			ir.Dump()
-			ret := p.cg.EE.RunFunction(ir, []llvm.GenericValue{})
-			fmt.Printf("Evaluated to: %v\n", ret.Float(llvm.DoubleType()))
-			p.cg.Init()
-		}
-	} else {
+	fn := p.parseTop()
+	if fn == nil {
 		p.next()
+		return
 	}
+	v, err := p.be.Eval(fn)
+	if err != nil {
+		fmt.Fprintln(p.Err, err)
+		return
+	}
+	fmt.Fprintf(p.Out, "Evaluated to: %v\n", v)
 }
 
 func (p *Parser) parseDef() *FuncDecl {
@@ -285,7 +401,7 @@ func (p *Parser) parseProto() *ProtoDecl {
 	prec := 30
 	switch p.tok {
 	default:
-		return errp("Expected function name in prototype")
+		return p.errp("Expected function name in prototype")
 	case IDENT:
 		name = p.lex.Ident
 		kind = 0
@@ -293,7 +409,7 @@ func (p *Parser) parseProto() *ProtoDecl {
 	case UNARY:
 		p.next()
 		if !isAscii(p.tok) {
-			return errp("Expected unary operator")
+			return p.errp("Expected unary operator")
 		}
 		name = "unary" + string(p.tok)
 		kind = 1
@@ -301,7 +417,7 @@ func (p *Parser) parseProto() *ProtoDecl {
 	case BINARY:
 		p.next()
 		if !isAscii(p.tok) {
-			return errp("Expected binary operator")
+			return p.errp("Expected binary operator")
 		}
 		name = "binary" + string(p.tok)
 		kind = 2
@@ -309,7 +425,7 @@ func (p *Parser) parseProto() *ProtoDecl {
 
 		if p.tok == NUMBER {
 			if p.lex.Number < 1 || p.lex.Number > 100 {
-				return errp("Invalid precedence: must be 1..100")
+				return p.errp("Invalid precedence: must be 1..100")
 			}
 			prec = int(p.lex.Number)
 			p.next()
@@ -317,21 +433,21 @@ func (p *Parser) parseProto() *ProtoDecl {
 	}
 
 	if p.tok != '(' {
-		return errp("Expected '(' in prototype")
+		return p.errp("Expected '(' in prototype")
 	}
 
 	var args []string
-	for p.next() != IDENT {
+	for p.next() == IDENT {
 		args = append(args, p.lex.Ident)
 	}
 	if p.tok != ')' {
-		return errp("Expected ')' in prototype")
+		return p.errp("Expected ')' in prototype")
 	}
 
 	p.next()
 
 	if kind != 0 && len(args) != kind {
-		return errp("Invalid number of operands for operator")
+		return p.errp("Invalid number of operands for operator")
 	}
 
 	return &ProtoDecl{name, args, kind != 0, prec}
@@ -391,7 +507,7 @@ func (p *Parser) parseBinOpRHS(prec int, lhs Expr) Expr {
 func (p *Parser) parsePrimary() Expr {
 	switch p.tok {
 	default:
-		return errx("unknown token when expecting an expression")
+		return p.errx("unknown token when expecting an expression")
 	case IDENT:
 		return p.parseIdent()
 	case NUMBER:
@@ -430,7 +546,7 @@ func (p *Parser) parseIdent() Expr {
 			}
 
 			if p.tok != ',' {
-				return errx("Expected ')' or ',' in argument list")
+				return p.errx("Expected ')' or ',' in argument list")
 			}
 			p.next()
 		}
@@ -454,23 +570,23 @@ func (p *Parser) parseParen() Expr {
 	}
 
 	if p.tok != ')' {
-		return errp("expected ')'")
+		return p.errx("expected ')'")
 	}
 	p.next()
 
-	return nil
+	return expr
 }
 
 func (p *Parser) parseIf() Expr {
 	p.next()
 
 	cond := p.parseExpr()
-	if cond != nil {
+	if cond == nil {
 		return nil
 	}
 
 	if p.tok != THEN {
-		return errx("expected then")
+		return p.errx("expected then")
 	}
 	p.next()
 
@@ -480,7 +596,7 @@ func (p *Parser) parseIf() Expr {
 	}
 
 	if p.tok != ELSE {
-		return errx("expected else")
+		return p.errx("expected else")
 	}
 
 	p.next()
@@ -497,14 +613,14 @@ func (p *Parser) parseFor() Expr {
 	p.next()
 
 	if p.tok != IDENT {
-		return errx("Expected identifier after for")
+		return p.errx("Expected identifier after for")
 	}
 
 	id := p.lex.Ident
 	p.next()
 
 	if p.tok != '=' {
-		return errx("Expected '=' after for")
+		return p.errx("Expected '=' after for")
 	}
 	p.next()
 
@@ -513,7 +629,7 @@ func (p *Parser) parseFor() Expr {
 		return nil
 	}
 	if p.tok != ',' {
-		return errx("expected ',' after for start value")
+		return p.errx("expected ',' after for start value")
 	}
 	p.next()
 
@@ -532,7 +648,7 @@ func (p *Parser) parseFor() Expr {
 	}
 
 	if p.tok != IN {
-		return errx("expected 'in' after for")
+		return p.errx("expected 'in' after for")
 	}
 	p.next()
 
@@ -547,9 +663,9 @@ func (p *Parser) parseFor() Expr {
 func (p *Parser) parseVar() Expr {
 	p.next()
 
-	names := make(map[string]Expr)
+	var vars []VarInit
 	if p.tok != IDENT {
-		return errx("Expected identifier after var")
+		return p.errx("Expected identifier after var")
 	}
 
 	for {
@@ -566,7 +682,7 @@ func (p *Parser) parseVar() Expr {
 			}
 		}
 
-		names[name] = init
+		vars = append(vars, VarInit{name, init})
 
 		if p.tok != ',' {
 			break
@@ -574,12 +690,12 @@ func (p *Parser) parseVar() Expr {
 		p.next()
 
 		if p.tok != IDENT {
-			return errx("expected identifier list after var")
+			return p.errx("expected identifier list after var")
 		}
 	}
 
 	if p.tok != IN {
-		return errx("expected 'in' keyword after 'var'")
+		return p.errx("expected 'in' keyword after 'var'")
 	}
 	p.next()
 
@@ -588,11 +704,13 @@ func (p *Parser) parseVar() Expr {
 		return nil
 	}
 
-	return &VarExpr{names, body}
+	return &VarExpr{vars, body}
 }
 
+// each backend adds its own methods to the nodes, the bytecode
+// compiler's are in kaleidovm.go
 type Expr interface {
-	Gen(*CG) llvm.Value
+	Emit(*Compiler) error
 }
 
 type NumberExpr struct {
@@ -627,9 +745,16 @@ type ForExpr struct {
 	Start, End, Step, Body Expr
 }
 
+// the variables are bound in order, so an initializer
+// can use the ones before it
 type VarExpr struct {
-	Names map[string]Expr
-	Body  Expr
+	Vars []VarInit
+	Body Expr
+}
+
+type VarInit struct {
+	Name string
+	Init Expr
 }
 
 type ProtoDecl struct {
@@ -644,247 +769,6 @@ type FuncDecl struct {
 	Body  Expr
 }
 
-func (n *NumberExpr) Gen(cg *CG) llvm.Value {
-	return llvm.ConstFloat(cg.DoubleType(), n.Value)
-}
-
-func (n *VariableExpr) Gen(cg *CG) llvm.Value {
-	v := cg.NamedValues[n.Name]
-	if v.IsNil() {
-		return errv("Unknown variable name")
-	}
-	return cg.CreateLoad(v, n.Name)
-}
-
-func (n *IfExpr) Gen(cg *CG) llvm.Value {
-	condv := n.Cond.Gen(cg)
-	if condv.IsNil() {
-		return errv("Code generation failed for if expression")
-	}
-
-	fun := cg.GetInsertBlock().Parent()
-	thenBB := cg.AddBasicBlock(fun, "then")
-	elseBB := cg.AddBasicBlock(fun, "else")
-	mergeBB := cg.AddBasicBlock(fun, "merge")
-	cg.CreateCondBr(condv, thenBB, elseBB)
-
-	cg.SetInsertPointAtEnd(thenBB)
-	thenv := n.Then.Gen(cg)
-	if thenv.IsNil() {
-		return errv("Code generation failed for then expression")
-	}
-	cg.CreateBr(mergeBB)
-	thenBB = cg.GetInsertBlock()
-
-	cg.SetInsertPointAtEnd(elseBB)
-	elsev := n.Else.Gen(cg)
-	if elsev.IsNil() {
-		return errv("Code generation failed for else expression")
-	}
-
-	cg.CreateBr(mergeBB)
-	elseBB = cg.GetInsertBlock()
-
-	cg.SetInsertPointAtEnd(mergeBB)
-	pn := cg.CreatePHI(cg.DoubleType(), "iftmp")
-	pn.AddIncoming([]llvm.Value{thenv}, []llvm.BasicBlock{thenBB})
-	pn.AddIncoming([]llvm.Value{elsev}, []llvm.BasicBlock{elseBB})
-
-	return pn
-}
-
-func (n *UnaryExpr) Gen(cg *CG) llvm.Value {
-	v := n.Operand.Gen(cg)
-	if v.IsNil() {
-		return llvm.Value{}
-	}
-
-	f := cg.GetFunction("unary" + string(n.Op))
-	return cg.CreateCall(f, []llvm.Value{v}, "unop")
-}
-
-func (n *BinaryExpr) Gen(cg *CG) llvm.Value {
-	if n.Op == '=' {
-		lhse, _ := n.Lhs.(*VariableExpr)
-		if lhse == nil {
-			return errv("Destination of '=' must be a variable")
-		}
-
-		val := n.Rhs.Gen(cg)
-		if val.IsNil() {
-			return llvm.Value{}
-		}
-
-		variable := cg.NamedValues[lhse.Name]
-		if variable.IsNil() {
-			return errv("Unknown variable name")
-		}
-
-		cg.CreateStore(val, variable)
-		return val
-	}
-
-	l := n.Lhs.Gen(cg)
-	r := n.Rhs.Gen(cg)
-	if l.IsNil() || r.IsNil() {
-		return llvm.Value{}
-	}
-
-	switch n.Op {
-	case '+':
-		return cg.CreateFAdd(l, r, "addtmp")
-	case '-':
-		return cg.CreateFSub(l, r, "subtmp")
-	case '*':
-		return cg.CreateFMul(l, r, "multmp")
-	case '<':
-		l = cg.CreateFCmp(llvm.FloatULT, l, r, "cmptmp")
-		return cg.CreateUIToFP(l, cg.DoubleType(), "booltmp")
-	}
-
-	f := cg.GetFunction("binary" + string(n.Op))
-	if f.IsNil() {
-		panic("Function is nil")
-	}
-
-	return cg.CreateCall(f, []llvm.Value{l, r}, "binop")
-}
-
-func (n *VarExpr) Gen(cg *CG) llvm.Value {
-	fun := cg.GetInsertBlock().Parent()
-
-	var oldBindingNames []string
-	var oldBindingValues []llvm.Value
-	for name, init := range n.Names {
-		var initVal llvm.Value
-		if init != nil {
-			init.Gen(cg)
-			if initVal.IsNil() {
-				return llvm.Value{}
-			}
-		} else {
-			initVal = llvm.ConstFloat(cg.FloatType(), 0)
-		}
-
-		alloca := createEntryBlockAlloca(fun, name)
-		cg.CreateStore(initVal, alloca)
-
-		oldBindingNames = append(oldBindingNames, name)
-		oldBindingValues = append(oldBindingValues, cg.NamedValues[name])
-		cg.NamedValues[name] = alloca
-	}
-
-	bodyVal := n.Body.Gen(cg)
-	if bodyVal.IsNil() {
-		return llvm.Value{}
-	}
-
-	for i, name := range oldBindingNames {
-		cg.NamedValues[name] = oldBindingValues[i]
-	}
-
-	return bodyVal
-}
-
-func (n *ForExpr) Gen(cg *CG) llvm.Value {
-	startVal := n.Start.Gen(cg)
-	if startVal.IsNil() {
-		return errv("Code generation failed for start expression")
-	}
-
-	fun := cg.GetInsertBlock().Parent()
-	alloca := createEntryBlockAlloca(fun, n.Var)
-	cg.CreateStore(startVal, alloca)
-
-	loopBB := llvm.AddBasicBlock(fun, "loop")
-	cg.CreateBr(loopBB)
-	cg.SetInsertPointAtEnd(loopBB)
-
-	oldVal := cg.NamedValues[n.Var]
-	cg.NamedValues[n.Var] = alloca
-
-	if n.Body.Gen(cg).IsNil() {
-		return llvm.Value{}
-	}
-
-	var stepVal llvm.Value
-	if n.Step != nil {
-		stepVal = n.Step.Gen(cg)
-		if stepVal.IsNil() {
-			return llvm.ConstNull(llvm.DoubleType())
-		}
-	} else {
-		stepVal = llvm.ConstFloat(llvm.DoubleType(), 1)
-	}
-
-	endVal := n.End.Gen(cg)
-	if endVal.IsNil() {
-		return llvm.Value{}
-	}
-
-	curVar := cg.CreateLoad(alloca, n.Var)
-	nextVar := cg.CreateFAdd(curVar, stepVal, "nextvar")
-	cg.CreateStore(nextVar, alloca)
-
-	endVal = cg.CreateFCmp(llvm.FloatONE, endVal, llvm.ConstFloat(llvm.DoubleType(), 0), "loopcond")
-	afterBB := cg.AddBasicBlock(fun, "afterloop")
-
-	cg.CreateCondBr(endVal, loopBB, afterBB)
-
-	cg.SetInsertPointAtEnd(afterBB)
-
-	if !oldVal.IsNil() {
-		cg.NamedValues[n.Var] = oldVal
-	} else {
-		delete(cg.NamedValues, n.Var)
-	}
-
-	return llvm.ConstFloat(llvm.DoubleType(), 0)
-}
-
-func (n *CallExpr) Gen(cg *CG) llvm.Value {
-	callee := cg.Mod.NamedFunction(n.Callee)
-	if callee.IsNil() {
-		return errv("Unknown function referenced: " + n.Callee)
-	}
-
-	if callee.ParamsCount() != len(n.Args) {
-		return errv("Incorrect number of arguments passed")
-	}
-
-	args := []llvm.Value{}
-	for _, arg := range n.Args {
-		args = append(args, arg.Gen(cg))
-		if args[len(args)-1].IsNil() {
-			return errv("An argument was nil")
-		}
-	}
-	return cg.CreateCall(callee, args, "calltmp")
-}
-
-func (n *ProtoDecl) Gen(cg *CG) llvm.Value {
-	var args []llvm.Type
-	for _ = range n.Args {
-		args = append(args, llvm.DoubleType())
-	}
-	typ := llvm.FunctionType(llvm.DoubleType(), args, false)
-	fun := llvm.AddFunction(cg.Mod, n.Name, typ)
-
-	if fun.BasicBlocksCount() != 0 {
-		return errv("redefinition of function: " + n.Name)
-	}
-
-	if fun.ParamsCount() != len(n.Args) {
-		return errv("redefinition of function with different number of args")
-	}
-
-	for i, param := range fun.Params() {
-		param.SetName(n.Args[i])
-	}
-
-	return fun
-}
-
 func (n *ProtoDecl) IsUnaryOp() bool {
 	return n.IsOperator && len(n.Args) == 1
 }
@@ -900,99 +784,3 @@ func (n *ProtoDecl) OperatorName() rune {
 	r, _ := utf8.DecodeLastRuneInString(n.Name)
 	return r
 }
-
-func (n *FuncDecl) Gen(p *Parser, cg *CG) llvm.Value {
-	cg.Protos[n.Proto.Name] = n.Proto
-	fun := cg.GetFunction(n.Proto.Name)
-	if fun.IsNil() {
-		return errv("Prototype is missing")
-	}
-
-	if n.Proto.IsBinaryOp() {
-		p.Prec[n.Proto.OperatorName()] = p.precedence()
-	}
-
-	bb := llvm.AddBasicBlock(fun, "entry")
-	cg.SetInsertPointAtEnd(bb)
-
-	cg.NamedValues = make(map[string]llvm.Value)
-
-	args := fun.Params()
-	for i := range args {
-		alloca := createEntryBlockAlloca(fun, n.Proto.Args[i])
-		cg.CreateStore(args[i], alloca)
-		cg.NamedValues[n.Proto.Args[i]] = alloca
-	}
-
-	retVal := n.Body.Gen(cg)
-	if !retVal.IsNil() {
-		cg.CreateRet(retVal)
-		llvm.VerifyFunction(fun, llvm.PrintMessageAction)
-		cg.Fpm.RunFunc(fun)
-		return fun
-	}
-
-	fun.EraseFromParentAsFunction()
-	if n.Proto.IsBinaryOp() {
-		delete(p.Prec, n.Proto.OperatorName())
-	}
-
-	return llvm.Value{}
-}
-
-type CG struct {
-	llvm.Context
-	llvm.Builder
-	EE          llvm.ExecutionEngine
-	Mod         llvm.Module
-	Fpm         llvm.PassManager
-	NamedValues map[string]llvm.Value
-	Protos      map[string]*ProtoDecl
-}
-
-func NewCG() *CG {
-	cg := &CG{
-		Context:     llvm.GlobalContext(),
-		Builder:     llvm.NewBuilder(),
-		Mod:         llvm.NewModule("kaleidoscope"),
-		NamedValues: make(map[string]llvm.Value),
-		Protos:      make(map[string]*ProtoDecl),
-	}
-	cg.Init()
-	return cg
-}
-
-func (c *CG) Init() {
-	var err error
-	c.Mod = c.NewModule("kaleidoscope")
-	c.EE, err = llvm.NewInterpreter(c.Mod)
-	ck(err)
-	c.Fpm = llvm.NewFunctionPassManagerForModule(c.Mod)
-
-	c.Fpm.Add(c.EE.TargetData())
-	c.Fpm.AddInstructionCombiningPass()
-	c.Fpm.AddReassociatePass()
-	c.Fpm.AddGVNPass()
-	c.Fpm.AddCFGSimplificationPass()
-	c.Fpm.InitializeFunc()
-}
-
-func (cg *CG) GetFunction(name string) llvm.Value {
-	f := cg.Mod.NamedFunction(name)
-	if !f.IsNil() {
-		return f
-	}
-
-	fi, found := cg.Protos[name]
-	if found {
-		return fi.Gen(cg)
-	}
-
-	return llvm.Value{}
-}
-
-func createEntryBlockAlloca(f llvm.Value, name string) llvm.Value {
-	b := llvm.NewBuilder()
-	b.SetInsertPoint(f.EntryBasicBlock(), f.EntryBasicBlock().FirstInstruction())
-	return b.CreateAlloca(llvm.DoubleType(), name)
-}
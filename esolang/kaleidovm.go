@@ -0,0 +1,507 @@
+// the bytecode backend for kaleidoscope, a stack machine where every
+// value is a float64 and each function has a frame of numbered slots
+// holding its arguments and then its variables
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+type Opcode int
+
+const (
+	PUSH  Opcode = iota // push Num
+	LOAD                // push slot Arg
+	STORE               // copy the top into slot Arg, leaving it there
+	POP
+	ADD
+	SUB
+	MUL
+	LT
+	JMP // to Arg
+	JZ  // pop and jump if false
+	JNZ // pop and jump if true
+	CALL
+	RET
+)
+
+var opnames = [...]string{"push", "load", "store", "pop", "add", "sub", "mul", "lt", "jmp", "jz", "jnz", "call", "ret"}
+
+type Inst struct {
+	Op  Opcode
+	Arg int
+	Num float64
+}
+
+type Func struct {
+	Name   string
+	NArgs  int
+	NSlots int
+	Code   []Inst
+	Native func(vm *VM, args []float64) float64
+}
+
+// calls go through the function table, so redefining a
+// function changes what the functions calling it do
+type VM struct {
+	Funcs    []*Func
+	index    map[string]int
+	Out      io.Writer
+	MaxDepth int
+	stack    []float64
+}
+
+type frame struct {
+	fn   *Func
+	pc   int
+	base int
+}
+
+func NewVM(out io.Writer) *VM {
+	return &VM{
+		index:    make(map[string]int),
+		Out:      out,
+		MaxDepth: 100000,
+	}
+}
+
+// what extern can declare
+var natives = map[string]*Func{
+	"sin":   math1(math.Sin),
+	"cos":   math1(math.Cos),
+	"tan":   math1(math.Tan),
+	"asin":  math1(math.Asin),
+	"acos":  math1(math.Acos),
+	"atan":  math1(math.Atan),
+	"atan2": math2(math.Atan2),
+	"sinh":  math1(math.Sinh),
+	"cosh":  math1(math.Cosh),
+	"tanh":  math1(math.Tanh),
+	"exp":   math1(math.Exp),
+	"log":   math1(math.Log),
+	"log10": math1(math.Log10),
+	"sqrt":  math1(math.Sqrt),
+	"pow":   math2(math.Pow),
+	"fmod":  math2(math.Mod),
+	"fabs":  math1(math.Abs),
+	"floor": math1(math.Floor),
+	"ceil":  math1(math.Ceil),
+	"putchard": {NArgs: 1, Native: func(vm *VM, a []float64) float64 {
+		vm.Out.Write([]byte{byte(a[0])})
+		return 0
+	}},
+	"printd": {NArgs: 1, Native: func(vm *VM, a []float64) float64 {
+		fmt.Fprintf(vm.Out, "%f\n", a[0])
+		return 0
+	}},
+}
+
+func math1(f func(float64) float64) *Func {
+	return &Func{NArgs: 1, Native: func(vm *VM, a []float64) float64 { return f(a[0]) }}
+}
+
+func math2(f func(float64, float64) float64) *Func {
+	return &Func{NArgs: 2, Native: func(vm *VM, a []float64) float64 { return f(a[0], a[1]) }}
+}
+
+func (vm *VM) lookup(name string) *Func {
+	if i, ok := vm.index[name]; ok {
+		return vm.Funcs[i]
+	}
+	return nil
+}
+
+func (vm *VM) install(f *Func) {
+	if i, ok := vm.index[f.Name]; ok {
+		vm.Funcs[i] = f
+		return
+	}
+	vm.index[f.Name] = len(vm.Funcs)
+	vm.Funcs = append(vm.Funcs, f)
+}
+
+// an extern that is not a native function is a prototype
+// for one that is defined later
+func (vm *VM) Extern(proto *ProtoDecl) error {
+	f := &Func{Name: proto.Name, NArgs: len(proto.Args)}
+	if nf, ok := natives[proto.Name]; ok {
+		if nf.NArgs != f.NArgs {
+			return fmt.Errorf("extern %s takes %d arguments", proto.Name, nf.NArgs)
+		}
+		f.Native = nf.Native
+	}
+	if old := vm.lookup(proto.Name); old != nil {
+		if old.NArgs != f.NArgs {
+			return errors.New("redefinition of function with different number of args")
+		}
+		if old.Code != nil || old.Native != nil {
+			return nil
+		}
+	}
+	vm.install(f)
+	if *dump {
+		fmt.Fprintf(vm.Out, "Read extern: %s/%d\n", f.Name, f.NArgs)
+	}
+	return nil
+}
+
+func (vm *VM) Def(fn *FuncDecl) error {
+	old := vm.lookup(fn.Proto.Name)
+	if old != nil {
+		if old.Native != nil {
+			return errors.New("redefinition of extern: " + fn.Proto.Name)
+		}
+		if old.NArgs != len(fn.Proto.Args) {
+			return errors.New("redefinition of function with different number of args")
+		}
+	} else {
+		// declared first so the body can call it
+		vm.install(&Func{Name: fn.Proto.Name, NArgs: len(fn.Proto.Args)})
+	}
+
+	f, err := vm.compile(fn)
+	if err != nil {
+		if old == nil {
+			delete(vm.index, fn.Proto.Name)
+		}
+		return err
+	}
+	vm.install(f)
+	if *dump {
+		fmt.Fprintln(vm.Out, "Read function definition:")
+		vm.Disasm(vm.Out, f)
+	}
+	return nil
+}
+
+func (vm *VM) Eval(fn *FuncDecl) (float64, error) {
+	f, err := vm.compile(fn)
+	if err != nil {
+		return 0, err
+	}
+	if *dump {
+		vm.Disasm(vm.Out, f)
+	}
+	return vm.Call(f)
+}
+
+func (vm *VM) compile(fn *FuncDecl) (*Func, error) {
+	c := &Compiler{
+		vm:    vm,
+		fn:    &Func{Name: fn.Proto.Name, NArgs: len(fn.Proto.Args)},
+		scope: make(map[string]int),
+	}
+	for _, arg := range fn.Proto.Args {
+		c.scope[arg] = c.slot()
+	}
+	if err := fn.Body.Emit(c); err != nil {
+		return nil, err
+	}
+	c.emit(RET, 0)
+	return c.fn, nil
+}
+
+func (vm *VM) Call(f *Func, args ...float64) (float64, error) {
+	vm.stack = append(vm.stack[:0], args...)
+	var frames []frame
+	fr := frame{f, 0, 0}
+	vm.enter(f)
+
+	for {
+		in := fr.fn.Code[fr.pc]
+		fr.pc++
+		s := vm.stack
+		top := len(s) - 1
+
+		switch in.Op {
+		case PUSH:
+			vm.stack = append(s, in.Num)
+		case LOAD:
+			vm.stack = append(s, s[fr.base+in.Arg])
+		case STORE:
+			s[fr.base+in.Arg] = s[top]
+		case POP:
+			vm.stack = s[:top]
+		case ADD:
+			s[top-1] += s[top]
+			vm.stack = s[:top]
+		case SUB:
+			s[top-1] -= s[top]
+			vm.stack = s[:top]
+		case MUL:
+			s[top-1] *= s[top]
+			vm.stack = s[:top]
+		case LT:
+			// unordered or less than, as llvm's ult
+			s[top-1] = bool2f(!(s[top-1] >= s[top]))
+			vm.stack = s[:top]
+		case JMP:
+			fr.pc = in.Arg
+		case JZ, JNZ:
+			vm.stack = s[:top]
+			if truth(s[top]) == (in.Op == JNZ) {
+				fr.pc = in.Arg
+			}
+		case CALL:
+			callee := vm.Funcs[in.Arg]
+			base := len(s) - callee.NArgs
+			if callee.Native != nil {
+				v := callee.Native(vm, s[base:])
+				vm.stack = append(s[:base], v)
+				break
+			}
+			if callee.Code == nil {
+				return 0, fmt.Errorf("%s is declared but never defined", callee.Name)
+			}
+			if len(frames) >= vm.MaxDepth {
+				return 0, fmt.Errorf("stack overflow in %s", callee.Name)
+			}
+			frames = append(frames, fr)
+			fr = frame{callee, 0, base}
+			vm.enter(callee)
+		case RET:
+			v := s[top]
+			vm.stack = append(s[:fr.base], v)
+			if len(frames) == 0 {
+				return v, nil
+			}
+			fr = frames[len(frames)-1]
+			frames = frames[:len(frames)-1]
+		}
+	}
+}
+
+// makes room for the variables after the arguments
+func (vm *VM) enter(f *Func) {
+	for i := f.NArgs; i < f.NSlots; i++ {
+		vm.stack = append(vm.stack, 0)
+	}
+}
+
+// conditions are ordered and not equal to zero, so nan is false
+func truth(v float64) bool {
+	return v != 0 && v == v
+}
+
+func bool2f(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (vm *VM) Disasm(w io.Writer, f *Func) {
+	fmt.Fprintf(w, "%s/%d, %d slots\n", f.Name, f.NArgs, f.NSlots)
+	for pc, in := range f.Code {
+		fmt.Fprintf(w, "%4d  %s", pc, opnames[in.Op])
+		switch in.Op {
+		case PUSH:
+			fmt.Fprintf(w, "\t%v", in.Num)
+		case LOAD, STORE, JMP, JZ, JNZ:
+			fmt.Fprintf(w, "\t%d", in.Arg)
+		case CALL:
+			fmt.Fprintf(w, "\t%s", vm.Funcs[in.Arg].Name)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+type Compiler struct {
+	vm    *VM
+	fn    *Func
+	scope map[string]int
+}
+
+func (c *Compiler) slot() int {
+	c.fn.NSlots++
+	return c.fn.NSlots - 1
+}
+
+func (c *Compiler) emit(op Opcode, arg int) int {
+	c.fn.Code = append(c.fn.Code, Inst{Op: op, Arg: arg})
+	return len(c.fn.Code) - 1
+}
+
+// points the jump at pc to the next instruction
+func (c *Compiler) patch(pc int) {
+	c.fn.Code[pc].Arg = len(c.fn.Code)
+}
+
+// binds name to a new slot and returns what it hid
+func (c *Compiler) bind(name string) (slot, old int, shadowed bool) {
+	old, shadowed = c.scope[name]
+	slot = c.slot()
+	c.scope[name] = slot
+	return
+}
+
+func (c *Compiler) unbind(name string, old int, shadowed bool) {
+	if shadowed {
+		c.scope[name] = old
+	} else {
+		delete(c.scope, name)
+	}
+}
+
+func (c *Compiler) call(name string, nargs int) error {
+	i, ok := c.vm.index[name]
+	if !ok {
+		return errors.New("Unknown function referenced: " + name)
+	}
+	if c.vm.Funcs[i].NArgs != nargs {
+		return errors.New("Incorrect number of arguments passed")
+	}
+	c.emit(CALL, i)
+	return nil
+}
+
+func (n *NumberExpr) Emit(c *Compiler) error {
+	c.fn.Code = append(c.fn.Code, Inst{Op: PUSH, Num: n.Value})
+	return nil
+}
+
+func (n *VariableExpr) Emit(c *Compiler) error {
+	slot, ok := c.scope[n.Name]
+	if !ok {
+		return errors.New("Unknown variable name: " + n.Name)
+	}
+	c.emit(LOAD, slot)
+	return nil
+}
+
+func (n *UnaryExpr) Emit(c *Compiler) error {
+	if err := n.Operand.Emit(c); err != nil {
+		return err
+	}
+	if _, ok := c.vm.index["unary"+string(n.Op)]; !ok {
+		return fmt.Errorf("Unknown unary operator %c", n.Op)
+	}
+	return c.call("unary"+string(n.Op), 1)
+}
+
+func (n *BinaryExpr) Emit(c *Compiler) error {
+	if n.Op == '=' {
+		lhse, _ := n.Lhs.(*VariableExpr)
+		if lhse == nil {
+			return errors.New("Destination of '=' must be a variable")
+		}
+		if err := n.Rhs.Emit(c); err != nil {
+			return err
+		}
+		slot, ok := c.scope[lhse.Name]
+		if !ok {
+			return errors.New("Unknown variable name: " + lhse.Name)
+		}
+		c.emit(STORE, slot)
+		return nil
+	}
+
+	if err := n.Lhs.Emit(c); err != nil {
+		return err
+	}
+	if err := n.Rhs.Emit(c); err != nil {
+		return err
+	}
+	switch n.Op {
+	case '+':
+		c.emit(ADD, 0)
+	case '-':
+		c.emit(SUB, 0)
+	case '*':
+		c.emit(MUL, 0)
+	case '<':
+		c.emit(LT, 0)
+	default:
+		if _, ok := c.vm.index["binary"+string(n.Op)]; !ok {
+			return fmt.Errorf("Unknown binary operator %c", n.Op)
+		}
+		return c.call("binary"+string(n.Op), 2)
+	}
+	return nil
+}
+
+func (n *CallExpr) Emit(c *Compiler) error {
+	for _, arg := range n.Args {
+		if err := arg.Emit(c); err != nil {
+			return err
+		}
+	}
+	return c.call(n.Callee, len(n.Args))
+}
+
+func (n *IfExpr) Emit(c *Compiler) error {
+	if err := n.Cond.Emit(c); err != nil {
+		return err
+	}
+	toElse := c.emit(JZ, 0)
+	if err := n.Then.Emit(c); err != nil {
+		return err
+	}
+	toEnd := c.emit(JMP, 0)
+	c.patch(toElse)
+	if err := n.Else.Emit(c); err != nil {
+		return err
+	}
+	c.patch(toEnd)
+	return nil
+}
+
+// like the tutorial the body runs before the end condition is
+// looked at, and the condition sees the variable before the step
+func (n *ForExpr) Emit(c *Compiler) error {
+	if err := n.Start.Emit(c); err != nil {
+		return err
+	}
+	slot, old, shadowed := c.bind(n.Var)
+	defer c.unbind(n.Var, old, shadowed)
+	c.emit(STORE, slot)
+	c.emit(POP, 0)
+
+	loop := len(c.fn.Code)
+	if err := n.Body.Emit(c); err != nil {
+		return err
+	}
+	c.emit(POP, 0)
+	if n.Step != nil {
+		if err := n.Step.Emit(c); err != nil {
+			return err
+		}
+	} else {
+		c.fn.Code = append(c.fn.Code, Inst{Op: PUSH, Num: 1})
+	}
+	step := c.slot()
+	c.emit(STORE, step)
+	c.emit(POP, 0)
+	if err := n.End.Emit(c); err != nil {
+		return err
+	}
+	c.emit(LOAD, slot)
+	c.emit(LOAD, step)
+	c.emit(ADD, 0)
+	c.emit(STORE, slot)
+	c.emit(POP, 0)
+	c.emit(JNZ, loop)
+
+	c.fn.Code = append(c.fn.Code, Inst{Op: PUSH, Num: 0})
+	return nil
+}
+
+func (n *VarExpr) Emit(c *Compiler) error {
+	for _, v := range n.Vars {
+		if v.Init != nil {
+			if err := v.Init.Emit(c); err != nil {
+				return err
+			}
+		} else {
+			c.fn.Code = append(c.fn.Code, Inst{Op: PUSH, Num: 0})
+		}
+		slot, old, shadowed := c.bind(v.Name)
+		defer c.unbind(v.Name, old, shadowed)
+		c.emit(STORE, slot)
+		c.emit(POP, 0)
+	}
+	return n.Body.Emit(c)
+}
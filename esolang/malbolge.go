@@ -1,42 +1,63 @@
 // ported from original malbolge source
 // http://www.lscheffer.com/malbolge_interp.html
+// go build malbolge.go esolimit.go
 
 package main
 
 import (
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"strings"
 	"unicode"
 )
 
+var (
+	limits Limits
+	status = 0
+)
+
 func main() {
+	limits.AddFlags(flag.CommandLine)
 	flag.Usage = usage
 	flag.Parse()
 	if flag.NArg() < 1 {
 		usage()
 	}
 
-	ip := Interp{Stdin: os.Stdin, Stdout: os.Stdout}
+	in, err := limits.Stdin()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "malbolge: %v\n", err)
+		os.Exit(1)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	ip := Interp{Stdin: in, Stdout: out}
 	for _, name := range flag.Args() {
 		err := run(name, &ip)
+		out.Flush()
+		limits.Report(os.Stderr)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "malbolge: %v\n", err)
+			fmt.Fprintf(os.Stderr, "malbolge: %s: %v\n", name, err)
+			status = 1
+			if errors.As(err, new(*LimitError)) {
+				status = exitLimit
+			}
 		}
 	}
+	os.Exit(status)
 }
 
 func usage() {
-	fmt.Fprintln(os.Stderr, "usage: file ...")
+	fmt.Fprintln(os.Stderr, "usage: malbolge [options] file ...")
 	flag.PrintDefaults()
 	os.Exit(1)
 }
 
 func run(name string, ip *Interp) error {
-	buf, err := ioutil.ReadFile(name)
+	buf, err := os.ReadFile(name)
 	if err != nil {
 		return err
 	}
@@ -46,12 +67,7 @@ func run(name string, ip *Interp) error {
 		return err
 	}
 
-	err = ip.Exec()
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return limits.Run(ip)
 }
 
 const (
@@ -63,15 +79,17 @@ const (
 )
 
 type Interp struct {
-	Stdin  io.Reader
-	Stdout io.Writer
-	mem    [59049]uint16
+	Stdin   io.Reader
+	Stdout  io.Writer
+	mem     [59049]uint16
+	a, c, d uint16
 }
 
 func (p *Interp) Load(b []byte) error {
 	for i := range p.mem {
 		p.mem[i] = 0
 	}
+	p.a, p.c, p.d = 0, 0, 0
 
 	var i int
 	for _, x := range b {
@@ -91,69 +109,80 @@ func (p *Interp) Load(b []byte) error {
 
 		p.mem[i], i = uint16(x), i+1
 	}
+	if i < 2 {
+		return fmt.Errorf("program too short")
+	}
 
 	for ; i < len(p.mem); i++ {
-		if i >= 3 {
-			p.mem[i] = p.op(p.mem[i-1], p.mem[i-2])
-		}
+		p.mem[i] = p.op(p.mem[i-1], p.mem[i-2])
 	}
 
 	return nil
 }
 
-func (p *Interp) Exec() (err error) {
-	var a, c, d uint16
-	var x int
+var opnames = map[byte]string{
+	'j': "j mov d",
+	'i': "i jmp",
+	'*': "* rotr",
+	'p': "p crz",
+	'<': "< out",
+	'/': "/ in",
+	'v': "v end",
+}
 
-	defer func() {
-		if e, _ := recover().(error); e != nil {
-			err = e
-		}
-	}()
+func (p *Interp) Op() string {
+	if p.mem[p.c] < 33 || p.mem[p.c] > 126 {
+		return "invalid"
+	}
+	if s, ok := opnames[xlat1[(p.mem[p.c]-33+p.c)%94]]; ok {
+		return s
+	}
+	return "nop"
+}
 
-loop:
-	for {
-		if p.mem[c] < 33 || p.mem[c] > 126 {
-			continue
-		}
-		switch xlat1[(p.mem[c]-33+c)%94] {
-		case 'j':
-			d = p.mem[d]
-		case 'i':
-			c = p.mem[d]
-		case '*':
-			p.mem[d] = p.mem[d]/3 + p.mem[d]%3*19683
-			a = p.mem[d]
-		case 'p':
-			p.mem[d] = p.op(a, p.mem[d])
-			a = p.mem[d]
-		case '<':
-			fmt.Fprintf(p.Stdout, "%c", a&0xff)
-		case '/':
-			var b [1]uint8
-
-			_, err := p.Stdin.Read(b[:])
-			x = int(b[0])
-
-			if err == io.EOF {
-				a = uint16(len(p.mem)) - 1
-			} else {
-				a = uint16(x)
-			}
-		case 'v':
-			break loop
-		}
+func (p *Interp) Step() (bool, error) {
+	mem, a, c, d := &p.mem, p.a, p.c, p.d
 
-		p.mem[c] = uint16(xlat2[p.mem[c]-33])
-		if c++; int(c) >= len(p.mem) {
-			c = 0
-		}
-		if d++; int(d) >= len(p.mem) {
-			d = 0
+	// the reference interpreter spins here for ever
+	if mem[c] < 33 || mem[c] > 126 {
+		return true, fmt.Errorf("invalid instruction %d at %d", mem[c], c)
+	}
+	switch xlat1[(mem[c]-33+c)%94] {
+	case 'j':
+		d = mem[d]
+	case 'i':
+		c = mem[d]
+	case '*':
+		mem[d] = mem[d]/3 + mem[d]%3*19683
+		a = mem[d]
+	case 'p':
+		mem[d] = p.op(a, mem[d])
+		a = mem[d]
+	case '<':
+		fmt.Fprintf(p.Stdout, "%c", a&0xff)
+	case '/':
+		var b [1]uint8
+		if _, err := io.ReadFull(p.Stdin, b[:]); err != nil {
+			a = uint16(len(mem)) - 1
+		} else {
+			a = uint16(b[0])
 		}
+	case 'v':
+		return true, nil
 	}
 
-	return nil
+	if mem[c] < 33 || mem[c] > 126 {
+		return true, fmt.Errorf("jumped to invalid instruction %d at %d", mem[c], c)
+	}
+	mem[c] = uint16(xlat2[mem[c]-33])
+	if c++; int(c) >= len(mem) {
+		c = 0
+	}
+	if d++; int(d) >= len(mem) {
+		d = 0
+	}
+	p.a, p.c, p.d = a, c, d
+	return false, nil
 }
 
 func (p *Interp) op(x, y uint16) uint16 {
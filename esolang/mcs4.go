@@ -0,0 +1,189 @@
+// the 4004/4040 instruction set, shared by the assembler and the emulator
+// go build mcs4as.go mcs4.go
+// go build mcs4emu.go mcs4.go
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type param struct {
+	bits  uint
+	shift uint
+	str   string
+}
+
+var params = [256]param{
+	'c': {0, 4, "condition"},
+	'r': {0, 4, "register"},
+	'R': {1, 3, "register pair"},
+	'd': {0, 4, "immediate data"},
+	'D': {8, 8, "rom data"},
+	'a': {8, 8, "short rom address"},
+	'A': {8, 12, "long rom address"},
+}
+
+type opcode struct {
+	enc      []byte
+	par      string
+	only4040 bool
+}
+
+var opcodes = map[string]opcode{
+	"NOP": {[]byte{0}, "", false},
+	"JCN": {[]byte{0x10, 0x00}, "ca", false},
+	"FIM": {[]byte{0x20, 0x00}, "RD", false},
+	"FIN": {[]byte{0x30}, "R", false},
+	"JIN": {[]byte{0x31}, "R", false},
+	"JUN": {[]byte{0x40, 0x00}, "A", false},
+	"JMS": {[]byte{0x50, 0x00}, "A", false},
+	"INC": {[]byte{0x60}, "r", false},
+	"ISZ": {[]byte{0x70, 0x00}, "ra", false},
+	"ADD": {[]byte{0x80}, "r", false},
+	"SUB": {[]byte{0x90}, "r", false},
+	"LD":  {[]byte{0xA0}, "r", false},
+	"XCH": {[]byte{0xB0}, "r", false},
+	"BBL": {[]byte{0xC0}, "d", false},
+	"LDM": {[]byte{0xD0}, "d", false},
+	"CLB": {[]byte{0xF0}, "", false},
+	"CLC": {[]byte{0xF1}, "", false},
+	"IAC": {[]byte{0xF2}, "", false},
+	"CMC": {[]byte{0xF3}, "", false},
+	"CMA": {[]byte{0xF4}, "", false},
+	"RAL": {[]byte{0xF5}, "", false},
+	"RAR": {[]byte{0xF6}, "", false},
+	"TCC": {[]byte{0xF7}, "", false},
+	"DAC": {[]byte{0xF8}, "", false},
+	"TCS": {[]byte{0xF9}, "", false},
+	"STC": {[]byte{0xFA}, "", false},
+	"DAA": {[]byte{0xFB}, "", false},
+	"KBP": {[]byte{0xFC}, "", false},
+	"DCL": {[]byte{0xFD}, "", false},
+	// io and ram
+	"SRC": {[]byte{0x21}, "R", false},
+	"WRM": {[]byte{0xE0}, "", false},
+	"WMP": {[]byte{0xE1}, "", false},
+	"WRR": {[]byte{0xE2}, "", false},
+	"WPM": {[]byte{0xE3}, "", false},
+	"WR0": {[]byte{0xE4}, "", false},
+	"WR1": {[]byte{0xE5}, "", false},
+	"WR2": {[]byte{0xE6}, "", false},
+	"WR3": {[]byte{0xE7}, "", false},
+	"SBM": {[]byte{0xE8}, "", false},
+	"RDM": {[]byte{0xE9}, "", false},
+	"RDR": {[]byte{0xEA}, "", false},
+	"ADM": {[]byte{0xEB}, "", false},
+	"RD0": {[]byte{0xEC}, "", false},
+	"RD1": {[]byte{0xED}, "", false},
+	"RD2": {[]byte{0xEE}, "", false},
+	"RD3": {[]byte{0xEF}, "", false},
+	// 4040
+	"HLT": {[]byte{0x01}, "", true},
+	"BBS": {[]byte{0x02}, "", true},
+	"LCR": {[]byte{0x03}, "", true},
+	"OR4": {[]byte{0x04}, "", true},
+	"OR5": {[]byte{0x05}, "", true},
+	"AN6": {[]byte{0x06}, "", true},
+	"AN7": {[]byte{0x07}, "", true},
+	"DB0": {[]byte{0x08}, "", true},
+	"DB1": {[]byte{0x09}, "", true},
+	"SB0": {[]byte{0x0A}, "", true},
+	"SB1": {[]byte{0x0B}, "", true},
+	"EIN": {[]byte{0x0C}, "", true},
+	"DIN": {[]byte{0x0D}, "", true},
+	"RPM": {[]byte{0x0E}, "", true},
+}
+
+// jcn conditions, the bits are invert, accumulator zero, carry set, test low
+var conditions = map[string]int{
+	"T":   1,
+	"TZ":  1,
+	"C":   2,
+	"C1":  2,
+	"Z":   4,
+	"AZ":  4,
+	"NT":  9,
+	"TN":  9,
+	"NC":  10,
+	"C0":  10,
+	"NZ":  12,
+	"AN":  12,
+	"NZA": 12,
+}
+
+// first byte to mnemonic, the operands are in the bits that are not fixed
+var decode [256]string
+
+func init() {
+	for name, op := range opcodes {
+		mask := 0xff
+		for _, p := range op.par {
+			switch p {
+			case 'c', 'r', 'd', 'A':
+				mask = 0xf0
+			case 'R':
+				mask &^= 0x0e
+			}
+		}
+		for b := 0; b < 256; b++ {
+			if b&mask == int(op.enc[0]) {
+				decode[b] = name
+			}
+		}
+	}
+}
+
+func insize(b byte) int {
+	if op, ok := opcodes[decode[b]]; ok {
+		return len(op.enc)
+	}
+	return 1
+}
+
+// disassembles the instruction at addr, jump targets are
+// given in full so the assembler can read the output back
+func disasm(rom []byte, addr int, syms map[int]string) (string, int) {
+	at := func(a int) byte {
+		if a < len(rom) {
+			return rom[a]
+		}
+		return 0
+	}
+	b0, b1 := at(addr), at(addr+1)
+	name := decode[b0]
+	if name == "" {
+		return fmt.Sprintf("DB 0x%02X", b0), 1
+	}
+	op := opcodes[name]
+	target := func(a int) string {
+		if s, ok := syms[a]; ok {
+			return s
+		}
+		return fmt.Sprintf("0x%03X", a)
+	}
+
+	var args []string
+	for _, p := range op.par {
+		switch p {
+		case 'c', 'd':
+			args = append(args, fmt.Sprint(b0&15))
+		case 'r':
+			args = append(args, fmt.Sprintf("R%d", b0&15))
+		case 'R':
+			args = append(args, fmt.Sprintf("P%d", b0>>1&7))
+		case 'D':
+			args = append(args, fmt.Sprintf("0x%02X", b1))
+		case 'a':
+			args = append(args, target((addr+2)&^0xff|int(b1)))
+		case 'A':
+			args = append(args, target(addr&^0xfff|int(b0&15)<<8|int(b1)))
+		}
+	}
+	s := name
+	if len(args) > 0 {
+		s += " " + strings.Join(args, ", ")
+	}
+	return s, len(op.enc)
+}
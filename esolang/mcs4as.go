@@ -1,18 +1,38 @@
 // ported from https://github.com/wolfram77/js-4004-assembler
+// go build mcs4as.go mcs4.go
+// a two pass assembler for the intel 4004 and 4040, writes file.bin
+//
+//	; comments start with a semicolon
+//	count	equ 5           ; or count = 5
+//		org 0
+//	start:	fim p0, table   ; registers are r0-r15, pairs p0-p7, 0p-7p or r0r1
+//		ldm count & 15
+//	loop:	isz r2, loop    ; jcn and isz can only reach their own page
+//		jcn nz, loop     ; conditions are numbers or t, c, z, nt, nc, nz
+//		jun start
+//	table:	db 1, 2, "ab"   ; numbers are 12, 0x0c, 0ch, $0c, 1100b or 'c'
+//
+// expressions have + - * / % & | ^ << >> ~ and parentheses, $ is the
+// address of the current line
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
 
 var (
+	cpu4040 = flag.Bool("4040", false, "accept 4040 instructions and 8k of rom")
+	listing = flag.Bool("l", false, "write a listing to file.lst")
+	symbols = flag.Bool("s", false, "write the symbol table to file.sym")
+
 	status = 0
 )
 
@@ -31,75 +51,654 @@ func main() {
 }
 
 func usage() {
-	fmt.Fprintln(os.Stderr, "usage: file ...")
+	fmt.Fprintln(os.Stderr, "usage: mcs4as [options] file ...")
 	flag.PrintDefaults()
 	os.Exit(2)
 }
 
 func ek(err error) {
+	if j, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range j.Unwrap() {
+			ek(e)
+		}
+		return
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "as:", err)
 		status = 1
 	}
 }
 
+type stmt struct {
+	line  int
+	text  string
+	label string
+	op    string
+	args  []string
+	addr  int
+	code  []byte
+}
+
+type asm struct {
+	name  string
+	stmts []*stmt
+	syms  map[string]int
+	pc    int
+	pass  int
+	rom   []byte
+	used  []bool
+	end   int
+	equ   map[string]bool
+}
+
+type asmError struct {
+	line int
+	msg  string
+}
+
+func (e *asmError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.msg)
+}
+
+// puts the file name in front of each of the errors
+func fileError(name string, err error) error {
+	if j, ok := err.(interface{ Unwrap() []error }); ok {
+		var errs []error
+		for _, e := range j.Unwrap() {
+			errs = append(errs, fileError(name, e))
+		}
+		return errors.Join(errs...)
+	}
+	return fmt.Errorf("%s: %v", name, err)
+}
+
 func assemble(name string) error {
-	buf, err := ioutil.ReadFile(name)
+	buf, err := os.ReadFile(name)
 	if err != nil {
 		return err
 	}
 
-	re := regexp.MustCompile("[0-9A-z]+")
-	lines := strings.Split(string(buf), "\n")
+	a := &asm{name: name, syms: make(map[string]int), equ: make(map[string]bool)}
+	size := 4096
+	if *cpu4040 {
+		size = 8192
+	}
+	a.rom = make([]byte, size)
+	a.used = make([]bool, size)
+
+	if err := a.parse(string(buf)); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	for a.pass = 1; a.pass <= 2; a.pass++ {
+		if err := a.run(); err != nil {
+			return fileError(name, err)
+		}
+	}
 
-	var code []byte
-loop:
-	for i, line := range lines {
-		toks := re.FindAllString(line, -1)
-		if len(toks) == 0 {
+	ext := filepath.Ext(name)
+	base := name[:len(name)-len(ext)]
+	out := base + ".bin"
+	if out == name {
+		out += ".bin"
+	}
+	if err := os.WriteFile(out, a.rom[:a.end], 0644); err != nil {
+		return err
+	}
+	if *listing {
+		if err := os.WriteFile(base+".lst", a.listing(), 0644); err != nil {
+			return err
+		}
+	}
+	if *symbols {
+		if err := os.WriteFile(base+".sym", a.symtab(), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	reLabel = regexp.MustCompile(`^\s*([A-Za-z_.][A-Za-z0-9_.]*)\s*:`)
+	reEqu   = regexp.MustCompile(`^\s*([A-Za-z_.][A-Za-z0-9_.]*)\s+(?i:equ)\s+(.*)$|^\s*([A-Za-z_.][A-Za-z0-9_.]*)\s*=\s*(.*)$`)
+)
+
+func (a *asm) parse(src string) error {
+	for i, text := range strings.Split(src, "\n") {
+		text = strings.TrimRight(text, "\r")
+		s := &stmt{line: i + 1, text: text}
+		a.stmts = append(a.stmts, s)
+
+		line := stripComment(text)
+		if m := reEqu.FindStringSubmatch(line); m != nil {
+			s.op = "EQU"
+			if m[1] != "" {
+				s.label, s.args = m[1], []string{m[2]}
+			} else {
+				s.label, s.args = m[3], []string{m[4]}
+			}
+			continue
+		}
+		if m := reLabel.FindStringSubmatch(line); m != nil {
+			s.label = m[1]
+			line = line[len(m[0]):]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
 			continue
 		}
 
-		op := strings.ToUpper(toks[0])
-		args := []int64{}
-		for _, arg := range toks[1:] {
-			n, err := strconv.ParseInt(arg, 0, 64)
+		f := strings.Fields(line)
+		s.op = strings.ToUpper(f[0])
+		rest := strings.TrimSpace(line[len(f[0]):])
+		if rest == "" {
+			continue
+		}
+		s.args = splitArgs(rest)
+
+		// the old syntax separated operands with spaces
+		if x, ok := opcodes[s.op]; ok && len(s.args) == 1 && len(x.par) > 1 {
+			if f := strings.Fields(rest); len(f) == len(x.par) {
+				s.args = f
+			}
+		}
+	}
+	return nil
+}
+
+// a semicolon outside of quotes starts a comment
+func stripComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ';':
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func splitArgs(s string) []string {
+	var args []string
+	var quote byte
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(args, strings.TrimSpace(s[start:]))
+}
+
+func (a *asm) run() error {
+	a.pc = 0
+	if a.pass == 1 {
+		if err := a.defineAll(); err != nil {
+			return err
+		}
+	}
+	// keep going so every bad line in the pass is reported
+	var errs []error
+	for _, s := range a.stmts {
+		s.addr = a.pc
+		if err := a.stmt(s); err != nil {
+			errs = append(errs, &asmError{s.line, err.Error()})
+			if s.op != "ORG" {
+				a.pc = s.addr + size(s)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// equates can refer to labels further down and orgs to equates, so
+// both are worked out over and over until no new symbol turns up
+func (a *asm) defineAll() error {
+	var pending []*stmt
+	for _, s := range a.stmts {
+		if s.op == "EQU" {
+			pending = append(pending, s)
+		}
+	}
+	for {
+		known := len(a.syms)
+		var left []*stmt
+		for _, s := range pending {
+			v, ok, err := a.eval(s.args[0])
 			if err != nil {
-				continue loop
+				return &asmError{s.line, err.Error()}
+			}
+			if !ok {
+				left = append(left, s)
+				continue
+			}
+			if err := a.define(s.label, v, s.line); err != nil {
+				return &asmError{s.line, err.Error()}
 			}
-			args = append(args, n)
+			a.equ[s.label] = true
 		}
-		if err := validate(op, args); err != nil {
-			return fmt.Errorf("%s: %d: %v", name, i+1, err)
+		pending = left
+		org := a.layout()
+		switch {
+		case org == nil && len(pending) == 0:
+			return nil
+		case len(a.syms) > known:
+		case org != nil:
+			return &asmError{org.line, "org refers to an undefined symbol"}
+		default:
+			return &asmError{pending[0].line, "equate refers to an undefined symbol"}
 		}
-		code = gen(code, op, args)
 	}
+}
 
-	ext := filepath.Ext(name)
-	out := name[:len(name)-len(ext)] + ".bin"
-	if out == name {
-		out += ".bin"
+// defines the labels, sizes do not depend on any operand so this
+// only stops at an org it cannot evaluate yet, which it returns
+func (a *asm) layout() *stmt {
+	pc := 0
+	for _, s := range a.stmts {
+		if s.label != "" && s.op != "EQU" {
+			a.syms[s.label] = pc
+		}
+		switch s.op {
+		case "", "EQU":
+		case "ORG":
+			if len(s.args) != 1 {
+				return nil
+			}
+			v, ok, err := a.eval(s.args[0])
+			if err != nil {
+				return nil
+			}
+			if !ok {
+				return s
+			}
+			pc = v
+		default:
+			pc += size(s)
+		}
 	}
-	return ioutil.WriteFile(out, code, 0644)
+	return nil
 }
 
-func validate(op string, args []int64) error {
-	x, found := opcodes[op]
+// how many bytes a db or an instruction takes, whatever its operands are
+func size(s *stmt) int {
+	if s.op == "DB" {
+		n, _ := dbSize(s.args)
+		return n
+	}
+	return len(opcodes[s.op].enc)
+}
+
+func dbSize(args []string) (int, error) {
+	n := 0
+	for _, arg := range args {
+		if strings.HasPrefix(arg, `"`) {
+			s, err := strconv.Unquote(arg)
+			if err != nil {
+				return 0, fmt.Errorf("bad string %s", arg)
+			}
+			n += len(s)
+		} else {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (a *asm) define(name string, v, line int) error {
+	if _, dup := a.syms[name]; dup && a.pass == 1 {
+		for _, s := range a.stmts {
+			if s.label == name && s.line != line {
+				return fmt.Errorf("%s is already defined on line %d", name, s.line)
+			}
+		}
+	}
+	a.syms[name] = v
+	return nil
+}
+
+func (a *asm) stmt(s *stmt) error {
+	if s.label != "" && s.op != "EQU" {
+		if a.pass == 1 {
+			if err := a.define(s.label, a.pc, s.line); err != nil {
+				return err
+			}
+		} else if a.syms[s.label] != a.pc {
+			return fmt.Errorf("phase error, %s moved from 0x%03X to 0x%03X", s.label, a.syms[s.label], a.pc)
+		}
+	}
+
+	switch s.op {
+	case "", "EQU":
+		return nil
+	case "ORG":
+		if len(s.args) != 1 {
+			return fmt.Errorf("org takes one address")
+		}
+		v, err := a.value(s.args[0])
+		if err != nil {
+			return err
+		}
+		if v < 0 || v >= len(a.rom) {
+			return fmt.Errorf("org 0x%X is outside the rom", v)
+		}
+		a.pc = v
+		return nil
+	case "DB":
+		var code []byte
+		for _, arg := range s.args {
+			if strings.HasPrefix(arg, `"`) {
+				str, err := strconv.Unquote(arg)
+				if err != nil {
+					return fmt.Errorf("bad string %s", arg)
+				}
+				code = append(code, str...)
+				continue
+			}
+			v, err := a.value(arg)
+			if err != nil {
+				return err
+			}
+			if v < -128 || v > 255 {
+				return fmt.Errorf("db value %d does not fit in a byte", v)
+			}
+			code = append(code, byte(v))
+		}
+		return a.emit(s, code)
+	}
+
+	x, found := opcodes[s.op]
 	if !found {
-		return fmt.Errorf("no such opcode %q", op)
+		return fmt.Errorf("no such opcode %q", s.op)
 	}
-	if len(x.par) != len(args) {
-		return fmt.Errorf("parameter count mismatch (%d != %d)", len(x.par), len(args))
+	if x.only4040 && !*cpu4040 {
+		return fmt.Errorf("%s is a 4040 instruction, use -4040", s.op)
 	}
-	for i := range args {
+	if len(x.par) != len(s.args) {
+		return fmt.Errorf("parameter count mismatch (%d != %d)", len(x.par), len(s.args))
+	}
+
+	args := make([]int64, len(s.args))
+	for i, arg := range s.args {
 		p := params[x.par[i]]
-		if args[i] >= 1<<p.shift {
+		v, err := a.operand(x.par[i], arg)
+		if err != nil {
+			return err
+		}
+		switch x.par[i] {
+		case 'a':
+			// the high bits come from the program counter, which has
+			// already moved past both bytes of the instruction
+			page := (a.pc + 2) &^ 0xff
+			if a.pass == 2 && v&^0xff != page {
+				return fmt.Errorf("%s target 0x%03X is not on page 0x%03X", s.op, v, page)
+			}
+			v &= 0xff
+		case 'A':
+			if v < 0 || v >= len(a.rom) {
+				return fmt.Errorf("address 0x%X is outside the rom", v)
+			}
+			v &= 0xfff
+		}
+		if v < 0 || v >= 1<<p.shift {
 			return fmt.Errorf("parameter %q overflow (%d bits)", p.str, p.shift)
 		}
+		args[i] = int64(v)
 	}
+	return a.emit(s, gen(nil, s.op, args))
+}
+
+func (a *asm) emit(s *stmt, code []byte) error {
+	s.code = code
+	if a.pc+len(code) > len(a.rom) {
+		return fmt.Errorf("code runs past the end of the rom")
+	}
+	if a.pass == 2 {
+		for i, b := range code {
+			if a.used[a.pc+i] {
+				return fmt.Errorf("overwrites code already at 0x%03X", a.pc+i)
+			}
+			a.used[a.pc+i] = true
+			a.rom[a.pc+i] = b
+		}
+		a.end = max(a.end, a.pc+len(code))
+	}
+	a.pc += len(code)
 	return nil
 }
 
+var (
+	reReg   = regexp.MustCompile(`^[Rr]([0-9]+)$`)
+	rePair  = regexp.MustCompile(`^(?:[Pp]([0-7])|([0-7])[Pp])$`)
+	reRegRR = regexp.MustCompile(`^[Rr]([0-9]+)[Rr]([0-9]+)$`)
+)
+
+func (a *asm) operand(kind byte, arg string) (int, error) {
+	switch kind {
+	case 'r':
+		if m := reReg.FindStringSubmatch(arg); m != nil {
+			return strconv.Atoi(m[1])
+		}
+	case 'R':
+		if m := rePair.FindStringSubmatch(arg); m != nil {
+			return strconv.Atoi(m[1] + m[2])
+		}
+		if m := reRegRR.FindStringSubmatch(arg); m != nil {
+			r0, _ := strconv.Atoi(m[1])
+			r1, _ := strconv.Atoi(m[2])
+			if r0%2 != 0 || r1 != r0+1 {
+				return 0, fmt.Errorf("%s is not a register pair", arg)
+			}
+			return r0 / 2, nil
+		}
+	case 'c':
+		if c, ok := conditions[strings.ToUpper(arg)]; ok {
+			return c, nil
+		}
+	}
+	return a.value(arg)
+}
+
+// the value of an expression, symbols that are not
+// defined yet only matter on the second pass
+func (a *asm) value(s string) (int, error) {
+	v, ok, err := a.eval(s)
+	if err == nil && !ok && a.pass == 2 {
+		err = fmt.Errorf("undefined symbol in %q", s)
+	}
+	return v, err
+}
+
+func (a *asm) eval(s string) (int, bool, error) {
+	p := &exprParser{s: s, a: a, ok: true}
+	v := p.expr(0)
+	p.space()
+	if p.err == nil && p.i < len(p.s) {
+		p.err = fmt.Errorf("unexpected %q in expression", p.s[p.i:])
+	}
+	return v, p.ok, p.err
+}
+
+type exprParser struct {
+	s   string
+	i   int
+	a   *asm
+	ok  bool
+	err error
+}
+
+var binops = []struct {
+	op   string
+	prec int
+	fn   func(x, y int) int
+}{
+	{"<<", 4, func(x, y int) int { return x << uint(y) }},
+	{">>", 4, func(x, y int) int { return x >> uint(y) }},
+	{"|", 1, func(x, y int) int { return x | y }},
+	{"^", 2, func(x, y int) int { return x ^ y }},
+	{"&", 3, func(x, y int) int { return x & y }},
+	{"+", 5, func(x, y int) int { return x + y }},
+	{"-", 5, func(x, y int) int { return x - y }},
+	{"*", 6, func(x, y int) int { return x * y }},
+	{"/", 6, nil},
+	{"%", 6, nil},
+}
+
+func (p *exprParser) space() {
+	for p.i < len(p.s) && (p.s[p.i] == ' ' || p.s[p.i] == '\t') {
+		p.i++
+	}
+}
+
+// precedence climbing, everything is left associative
+func (p *exprParser) expr(min int) int {
+	x := p.unary()
+	for p.err == nil {
+		p.space()
+		found := false
+		for _, b := range binops {
+			if b.prec < min || !strings.HasPrefix(p.s[p.i:], b.op) {
+				continue
+			}
+			p.i += len(b.op)
+			y := p.expr(b.prec + 1)
+			switch {
+			case b.fn != nil:
+				x = b.fn(x, y)
+			case y == 0:
+				if p.ok {
+					p.err = fmt.Errorf("division by zero")
+				}
+			case b.op == "/":
+				x /= y
+			default:
+				x %= y
+			}
+			found = true
+			break
+		}
+		if !found {
+			break
+		}
+	}
+	return x
+}
+
+func (p *exprParser) unary() int {
+	p.space()
+	if p.i >= len(p.s) {
+		p.err = fmt.Errorf("missing operand")
+		return 0
+	}
+	switch p.s[p.i] {
+	case '-':
+		p.i++
+		return -p.unary()
+	case '+':
+		p.i++
+		return p.unary()
+	case '~':
+		p.i++
+		return ^p.unary()
+	case '(':
+		p.i++
+		v := p.expr(0)
+		p.space()
+		if p.i >= len(p.s) || p.s[p.i] != ')' {
+			p.err = fmt.Errorf("missing )")
+			return 0
+		}
+		p.i++
+		return v
+	case '\'':
+		c, _, tail, err := strconv.UnquoteChar(p.s[p.i+1:], '\'')
+		if err == nil && c < 256 && strings.HasPrefix(tail, "'") {
+			p.i = len(p.s) - len(tail) + 1
+			return int(c)
+		}
+		p.err = fmt.Errorf("bad character constant")
+		return 0
+	case '$':
+		p.i++
+		start := p.i
+		for p.i < len(p.s) && isHex(p.s[p.i]) {
+			p.i++
+		}
+		if start == p.i {
+			return p.a.pc
+		}
+		v, _ := strconv.ParseInt(p.s[start:p.i], 16, 64)
+		return int(v)
+	}
+
+	start := p.i
+	for p.i < len(p.s) && isWord(p.s[p.i]) {
+		p.i++
+	}
+	tok := p.s[start:p.i]
+	switch {
+	case tok == "":
+		p.err = fmt.Errorf("unexpected %q in expression", p.s[p.i:])
+		return 0
+	case tok[0] >= '0' && tok[0] <= '9':
+		v, err := parseNumber(tok)
+		if err != nil {
+			p.err = err
+		}
+		return v
+	}
+	v, ok := p.a.syms[tok]
+	if !ok {
+		p.ok = false
+	}
+	return v
+}
+
+func parseNumber(s string) (int, error) {
+	var v int64
+	var err error
+	t := strings.ToLower(s)
+	switch {
+	case strings.HasPrefix(t, "0x"), strings.HasPrefix(t, "0b"), strings.HasPrefix(t, "0o"):
+		v, err = strconv.ParseInt(t, 0, 64)
+	case strings.HasSuffix(t, "h"):
+		v, err = strconv.ParseInt(t[:len(t)-1], 16, 64)
+	case strings.HasSuffix(t, "b"):
+		v, err = strconv.ParseInt(t[:len(t)-1], 2, 64)
+	default:
+		v, err = strconv.ParseInt(t, 10, 64)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("bad number %q", s)
+	}
+	return int(v), nil
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func isWord(c byte) bool {
+	return isHex(c) || 'g' <= c && c <= 'z' || 'G' <= c && c <= 'Z' || c == '_' || c == '.'
+}
+
 func gen(code []byte, op string, args []int64) []byte {
 	x := opcodes[op]
 	o := append([]byte{}, x.enc...)
@@ -120,72 +719,47 @@ func insert(arr []byte, val int64, pos uint) {
 	}
 }
 
-type param struct {
-	bits  uint
-	shift uint
-	str   string
-}
-
-var params = [256]param{
-	'c': {0, 4, "condition"},
-	'r': {0, 4, "register"},
-	'R': {1, 3, "register pair"},
-	'd': {0, 4, "immediate data"},
-	'D': {8, 8, "rom data"},
-	'a': {8, 8, "short rom address"},
-	'A': {8, 12, "long rom address"},
-}
-
-type opcode struct {
-	enc []byte
-	par string
-}
-
-var opcodes = map[string]opcode{
-	"NOP": {[]byte{0}, ""},
-	"JCN": {[]byte{0x10, 0x00}, "ca"},
-	"FIM": {[]byte{0x20, 0x00}, "RD"},
-	"FIN": {[]byte{0x30}, "R"},
-	"JIN": {[]byte{0x31}, "R"},
-	"JUN": {[]byte{0x40, 0x00}, "A"},
-	"JMS": {[]byte{0x50, 0x00}, "A"},
-	"INC": {[]byte{0x60}, "r"},
-	"ISZ": {[]byte{0x70, 0x00}, "ra"},
-	"ADD": {[]byte{0x80}, "r"},
-	"SUB": {[]byte{0x90}, "r"},
-	"LD":  {[]byte{0xA0}, "r"},
-	"XCH": {[]byte{0xB0}, "r"},
-	"BBL": {[]byte{0xC0}, "d"},
-	"LDM": {[]byte{0xD0}, "d"},
-	"CLB": {[]byte{0xF0}, ""},
-	"CLC": {[]byte{0xF1}, ""},
-	"IAC": {[]byte{0xF2}, ""},
-	"CMC": {[]byte{0xF3}, ""},
-	"RAL": {[]byte{0xF5}, ""},
-	"RAR": {[]byte{0xF6}, ""},
-	"TCC": {[]byte{0xF7}, ""},
-	"DAC": {[]byte{0xF8}, ""},
-	"TCS": {[]byte{0xF9}, ""},
-	"STC": {[]byte{0xFA}, ""},
-	"DAA": {[]byte{0xFB}, ""},
-	"KBP": {[]byte{0xFC}, ""},
-	"DCL": {[]byte{0xFD}, ""},
-	// io and ram
-	"SRC": {[]byte{0x21}, "R"},
-	"WRM": {[]byte{0xE0}, ""},
-	"WMP": {[]byte{0xE1}, ""},
-	"WRR": {[]byte{0xE2}, ""},
-	"WPM": {[]byte{0xE3}, ""},
-	"WR0": {[]byte{0xE4}, ""},
-	"WR1": {[]byte{0xE5}, ""},
-	"WR2": {[]byte{0xE6}, ""},
-	"WR3": {[]byte{0xE7}, ""},
-	"SBM": {[]byte{0xE8}, ""},
-	"RDM": {[]byte{0xE9}, ""},
-	"RDR": {[]byte{0xEA}, ""},
-	"ADM": {[]byte{0xEB}, ""},
-	"RD0": {[]byte{0xEC}, ""},
-	"RD1": {[]byte{0xED}, ""},
-	"RD2": {[]byte{0xEE}, ""},
-	"RD3": {[]byte{0xEF}, ""},
+func (a *asm) listing() []byte {
+	var b strings.Builder
+	for _, s := range a.stmts {
+		var hex []string
+		for _, c := range s.code {
+			hex = append(hex, fmt.Sprintf("%02X", c))
+		}
+		addr := "   "
+		if len(s.code) > 0 || s.label != "" {
+			addr = fmt.Sprintf("%03X", s.addr)
+		}
+		if s.op == "EQU" {
+			addr = "   "
+			hex = []string{fmt.Sprintf("=%X", a.syms[s.label])}
+		}
+		// long db lines get their bytes on the following lines
+		for len(hex) > 4 {
+			fmt.Fprintf(&b, "%s  %-12s\n", addr, strings.Join(hex[:4], " "))
+			hex = hex[4:]
+			addr = "   "
+		}
+		fmt.Fprintf(&b, "%s  %-12s %5d  %s\n", addr, strings.Join(hex, " "), s.line, s.text)
+	}
+	b.WriteString("\n")
+	b.Write(a.symtab())
+	return []byte(b.String())
+}
+
+func (a *asm) symtab() []byte {
+	var names []string
+	for name := range a.syms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		kind := "label"
+		if a.equ[name] {
+			kind = "equ"
+		}
+		fmt.Fprintf(&b, "%-16s 0x%03X %s\n", name, a.syms[name], kind)
+	}
+	return []byte(b.String())
 }
@@ -0,0 +1,526 @@
+// emulates an intel 4004 or 4040 running a rom image from mcs4as
+// go build mcs4emu.go mcs4.go
+// timing is counted in instruction cycles of 8 clock periods, one for
+// most instructions and two for fin and the two byte ones. the rom ports
+// and the 4002 ram output ports are printed as they are written, -tty
+// turns the writes to one rom port into text, high nibble first.
+// the emulator stops on hlt, on a jump to itself, when it runs off the
+// end of the image or after -n cycles
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	cpu4040 = flag.Bool("4040", false, "emulate a 4040")
+	trace   = flag.Bool("t", false, "trace every instruction")
+	limit   = flag.Int64("n", 10000000, "stop after this many instruction cycles")
+	clock   = flag.Float64("clock", 740e3, "clock frequency in hz, for the run time")
+	rdr     = flag.String("rdr", "", "hex digits handed out by rdr, one per read")
+	test    = flag.Int("test", 1, "level of the test pin")
+	tty     = flag.Int("tty", -1, "print writes to this rom port as text")
+	dumpRAM = flag.Bool("ram", false, "dump the ram when done")
+	symfile = flag.String("sym", "", "symbol file for the trace, default file.sym")
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("mcs4emu: ")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+	}
+
+	name := flag.Arg(0)
+	rom, err := os.ReadFile(name)
+	ck(err)
+	size := 4096
+	if *cpu4040 {
+		size = 8192
+	}
+	if len(rom) > size {
+		log.Fatalf("%s: %d bytes is more than the %d byte rom", name, len(rom), size)
+	}
+
+	c := NewCPU(rom, *cpu4040)
+	c.Test = uint8(*test & 1)
+	for _, r := range *rdr {
+		v, err := strconv.ParseUint(string(r), 16, 4)
+		if err != nil {
+			log.Fatalf("bad rdr digit %q", r)
+		}
+		c.Input = append(c.Input, uint8(v))
+	}
+
+	sym := *symfile
+	if sym == "" {
+		sym = strings.TrimSuffix(name, filepath.Ext(name)) + ".sym"
+	}
+	c.Syms, err = readSyms(sym)
+	if err != nil && (*symfile != "" || !os.IsNotExist(err)) {
+		log.Fatal(err)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	c.Out = w
+
+	why := c.Run(*limit)
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "%s at 0x%03X after %d cycles, %.3f ms\n",
+		why, c.addr(c.PC), c.Cycles, float64(c.Cycles)*8/(*clock)*1e3)
+	c.dump(os.Stderr)
+}
+
+func ck(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: mcs4emu [options] file.bin")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+// a 4002 has four registers of 16 characters and 4 status
+// characters, plus a 4 bit output port
+type RAMChip struct {
+	Main   [4][16]uint8
+	Status [4][4]uint8
+	Port   uint8
+}
+
+type CPU struct {
+	ACC, CY uint8
+	R       [2][16]uint8 // the 4040 has a second bank of r0-r7
+	Bank    int
+	PC      int
+	Stack   []int
+	SP      int
+	SRC     uint8
+	DCL     uint8 // selects the ram bank
+	Test    uint8
+	Cycles  int64
+
+	is4040   bool
+	ROM      []byte
+	ROMBank  int // 4040 only, set by db0/db1 and taken at the next jun or jms
+	nextBank int
+	size     int
+	RAM      [8][4]RAMChip
+	ROMPort  [16]uint8
+	ProgRAM  [256]uint8 // what wpm writes, as a 4008/4009 pair would see it
+	wpmLow   bool
+	IntOn    bool
+	Halted   bool
+
+	Input []uint8
+	Out   *bufio.Writer
+	Syms  map[int]string
+	text  []uint8
+}
+
+func NewCPU(rom []byte, is4040 bool) *CPU {
+	c := &CPU{is4040: is4040, size: len(rom)}
+	depth := 3
+	n := 4096
+	if is4040 {
+		depth, n = 7, 8192
+	}
+	c.Stack = make([]int, depth)
+	c.ROM = make([]byte, n)
+	copy(c.ROM, rom)
+	return c
+}
+
+func (c *CPU) addr(pc int) int {
+	return c.ROMBank<<12 | pc
+}
+
+func (c *CPU) fetch() byte {
+	b := c.ROM[c.addr(c.PC)]
+	c.PC = (c.PC + 1) & 0xfff
+	return b
+}
+
+func (c *CPU) reg(r uint8) *uint8 {
+	if r < 8 {
+		return &c.R[c.Bank][r]
+	}
+	return &c.R[0][r]
+}
+
+func (c *CPU) pair(p uint8) uint8 {
+	return *c.reg(2 * p)<<4 | *c.reg(2*p + 1)
+}
+
+func (c *CPU) setPair(p, v uint8) {
+	*c.reg(2 * p) = v >> 4
+	*c.reg(2*p + 1) = v & 15
+}
+
+// the stack wraps around, a fourth call on the 4004 loses the first
+func (c *CPU) push(pc int) {
+	c.Stack[c.SP] = pc
+	c.SP = (c.SP + 1) % len(c.Stack)
+}
+
+func (c *CPU) pop() int {
+	c.SP = (c.SP + len(c.Stack) - 1) % len(c.Stack)
+	return c.Stack[c.SP]
+}
+
+func (c *CPU) ram() *RAMChip {
+	return &c.RAM[c.DCL&7][c.SRC>>6]
+}
+
+func (c *CPU) ramChar() *uint8 {
+	return &c.ram().Main[c.SRC>>4&3][c.SRC&15]
+}
+
+// runs until something stops it and says what
+func (c *CPU) Run(limit int64) string {
+	for c.Cycles < limit {
+		if c.Halted {
+			return "halted"
+		}
+		if c.addr(c.PC) >= c.size {
+			return "ran off the end of the program"
+		}
+		at, op := c.PC, c.ROM[c.addr(c.PC)]
+		if *trace {
+			c.traceLine()
+		}
+		if err := c.Step(); err != "" {
+			return err
+		}
+		// jun, jcn and jin to themselves never get out, isz does
+		if c.PC == at && (op>>4 == 0x4 || op>>4 == 0x1 || op&0xf1 == 0x31) {
+			return "stopped in a loop"
+		}
+	}
+	return "cycle limit reached"
+}
+
+func (c *CPU) traceLine() {
+	a := c.addr(c.PC)
+	dis, _ := disasm(c.ROM, a, c.Syms)
+	label := ""
+	if s, ok := c.Syms[a]; ok {
+		label = s + ":"
+	}
+	var regs strings.Builder
+	for r := uint8(0); r < 16; r++ {
+		fmt.Fprintf(&regs, "%X", *c.reg(r))
+	}
+	c.Out.Flush()
+	width := 3
+	if c.is4040 {
+		width = 4
+	}
+	fmt.Fprintf(os.Stderr, "%-12s %0*X  %-18s A=%X C=%d R=%s\n", label, width, a, dis, c.ACC, c.CY, regs.String())
+}
+
+func (c *CPU) Step() string {
+	op := c.fetch()
+	c.Cycles++
+	hi, lo := op>>4, op&15
+
+	// the page of a short jump is the one the pc is on after the second byte
+	short := func() int {
+		b := c.fetch()
+		c.Cycles++
+		return c.PC&0xf00 | int(b)
+	}
+
+	switch hi {
+	case 0x0:
+		if lo == 0 {
+			break
+		}
+		if !c.is4040 {
+			return fmt.Sprintf("4040 instruction 0x%02X", op)
+		}
+		switch lo {
+		case 0x1: // hlt
+			c.Halted = true
+		case 0x2: // bbs, there are no interrupts to return from so it is a plain return
+			c.PC = c.pop()
+		case 0x3: // lcr
+			c.ACC = c.DCL
+		case 0x4: // or4
+			c.ACC |= *c.reg(4)
+		case 0x5: // or5
+			c.ACC |= *c.reg(5)
+		case 0x6: // an6
+			c.ACC &= *c.reg(6)
+		case 0x7: // an7
+			c.ACC &= *c.reg(7)
+		case 0x8, 0x9: // db0, db1
+			c.nextBank = int(lo & 1)
+		case 0xa, 0xb: // sb0, sb1
+			c.Bank = int(lo & 1)
+		case 0xc: // ein
+			c.IntOn = true
+		case 0xd: // din
+			c.IntOn = false
+		case 0xe: // rpm
+			c.ACC = c.progRAM(false)
+		default:
+			return fmt.Sprintf("unknown instruction 0x%02X", op)
+		}
+
+	case 0x1: // jcn
+		target := short()
+		jump := lo&4 != 0 && c.ACC == 0 || lo&2 != 0 && c.CY == 1 || lo&1 != 0 && c.Test == 0
+		if lo&8 != 0 {
+			jump = !jump
+		}
+		if jump {
+			c.PC = target
+		}
+
+	case 0x2:
+		if lo&1 == 0 { // fim
+			c.setPair(lo>>1, c.fetch())
+			c.Cycles++
+		} else { // src
+			c.SRC = c.pair(lo >> 1)
+		}
+
+	case 0x3:
+		if lo&1 == 0 { // fin, from the page the next instruction is on
+			c.setPair(lo>>1, c.ROM[c.addr(c.PC&0xf00|int(c.pair(0)))])
+			c.Cycles++
+		} else { // jin
+			c.PC = c.PC&0xf00 | int(c.pair(lo>>1))
+		}
+
+	case 0x4, 0x5: // jun, jms
+		b := c.fetch()
+		c.Cycles++
+		if hi == 0x5 {
+			c.push(c.PC)
+		}
+		c.ROMBank = c.nextBank
+		c.PC = int(lo)<<8 | int(b)
+
+	case 0x6: // inc
+		r := c.reg(lo)
+		*r = (*r + 1) & 15
+
+	case 0x7: // isz
+		target := short()
+		r := c.reg(lo)
+		*r = (*r + 1) & 15
+		if *r != 0 {
+			c.PC = target
+		}
+
+	case 0x8: // add
+		c.add(*c.reg(lo), c.CY)
+	case 0x9: // sub, the carry is an inverted borrow
+		c.add(^*c.reg(lo)&15, c.CY^1)
+	case 0xa: // ld
+		c.ACC = *c.reg(lo)
+	case 0xb: // xch
+		r := c.reg(lo)
+		c.ACC, *r = *r, c.ACC
+	case 0xc: // bbl
+		c.PC = c.pop()
+		c.ACC = lo
+	case 0xd: // ldm
+		c.ACC = lo
+
+	case 0xe:
+		return c.io(lo)
+
+	case 0xf:
+		switch lo {
+		case 0x0: // clb
+			c.ACC, c.CY = 0, 0
+		case 0x1: // clc
+			c.CY = 0
+		case 0x2: // iac
+			c.add(1, 0)
+		case 0x3: // cmc
+			c.CY ^= 1
+		case 0x4: // cma
+			c.ACC ^= 15
+		case 0x5: // ral
+			c.ACC, c.CY = (c.ACC<<1|c.CY)&15, c.ACC>>3
+		case 0x6: // rar
+			c.ACC, c.CY = c.ACC>>1|c.CY<<3, c.ACC&1
+		case 0x7: // tcc
+			c.ACC, c.CY = c.CY, 0
+		case 0x8: // dac
+			c.add(15, 0)
+		case 0x9: // tcs
+			c.ACC, c.CY = 9+c.CY, 0
+		case 0xa: // stc
+			c.CY = 1
+		case 0xb: // daa, leaves the carry alone unless it overflows
+			if c.ACC > 9 || c.CY == 1 {
+				c.ACC += 6
+				if c.ACC > 15 {
+					c.CY = 1
+				}
+				c.ACC &= 15
+			}
+		case 0xc: // kbp, which line of a keyboard column is down
+			switch c.ACC {
+			case 0, 1, 2:
+			case 4:
+				c.ACC = 3
+			case 8:
+				c.ACC = 4
+			default:
+				c.ACC = 15
+			}
+		case 0xd: // dcl
+			c.DCL = c.ACC & 7
+		default:
+			return fmt.Sprintf("unknown instruction 0x%02X", op)
+		}
+	}
+	return ""
+}
+
+func (c *CPU) add(v, carry uint8) {
+	s := c.ACC + v + carry
+	c.ACC, c.CY = s&15, s>>4
+}
+
+func (c *CPU) io(lo uint8) string {
+	chip := c.ram()
+	switch lo {
+	case 0x0: // wrm
+		*c.ramChar() = c.ACC
+	case 0x1: // wmp
+		chip.Port = c.ACC
+		fmt.Fprintf(c.Out, "ram port %d.%d = %X\n", c.DCL, c.SRC>>6, c.ACC)
+	case 0x2: // wrr
+		port := c.SRC >> 4
+		c.ROMPort[port] = c.ACC
+		if int(port) == *tty {
+			c.text = append(c.text, c.ACC)
+			if len(c.text) == 2 {
+				c.Out.WriteByte(c.text[0]<<4 | c.text[1])
+				c.text = c.text[:0]
+			}
+			break
+		}
+		fmt.Fprintf(c.Out, "rom port %X = %X\n", port, c.ACC)
+	case 0x3: // wpm
+		c.progRAM(true)
+	case 0x4, 0x5, 0x6, 0x7: // wr0-wr3
+		chip.Status[c.SRC>>4&3][lo&3] = c.ACC
+	case 0x8: // sbm
+		c.add(^*c.ramChar()&15, c.CY^1)
+	case 0x9: // rdm
+		c.ACC = *c.ramChar()
+	case 0xa: // rdr
+		c.ACC = 0
+		if len(c.Input) > 0 {
+			c.ACC, c.Input = c.Input[0], c.Input[1:]
+		}
+	case 0xb: // adm
+		c.add(*c.ramChar(), c.CY)
+	case 0xc, 0xd, 0xe, 0xf: // rd0-rd3
+		c.ACC = chip.Status[c.SRC>>4&3][lo&3]
+	}
+	return ""
+}
+
+// program ram is written and read a nibble at a time at the
+// src address, high nibble first
+func (c *CPU) progRAM(write bool) uint8 {
+	p := &c.ProgRAM[c.SRC]
+	v := *p >> 4
+	if c.wpmLow {
+		v = *p & 15
+	}
+	if write {
+		if c.wpmLow {
+			*p = *p&0xf0 | c.ACC
+		} else {
+			*p = c.ACC<<4 | *p&15
+		}
+	}
+	c.wpmLow = !c.wpmLow
+	return v
+}
+
+func (c *CPU) dump(w *os.File) {
+	fmt.Fprintf(w, "acc %X  carry %d  src %02X  dcl %d", c.ACC, c.CY, c.SRC, c.DCL)
+	if c.is4040 {
+		fmt.Fprintf(w, "  register bank %d  rom bank %d  interrupts %v", c.Bank, c.ROMBank, c.IntOn)
+	}
+	fmt.Fprintln(w)
+	for r := uint8(0); r < 16; r += 2 {
+		fmt.Fprintf(w, "P%d  R%-2d %X R%-2d %X\n", r/2, r, *c.reg(r), r+1, *c.reg(r + 1))
+	}
+	fmt.Fprint(w, "stack")
+	for i := 1; i <= len(c.Stack); i++ {
+		fmt.Fprintf(w, " %03X", c.Stack[(c.SP+len(c.Stack)-i)%len(c.Stack)])
+	}
+	fmt.Fprintln(w)
+
+	if !*dumpRAM {
+		return
+	}
+	for b := range c.RAM {
+		for ch := range c.RAM[b] {
+			chip := &c.RAM[b][ch]
+			for r := range chip.Main {
+				if chip.Main[r] == [16]uint8{} && chip.Status[r] == [4]uint8{} {
+					continue
+				}
+				fmt.Fprintf(w, "ram %d.%d.%d  ", b, ch, r)
+				for _, v := range chip.Main[r] {
+					fmt.Fprintf(w, "%X", v)
+				}
+				fmt.Fprint(w, "  ")
+				for _, v := range chip.Status[r] {
+					fmt.Fprintf(w, "%X", v)
+				}
+				fmt.Fprintln(w)
+			}
+		}
+	}
+}
+
+func readSyms(name string) (map[int]string, error) {
+	syms := make(map[int]string)
+	f, err := os.Open(name)
+	if err != nil {
+		return syms, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fl := strings.Fields(s.Text())
+		if len(fl) != 3 || fl[2] != "label" {
+			continue
+		}
+		v, err := strconv.ParseInt(fl[1], 0, 32)
+		if err != nil {
+			return syms, fmt.Errorf("%s: bad value %q", name, fl[1])
+		}
+		if _, dup := syms[int(v)]; !dup {
+			syms[int(v)] = fl[0]
+		}
+	}
+	return syms, s.Err()
+}
@@ -1,46 +1,66 @@
 // https://esolangs.org/wiki/4
+// go build s4.go esolimit.go
 
 package main
 
 import (
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"text/scanner"
 	"unicode"
 )
 
 var (
+	limits Limits
 	status = 0
 )
 
 func main() {
+	limits.AddFlags(flag.CommandLine)
 	flag.Parse()
+	in, err := limits.Stdin()
+	if ek(err) {
+		os.Exit(status)
+	}
+	stdio := &Stdio{in, bufio.NewWriter(os.Stdout)}
 	if flag.NArg() < 1 {
-		run("-", os.Stdin)
+		run("-", os.Stdin, stdio)
 	} else {
 		for _, name := range flag.Args() {
 			fd, err := os.Open(name)
 			if ek(err) {
 				continue
 			}
-			run(name, fd)
+			run(name, fd, stdio)
 			fd.Close()
 		}
 	}
 	os.Exit(status)
 }
 
-func run(name string, r io.Reader) {
-	src, err := ioutil.ReadAll(r)
+func run(name string, r io.Reader, stdio *Stdio) {
+	src, err := io.ReadAll(r)
 	if ek(err) {
 		return
 	}
 
-	s4 := NewS4(&Stdio{os.Stdin, os.Stdout})
-	ek(s4.Interpret(name, src))
+	s4 := NewS4(stdio)
+	if ek(s4.Parse(name, src)) {
+		return
+	}
+	err = limits.Run(s4)
+	stdio.Flush()
+	limits.Report(os.Stderr)
+	if errors.As(err, new(*LimitError)) {
+		ek(fmt.Errorf("%s: %v", name, err))
+		status = exitLimit
+		return
+	}
+	ek(err)
 }
 
 func ek(err error) bool {
@@ -58,7 +78,7 @@ func isnum(ch int) bool {
 
 type Stdio struct {
 	io.Reader
-	io.Writer
+	*bufio.Writer
 }
 
 type inst struct {
@@ -67,12 +87,15 @@ type inst struct {
 	arg [3]int
 }
 
+var opnames = [10]string{"add", "sub", "mul", "div", "end", "out", "set", "in", "loop", "pool"}
+
 type S4 struct {
 	pos   scanner.Position
 	src   []byte
 	state int
 	stdio *Stdio
 	inst  []inst
+	pc    int
 	Cells [100]int
 }
 
@@ -87,7 +110,7 @@ func (p *S4) errf(format string, args ...interface{}) {
 	panic(fmt.Errorf("%v: %v", p.pos, text))
 }
 
-func (p *S4) Interpret(name string, src []byte) (err error) {
+func (p *S4) Parse(name string, src []byte) (err error) {
 	defer func() {
 		if e := recover(); e != nil {
 			err = e.(error)
@@ -120,11 +143,34 @@ func (p *S4) Interpret(name string, src []byte) (err error) {
 			break
 		}
 	}
-	p.exec()
+	p.match()
 
 	return
 }
 
+// loops keep the index of the other end in their last argument
+func (p *S4) match() {
+	var open []int
+	for i := range p.inst {
+		switch p.inst[i].op {
+		case 8:
+			open = append(open, i)
+		case 9:
+			if len(open) == 0 {
+				p.pos = p.inst[i].pos
+				p.errf("syntax error: unmatched loop")
+			}
+			j := open[len(open)-1]
+			open = open[:len(open)-1]
+			p.inst[i].arg[2], p.inst[j].arg[2] = j, i
+		}
+	}
+	if len(open) > 0 {
+		p.pos = p.inst[open[len(open)-1]].pos
+		p.errf("syntax error: unmatched loop")
+	}
+}
+
 func (p *S4) getch0() int {
 	s := &p.pos
 	if s.Offset >= len(p.src) {
@@ -180,58 +226,43 @@ func (p *S4) arg(op int) (arg [3]int) {
 	return
 }
 
-func (p *S4) exec() {
+func (p *S4) Op() string {
+	return opnames[p.inst[p.pc].op]
+}
+
+func (p *S4) Step() (bool, error) {
 	c := p.Cells[:]
-	t := p.inst[:]
-	for i := 0; i < len(t); i++ {
-		w := &t[i]
-		x, y, z := w.arg[0], w.arg[1], w.arg[2]
-
-		p.pos = w.pos
-
-		switch w.op {
-		case 0:
-			c[x] = c[y] + c[z]
-		case 1:
-			c[x] = c[y] - c[z]
-		case 2:
-			c[x] = c[y] * c[z]
-		case 3:
-			c[x] = c[y] / c[z]
-		case 4:
-			return
-		case 5:
-			fmt.Fprintf(p.stdio, "%c", c[x])
-		case 6:
-			c[x] = y
-		case 7:
-			fmt.Fscanf(p.stdio, "%c", &c[x])
-		case 8:
-			if c[x] == 0 {
-				for n := 1; n > 0; {
-					if i++; i >= len(t) {
-						p.errf("syntax error: unmatched loop")
-					}
-
-					if t[i].op == 8 {
-						n++
-					} else if t[i].op == 9 {
-						n--
-					}
-				}
-			}
-		case 9:
-			for n := 1; n > 0; {
-				if i--; i < 0 {
-					p.errf("syntax error: unmatched loop")
-				}
-
-				if t[i].op == 9 {
-					n++
-				} else if t[i].op == 8 {
-					n--
-				}
-			}
+	w := &p.inst[p.pc]
+	x, y, z := w.arg[0], w.arg[1], w.arg[2]
+	p.pos = w.pos
+	p.pc++
+
+	switch w.op {
+	case 0:
+		c[x] = c[y] + c[z]
+	case 1:
+		c[x] = c[y] - c[z]
+	case 2:
+		c[x] = c[y] * c[z]
+	case 3:
+		if c[z] == 0 {
+			return true, fmt.Errorf("%v: division by zero", p.pos)
+		}
+		c[x] = c[y] / c[z]
+	case 4:
+		return true, nil
+	case 5:
+		fmt.Fprintf(p.stdio, "%c", c[x])
+	case 6:
+		c[x] = y
+	case 7:
+		fmt.Fscanf(p.stdio, "%c", &c[x])
+	case 8:
+		if c[x] == 0 {
+			p.pc = z + 1
 		}
+	case 9:
+		p.pc = z
 	}
+	return false, nil
 }
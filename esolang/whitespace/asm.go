@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the assembler reads the same syntax -d prints:
+//
+//	; comments start with ; or #
+//	loop:           labels end with a colon, an instruction can follow
+//		push 'a'    numbers can be decimal, 0x hex, negative or a quoted char
+//		outc
+//		jmp loop
+//
+// next to the whitespace it writes a source map, so the vm can
+// show assembler lines and label names when tracing or debugging
+
+var mnemonics = map[string]Token{
+	"halt": HLT,
+	"end":  HLT,
+	"pop":  DISCARD,
+}
+
+func init() {
+	for t := Token(NOP); t <= INN; t++ {
+		mnemonics[t.String()] = t
+	}
+}
+
+var encoding = map[Token]string{
+	PUSH:     "  ",
+	DUP:      " \n ",
+	SWAP:     " \n\t",
+	DISCARD:  " \n\n",
+	ADD:      "\t   ",
+	SUB:      "\t  \t",
+	MUL:      "\t  \n",
+	DIV:      "\t \t ",
+	MOD:      "\t \t\t",
+	STORE:    "\t\t ",
+	RETRIEVE: "\t\t\t",
+	LABEL:    "\n  ",
+	CALL:     "\n \t",
+	JMP:      "\n \n",
+	JZ:       "\n\t ",
+	JN:       "\n\t\t",
+	RET:      "\n\t\n",
+	HLT:      "\n\n\n",
+	OUTC:     "\t\n  ",
+	OUTN:     "\t\n \t",
+	INC:      "\t\n\t ",
+	INN:      "\t\n\t\t",
+}
+
+type asmInst struct {
+	Op     Token
+	Number int
+	Label  string
+	Line   int
+}
+
+// what the assembler knows that the whitespace does not
+type SourceMap struct {
+	Labels map[string]string // label bits to names
+	Src    []string          // file:line of each instruction
+}
+
+func Assemble(r io.Reader, name string) ([]byte, *SourceMap, error) {
+	var prog []asmInst
+	ids := make(map[string]string)
+	sm := &SourceMap{Labels: make(map[string]string)}
+
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := stripComment(s.Text())
+		errorf := func(format string, args ...interface{}) error {
+			return fmt.Errorf("%s:%d: %s", name, line, fmt.Sprintf(format, args...))
+		}
+
+		for {
+			text = strings.TrimSpace(text)
+			i := strings.IndexByte(text, ':')
+			if i < 0 || strings.ContainsAny(text[:i], " \t'") {
+				break
+			}
+			lb := text[:i]
+			if _, dup := ids[lb]; dup {
+				return nil, nil, errorf("label %s defined twice", lb)
+			}
+			// label bits are the definition order, counting from 1
+			// so none of them is empty
+			ids[lb] = strconv.FormatInt(int64(len(ids)+1), 2)
+			sm.Labels[ids[lb]] = lb
+			prog = append(prog, asmInst{Op: LABEL, Label: lb, Line: line})
+			text = text[i+1:]
+		}
+		if text == "" {
+			continue
+		}
+
+		f := strings.Fields(text)
+		op, ok := mnemonics[strings.ToLower(f[0])]
+		if !ok || op == NOP || op == EOF || op == LABEL {
+			return nil, nil, errorf("unknown instruction %q", f[0])
+		}
+		in := asmInst{Op: op, Line: line}
+		arg := strings.TrimSpace(text[len(f[0]):])
+		switch op {
+		case PUSH:
+			n, err := parseNumber(arg)
+			if err != nil {
+				return nil, nil, errorf("%v", err)
+			}
+			in.Number = n
+		case CALL, JMP, JZ, JN:
+			if len(f) != 2 {
+				return nil, nil, errorf("%s takes a label", op)
+			}
+			in.Label = f[1]
+		default:
+			if len(f) != 1 {
+				return nil, nil, errorf("%s takes no argument", op)
+			}
+		}
+		prog = append(prog, in)
+	}
+	if err := s.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var b bytes.Buffer
+	for _, in := range prog {
+		b.WriteString(encoding[in.Op])
+		switch in.Op {
+		case PUSH:
+			b.WriteString(encodeNumber(in.Number))
+		case LABEL, CALL, JMP, JZ, JN:
+			id, ok := ids[in.Label]
+			if !ok {
+				return nil, nil, fmt.Errorf("%s:%d: label %s is not defined", name, in.Line, in.Label)
+			}
+			b.WriteString(encodeBits(id))
+		}
+		sm.Src = append(sm.Src, fmt.Sprintf("%s:%d", name, in.Line))
+	}
+	return b.Bytes(), sm, nil
+}
+
+// ; and # start a comment, unless they are quoted
+func stripComment(s string) string {
+	quote := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\'':
+			quote = !quote
+		case '\\':
+			i++
+		case ';', '#':
+			if !quote {
+				return s[:i]
+			}
+		}
+	}
+	return s
+}
+
+func parseNumber(s string) (int, error) {
+	if strings.HasPrefix(s, "'") {
+		r, _, tail, err := strconv.UnquoteChar(strings.TrimPrefix(s, "'"), '\'')
+		if err != nil || tail != "'" {
+			return 0, fmt.Errorf("bad character %s", s)
+		}
+		return int(r), nil
+	}
+	n, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad number %q", s)
+	}
+	return int(n), nil
+}
+
+func encodeNumber(n int) string {
+	sign := " "
+	if n < 0 {
+		sign, n = "\t", -n
+	}
+	return sign + encodeBits(strconv.FormatInt(int64(n), 2))
+}
+
+func encodeBits(bits string) string {
+	r := strings.NewReplacer("0", " ", "1", "\t")
+	return r.Replace(bits) + "\n"
+}
+
+// assembles a file into the output file and its map, or to stdout
+func assembleFile(name, output string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	code, sm, err := Assemble(f, name)
+	if err != nil {
+		return err
+	}
+	if output == "" {
+		_, err = os.Stdout.Write(code)
+		return err
+	}
+	if err := os.WriteFile(output, code, 0644); err != nil {
+		return err
+	}
+	return sm.Write(output + ".map")
+}
+
+func (sm *SourceMap) Write(name string) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# whitespace source map\n")
+	var bits []string
+	for k := range sm.Labels {
+		bits = append(bits, k)
+	}
+	sort.Strings(bits)
+	for _, k := range bits {
+		fmt.Fprintf(&b, "label %s %s\n", k, sm.Labels[k])
+	}
+	for i, src := range sm.Src {
+		fmt.Fprintf(&b, "inst %d %s\n", i, src)
+	}
+	return os.WriteFile(name, b.Bytes(), 0644)
+}
+
+func ReadSourceMap(name string) (*SourceMap, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	sm := &SourceMap{Labels: make(map[string]string)}
+	for i, line := range strings.Split(string(data), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		if len(f) != 3 {
+			return nil, fmt.Errorf("%s:%d: bad line", name, i+1)
+		}
+		switch f[0] {
+		case "label":
+			if strings.Trim(f[1], "01") != "" {
+				return nil, fmt.Errorf("%s:%d: bad label %q", name, i+1, f[1])
+			}
+			sm.Labels[f[1]] = f[2]
+		case "inst":
+			n, err := strconv.Atoi(f[1])
+			if err != nil || n != len(sm.Src) {
+				return nil, fmt.Errorf("%s:%d: instructions out of order", name, i+1)
+			}
+			sm.Src = append(sm.Src, f[2])
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown entry %q", name, i+1, f[0])
+		}
+	}
+	return sm, nil
+}
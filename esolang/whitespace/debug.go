@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// no instruction touches more than the top two stack slots, the top of the
+// call stack and one heap cell, so saving those before each step is enough
+// to undo it. input is kept so stepping forward again reads the same thing
+type undo struct {
+	pc, stackLen, callLen int
+	halt                  bool
+	stack, call           []int
+	heapSet, heapHad      bool
+	heapAddr, heapOld     int
+	inPos, outLen         int
+}
+
+type Debugger struct {
+	*VM
+	hist   []undo
+	max    int
+	steps  int
+	breaks map[int]bool
+	in     *replayReader
+	out    *bytes.Buffer
+	cmd    *bufio.Scanner
+}
+
+// commands come from the terminal so stdin is left for the program
+func NewDebugger(vm *VM) *Debugger {
+	r := io.Reader(os.Stdin)
+	if tty, err := os.Open("/dev/tty"); err == nil {
+		r = tty
+	}
+	d := &Debugger{
+		VM:     vm,
+		max:    1000000,
+		breaks: make(map[int]bool),
+		in:     &replayReader{r: bufio.NewReader(vm.In)},
+		out:    new(bytes.Buffer),
+		cmd:    bufio.NewScanner(r),
+	}
+	vm.In = d.in
+	vm.Out = io.MultiWriter(vm.Out, d.out)
+	vm.Reset()
+	return d
+}
+
+const debugHelp = `s [n]       step n instructions
+n           step over a call
+c           continue to a breakpoint or the end
+bs [n]      step back n instructions
+bc          go back to the previous breakpoint or the start
+b [loc]     set a breakpoint, or list them. loc is a label,
+            an assembler line as file:line or line, or @n for instruction n
+d loc       delete a breakpoint
+l [loc]     list the program around the pc or loc
+stack       show the stack
+heap        show the heap
+calls       show the call stack
+o           show the output so far
+q           quit`
+
+func (d *Debugger) Run() error {
+	d.where()
+	for {
+		fmt.Fprint(os.Stderr, "(ws) ")
+		if !d.cmd.Scan() {
+			return d.cmd.Err()
+		}
+		args := strings.Fields(d.cmd.Text())
+		if len(args) == 0 {
+			args = []string{"s"}
+		}
+		count := 1
+		if len(args) > 1 {
+			if n, err := strconv.Atoi(args[1]); err == nil {
+				count = n
+			}
+		}
+
+		switch args[0] {
+		case "s", "step":
+			for i := 0; i < count && d.step(); i++ {
+			}
+			d.where()
+		case "n", "next":
+			depth := len(d.Call)
+			for d.step() && len(d.Call) > depth && !d.breaks[d.PC] {
+			}
+			d.where()
+		case "c", "cont":
+			for d.step() && !d.breaks[d.PC] {
+			}
+			d.where()
+		case "bs", "back":
+			for i := 0; i < count && d.back(); i++ {
+			}
+			d.where()
+			d.atStart()
+		case "bc":
+			for d.back() && !d.breaks[d.PC] {
+			}
+			d.where()
+			d.atStart()
+		case "b", "break", "d", "delete":
+			if len(args) == 1 {
+				for pc := range d.Inst {
+					if d.breaks[pc] {
+						fmt.Fprintf(os.Stderr, "%s\n", d.describe(pc))
+					}
+				}
+				break
+			}
+			pc, err := d.locate(args[1])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				break
+			}
+			d.breaks[pc] = args[0][0] == 'b'
+		case "l", "list":
+			pc := d.PC
+			if len(args) > 1 {
+				var err error
+				if pc, err = d.locate(args[1]); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					break
+				}
+			}
+			for i := max(pc-5, 0); i < min(pc+6, len(d.Inst)); i++ {
+				mark := "  "
+				if i == d.PC {
+					mark = "=>"
+				}
+				if d.breaks[i] {
+					mark = mark[:1] + "*"
+				}
+				fmt.Fprintf(os.Stderr, "%s %s\n", mark, d.describe(i))
+			}
+		case "stack":
+			fmt.Fprintln(os.Stderr, d.Stack)
+		case "heap":
+			var addrs []int
+			for a := range d.Heap {
+				addrs = append(addrs, a)
+			}
+			sort.Ints(addrs)
+			for _, a := range addrs {
+				fmt.Fprintf(os.Stderr, "%6d: %d\n", a, d.Heap[a])
+			}
+		case "calls":
+			for i := len(d.Call) - 1; i >= 0; i-- {
+				fmt.Fprintf(os.Stderr, "returns to %s\n", d.describe(d.Call[i]))
+			}
+		case "o", "output":
+			fmt.Fprintf(os.Stderr, "%q\n", d.out.String())
+		case "q", "quit":
+			return nil
+		case "h", "help", "?":
+			fmt.Fprintln(os.Stderr, debugHelp)
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command %q, h for help\n", args[0])
+		}
+	}
+}
+
+func (d *Debugger) step() bool {
+	if d.Halt {
+		return false
+	}
+	u := undo{
+		pc:       d.PC,
+		halt:     d.Halt,
+		stackLen: len(d.Stack),
+		stack:    append([]int(nil), d.Stack[max(len(d.Stack)-2, 0):]...),
+		callLen:  len(d.Call),
+		call:     append([]int(nil), d.Call[max(len(d.Call)-1, 0):]...),
+		inPos:    d.in.pos,
+		outLen:   d.out.Len(),
+	}
+	if d.PC < len(d.Inst) {
+		switch d.Inst[d.PC].Op {
+		case STORE:
+			u.heapSet, u.heapAddr = true, d.peek(-2)
+		case INC, INN:
+			u.heapSet, u.heapAddr = true, d.top()
+		}
+		u.heapOld, u.heapHad = d.Heap[u.heapAddr]
+	}
+	if len(d.hist) >= d.max {
+		d.hist = d.hist[1:]
+	}
+	d.hist = append(d.hist, u)
+	d.Step()
+	d.steps++
+	return true
+}
+
+func (d *Debugger) back() bool {
+	if len(d.hist) == 0 {
+		return false
+	}
+	u := d.hist[len(d.hist)-1]
+	d.hist = d.hist[:len(d.hist)-1]
+
+	d.PC, d.Halt = u.pc, u.halt
+	d.Stack = append(d.Stack[:u.stackLen-len(u.stack)], u.stack...)
+	d.Call = append(d.Call[:u.callLen-len(u.call)], u.call...)
+	if u.heapSet {
+		if u.heapHad {
+			d.Heap[u.heapAddr] = u.heapOld
+		} else {
+			delete(d.Heap, u.heapAddr)
+		}
+	}
+	d.in.pos = u.inPos
+	d.out.Truncate(u.outLen)
+	d.steps--
+	return true
+}
+
+func (d *Debugger) where() {
+	if d.Halt {
+		fmt.Fprintf(os.Stderr, "halted after %d steps, bs steps back\n", d.steps)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s\n", d.describe(d.PC))
+}
+
+func (d *Debugger) atStart() {
+	switch {
+	case len(d.hist) > 0:
+	case d.steps > 0:
+		fmt.Fprintf(os.Stderr, "history only goes back %d steps\n", d.max)
+	default:
+		fmt.Fprintln(os.Stderr, "at the start of the program")
+	}
+}
+
+func (d *Debugger) describe(pc int) string {
+	if pc >= len(d.Inst) {
+		return fmt.Sprintf("@%d end of program", pc)
+	}
+	ip := d.Inst[pc]
+	s := fmt.Sprintf("@%d", pc)
+	if ip.Src != "" {
+		s += " " + ip.Src
+	}
+	return fmt.Sprintf("%-20s %s", s, d.Disasm(ip, pc == d.PC))
+}
+
+// finds an instruction from @n, a label, or an assembler line
+func (d *Debugger) locate(loc string) (int, error) {
+	if n, err := strconv.Atoi(strings.TrimPrefix(loc, "@")); err == nil && loc[0] == '@' {
+		if n < 0 || n >= len(d.Inst) {
+			return 0, fmt.Errorf("no instruction %s", loc)
+		}
+		return n, nil
+	}
+	for pc, ip := range d.Inst {
+		if ip.Op == LABEL && ip.Label == loc {
+			return pc, nil
+		}
+	}
+	if _, err := strconv.Atoi(loc); err == nil {
+		loc = ":" + loc
+	}
+	for pc, ip := range d.Inst {
+		if ip.Src != "" && (ip.Src == loc || strings.HasSuffix(ip.Src, loc) && loc[0] == ':') {
+			return pc, nil
+		}
+	}
+	return 0, fmt.Errorf("no instruction at %s", loc)
+}
+
+// hands out input again after stepping back over the instruction that read it
+type replayReader struct {
+	r   *bufio.Reader
+	buf []rune
+	pos int
+}
+
+func (r *replayReader) ReadRune() (rune, int, error) {
+	if r.pos == len(r.buf) {
+		c, _, err := r.r.ReadRune()
+		if err != nil {
+			return 0, 0, err
+		}
+		r.buf = append(r.buf, c)
+	}
+	c := r.buf[r.pos]
+	r.pos++
+	return c, utf8.RuneLen(c), nil
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	if len(p) < utf8.UTFMax {
+		return 0, io.ErrShortBuffer
+	}
+	c, _, err := r.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	return utf8.EncodeRune(p, c), nil
+}
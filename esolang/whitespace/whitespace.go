@@ -1,45 +1,84 @@
+// a whitespace interpreter, with an assembler and a debugger
+// go build whitespace.go asm.go debug.go ../esolimit.go
+// whitespace -a -o hello.ws hello.wsa assembles readable source and writes
+// hello.ws.map next to it, so -t and -g can show assembler lines.
+// -check runs programs and compares what they print to the .out file next
+// to them, feeding them the .in file if there is one, and stops them
+// after 10000000 steps unless -limit says otherwise:
+// whitespace -check *.ws conformance/*.wsa
+
 package main
 
 import (
 	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"text/scanner"
+	"unicode"
 )
 
 func main() {
 	var (
 		disasm = flag.Bool("d", false, "show disassembly")
 		trace  = flag.Bool("t", false, "trace program")
+		asm    = flag.Bool("a", false, "assemble the file into whitespace")
+		output = flag.String("o", "", "assembler output, the source map is written next to it")
+		debug  = flag.Bool("g", false, "run under the debugger")
+		check  = flag.Bool("check", false, "run the files and compare their output to the .out files")
+		update = flag.Bool("update", false, "with -check, rewrite the .out files")
+		limits Limits
 	)
+	limits.AddFlags(flag.CommandLine)
 	log.SetFlags(0)
 	log.SetPrefix("whitespace: ")
 	flag.Usage = usage
 	flag.Parse()
+	if *check && flag.NArg() > 0 {
+		if limits.Steps == 0 {
+			limits.Steps = 10000000
+		}
+		os.Exit(runChecks(flag.Args(), limits.Steps, *update))
+	}
 	if flag.NArg() != 1 {
 		usage()
 	}
 
+	if *asm {
+		ck(assembleFile(flag.Arg(0), *output))
+		return
+	}
+
 	vm := NewVM()
 	err := vm.LoadProg(flag.Arg(0))
 	ck(err)
+	vm.In, err = limits.Stdin()
+	ck(err)
 
 	if *disasm {
-		for _, ip := range vm.Inst {
-			if ip.Op != LABEL {
-				fmt.Printf("\t")
-			}
-			fmt.Printf("%s\n", vm.Disasm(ip, false))
-		}
+		vm.Listing(os.Stdout)
+		return
+	}
+
+	if *debug {
+		ck(NewDebugger(vm).Run())
 		return
 	}
 
 	vm.Trace = *trace
-	vm.Run()
+	vm.Reset()
+	err = limits.Run(stepper{vm})
+	limits.Report(os.Stderr)
+	if err != nil {
+		// the same status as the interpreters esorun drives
+		log.Print(err)
+		os.Exit(exitLimit)
+	}
 }
 
 func ck(err error) {
@@ -49,7 +88,8 @@ func ck(err error) {
 }
 
 func usage() {
-	fmt.Fprintln(os.Stderr, "usage: [options] file")
+	fmt.Fprintln(os.Stderr, "usage: whitespace [options] file")
+	fmt.Fprintln(os.Stderr, "       whitespace -check [options] file ...")
 	flag.PrintDefaults()
 	os.Exit(2)
 }
@@ -161,10 +201,11 @@ func (l *Lexer) Lex() (pos scanner.Position, tok Token, val string) {
 	tok = NOP
 	switch l.next() {
 	case ' ':
-		switch ch := l.next(); ch {
-		case ' ', '\t':
+		switch l.next() {
+		case ' ':
+			// push is two spaces, then the sign
 			tok = PUSH
-			val = l.number(ch)
+			val = l.number(l.next())
 		case '\n':
 			switch l.next() {
 			case ' ':
@@ -343,6 +384,7 @@ type Inst struct {
 	Op     Token
 	Number int
 	Label  string
+	Src    string // assembler line, from the source map
 }
 
 type VM struct {
@@ -373,7 +415,10 @@ func (vm *VM) Disasm(ip Inst, trace bool) string {
 	case LABEL:
 		dis = fmt.Sprintf("%s:", ip.Label)
 	case PUSH:
-		dis += fmt.Sprintf(" %d (%q)", ip.Number, string(ip.Number))
+		dis += fmt.Sprintf(" %d", ip.Number)
+		if r := rune(ip.Number); r == '\n' || r == '\t' || 0 <= ip.Number && ip.Number <= unicode.MaxRune && unicode.IsPrint(r) {
+			dis += fmt.Sprintf("\t; %q", rune(ip.Number))
+		}
 	case ADD, SUB, MUL, DIV, MOD:
 		if trace {
 			dis += fmt.Sprintf(" %d %d", vm.peek(-2), vm.peek(-1))
@@ -382,7 +427,7 @@ func (vm *VM) Disasm(ip Inst, trace bool) string {
 		dis += fmt.Sprintf(" %s", ip.Label)
 	case OUTC:
 		if trace {
-			dis += fmt.Sprintf(" %q", vm.top())
+			dis += fmt.Sprintf(" %q", rune(vm.top()))
 		}
 	case OUTN:
 		if trace {
@@ -400,6 +445,8 @@ func (vm *VM) Disasm(ip Inst, trace bool) string {
 	return dis
 }
 
+// loads whitespace, or assembler source if the name ends in .wsa.
+// a source map next to the whitespace is picked up too
 func (vm *VM) LoadProg(name string) error {
 	f, err := os.Open(name)
 	if err != nil {
@@ -407,8 +454,25 @@ func (vm *VM) LoadProg(name string) error {
 	}
 	defer f.Close()
 
+	if strings.HasSuffix(name, ".wsa") {
+		code, sm, err := Assemble(f, name)
+		if err != nil {
+			return err
+		}
+		return vm.Load(bytes.NewReader(code), name, sm)
+	}
+
+	sm, err := ReadSourceMap(name + ".map")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return vm.Load(f, name, sm)
+}
+
+func (vm *VM) Load(r io.Reader, name string, sm *SourceMap) error {
+	vm.Inst = vm.Inst[:0]
 	var lx Lexer
-	lx.Init(f, name)
+	lx.Init(r, name)
 	for {
 		_, tok, val := lx.Lex()
 		if tok == EOF {
@@ -429,6 +493,9 @@ func (vm *VM) LoadProg(name string) error {
 		ip := &vm.Inst[i]
 		if ip.Op == LABEL {
 			lb[ip.Label] = fmt.Sprintf("label_%d", ln)
+			if sm != nil && sm.Labels[ip.Label] != "" {
+				lb[ip.Label] = sm.Labels[ip.Label]
+			}
 			ln++
 		}
 	}
@@ -444,9 +511,32 @@ func (vm *VM) LoadProg(name string) error {
 		ip.Label = lp
 	}
 
+	if sm != nil {
+		if len(sm.Src) != len(vm.Inst) {
+			return fmt.Errorf("%s: source map has %d instructions, the program %d", name, len(sm.Src), len(vm.Inst))
+		}
+		for i := range vm.Inst {
+			vm.Inst[i].Src = sm.Src[i]
+		}
+	}
 	return nil
 }
 
+// the disassembly, in a form the assembler reads back. nops
+// are what the lexer makes of garbage and have no encoding
+func (vm *VM) Listing(w io.Writer) {
+	for _, ip := range vm.Inst {
+		switch ip.Op {
+		case LABEL:
+		case NOP:
+			fmt.Fprintf(w, "\t; ")
+		default:
+			fmt.Fprintf(w, "\t")
+		}
+		fmt.Fprintf(w, "%s\n", vm.Disasm(ip, false))
+	}
+}
+
 func (vm *VM) Reset() {
 	vm.Call = vm.Call[:0]
 	vm.Stack = vm.Stack[:0]
@@ -469,9 +559,27 @@ func (vm *VM) Run() {
 	}
 }
 
+// the vm as a Stepper for the limits
+type stepper struct{ *VM }
+
+func (s stepper) Step() (bool, error) {
+	s.VM.Step()
+	return s.Halt, nil
+}
+
+func (s stepper) Op() string {
+	if s.PC < len(s.Inst) {
+		return s.Inst[s.PC].Op.String()
+	}
+	return Token(HLT).String()
+}
+
 func (vm *VM) Step() {
 	ip := vm.fetch()
 	if vm.Trace {
+		if ip.Src != "" {
+			fmt.Printf("%s: ", ip.Src)
+		}
 		fmt.Printf("%s\n", vm.Disasm(ip, vm.Trace))
 		fmt.Printf("Stack: ")
 		for _, v := range vm.Stack {
@@ -534,18 +642,17 @@ func (vm *VM) Step() {
 		vm.branch(vm.pop() < 0, ip.Label)
 
 	case INC:
-		var c int
-		_, err := fmt.Fscanf(vm.In, "%c", &c)
+		c, _, err := vm.reader().ReadRune()
 		if err == io.EOF {
 			vm.Halt = true
 		}
-		vm.writemem(vm.pop(), c)
+		vm.writemem(vm.pop(), int(c))
 	case INN:
-		var n int
-		_, err := fmt.Fscanf(vm.In, "%d", &n)
+		line, err := vm.readLine()
 		if err == io.EOF {
 			vm.Halt = true
 		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line))
 		vm.writemem(vm.pop(), n)
 	case OUTC:
 		format := "%c"
@@ -573,6 +680,36 @@ func (vm *VM) fetch() Inst {
 	return ip
 }
 
+// reading a character must not take more than that from the input,
+// so it needs to be read a rune at a time
+func (vm *VM) reader() io.RuneReader {
+	r, ok := vm.In.(io.RuneReader)
+	if !ok {
+		b := bufio.NewReader(vm.In)
+		vm.In, r = b, b
+	}
+	return r
+}
+
+// numbers are read a line at a time, like the reference interpreter
+func (vm *VM) readLine() (string, error) {
+	var line []rune
+	r := vm.reader()
+	for {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			if len(line) > 0 {
+				err = nil
+			}
+			return string(line), err
+		}
+		if c == '\n' {
+			return string(line), nil
+		}
+		line = append(line, c)
+	}
+}
+
 func (vm *VM) readmem(a int) int {
 	return vm.Heap[a]
 }
@@ -638,3 +775,80 @@ func (vm *VM) branch(cond bool, label string) {
 		vm.PC = vm.Label[label]
 	}
 }
+
+// runs each program and compares its output to the golden file, the
+// whitespace ones are also disassembled and assembled again to check
+// the assembler gives back the same program
+func runChecks(files []string, limit int64, update bool) int {
+	status := 0
+	for _, name := range files {
+		err := checkProg(name, limit, update)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", name, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("ok   %s\n", name)
+	}
+	return status
+}
+
+func checkProg(name string, limit int64, update bool) error {
+	base := strings.TrimSuffix(name, ".wsa")
+	base = strings.TrimSuffix(base, ".ws")
+
+	vm := NewVM()
+	if err := vm.LoadProg(name); err != nil {
+		return err
+	}
+	in, err := os.ReadFile(base + ".in")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var out bytes.Buffer
+	vm.In = bytes.NewReader(in)
+	vm.Out = &out
+
+	vm.Reset()
+	limits := Limits{Steps: limit}
+	if err := limits.Run(stepper{vm}); err != nil {
+		return err
+	}
+
+	if update {
+		return os.WriteFile(base+".out", out.Bytes(), 0644)
+	}
+	want, err := os.ReadFile(base + ".out")
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		return fmt.Errorf("output differs from %s.out at byte %d", base, mismatch(out.Bytes(), want))
+	}
+
+	if strings.HasSuffix(name, ".ws") {
+		var src, again bytes.Buffer
+		vm.Listing(&src)
+		code, sm, err := Assemble(bytes.NewReader(src.Bytes()), name+" listing")
+		if err != nil {
+			return err
+		}
+		vm2 := NewVM()
+		if err := vm2.Load(bytes.NewReader(code), name, sm); err != nil {
+			return err
+		}
+		vm2.Listing(&again)
+		if strings.ReplaceAll(src.String(), "\t; nop\n", "") != again.String() {
+			return fmt.Errorf("disassembly does not assemble back to the same program")
+		}
+	}
+	return nil
+}
+
+func mismatch(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
@@ -1,10 +1,37 @@
+// generates uuids from a template, and looks up bluetooth assigned numbers:
+// uuids, company identifiers, appearance values and class of device bits.
+// the names come from the yaml files in the assigned_numbers directory of
+// the bluetooth sig public repository (bitbucket.org/bluetooth-SIG/public).
+// the files it reads are kept in assigned_numbers here and built in from
+// assigned.go, -db or $BT_ASSIGNED_NUMBERS point at a newer copy instead:
+// go build bt-uuidgen.go assigned.go
+// bt-uuidgen -u 180f
+// bt-uuidgen -u 00002a19-0000-1000-8000-00805f9b34fb
+// bt-uuidgen -c 0x004c -a 0x03c1 -cod 0x5a020c
+// bt-uuidgen -s battery
+// assigned.go and hwdb.go's company table are generated from the copy,
+// to update them copy the sig's assigned_numbers over it and run
+// go generate bt-uuidgen.go
+
+//go:generate go run bt-uuidgen.go -db assigned_numbers -gen-tables -o assigned.go
+//go:generate go run bt-uuidgen.go -db assigned_numbers -gen-hwdb -o hwdb.go
+
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
+	"errors"
 	"flag"
 	"fmt"
+	"go/format"
+	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 // https://www.bluetooth.com/specifications/assigned-numbers/service-discovery/
@@ -17,20 +44,116 @@ const (
 var (
 	usebase = flag.Bool("b", false, "generate uuid inside the base range")
 	tmpl    = flag.String("t", "XXXXXXXX-XXXX-XXXX-XXXX-XXXXXXXXXXXX", "use template")
+	dbdir   = flag.String("db", os.Getenv("BT_ASSIGNED_NUMBERS"), "assigned_numbers directory of the sig yaml files")
+	uuidq   = flag.String("u", "", "look up a 16, 32 or 128 bit uuid")
+	compq   = flag.String("c", "", "look up a company identifier")
+	appq    = flag.String("a", "", "look up an appearance value")
+	codq    = flag.String("cod", "", "decode a class of device")
+	search  = flag.String("s", "", "list the assigned numbers whose name contains this")
+	genHwdb = flag.Bool("gen-hwdb", false, "write hwdb.go with the company table from the yaml")
+	genTabs = flag.Bool("gen-tables", false, "write assigned.go with every table from the yaml")
+	output  = flag.String("o", "", "write what -gen-hwdb or -gen-tables make to this file instead of stdout")
 )
 
 func main() {
 	log.SetFlags(0)
 	log.SetPrefix("bt-uuidgen: ")
 	flag.Parse()
-	if *usebase {
-		*tmpl = BASE_UUID
+
+	if *genHwdb && *genTabs {
+		log.Fatal("-gen-hwdb and -gen-tables write a file each, run them one at a time")
+	}
+	if *uuidq == "" && *compq == "" && *appq == "" && *codq == "" && *search == "" && !*genHwdb && !*genTabs {
+		if *usebase {
+			*tmpl = BASE_UUID
+		}
+		uuid, err := gen(*tmpl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(uuid)
+		return
 	}
-	uuid, err := gen(*tmpl)
+
+	db, err := LoadDB(*dbdir)
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println(uuid)
+	status := 0
+	fail := func(err error) {
+		fmt.Fprintln(os.Stderr, "bt-uuidgen:", err)
+		status = 1
+	}
+
+	if *uuidq != "" {
+		es, err := db.LookupUUID(*uuidq)
+		if err != nil {
+			fail(err)
+		}
+		for _, e := range es {
+			fmt.Println(e)
+		}
+	}
+	if *compq != "" {
+		v, err := parseNumber(*compq, 16)
+		if err == nil {
+			name, ok := db.Companies[uint16(v)]
+			if ok {
+				fmt.Printf("company 0x%04X %s\n", v, name)
+			} else {
+				err = fmt.Errorf("company 0x%04X is not assigned", v)
+			}
+		}
+		if err != nil {
+			fail(err)
+		}
+	}
+	if *appq != "" {
+		v, err := parseNumber(*appq, 16)
+		if err == nil {
+			var name string
+			name, err = db.Appearance(uint16(v))
+			fmt.Printf("appearance 0x%04X %s\n", v, name)
+		}
+		if err != nil {
+			fail(err)
+		}
+	}
+	if *codq != "" {
+		v, err := parseNumber(*codq, 24)
+		if err == nil {
+			for _, s := range db.ClassOfDevice(uint32(v)) {
+				fmt.Println(s)
+			}
+		} else {
+			fail(err)
+		}
+	}
+	if *search != "" {
+		es := db.Search(*search)
+		if len(es) == 0 {
+			fail(fmt.Errorf("nothing named like %q", *search))
+		}
+		for _, e := range es {
+			fmt.Println(e)
+		}
+	}
+	if *genHwdb || *genTabs {
+		gen := db.hwdb
+		if *genTabs {
+			gen = db.tables
+		}
+		src, err := gen()
+		if err == nil && *output != "" {
+			err = os.WriteFile(*output, src, 0644)
+		} else if err == nil {
+			_, err = os.Stdout.Write(src)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	os.Exit(status)
 }
 
 func gen(tmpl string) (uuid string, err error) {
@@ -82,3 +205,694 @@ func ishex(b byte) bool {
 	}
 	return false
 }
+
+// one named value, Kind says which table it came from
+type Entry struct {
+	Kind  string
+	Value uint32
+	Name  string
+	ID    string
+}
+
+func (e Entry) String() string {
+	width := 4
+	switch {
+	case e.Kind == "class of device":
+		width = 6
+	case e.Value > 0xffff:
+		width = 8
+	}
+	s := fmt.Sprintf("%s 0x%0*X %s", e.Kind, width, e.Value, e.Name)
+	if e.ID != "" {
+		s += " (" + e.ID + ")"
+	}
+	return s
+}
+
+type Appearance struct {
+	Name string
+	Sub  map[uint16]string
+}
+
+type DeviceClass struct {
+	Name  string
+	Minor map[uint32]string
+	Split int // when not 0, minor names only the top bits and Sub the rest
+	Sub   map[uint32]string
+}
+
+type DB struct {
+	UUIDs       map[uint32][]Entry
+	Companies   map[uint16]string
+	Appearances map[uint16]Appearance // by category
+	Services    map[int]string        // class of device service bits
+	Classes     map[uint32]DeviceClass
+	entries     []Entry // everything above for Search, made by index
+}
+
+// set by assigned.go when it is built in
+var builtin *DB
+
+// the layout of the sig repository, under assigned_numbers
+const (
+	uuidDir        = "uuids"
+	companyFile    = "company_identifiers/company_identifiers.yaml"
+	appearanceFile = "core/appearance_values.yaml"
+	codFile        = "core/class_of_device.yaml"
+)
+
+func LoadDB(dir string) (*DB, error) {
+	if dir == "" {
+		if builtin == nil {
+			return nil, errors.New("no assigned numbers built in, build with assigned.go or use -db or $BT_ASSIGNED_NUMBERS")
+		}
+		builtin.index()
+		return builtin, nil
+	}
+	// take the top of the repository as well
+	if _, err := os.Stat(filepath.Join(dir, "assigned_numbers")); err == nil {
+		dir = filepath.Join(dir, "assigned_numbers")
+	}
+
+	db := &DB{
+		UUIDs:       make(map[uint32][]Entry),
+		Companies:   make(map[uint16]string),
+		Appearances: make(map[uint16]Appearance),
+		Services:    make(map[int]string),
+		Classes:     make(map[uint32]DeviceClass),
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, uuidDir, "*.yaml"))
+	for _, f := range files {
+		if err := db.loadUUIDs(f); err != nil {
+			return nil, err
+		}
+	}
+	for _, l := range []struct {
+		file string
+		load func(string) error
+	}{
+		{companyFile, db.loadCompanies},
+		{appearanceFile, db.loadAppearance},
+		{codFile, db.loadClasses},
+	} {
+		f := filepath.Join(dir, l.file)
+		if _, err := os.Stat(f); err != nil {
+			continue
+		}
+		files = append(files, f)
+		if err := l.load(f); err != nil {
+			return nil, err
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s: no assigned number yaml files found", dir)
+	}
+	db.index()
+	return db, nil
+}
+
+// the entries Search goes through, the uuids, companies, appearances
+// and device classes each in order of their value
+func (db *DB) index() {
+	db.entries = db.entries[:0]
+	for _, v := range sortedKeys(db.UUIDs) {
+		db.entries = append(db.entries, db.UUIDs[v]...)
+	}
+	for _, v := range sortedKeys(db.Companies) {
+		db.entries = append(db.entries, Entry{Kind: "company", Value: uint32(v), Name: db.Companies[v]})
+	}
+	for _, cat := range sortedKeys(db.Appearances) {
+		a := db.Appearances[cat]
+		db.entries = append(db.entries, Entry{Kind: "appearance", Value: uint32(cat) << 6, Name: a.Name})
+		for _, v := range sortedKeys(a.Sub) {
+			db.entries = append(db.entries, Entry{Kind: "appearance", Value: uint32(cat)<<6 | uint32(v), Name: a.Name + ": " + a.Sub[v]})
+		}
+	}
+	for _, major := range sortedKeys(db.Classes) {
+		db.entries = append(db.entries, Entry{Kind: "class of device", Value: major << 8, Name: db.Classes[major].Name})
+	}
+}
+
+func sortedKeys[K uint16 | uint32 | int, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func readYAML(name string) (map[string]any, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	v, err := parseYAML(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected a mapping at the top", name)
+	}
+	return m, nil
+}
+
+// the list under key, as maps
+func items(m map[string]any, key string) []map[string]any {
+	l, _ := m[key].([]any)
+	var r []map[string]any
+	for _, x := range l {
+		if xm, ok := x.(map[string]any); ok {
+			r = append(r, xm)
+		}
+	}
+	return r
+}
+
+func str(m map[string]any, key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+func num(m map[string]any, key string) (uint32, bool) {
+	v, err := strconv.ParseUint(str(m, key), 0, 32)
+	return uint32(v), err == nil
+}
+
+// service_uuids.yaml is the service table, descriptors.yaml the descriptors
+func (db *DB) loadUUIDs(name string) error {
+	m, err := readYAML(name)
+	if err != nil {
+		return err
+	}
+	kind := strings.TrimSuffix(filepath.Base(name), ".yaml")
+	kind = strings.TrimSuffix(kind, "_uuids")
+	kind = strings.TrimSuffix(kind, "s")
+	kind = strings.ReplaceAll(kind, "_", " ")
+	for _, it := range items(m, "uuids") {
+		v, ok := num(it, "uuid")
+		if !ok {
+			continue
+		}
+		e := Entry{Kind: kind, Value: v, Name: str(it, "name"), ID: str(it, "id")}
+		db.UUIDs[v] = append(db.UUIDs[v], e)
+	}
+	return nil
+}
+
+func (db *DB) loadCompanies(name string) error {
+	m, err := readYAML(name)
+	if err != nil {
+		return err
+	}
+	for _, it := range items(m, "company_identifiers") {
+		v, ok := num(it, "value")
+		if !ok || v > 0xffff {
+			continue
+		}
+		db.Companies[uint16(v)] = str(it, "name")
+	}
+	return nil
+}
+
+// the value is a 10 bit category and a 6 bit subcategory
+func (db *DB) loadAppearance(name string) error {
+	m, err := readYAML(name)
+	if err != nil {
+		return err
+	}
+	for _, it := range items(m, "appearance_values") {
+		cat, ok := num(it, "category")
+		if !ok {
+			continue
+		}
+		a := Appearance{Name: str(it, "name"), Sub: make(map[uint16]string)}
+		for _, sub := range items(it, "subcategory") {
+			v, ok := num(sub, "value")
+			if !ok {
+				continue
+			}
+			a.Sub[uint16(v)] = str(sub, "name")
+		}
+		db.Appearances[uint16(cat)] = a
+	}
+	return nil
+}
+
+// service classes are single bits, the device class is a major number
+// with minor numbers under it; some majors split the minor number
+// (subsplit) into two fields named separately
+func (db *DB) loadClasses(name string) error {
+	m, err := readYAML(name)
+	if err != nil {
+		return err
+	}
+	for _, it := range items(m, "cod_services") {
+		bit, ok := num(it, "bit")
+		if ok {
+			db.Services[int(bit)] = str(it, "name")
+		}
+	}
+	for _, it := range items(m, "cod_device_class") {
+		major, ok := num(it, "major")
+		if !ok {
+			continue
+		}
+		dc := DeviceClass{Name: str(it, "name"), Minor: make(map[uint32]string), Sub: make(map[uint32]string)}
+		if n, ok := num(it, "subsplit"); ok && n < 6 {
+			dc.Split = int(n)
+		}
+		for _, minor := range items(it, "minor") {
+			v, ok := num(minor, "value")
+			if ok {
+				dc.Minor[v] = str(minor, "name")
+			}
+		}
+		for _, sub := range items(it, "subminor") {
+			v, ok := num(sub, "value")
+			if ok {
+				dc.Sub[v] = str(sub, "name")
+			}
+		}
+		db.Classes[major] = dc
+	}
+	return nil
+}
+
+var baseSuffix = "-0000-1000-8000-00805F9B34FB"
+
+// 16 and 32 bit uuids are short forms of xxxxxxxx-0000-1000-8000-00805f9b34fb
+func (db *DB) LookupUUID(s string) ([]Entry, error) {
+	t := strings.ToUpper(strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X"))
+	var hexPart string
+	switch {
+	case len(t) == 36 && t[8] == '-':
+		if t[8:] != baseSuffix {
+			return nil, fmt.Errorf("%s is not in the bluetooth base range, so it is not assigned", s)
+		}
+		hexPart = t[:8]
+	case len(t) <= 8:
+		hexPart = t
+	default:
+		return nil, fmt.Errorf("bad uuid %q", s)
+	}
+	v, err := strconv.ParseUint(hexPart, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("bad uuid %q", s)
+	}
+
+	es := db.UUIDs[uint32(v)]
+	if len(es) == 0 {
+		return nil, fmt.Errorf("uuid 0x%04X is not assigned", v)
+	}
+	return es, nil
+}
+
+func (db *DB) Appearance(v uint16) (string, error) {
+	a, ok := db.Appearances[v>>6]
+	if !ok {
+		return "", fmt.Errorf("appearance category %#x is not assigned", v>>6)
+	}
+	if v&0x3f == 0 {
+		return a.Name, nil
+	}
+	sub, ok := a.Sub[v&0x3f]
+	if !ok {
+		return a.Name, fmt.Errorf("appearance subcategory %#x of %s is not assigned", v&0x3f, a.Name)
+	}
+	return a.Name + ": " + sub, nil
+}
+
+// the 24 bits are service classes 13-23, major class 8-12, minor
+// class 2-7 and a format type of 0 in 0-1
+func (db *DB) ClassOfDevice(v uint32) []string {
+	var s []string
+	if v&3 != 0 {
+		s = append(s, fmt.Sprintf("format type %d is not known", v&3))
+		return s
+	}
+	var bits []int
+	for bit := range db.Services {
+		bits = append(bits, bit)
+	}
+	sort.Ints(bits)
+	for _, bit := range bits {
+		if v&(1<<bit) != 0 {
+			s = append(s, "service: "+db.Services[bit])
+		}
+	}
+
+	major := v >> 8 & 0x1f
+	dc, ok := db.Classes[major]
+	if !ok {
+		s = append(s, fmt.Sprintf("major class %#x is not assigned", major))
+		return s
+	}
+	s = append(s, "major: "+dc.Name)
+
+	minor, sub := v>>2&0x3f, uint32(0)
+	if dc.Split > 0 {
+		low := 6 - dc.Split
+		minor, sub = minor>>low, minor&(1<<low-1)
+	}
+	if name, ok := dc.Minor[minor]; ok {
+		s = append(s, "minor: "+name)
+	} else if len(dc.Minor) > 0 {
+		s = append(s, fmt.Sprintf("minor class %#x is not assigned", minor))
+	}
+	if name, ok := dc.Sub[sub]; ok && dc.Split > 0 {
+		s = append(s, "minor: "+name)
+	}
+	return s
+}
+
+// every kind of assigned number whose name or id contains pattern
+func (db *DB) Search(pattern string) []Entry {
+	p := strings.ToLower(pattern)
+	var es []Entry
+	for _, e := range db.entries {
+		if strings.Contains(strings.ToLower(e.Name), p) || strings.Contains(strings.ToLower(e.ID), p) {
+			es = append(es, e)
+		}
+	}
+	return es
+}
+
+// the lister that used to be hwdb.go's main
+const listCompaniesSrc = `// every assigned identifier, one a line
+func listCompanies(w io.Writer) {
+	for id := 0; ; id++ {
+		str := compidtostr(id)
+		if str == "" || str == "internal use" {
+			break
+		}
+		if str == "not assigned" {
+			continue
+		}
+		fmt.Fprintf(w, "id=%04X vendor=%s\n", id, str)
+	}
+}
+`
+
+// writes compidtostr with the same shape as the hand made one it replaces
+func (db *DB) hwdb() ([]byte, error) {
+	if len(db.Companies) == 0 {
+		return nil, errors.New("no company identifiers loaded")
+	}
+	ids := make([]int, 0, len(db.Companies))
+	for id := range db.Companies {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	w := new(bytes.Buffer)
+	fmt.Fprintln(w, "// the company identifier table, shared by the programs built with it")
+	fmt.Fprintln(w, "// go build hciscan.go hwdb.go linux/hcidev.go")
+	fmt.Fprintln(w, "// go build companies.go hwdb.go")
+	fmt.Fprintln(w, "// generated from assigned_numbers by go generate bt-uuidgen.go")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "package main")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "import (\n\"fmt\"\n\"io\"\n)")
+	fmt.Fprintln(w)
+	w.WriteString(listCompaniesSrc)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "// https://www.bluetooth.com/specifications/assigned-numbers/company-identifiers/")
+	fmt.Fprintln(w, "func compidtostr(compid int) string {")
+	fmt.Fprintln(w, "switch compid {")
+	for _, id := range ids {
+		fmt.Fprintf(w, "case %d:\nreturn %s\n", id, strconv.QuoteToGraphic(db.Companies[uint16(id)]))
+	}
+	if _, ok := db.Companies[0xffff]; !ok {
+		fmt.Fprintf(w, "case 65535:\nreturn \"internal use\"\n")
+	}
+	fmt.Fprintln(w, "default:\nreturn \"not assigned\"\n}\n}")
+	return format.Source(w.Bytes())
+}
+
+// writes assigned.go, which builds the tables in as they were read
+func (db *DB) tables() ([]byte, error) {
+	if len(db.entries) == 0 {
+		return nil, errors.New("no assigned numbers loaded")
+	}
+	w := new(bytes.Buffer)
+	fmt.Fprintln(w, "// the assigned numbers bt-uuidgen looks up without -db")
+	fmt.Fprintln(w, "// go build bt-uuidgen.go assigned.go")
+	fmt.Fprintln(w, "// generated from assigned_numbers by go generate bt-uuidgen.go")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "package main")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "func init() {\nbuiltin = &DB{")
+	fmt.Fprintln(w, "UUIDs: map[uint32][]Entry{")
+	for _, v := range sortedKeys(db.UUIDs) {
+		fmt.Fprintf(w, "0x%04X: {", v)
+		for _, e := range db.UUIDs[v] {
+			fmt.Fprintf(w, "{%q, 0x%04X, %q, %q},", e.Kind, e.Value, e.Name, e.ID)
+		}
+		fmt.Fprintln(w, "},")
+	}
+	fmt.Fprintln(w, "},")
+	fmt.Fprint(w, "Companies: ")
+	writeNames(w, "uint16", db.Companies, "0x%04X")
+	fmt.Fprintln(w, ",")
+	fmt.Fprintln(w, "Appearances: map[uint16]Appearance{")
+	for _, cat := range sortedKeys(db.Appearances) {
+		a := db.Appearances[cat]
+		fmt.Fprintf(w, "0x%03X: {Name: %q", cat, a.Name)
+		if len(a.Sub) > 0 {
+			fmt.Fprint(w, ", Sub: ")
+			writeNames(w, "uint16", a.Sub, "0x%02X")
+		}
+		fmt.Fprintln(w, "},")
+	}
+	fmt.Fprintln(w, "},")
+	fmt.Fprint(w, "Services: ")
+	writeNames(w, "int", db.Services, "%d")
+	fmt.Fprintln(w, ",")
+	fmt.Fprintln(w, "Classes: map[uint32]DeviceClass{")
+	for _, major := range sortedKeys(db.Classes) {
+		dc := db.Classes[major]
+		fmt.Fprintf(w, "0x%02X: {Name: %q", major, dc.Name)
+		if dc.Split > 0 {
+			fmt.Fprintf(w, ", Split: %d", dc.Split)
+		}
+		if len(dc.Minor) > 0 {
+			fmt.Fprint(w, ", Minor: ")
+			writeNames(w, "uint32", dc.Minor, "0x%02X")
+		}
+		if len(dc.Sub) > 0 {
+			fmt.Fprint(w, ", Sub: ")
+			writeNames(w, "uint32", dc.Sub, "0x%02X")
+		}
+		fmt.Fprintln(w, "},")
+	}
+	fmt.Fprintln(w, "},\n}\n}")
+	return format.Source(w.Bytes())
+}
+
+// a map literal of names, one a line
+func writeNames[K uint16 | uint32 | int](w io.Writer, key string, m map[K]string, format string) {
+	fmt.Fprintf(w, "map[%s]string{\n", key)
+	for _, k := range sortedKeys(m) {
+		fmt.Fprintf(w, format+": %q,\n", k, m[k])
+	}
+	fmt.Fprint(w, "}")
+}
+
+// enough yaml for the sig files: block mappings and sequences of
+// scalars, plain or quoted, with # comments
+type yamlLine struct {
+	indent int
+	text   string
+	lineno int
+}
+
+func parseYAML(src string) (any, error) {
+	var lines []yamlLine
+	for i, l := range strings.Split(src, "\n") {
+		l = strings.TrimRight(stripComment(l), " \t\r")
+		t := strings.TrimLeft(l, " ")
+		if t == "" || t == "---" || t == "..." {
+			continue
+		}
+		if strings.HasPrefix(t, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		lines = append(lines, yamlLine{len(l) - len(t), t, i + 1})
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	p := &yamlParser{lines: lines}
+	v, err := p.block(lines[0].indent)
+	if err == nil && p.pos < len(p.lines) {
+		err = fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].lineno)
+	}
+	return v, err
+}
+
+func stripComment(l string) string {
+	var quote byte
+	for i := 0; i < len(l); i++ {
+		c := l[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '#' && (i == 0 || l[i-1] == ' ' || l[i-1] == '\t'):
+			return l[:i]
+		}
+	}
+	return l
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func (p *yamlParser) block(indent int) (any, error) {
+	l := p.lines[p.pos]
+	if l.text == "-" || strings.HasPrefix(l.text, "- ") {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) sequence(indent int) (any, error) {
+	var seq []any
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent != indent || !(l.text == "-" || strings.HasPrefix(l.text, "- ")) {
+			break
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+		if rest == "" {
+			p.pos++
+			if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+				seq = append(seq, nil)
+				continue
+			}
+			v, err := p.block(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			continue
+		}
+
+		// "- key: value" starts a mapping whose keys line up after the dash
+		if _, _, ok := splitKey(rest); ok {
+			inner := indent + len(l.text) - len(rest)
+			p.lines[p.pos] = yamlLine{inner, rest, l.lineno}
+			v, err := p.mapping(inner)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			continue
+		}
+		s, err := scalar(rest)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", l.lineno, err)
+		}
+		seq = append(seq, s)
+		p.pos++
+	}
+	return seq, nil
+}
+
+func (p *yamlParser) mapping(indent int) (any, error) {
+	m := make(map[string]any)
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.lineno)
+		}
+		key, rest, ok := splitKey(l.text)
+		if !ok {
+			if l.text == "-" || strings.HasPrefix(l.text, "- ") {
+				break
+			}
+			return nil, fmt.Errorf("line %d: expected key: value", l.lineno)
+		}
+		p.pos++
+
+		if rest != "" {
+			s, err := scalar(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", l.lineno, err)
+			}
+			m[key] = s
+			continue
+		}
+		// a nested block, or a sequence at the same indentation as the key
+		if p.pos < len(p.lines) {
+			n := p.lines[p.pos]
+			isSeq := n.text == "-" || strings.HasPrefix(n.text, "- ")
+			if n.indent > indent || n.indent == indent && isSeq {
+				v, err := p.block(n.indent)
+				if err != nil {
+					return nil, err
+				}
+				m[key] = v
+				continue
+			}
+		}
+		m[key] = nil
+	}
+	return m, nil
+}
+
+// a key is everything up to the first ": " outside quotes
+func splitKey(s string) (key, rest string, ok bool) {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ':' && (i+1 == len(s) || s[i+1] == ' '):
+			k, err := scalar(strings.TrimSpace(s[:i]))
+			if err != nil {
+				return "", "", false
+			}
+			return k, strings.TrimSpace(s[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+func scalar(s string) (string, error) {
+	switch {
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		return strconv.Unquote(s)
+	case s != "" && (s[0] == '\'' || s[0] == '"'):
+		return "", fmt.Errorf("unterminated string %s", s)
+	case s != "" && (s[0] == '[' || s[0] == '{' || s[0] == '|' || s[0] == '>'):
+		return "", fmt.Errorf("unsupported yaml %s", s)
+	}
+	return s, nil
+}
+
+// numbers on the command line are hex with a 0x, or decimal
+func parseNumber(s string, bits int) (uint64, error) {
+	v, err := strconv.ParseUint(s, 0, bits)
+	if err != nil {
+		return 0, fmt.Errorf("bad number %q", s)
+	}
+	return v, nil
+}
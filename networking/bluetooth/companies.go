@@ -0,0 +1,11 @@
+// lists the bluetooth company identifiers, what hwdb.go did when it
+// was a program of its own
+// go build companies.go hwdb.go
+
+package main
+
+import "os"
+
+func main() {
+	listCompanies(os.Stdout)
+}
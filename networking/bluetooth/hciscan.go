@@ -0,0 +1,1160 @@
+//go:build linux
+// +build linux
+
+// hciscan lists the local hci adapters, runs classic inquiry and le scans
+// over a raw hci socket and keeps an inventory of the devices it hears.
+// it is the scanning companion to linux/l2ping.go and shares its device
+// ioctls from linux/hcidev.go, the file next to l2ping, and takes
+// company names from the table in hwdb.go, so build them together:
+// go build hciscan.go hwdb.go linux/hcidev.go
+// hciscan                        list adapters
+// hciscan -le -active -t 30s -v  le scan for 30 seconds
+// hciscan -inq -le -w scan.log   inquiry and le scan, recorded as btsnoop
+// hciscan -r scan.log            decode a recording, no radio needed
+// recordings are btsnoop files (from -w, btmon -w or an android snoop log)
+// or hex text with one h4 packet per line, like hcidump -R prints.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	intf      = flag.String("i", "hci0", "hci device")
+	inquiry   = flag.Bool("inq", false, "run a classic inquiry")
+	lescan    = flag.Bool("le", false, "run an le scan")
+	active    = flag.Bool("active", false, "le: active scan, asks for scan responses")
+	duration  = flag.Duration("t", 10*time.Second, "how long to scan")
+	readDump  = flag.String("r", "", "decode events from a btsnoop or hex dump instead of a device")
+	writeDump = flag.String("w", "", "record the hci traffic to this btsnoop file")
+	history   = flag.Int("n", 32, "rssi readings kept per device")
+	jsonOut   = flag.Bool("json", false, "print the inventory as json")
+	verbose   = flag.Bool("v", false, "print every report as it is decoded")
+	companies = flag.Bool("companies", false, "list the company identifiers")
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("hciscan: ")
+	flag.Usage = usage
+	flag.Parse()
+
+	switch {
+	case *companies:
+		listCompanies(os.Stdout)
+	case *readDump != "":
+		evs, err := readEvents(*readDump)
+		ck(err)
+		s := newScanner()
+		for _, ev := range evs {
+			s.event(ev)
+		}
+		s.print()
+	case *inquiry || *lescan:
+		hci, err := LookupHCIDevice(*intf)
+		ck(err)
+		s := newScanner()
+		ck(scan(int(hci.DevID), s))
+		s.print()
+	default:
+		ck(adapters())
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: hciscan [options]")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func ck(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+const (
+	HCI_CHANNEL_RAW = 0
+	SOL_HCI         = 0
+	HCI_FILTER      = 2
+)
+
+// addresses go over the air least significant byte first
+func wireBD(b []byte) BD {
+	var bd BD
+	for i := range bd {
+		bd[i] = b[5-i]
+	}
+	return bd
+}
+
+var busNames = []string{"VIRTUAL", "USB", "PCCARD", "UART", "RS232", "PCI", "SDIO", "SPI", "I2C", "SMD", "VIRTIO", "IPC"}
+
+var devFlags = []string{"UP", "INIT", "RUNNING", "PSCAN", "ISCAN", "AUTH", "ENCRYPT", "INQUIRY", "RAW"}
+
+var hciVersions = []string{"1.0b", "1.1", "1.2", "2.0", "2.1", "3.0", "4.0", "4.1", "4.2", "5.0", "5.1", "5.2", "5.3", "5.4", "6.0"}
+
+func adapters() error {
+	fd, err := hciSocket()
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	// struct hci_dev_list_req, a count then {dev_id, dev_opt} pairs
+	const maxDevs = 16
+	buf := make([]byte, 4+8*maxDevs)
+	binary.NativeEndian.PutUint16(buf, maxDevs)
+	err = ioctl(fd, HCIGETDEVLIST, unsafe.Pointer(&buf[0]))
+	if err != nil {
+		return err
+	}
+	n := int(binary.NativeEndian.Uint16(buf))
+	if n == 0 {
+		return errors.New("no adapters")
+	}
+	for i := 0; i < n; i++ {
+		di := HCIDeviceInfo{DevID: binary.NativeEndian.Uint16(buf[4+8*i:])}
+		err = ioctl(fd, HCIGETDEVINFO, unsafe.Pointer(&di))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "hciscan: hci%d: %v\n", di.DevID, err)
+			continue
+		}
+		printAdapter(&di)
+	}
+	return nil
+}
+
+func printAdapter(di *HCIDeviceInfo) {
+	name := string(bytes.TrimRight(di.Name[:], "\x00"))
+	typ := "Primary"
+	if di.Type>>4&3 == 1 {
+		typ = "AMP"
+	}
+	bus := fmt.Sprint(di.Type & 0xf)
+	if int(di.Type&0xf) < len(busNames) {
+		bus = busNames[di.Type&0xf]
+	}
+	fmt.Printf("%s:\tType: %s  Bus: %s\n", name, typ, bus)
+	fmt.Printf("\tBD Address: %s  ACL MTU: %d:%d  SCO MTU: %d:%d\n",
+		wireBD(di.BDAddr[:]), di.AclMtu, di.AclPkts, di.ScoMtu, di.ScoPkts)
+
+	var flags []string
+	for i, f := range devFlags {
+		if di.Flags&(1<<i) != 0 {
+			flags = append(flags, f)
+		}
+	}
+	if di.Flags&1 == 0 {
+		flags = append(flags, "DOWN")
+	}
+	fmt.Printf("\t%s\n", strings.Join(flags, " "))
+
+	s := &di.Stat
+	fmt.Printf("\tRX bytes:%d acl:%d sco:%d events:%d errors:%d\n", s.ByteRx, s.AclRx, s.ScoRx, s.EvtRx, s.ErrRx)
+	fmt.Printf("\tTX bytes:%d acl:%d sco:%d commands:%d errors:%d\n", s.ByteTx, s.AclTx, s.ScoTx, s.CmdTx, s.ErrTx)
+	fmt.Printf("\tFeatures: % #x\n", di.Features[:])
+
+	// the controller only answers while it is up, and needs CAP_NET_RAW
+	if di.Flags&1 != 0 {
+		h, err := openHCI(int(di.DevID))
+		if err == nil {
+			ret, err := h.cmd(ogfInfo, ocfReadLocalVersion, nil)
+			if err == nil && len(ret) >= 9 {
+				ver := fmt.Sprint(ret[1])
+				if int(ret[1]) < len(hciVersions) {
+					ver = hciVersions[ret[1]]
+				}
+				company := binary.LittleEndian.Uint16(ret[5:])
+				fmt.Printf("\tHCI Version: %s (%#x)  Revision: %#x  Manufacturer: %s (%d)\n",
+					ver, ret[1], binary.LittleEndian.Uint16(ret[2:]), compidtostr(int(company)), company)
+			}
+			h.Close()
+		}
+	}
+	fmt.Println()
+}
+
+const (
+	hciCommandPkt = 0x01
+	hciEventPkt   = 0x04
+
+	evInquiryComplete   = 0x01
+	evInquiryResult     = 0x02
+	evCommandComplete   = 0x0e
+	evCommandStatus     = 0x0f
+	evInquiryResultRSSI = 0x22
+	evExtInquiryResult  = 0x2f
+	evLEMeta            = 0x3e
+
+	leAdvReport    = 0x02
+	leExtAdvReport = 0x0d
+
+	ogfLinkCtl = 0x01
+	ogfHostCtl = 0x03
+	ogfInfo    = 0x04
+	ogfLE      = 0x08
+
+	ocfInquiry          = 0x0001
+	ocfInquiryCancel    = 0x0002
+	ocfWriteInquiryMode = 0x0045
+	ocfReadLocalVersion = 0x0001
+	ocfLESetScanParams  = 0x000b
+	ocfLESetScanEnable  = 0x000c
+)
+
+var hciStatus = map[byte]string{
+	0x01: "unknown hci command",
+	0x02: "unknown connection identifier",
+	0x03: "hardware failure",
+	0x0c: "command disallowed",
+	0x0d: "rejected, limited resources",
+	0x11: "unsupported feature or parameter value",
+	0x12: "invalid hci command parameters",
+	0x1f: "unspecified error",
+}
+
+type hciError byte
+
+func (e hciError) Error() string {
+	if s, ok := hciStatus[byte(e)]; ok {
+		return fmt.Sprintf("hci status %#02x (%s)", byte(e), s)
+	}
+	return fmt.Sprintf("hci status %#02x", byte(e))
+}
+
+type Event struct {
+	Time   time.Time
+	Code   byte
+	Params []byte
+}
+
+// an h4 packet is the packet type followed by the event
+func parseH4(t time.Time, b []byte) (*Event, bool) {
+	if len(b) < 1 || b[0] != hciEventPkt {
+		return nil, false
+	}
+	return parseEvent(t, b[1:])
+}
+
+func parseEvent(t time.Time, b []byte) (*Event, bool) {
+	if len(b) < 2 || int(b[1]) > len(b)-2 {
+		return nil, false
+	}
+	return &Event{t, b[0], b[2 : 2+int(b[1])]}, true
+}
+
+type HCI struct {
+	fd      int
+	snoop   *Snoop
+	pending []*Event
+}
+
+func openHCI(dev int) (*HCI, error) {
+	fd, err := hciSocket()
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Bind(fd, &unix.SockaddrHCI{Dev: uint16(dev), Channel: HCI_CHANNEL_RAW})
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	// struct hci_filter, let every event through
+	var filter [16]byte
+	binary.NativeEndian.PutUint32(filter[0:], 1<<hciEventPkt)
+	binary.NativeEndian.PutUint32(filter[4:], 0xffffffff)
+	binary.NativeEndian.PutUint32(filter[8:], 0xffffffff)
+	err = unix.SetsockoptString(fd, SOL_HCI, HCI_FILTER, string(filter[:]))
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &HCI{fd: fd}, nil
+}
+
+func (h *HCI) Close() error {
+	return unix.Close(h.fd)
+}
+
+// nil without an error when nothing arrived in time
+func (h *HCI) read(timeout time.Duration) (*Event, error) {
+	if len(h.pending) > 0 {
+		ev := h.pending[0]
+		h.pending = h.pending[1:]
+		return ev, nil
+	}
+
+	fds := []unix.PollFd{{Fd: int32(h.fd), Events: unix.POLLIN}}
+	n, err := unix.Poll(fds, int(timeout.Milliseconds()))
+	if err == unix.EINTR || n == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1024)
+	n, err = unix.Read(h.fd, buf)
+	if err != nil {
+		return nil, err
+	}
+	t := time.Now()
+	if h.snoop != nil {
+		h.snoop.write(t, buf[:n], true)
+	}
+	ev, _ := parseH4(t, buf[:n])
+	return ev, nil
+}
+
+// sends a command and waits for its complete or status event, the
+// events that come in meanwhile are kept for the next reads
+func (h *HCI) cmd(ogf, ocf uint16, params []byte) ([]byte, error) {
+	op := ogf<<10 | ocf
+	pkt := []byte{hciCommandPkt, byte(op), byte(op >> 8), byte(len(params))}
+	pkt = append(pkt, params...)
+	_, err := unix.Write(h.fd, pkt)
+	if err != nil {
+		return nil, err
+	}
+	if h.snoop != nil {
+		h.snoop.write(time.Now(), pkt, false)
+	}
+
+	var held []*Event
+	defer func() { h.pending = append(h.pending, held...) }()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		fds := []unix.PollFd{{Fd: int32(h.fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, int(time.Until(deadline).Milliseconds())+1)
+		if err == unix.EINTR || n == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 1024)
+		n, err = unix.Read(h.fd, buf)
+		if err != nil {
+			return nil, err
+		}
+		t := time.Now()
+		if h.snoop != nil {
+			h.snoop.write(t, buf[:n], true)
+		}
+		ev, ok := parseH4(t, buf[:n])
+		if !ok {
+			continue
+		}
+
+		p := ev.Params
+		switch {
+		case ev.Code == evCommandComplete && len(p) >= 3 && binary.LittleEndian.Uint16(p[1:]) == op:
+			ret := p[3:]
+			if len(ret) > 0 && ret[0] != 0 {
+				return nil, hciError(ret[0])
+			}
+			return ret, nil
+		case ev.Code == evCommandStatus && len(p) >= 4 && binary.LittleEndian.Uint16(p[2:]) == op:
+			if p[0] != 0 {
+				return nil, hciError(p[0])
+			}
+			return nil, nil
+		}
+		held = append(held, ev)
+	}
+	return nil, fmt.Errorf("command %#04x timed out", op)
+}
+
+func scan(dev int, s *Scanner) error {
+	h, err := openHCI(dev)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	if *writeDump != "" {
+		h.snoop, err = createSnoop(*writeDump)
+		if err != nil {
+			return err
+		}
+		defer h.snoop.Close()
+	}
+
+	if *lescan {
+		// interval and window of 10ms, public address, no whitelist
+		typ := byte(0)
+		if *active {
+			typ = 1
+		}
+		_, err = h.cmd(ogfLE, ocfLESetScanParams, []byte{typ, 0x10, 0x00, 0x10, 0x00, 0, 0})
+		if err != nil {
+			return fmt.Errorf("le set scan parameters: %v", err)
+		}
+		// duplicates are wanted, every report is another rssi reading
+		_, err = h.cmd(ogfLE, ocfLESetScanEnable, []byte{1, 0})
+		if err != nil {
+			return fmt.Errorf("le set scan enable: %v", err)
+		}
+		defer h.cmd(ogfLE, ocfLESetScanEnable, []byte{0, 0})
+	}
+
+	end := time.Now().Add(*duration)
+	inquiring := false
+	startInquiry := func() error {
+		// general inquiry access code, length in units of 1.28s
+		n := min(max(time.Until(end)*100/128/time.Second, 1), 0x30)
+		_, err := h.cmd(ogfLinkCtl, ocfInquiry, []byte{0x33, 0x8b, 0x9e, byte(n), 0})
+		inquiring = err == nil
+		return err
+	}
+	if *inquiry {
+		// results with rssi and extended inquiry response data,
+		// older controllers refuse and send plain results instead
+		h.cmd(ogfHostCtl, ocfWriteInquiryMode, []byte{2})
+		err = startInquiry()
+		if err != nil {
+			return fmt.Errorf("inquiry: %v", err)
+		}
+		defer func() {
+			if inquiring {
+				h.cmd(ogfLinkCtl, ocfInquiryCancel, nil)
+			}
+		}()
+	}
+
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt)
+	defer signal.Stop(sigch)
+	for time.Now().Before(end) {
+		select {
+		case <-sigch:
+			return nil
+		default:
+		}
+
+		ev, err := h.read(min(time.Until(end), 200*time.Millisecond))
+		if err != nil {
+			return err
+		}
+		if ev == nil {
+			continue
+		}
+		s.event(ev)
+
+		// an inquiry runs for a fixed time, keep it going until the end
+		if ev.Code == evInquiryComplete && *inquiry {
+			inquiring = false
+			if time.Until(end) > 2*time.Second {
+				err = startInquiry()
+				if err != nil {
+					return fmt.Errorf("inquiry: %v", err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// seconds from the year 0 to 1970 in microseconds, the btsnoop epoch
+const snoopEpoch = 0x00dcddb30f2f8000
+
+const (
+	snoopH4      = 1001
+	snoopMonitor = 2001
+)
+
+type Snoop struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func createSnoop(name string) (*Snoop, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	s := &Snoop{f: f, w: bufio.NewWriter(f)}
+	s.w.WriteString("btsnoop\x00")
+	binary.Write(s.w, binary.BigEndian, [2]uint32{1, snoopH4})
+	return s, nil
+}
+
+// the flags say which way it went and that it was a command or event
+func (s *Snoop) write(t time.Time, pkt []byte, received bool) {
+	flags := uint32(2)
+	if received {
+		flags |= 1
+	}
+	binary.Write(s.w, binary.BigEndian, struct {
+		Orig, Incl, Flags, Drops uint32
+		Time                     int64
+	}{uint32(len(pkt)), uint32(len(pkt)), flags, 0, t.UnixMicro() + snoopEpoch})
+	s.w.Write(pkt)
+}
+
+func (s *Snoop) Close() error {
+	err := s.w.Flush()
+	if xerr := s.f.Close(); err == nil {
+		err = xerr
+	}
+	return err
+}
+
+func readEvents(name string) ([]*Event, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(b, []byte("btsnoop\x00")) {
+		return readSnoop(b)
+	}
+	return readHex(b)
+}
+
+func readSnoop(b []byte) ([]*Event, error) {
+	if len(b) < 16 {
+		return nil, errors.New("short btsnoop header")
+	}
+	link := binary.BigEndian.Uint32(b[12:])
+	if link != snoopH4 && link != snoopMonitor {
+		return nil, fmt.Errorf("unsupported btsnoop datalink %d", link)
+	}
+
+	var evs []*Event
+	for off := 16; off < len(b); {
+		if off+24 > len(b) {
+			return evs, errors.New("truncated btsnoop record")
+		}
+		incl := int(binary.BigEndian.Uint32(b[off+4:]))
+		flags := binary.BigEndian.Uint32(b[off+8:])
+		usec := int64(binary.BigEndian.Uint64(b[off+16:])) - snoopEpoch
+		off += 24
+		if off+incl > len(b) {
+			return evs, errors.New("truncated btsnoop record")
+		}
+		pkt := b[off : off+incl]
+		off += incl
+
+		t := time.UnixMicro(usec)
+		var ev *Event
+		var ok bool
+		if link == snoopH4 {
+			ev, ok = parseH4(t, pkt)
+		} else if flags&0xffff == 3 {
+			// the btmon format keeps the packet type in the flags
+			ev, ok = parseEvent(t, pkt)
+		}
+		if ok {
+			evs = append(evs, ev)
+		}
+	}
+	return evs, nil
+}
+
+// hcidump -R style, > for received and < for sent, with continuation
+// lines indented, # starts a comment
+func readHex(b []byte) ([]*Event, error) {
+	var pkts [][]byte
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		cont := line[0] == ' ' || line[0] == '\t'
+		line = strings.TrimSpace(line)
+		line = strings.TrimLeft(line, "<> ")
+		data, err := hex.DecodeString(strings.Join(strings.Fields(line), ""))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		if cont && len(pkts) > 0 {
+			pkts[len(pkts)-1] = append(pkts[len(pkts)-1], data...)
+		} else {
+			pkts = append(pkts, data)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	var evs []*Event
+	t := time.Now()
+	for _, p := range pkts {
+		if ev, ok := parseH4(t, p); ok {
+			evs = append(evs, ev)
+		}
+	}
+	return evs, nil
+}
+
+// one sighting of a device, from an inquiry result or an advertisement
+type Report struct {
+	Time     time.Time
+	Addr     BD
+	AddrType string
+	Kind     string
+	RSSI     int // 127 when the controller did not say
+	Class    uint32
+	Data     []byte // extended inquiry response or advertising data
+}
+
+var addrTypes = []string{"public", "random", "public-id", "random-id"}
+
+func addrType(t byte) string {
+	if int(t) < len(addrTypes) {
+		return addrTypes[t]
+	}
+	if t == 0xff {
+		return "anonymous"
+	}
+	return fmt.Sprintf("type%d", t)
+}
+
+var advKinds = []string{"adv_ind", "adv_direct_ind", "adv_scan_ind", "adv_nonconn_ind", "scan_rsp"}
+
+func u24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+var errShortEvent = errors.New("short event")
+
+// the result events carry a count of entries, in practice always one,
+// laid out back to back the way bluez reads them
+func decodeEvent(ev *Event) ([]Report, error) {
+	p := ev.Params
+	var rs []Report
+	switch ev.Code {
+	case evInquiryResult, evInquiryResultRSSI:
+		size := 14
+		if len(p) < 1 || len(p) < 1+int(p[0])*size {
+			return nil, errShortEvent
+		}
+		for i := 0; i < int(p[0]); i++ {
+			e := p[1+i*size:]
+			r := Report{Time: ev.Time, Addr: wireBD(e), AddrType: "br/edr", Kind: "inquiry", RSSI: 127}
+			if ev.Code == evInquiryResult {
+				r.Class = u24(e[9:])
+			} else {
+				r.Class = u24(e[8:])
+				r.RSSI = int(int8(e[13]))
+			}
+			rs = append(rs, r)
+		}
+
+	case evExtInquiryResult:
+		if len(p) < 15 {
+			return nil, errShortEvent
+		}
+		rs = append(rs, Report{
+			Time:     ev.Time,
+			Addr:     wireBD(p[1:]),
+			AddrType: "br/edr",
+			Kind:     "ext_inquiry",
+			Class:    u24(p[9:]),
+			RSSI:     int(int8(p[14])),
+			Data:     p[15:],
+		})
+
+	case evLEMeta:
+		if len(p) < 2 {
+			return nil, errShortEvent
+		}
+		switch p[0] {
+		case leAdvReport:
+			e := p[2:]
+			for i := 0; i < int(p[1]); i++ {
+				if len(e) < 9 || len(e) < 10+int(e[8]) {
+					return rs, errShortEvent
+				}
+				n := int(e[8])
+				kind := fmt.Sprintf("adv_type%d", e[0])
+				if int(e[0]) < len(advKinds) {
+					kind = advKinds[e[0]]
+				}
+				rs = append(rs, Report{
+					Time:     ev.Time,
+					Addr:     wireBD(e[2:]),
+					AddrType: addrType(e[1]),
+					Kind:     kind,
+					RSSI:     int(int8(e[9+n])),
+					Data:     e[9 : 9+n],
+				})
+				e = e[10+n:]
+			}
+
+		case leExtAdvReport:
+			e := p[2:]
+			for i := 0; i < int(p[1]); i++ {
+				if len(e) < 24 || len(e) < 24+int(e[23]) {
+					return rs, errShortEvent
+				}
+				n := int(e[23])
+				props := binary.LittleEndian.Uint16(e)
+				kind := "ext_adv"
+				if props&0x08 != 0 {
+					kind = "ext_scan_rsp"
+				}
+				if props&0x10 != 0 {
+					kind = "legacy_adv"
+					if props&0x08 != 0 {
+						kind = "legacy_scan_rsp"
+					}
+				}
+				rs = append(rs, Report{
+					Time:     ev.Time,
+					Addr:     wireBD(e[3:]),
+					AddrType: addrType(e[2]),
+					Kind:     kind,
+					RSSI:     int(int8(e[13])),
+					Data:     e[24 : 24+n],
+				})
+				e = e[24+n:]
+			}
+		}
+	}
+	return rs, nil
+}
+
+const (
+	adFlags          = 0x01
+	adUUID16Some     = 0x02
+	adUUID16All      = 0x03
+	adUUID32Some     = 0x04
+	adUUID32All      = 0x05
+	adUUID128Some    = 0x06
+	adUUID128All     = 0x07
+	adShortName      = 0x08
+	adName           = 0x09
+	adTxPower        = 0x0a
+	adClass          = 0x0d
+	adServiceData16  = 0x16
+	adAppearance     = 0x19
+	adServiceData32  = 0x20
+	adServiceData128 = 0x21
+	adManufacturer   = 0xff
+)
+
+type ADField struct {
+	Type byte
+	Data []byte
+}
+
+// advertising and eir data are both length, type, value triples,
+// a zero length ends it early
+func parseAD(b []byte) ([]ADField, error) {
+	var fs []ADField
+	for len(b) > 0 {
+		n := int(b[0])
+		if n == 0 {
+			break
+		}
+		if 1+n > len(b) {
+			return fs, errors.New("truncated advertising data")
+		}
+		fs = append(fs, ADField{b[1], b[2 : 1+n]})
+		b = b[1+n:]
+	}
+	return fs, nil
+}
+
+// 16 and 32 bit uuids are shown as numbers, 128 bit ones in full;
+// all of them are sent little endian
+func uuidString(b []byte) string {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[i] = b[len(b)-1-i]
+	}
+	if len(r) != 16 {
+		return fmt.Sprintf("0x%X", r)
+	}
+	return fmt.Sprintf("%X-%X-%X-%X-%X", r[0:4], r[4:6], r[6:8], r[8:10], r[10:16])
+}
+
+func uuidList(b []byte, size int) []string {
+	var us []string
+	for ; len(b) >= size; b = b[size:] {
+		us = append(us, uuidString(b[:size]))
+	}
+	return us
+}
+
+var adFlagNames = []string{"le-limited", "le-general", "no-br/edr", "le+br/edr-controller", "le+br/edr-host"}
+
+func flagString(f byte) string {
+	var s []string
+	for i, name := range adFlagNames {
+		if f&(1<<i) != 0 {
+			s = append(s, name)
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+var majorClasses = []string{"misc", "computer", "phone", "network", "audio/video", "peripheral", "imaging", "wearable", "toy", "health"}
+
+var serviceClasses = []string{"le-audio", "", "positioning", "networking", "rendering", "capturing", "object-transfer", "audio", "telephony", "information"}
+
+func classString(c uint32) string {
+	major := "uncategorized"
+	if m := int(c >> 8 & 0x1f); m < len(majorClasses) {
+		major = majorClasses[m]
+	}
+	var svc []string
+	for i, name := range serviceClasses {
+		if name != "" && c&(1<<(14+i)) != 0 {
+			svc = append(svc, name)
+		}
+	}
+	if c&(1<<13) != 0 {
+		svc = append(svc, "limited-discoverable")
+	}
+	if len(svc) == 0 {
+		return fmt.Sprintf("0x%06x %s", c, major)
+	}
+	return fmt.Sprintf("0x%06x %s [%s]", c, major, strings.Join(svc, ","))
+}
+
+var appearanceCategories = []string{
+	"unknown", "phone", "computer", "watch", "clock", "display", "remote control",
+	"eye-glasses", "tag", "keyring", "media player", "barcode scanner", "thermometer",
+	"heart rate sensor", "blood pressure", "hid", "glucose meter", "running walking sensor",
+	"cycling", "control device", "network device", "sensor", "light fixtures", "fan",
+	"hvac", "air conditioning", "humidifier", "heating", "access control",
+	"motorized device", "power device", "light source", "window covering",
+	"audio sink", "audio source", "motorized vehicle", "domestic appliance",
+	"wearable audio device", "aircraft", "av equipment", "display equipment",
+	"hearing aid", "gaming", "signage",
+}
+
+func appearanceString(a uint16) string {
+	cat := int(a >> 6)
+	if cat < len(appearanceCategories) {
+		return fmt.Sprintf("0x%04x %s", a, appearanceCategories[cat])
+	}
+	return fmt.Sprintf("0x%04x", a)
+}
+
+func company(id uint16) string {
+	return fmt.Sprintf("%s (0x%04x)", compidtostr(int(id)), id)
+}
+
+func describeAD(f ADField) string {
+	d := f.Data
+	switch f.Type {
+	case adFlags:
+		if len(d) > 0 {
+			return "flags " + flagString(d[0])
+		}
+	case adUUID16Some, adUUID16All:
+		return "uuid16 " + strings.Join(uuidList(d, 2), " ")
+	case adUUID32Some, adUUID32All:
+		return "uuid32 " + strings.Join(uuidList(d, 4), " ")
+	case adUUID128Some, adUUID128All:
+		return "uuid128 " + strings.Join(uuidList(d, 16), " ")
+	case adShortName:
+		return fmt.Sprintf("short name %q", d)
+	case adName:
+		return fmt.Sprintf("name %q", d)
+	case adTxPower:
+		if len(d) > 0 {
+			return fmt.Sprintf("tx power %d dBm", int8(d[0]))
+		}
+	case adClass:
+		if len(d) >= 3 {
+			return "class " + classString(u24(d))
+		}
+	case adAppearance:
+		if len(d) >= 2 {
+			return "appearance " + appearanceString(binary.LittleEndian.Uint16(d))
+		}
+	case adServiceData16, adServiceData32, adServiceData128:
+		n := map[byte]int{adServiceData16: 2, adServiceData32: 4, adServiceData128: 16}[f.Type]
+		if len(d) >= n {
+			return fmt.Sprintf("service data %s %x", uuidString(d[:n]), d[n:])
+		}
+	case adManufacturer:
+		if len(d) >= 2 {
+			return fmt.Sprintf("manufacturer %s %x", company(binary.LittleEndian.Uint16(d)), d[2:])
+		}
+	}
+	return fmt.Sprintf("type 0x%02x %x", f.Type, d)
+}
+
+type Reading struct {
+	Time time.Time `json:"time"`
+	RSSI int       `json:"rssi"`
+}
+
+type Manufacturer struct {
+	ID      uint16 `json:"id"`
+	Company string `json:"company"`
+	Data    string `json:"data"`
+}
+
+type Device struct {
+	Addr         string         `json:"addr"`
+	AddrType     string         `json:"addr_type"`
+	Name         string         `json:"name,omitempty"`
+	Class        string         `json:"class,omitempty"`
+	Flags        string         `json:"flags,omitempty"`
+	Appearance   string         `json:"appearance,omitempty"`
+	TxPower      *int           `json:"tx_power,omitempty"`
+	UUIDs        []string       `json:"uuids,omitempty"`
+	Manufacturer []Manufacturer `json:"manufacturer,omitempty"`
+	Kinds        []string       `json:"kinds"`
+	FirstSeen    time.Time      `json:"first_seen"`
+	LastSeen     time.Time      `json:"last_seen"`
+	Reports      int            `json:"reports"`
+	RSSI         []Reading      `json:"rssi"`
+}
+
+func addUnique(list []string, s string) []string {
+	for _, x := range list {
+		if x == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// merges a report in, says whether anything worth showing changed
+func (d *Device) update(r *Report, fields []ADField) bool {
+	changed := false
+	set := func(p *string, v string) {
+		if v != "" && *p != v {
+			*p, changed = v, true
+		}
+	}
+
+	d.Reports++
+	d.LastSeen = r.Time
+	d.Kinds = addUnique(d.Kinds, r.Kind)
+	if r.RSSI != 127 {
+		d.RSSI = append(d.RSSI, Reading{r.Time, r.RSSI})
+		if len(d.RSSI) > *history {
+			d.RSSI = d.RSSI[len(d.RSSI)-*history:]
+		}
+	}
+	if r.Class != 0 {
+		set(&d.Class, classString(r.Class))
+	}
+
+	for _, f := range fields {
+		x := f.Data
+		switch f.Type {
+		case adFlags:
+			if len(x) > 0 {
+				set(&d.Flags, flagString(x[0]))
+			}
+		case adName:
+			set(&d.Name, string(x))
+		case adShortName:
+			// a complete name beats a shortened one
+			if d.Name == "" {
+				set(&d.Name, string(x))
+			}
+		case adUUID16Some, adUUID16All, adUUID32Some, adUUID32All, adUUID128Some, adUUID128All:
+			size := map[byte]int{adUUID16Some: 2, adUUID16All: 2, adUUID32Some: 4, adUUID32All: 4}[f.Type]
+			if size == 0 {
+				size = 16
+			}
+			for _, u := range uuidList(x, size) {
+				if l := addUnique(d.UUIDs, u); len(l) != len(d.UUIDs) {
+					d.UUIDs, changed = l, true
+				}
+			}
+		case adTxPower:
+			if len(x) > 0 {
+				p := int(int8(x[0]))
+				d.TxPower = &p
+			}
+		case adClass:
+			if len(x) >= 3 {
+				set(&d.Class, classString(u24(x)))
+			}
+		case adAppearance:
+			if len(x) >= 2 {
+				set(&d.Appearance, appearanceString(binary.LittleEndian.Uint16(x)))
+			}
+		case adManufacturer:
+			if len(x) < 2 {
+				continue
+			}
+			m := Manufacturer{binary.LittleEndian.Uint16(x), compidtostr(int(binary.LittleEndian.Uint16(x))), hex.EncodeToString(x[2:])}
+			found := false
+			for i := range d.Manufacturer {
+				if d.Manufacturer[i].ID == m.ID {
+					// the data often carries counters, only note a new company
+					d.Manufacturer[i], found = m, true
+				}
+			}
+			if !found {
+				d.Manufacturer = append(d.Manufacturer, m)
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+func (d *Device) rssiStats() (last, lo, hi int, avg float64) {
+	if len(d.RSSI) == 0 {
+		return 127, 127, 127, 127
+	}
+	lo, hi = 127, -128
+	sum := 0
+	for _, r := range d.RSSI {
+		lo, hi = min(lo, r.RSSI), max(hi, r.RSSI)
+		sum += r.RSSI
+	}
+	return d.RSSI[len(d.RSSI)-1].RSSI, lo, hi, float64(sum) / float64(len(d.RSSI))
+}
+
+func (d *Device) summary() string {
+	var s []string
+	if d.Name != "" {
+		s = append(s, fmt.Sprintf("%q", d.Name))
+	}
+	if d.Class != "" {
+		s = append(s, "class "+d.Class)
+	}
+	if d.Appearance != "" {
+		s = append(s, "appearance "+d.Appearance)
+	}
+	for _, m := range d.Manufacturer {
+		s = append(s, m.Company)
+	}
+	if len(d.UUIDs) > 0 {
+		s = append(s, "uuids "+strings.Join(d.UUIDs, ","))
+	}
+	return strings.Join(s, " ")
+}
+
+type Scanner struct {
+	devices map[string]*Device
+	order   []*Device
+	start   time.Time
+}
+
+func newScanner() *Scanner {
+	return &Scanner{devices: make(map[string]*Device)}
+}
+
+func (s *Scanner) event(ev *Event) {
+	rs, err := decodeEvent(ev)
+	if err != nil && *verbose {
+		fmt.Printf("event 0x%02x: %v: % x\n", ev.Code, err, ev.Params)
+	}
+	for i := range rs {
+		s.report(&rs[i])
+	}
+}
+
+func (s *Scanner) report(r *Report) {
+	if s.start.IsZero() {
+		s.start = r.Time
+	}
+	fields, err := parseAD(r.Data)
+
+	if *verbose {
+		fmt.Printf("%8.3f %s %-9s %-15s rssi %4d\n", r.Time.Sub(s.start).Seconds(), r.Addr, r.AddrType, r.Kind, r.RSSI)
+		if r.Class != 0 {
+			fmt.Printf("\tclass %s\n", classString(r.Class))
+		}
+		for _, f := range fields {
+			fmt.Printf("\t%s\n", describeAD(f))
+		}
+		if err != nil {
+			fmt.Printf("\t%v: % x\n", err, r.Data)
+		}
+	}
+
+	// random addresses are a different device from a public one with the same bits
+	key := r.AddrType + " " + r.Addr.String()
+	if r.AddrType == "br/edr" {
+		key = "public " + r.Addr.String()
+	}
+	d := s.devices[key]
+	isNew := d == nil
+	if isNew {
+		d = &Device{Addr: r.Addr.String(), AddrType: r.AddrType, FirstSeen: r.Time}
+		s.devices[key] = d
+		s.order = append(s.order, d)
+	}
+	changed := d.update(r, fields)
+	if *verbose || *jsonOut {
+		return
+	}
+	rssi := "   ?"
+	if r.RSSI != 127 {
+		rssi = fmt.Sprintf("%4d", r.RSSI)
+	}
+	switch {
+	case isNew:
+		fmt.Printf("new     %s %-9s rssi %s %s\n", d.Addr, d.AddrType, rssi, d.summary())
+	case changed:
+		fmt.Printf("update  %s %-9s rssi %s %s\n", d.Addr, d.AddrType, rssi, d.summary())
+	}
+}
+
+func (s *Scanner) print() {
+	// strongest signal first, devices never measured go last
+	devs := append([]*Device(nil), s.order...)
+	sort.SliceStable(devs, func(i, j int) bool {
+		if len(devs[i].RSSI) == 0 || len(devs[j].RSSI) == 0 {
+			return len(devs[j].RSSI) == 0 && len(devs[i].RSSI) > 0
+		}
+		_, _, _, a := devs[i].rssiStats()
+		_, _, _, b := devs[j].rssiStats()
+		return a > b
+	})
+
+	if *jsonOut {
+		if devs == nil {
+			devs = []*Device{}
+		}
+		b, err := json.MarshalIndent(devs, "", "\t")
+		ck(err)
+		fmt.Println(string(b))
+		return
+	}
+
+	fmt.Printf("\n%d devices\n", len(devs))
+	for _, d := range devs {
+		last, lo, hi, avg := d.rssiStats()
+		rssi := "    no rssi      "
+		if len(d.RSSI) > 0 {
+			rssi = fmt.Sprintf("%4d %4d/%6.1f/%4d", last, lo, avg, hi)
+		}
+		fmt.Printf("%s %-9s %s %4dx %s\n", d.Addr, d.AddrType, rssi, d.Reports, d.summary())
+		if *verbose && len(d.RSSI) > 0 {
+			var h []string
+			for _, r := range d.RSSI {
+				h = append(h, fmt.Sprint(r.RSSI))
+			}
+			fmt.Printf("\trssi history %s\n", strings.Join(h, " "))
+		}
+	}
+}
@@ -1,21 +1,26 @@
+// the company identifier table, shared by the programs built with it
+// go build hciscan.go hwdb.go linux/hcidev.go
+// go build companies.go hwdb.go
+// generated from assigned_numbers by go generate bt-uuidgen.go
+
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+)
 
-func main() {
+// every assigned identifier, one a line
+func listCompanies(w io.Writer) {
 	for id := 0; ; id++ {
 		str := compidtostr(id)
-		if str == "" {
-			break
-		}
-		if str == "internal use" {
+		if str == "" || str == "internal use" {
 			break
 		}
-
 		if str == "not assigned" {
 			continue
 		}
-		fmt.Printf("id=%04X vendor=%s\n", id, str)
+		fmt.Fprintf(w, "id=%04X vendor=%s\n", id, str)
 	}
 }
 
@@ -0,0 +1,103 @@
+//go:build linux
+// +build linux
+
+// the hci device ioctls, shared by the programs built with it.
+// go build l2ping.go hcidev.go
+// go build hciscan.go hwdb.go linux/hcidev.go, in ..
+
+package main
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func ior(t, nr, size uintptr) uintptr {
+	return (2 << 30) | (t << 8) | nr | (size << 16)
+}
+
+func iow(t, nr, size uintptr) uintptr {
+	return (1 << 30) | (t << 8) | nr | (size << 16)
+}
+
+var (
+	HCIGETDEVLIST = ior('H', 210, 4)
+	HCIGETDEVINFO = ior('H', 211, 4)
+)
+
+type HCIDeviceInfo struct {
+	DevID uint16
+	Name  [8]byte
+
+	BDAddr [6]uint8
+
+	Flags uint32
+	Type  uint8
+
+	Features [8]uint8
+
+	PktType    uint32
+	LinkPolicy uint32
+	LinkMode   uint32
+
+	AclMtu  uint16
+	AclPkts uint16
+	ScoMtu  uint16
+	ScoPkts uint16
+
+	Stat HCIDeviceStats
+}
+
+type HCIDeviceStats struct {
+	ErrRx  uint32
+	ErrTx  uint32
+	CmdTx  uint32
+	EvtRx  uint32
+	AclTx  uint32
+	AclRx  uint32
+	ScoTx  uint32
+	ScoRx  uint32
+	ByteRx uint32
+	ByteTx uint32
+}
+
+func hciSocket() (int, error) {
+	return unix.Socket(unix.AF_BLUETOOTH, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.BTPROTO_HCI)
+}
+
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// the kernel looks the device up by the id it is handed in di
+func LookupHCIDevice(s string) (di HCIDeviceInfo, err error) {
+	var d int
+	n, _ := fmt.Sscanf(s, "hci%d", &d)
+	if n != 1 {
+		err = fmt.Errorf("Invalid hci device: %s", s)
+		return
+	}
+
+	dd, err := hciSocket()
+	if err != nil {
+		return
+	}
+	defer unix.Close(dd)
+
+	di.DevID = uint16(d)
+	err = ioctl(dd, HCIGETDEVINFO, unsafe.Pointer(&di))
+	return
+}
+
+type BD [6]uint8
+
+func (b BD) String() string {
+	return fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X",
+		b[0], b[1], b[2], b[3], b[4], b[5])
+}
@@ -1,3 +1,6 @@
+// pings a bluetooth device with l2cap echo requests
+// go build l2ping.go hcidev.go
+
 package main
 
 import (
@@ -11,7 +14,6 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
-	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
@@ -212,82 +214,10 @@ func ck(err error) {
 	}
 }
 
-func ior(t, nr, size uintptr) uintptr {
-	return (2 << 30) | (t << 8) | nr | (size << 16)
-}
-
-func iow(t, nr, size uintptr) uintptr {
-	return (1 << 30) | (t << 8) | nr | (size << 16)
-}
-
-var (
-	HCIGETDEVINFO = ior('H', 211, 4)
-)
-
-type HCIDeviceInfo struct {
-	DevID uint16
-	Name  [8]byte
-
-	BDAddr [6]uint8
-
-	Flags uint32
-	Type  uint8
-
-	Features [8]uint8
-
-	PktType    uint32
-	LinkPolicy uint32
-	LinkMode   uint32
-
-	AclMtu  uint16
-	AclPkts uint16
-	ScoMtu  uint16
-	ScoPkts uint16
-
-	Stat HCIDeviceStats
-}
-
-type HCIDeviceStats struct {
-	ErrRx  uint32
-	ErrTx  uint32
-	CmdTx  uint32
-	EvtRx  uint32
-	AclTx  uint32
-	AclRx  uint32
-	ScoTx  uint32
-	ScoRx  uint32
-	ByteRx uint32
-	ByteTx uint32
-}
-
-func LookupHCIDevice(s string) (di HCIDeviceInfo, err error) {
-	var d int
-	n, _ := fmt.Sscanf(s, "hci%d", &d)
-	if n != 1 {
-		err = fmt.Errorf("Invalid hci device: %s", s)
-		return
-	}
-
-	dd, err := unix.Socket(unix.AF_BLUETOOTH, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.BTPROTO_HCI)
-	if err != nil {
-		return
-	}
-	defer unix.Close(dd)
-
-	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(dd), uintptr(HCIGETDEVINFO), uintptr(unsafe.Pointer(&di)))
-	if errno != 0 {
-		err = errno
-	}
-
-	return
-}
-
 const (
 	BDADDRANY = "00:00:00:00:00:00"
 )
 
-type BD [6]uint8
-
 func ParseBD(s string) (BD, error) {
 	var b BD
 	n, _ := fmt.Sscanf(s, "%02x:%02x:%02x:%02x:%02x:%02x",
@@ -298,11 +228,6 @@ func ParseBD(s string) (BD, error) {
 	return b, nil
 }
 
-func (b BD) String() string {
-	return fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X",
-		b[0], b[1], b[2], b[3], b[4], b[5])
-}
-
 type BDAddr struct {
 	BD       BD
 	Protocol string
@@ -1,25 +1,210 @@
+// estimates how long it takes to enumerate devices on a shared bus and
+// assign each one a port, for different bus models and algorithms
+
+// the sweep writes one csv row per sim, channel, device count and speed,
+// means come with confidence intervals and success rates use wilson intervals:
+// broadcast-sim -sim tree,aloha,search -channel ideal,loss -devices 10-100:10 -speed 2500,9600
+
 package main
 
 import (
+	"bufio"
+	"encoding/csv"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"log"
+	"math"
 	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
+var (
+	sims     = flag.String("sim", "sim1", "comma separated enumeration algorithms: sim1, tree, aloha, search")
+	channels = flag.String("channel", "rand", "comma separated channel models: rand, ideal, loss, ber, capture, trace")
+	devices  = flag.String("devices", "100", "device counts, comma separated list or range start-end:step")
+	speeds   = flag.String("speed", "2500", "bus speeds in frames per second, comma separated list or range")
+	iters    = flag.Int("n", 1e4, "iterations per data point")
+	duration = flag.Duration("d", 1*time.Second, "time budget for one enumeration")
+	backoff  = flag.Int("backoff", 8, "maximum backoff exponent for slotted aloha")
+	conf     = flag.Float64("conf", 0.95, "confidence level of the intervals")
+	output   = flag.String("o", "-", "csv output file")
+	seed     = flag.Int64("seed", 0, "random seed, 0 uses the time")
+
+	lossProb  = flag.Float64("loss", 0.01, "loss: probability a frame is lost")
+	ber       = flag.Float64("ber", 1e-4, "ber: bit error rate")
+	crc       = flag.Bool("crc", true, "ber: frames carry a crc so corrupt word frames are detected")
+	threshold = flag.Float64("capture", 6, "capture: power difference in dB for the strongest device to win a collision")
+	spread    = flag.Float64("spread", 6, "capture: standard deviation of the device power in dB")
+	trace     = flag.String("trace", "", "trace: recorded trace file to replay")
+	record    = flag.String("record", "", "record every bus transaction to this file")
+)
+
 func main() {
-	rand.Seed(time.Now().UnixNano())
+	log.SetFlags(0)
+	log.SetPrefix("broadcast-sim: ")
+	flag.Usage = usage
+	flag.Parse()
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	rand.Seed(*seed)
+
+	devs, err := parseList(*devices)
+	ck(err)
+	spds, err := parseList(*speeds)
+	ck(err)
+	for _, n := range devs {
+		if n < 1 || n >= 1<<idBits {
+			log.Fatalf("device count %d out of range", n)
+		}
+	}
+
+	w := os.Stdout
+	if *output != "-" {
+		w, err = os.Create(*output)
+		ck(err)
+	}
+
+	var rec *bufio.Writer
+	if *record != "" {
+		f, err := os.Create(*record)
+		ck(err)
+		defer f.Close()
+		rec = bufio.NewWriter(f)
+		defer rec.Flush()
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{
+		"sim", "channel", "devices", "speed", "trials",
+		"success", "success_lo", "success_hi",
+		"found", "found_ci", "time_ms", "time_ms_ci",
+		"probes", "probes_ci", "probe_miss_rate", "collisions",
+	})
+	z := math.Sqrt2 * math.Erfinv(*conf)
+
+	for _, simName := range strings.Split(*sims, ",") {
+		for _, chName := range strings.Split(*channels, ",") {
+			for _, n := range devs {
+				for _, speed := range spds {
+					sim, err := newSim(simName)
+					ck(err)
+					ch, err := newChannel(chName)
+					ck(err)
+					if rec != nil {
+						ch = &Recorder{Channel: ch, w: rec}
+					}
+
+					opt := &Option{
+						Devices:    n,
+						Iterations: *iters,
+						Duration:   *duration,
+						Speed:      uint64(speed),
+						MaxBackoff: *backoff,
+					}
+					trials, stats := runSims(sim, ch, opt)
+					cw.Write(row(simName, chName, opt, trials, stats, z))
+					cw.Flush()
+				}
+			}
+		}
+	}
+
+	cw.Flush()
+	ck(cw.Error())
+	if w != os.Stdout {
+		ck(w.Close())
+	}
+}
+
+func ck(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: broadcast-sim [options]")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
 
-	opt := &Option{
-		Devices:    100,
-		Iterations: 1e4,
-		Duration:   1 * time.Second,
-		Speed:      2500,
+// accepts 10,20,30 and 10-100:10 or a mix of both
+func parseList(s string) ([]int, error) {
+	var list []int
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		rng, step, hasStep := strings.Cut(f, ":")
+		lo, hi, isRange := strings.Cut(rng, "-")
+		if !isRange {
+			if hasStep {
+				return nil, fmt.Errorf("invalid list element %q", f)
+			}
+			hi = lo
+		}
+
+		a, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid list element %q", f)
+		}
+		b, err := strconv.Atoi(hi)
+		if err != nil {
+			return nil, fmt.Errorf("invalid list element %q", f)
+		}
+		inc := 1
+		if hasStep {
+			inc, err = strconv.Atoi(step)
+			if err != nil || inc < 1 {
+				return nil, fmt.Errorf("invalid list element %q", f)
+			}
+		}
+		for i := a; i <= b; i += inc {
+			list = append(list, i)
+		}
 	}
-	rng := &RandChannel{}
-	sim := &Sim1{}
-	_, stats := runSims(sim, rng, opt)
-	fmt.Println(stats)
+	return list, nil
+}
+
+func newSim(name string) (Sim, error) {
+	switch name {
+	case "sim1":
+		return &Sim1{}, nil
+	case "tree":
+		return &TreeSim{}, nil
+	case "aloha":
+		return &AlohaSim{}, nil
+	case "search":
+		return &SearchSim{}, nil
+	}
+	return nil, fmt.Errorf("unknown sim %q", name)
+}
+
+func newChannel(name string) (Channel, error) {
+	switch name {
+	case "rand":
+		return &RandChannel{}, nil
+	case "ideal":
+		return &IdealChannel{}, nil
+	case "loss":
+		return &LossChannel{Prob: *lossProb}, nil
+	case "ber":
+		return &BERChannel{BER: *ber, CRC: *crc}, nil
+	case "capture":
+		return &CaptureChannel{Threshold: *threshold, Spread: *spread}, nil
+	case "trace":
+		if *trace == "" {
+			return nil, errors.New("trace channel needs -trace")
+		}
+		return &TraceChannel{File: *trace}, nil
+	}
+	return nil, fmt.Errorf("unknown channel %q", name)
 }
 
 var (
@@ -27,13 +212,28 @@ var (
 	ErrInvalidPort = errors.New("invalid port")
 	ErrInvalidAddr = errors.New("invalid address")
 	ErrTimeout     = errors.New("timeout")
+	ErrCorrupt     = errors.New("corrupt")
+	ErrTrace       = errors.New("trace mismatch")
 )
 
+var errNames = []struct {
+	name string
+	err  error
+}{
+	{"collision", ErrCollision},
+	{"invalid_port", ErrInvalidPort},
+	{"invalid_addr", ErrInvalidAddr},
+	{"timeout", ErrTimeout},
+	{"corrupt", ErrCorrupt},
+	{"trace", ErrTrace},
+}
+
 type Option struct {
 	Devices    int
 	Iterations int
 	Duration   time.Duration
 	Speed      uint64
+	MaxBackoff int
 }
 
 type Channel interface {
@@ -42,25 +242,95 @@ type Channel interface {
 	WriteReg(int, int, int, time.Duration) (time.Duration, error)
 }
 
-type RandChannel struct {
+// registers on the broadcast port 0
+const (
+	// read: id of a responding device, write: port<<16|id assigns the port
+	// and mutes the device, 0 unmutes everyone
+	RegProbe = 0
+
+	// write: bits<<16|prefix, only devices whose low id bits match the
+	// prefix answer probes
+	RegSelect = 1
+
+	// write: ModeAll or ModeAloha|maxexp<<8
+	RegMode = 2
+
+	// 1-wire style search, read: id bit and its complement wired-and'ed
+	// over all devices still in the search, write: direction bit, devices
+	// with the other bit drop out
+	RegSearch = 3
+
+	// write: starts a new search with all unmuted devices
+	RegReset = 4
+)
+
+const (
+	// every selected device answers a probe
+	ModeAll = 0
+
+	// devices answer in a slot when their backoff counter runs out and pick
+	// a new one with binary exponential backoff after every attempt
+	ModeAloha = 1
+)
+
+const idBits = 16
+
+// the devices and their registers, the channel models embed it and
+// decide what the master sees when devices answer at the same time
+type Bus struct {
 	id   []int
 	port []int
 	mute []bool
-	tau  time.Duration
+
+	prefix     int
+	prefixBits int
+
+	mode    int
+	maxExp  int
+	backoff []int
+	tries   []int
+
+	active []bool
+	bit    int
+
+	// tau is the time of a 32 bit frame, search bits go at tau/32
+	tau   time.Duration
+	model busModel
 }
 
-func (c *RandChannel) Init(opt *Option) {
-	c.id = make([]int, opt.Devices)
-	c.port = make([]int, len(c.id))
-	c.mute = make([]bool, len(c.id))
-	for i := range c.id {
-		c.id[i] = i + 1
-		c.port[i] = i + 1
+type frame struct {
+	ids       []int
+	val       int
+	bits      int
+	broadcast bool
+	// open drain line, answers combine instead of colliding
+	wired bool
+}
+
+type busModel interface {
+	read(*Bus, *frame) (int, error)
+	write(*Bus, int, int) (int, bool)
+}
+
+func (b *Bus) init(opt *Option, m busModel) {
+	b.id = make([]int, opt.Devices)
+	b.port = make([]int, len(b.id))
+	b.mute = make([]bool, len(b.id))
+	b.backoff = make([]int, len(b.id))
+	b.tries = make([]int, len(b.id))
+	b.active = make([]bool, len(b.id))
+	for i := range b.id {
+		b.id[i] = i + 1
+		b.port[i] = i + 1
 	}
-	c.tau = (1 * time.Second) / time.Duration(opt.Speed)
+	b.prefix, b.prefixBits = 0, 0
+	b.mode, b.maxExp = ModeAll, opt.MaxBackoff
+	b.bit = 0
+	b.tau = (1 * time.Second) / time.Duration(opt.Speed)
+	b.model = m
 }
 
-func (c *RandChannel) lookup(tab []int, val int) int {
+func (b *Bus) lookup(tab []int, val int) int {
 	for i := range tab {
 		if tab[i] == val {
 			return i
@@ -69,68 +339,123 @@ func (c *RandChannel) lookup(tab []int, val int) int {
 	return -1
 }
 
-func (c *RandChannel) randID(muteAllowed bool) int {
-	var pool []int
-	for i := range c.id {
-		if muteAllowed || !c.mute[i] {
-			pool = append(pool, c.id[i])
-		}
-	}
-	if len(pool) == 0 {
-		return -1
-	}
-	return pool[rand.Intn(len(pool))]
+func (b *Bus) selected(i int) bool {
+	mask := 1<<b.prefixBits - 1
+	return !b.mute[i] && b.id[i]&mask == b.prefix&mask
 }
 
-func (c *RandChannel) ReadReg(port, addr int, timeout time.Duration) (val int, elapsed time.Duration, err error) {
-	if c.tau >= timeout {
+func (b *Bus) bitTime() time.Duration {
+	return b.tau / 32
+}
+
+func (b *Bus) ReadReg(port, addr int, timeout time.Duration) (val int, elapsed time.Duration, err error) {
+	elapsed = b.tau
+	if addr == RegSearch && port == 0 {
+		elapsed = 2 * b.bitTime()
+	}
+	if elapsed >= timeout {
 		return -1, timeout, ErrTimeout
 	}
-	elapsed = c.tau
 
-	val = -1
-	switch addr {
-	case 0:
-		if port == 0 {
-			if prob := 1 / float64(len(c.id)+1); rand.Float64() < prob {
-				err = ErrCollision
-			} else {
-				val = c.randID(false)
+	f := &frame{bits: idBits, broadcast: port == 0}
+	switch {
+	case port != 0 && addr == RegProbe:
+		idx := b.lookup(b.port, port)
+		if idx < 0 {
+			return -1, elapsed, ErrInvalidPort
+		}
+		f.ids = []int{b.id[idx]}
+
+	case addr == RegProbe:
+		for i := range b.id {
+			if !b.selected(i) {
+				continue
+			}
+			if b.mode == ModeAloha {
+				if b.backoff[i] > 0 {
+					b.backoff[i]--
+					continue
+				}
+				b.tries[i]++
+				b.backoff[i] = rand.Intn(1 << min(b.tries[i], b.maxExp))
 			}
-		} else if idx := c.lookup(c.port, port); idx >= 0 {
-			val = c.id[idx]
+			f.ids = append(f.ids, b.id[i])
 		}
 
-		if val < 0 && err == nil {
-			err = ErrInvalidPort
+	case port == 0 && addr == RegSearch:
+		f.wired, f.bits, f.val = true, 2, 3
+		for i := range b.id {
+			if b.active[i] {
+				f.ids = append(f.ids, b.id[i])
+				bit := b.id[i] >> b.bit & 1
+				f.val &= bit | (bit^1)<<1
+			}
 		}
 
 	default:
-		err = ErrInvalidAddr
+		return -1, elapsed, ErrInvalidAddr
 	}
 
+	val, err = b.model.read(b, f)
 	return
 }
 
-func (c *RandChannel) WriteReg(port, addr, val int, timeout time.Duration) (elapsed time.Duration, err error) {
-	elapsed = c.tau
+func (b *Bus) WriteReg(port, addr, val int, timeout time.Duration) (elapsed time.Duration, err error) {
+	elapsed = b.tau
+	bits := 32
+	if addr == RegSearch {
+		elapsed, bits = b.bitTime(), 1
+	}
 	if elapsed >= timeout {
 		elapsed = timeout
 		err = ErrTimeout
 	}
+	if port != 0 {
+		return
+	}
+
+	val, ok := b.model.write(b, val, bits)
+	if !ok {
+		return
+	}
 
 	switch addr {
-	case 0:
-		if port == 0 {
-			if val == 0 {
-				for i := range c.mute {
-					c.mute[i] = false
-				}
-			} else if idx := c.lookup(c.id, val&0xffff); idx >= 0 {
-				c.port[idx] = (val >> 16) & 0xffff
-				c.mute[idx] = true
+	case RegProbe:
+		if val == 0 {
+			for i := range b.mute {
+				b.mute[i] = false
+			}
+		} else if idx := b.lookup(b.id, val&0xffff); idx >= 0 {
+			b.port[idx] = (val >> 16) & 0xffff
+			b.mute[idx] = true
+		}
+
+	case RegSelect:
+		b.prefix = val & 0xffff
+		b.prefixBits = min((val>>16)&0xff, idBits)
+
+	case RegMode:
+		b.mode = val & 0xff
+		if exp := val >> 8 & 0xff; exp > 0 {
+			b.maxExp = exp
+		}
+		for i := range b.backoff {
+			b.backoff[i], b.tries[i] = 0, 0
+		}
+
+	case RegSearch:
+		for i := range b.id {
+			if b.active[i] && b.id[i]>>b.bit&1 != val&1 {
+				b.active[i] = false
 			}
 		}
+		b.bit++
+
+	case RegReset:
+		for i := range b.id {
+			b.active[i] = !b.mute[i]
+		}
+		b.bit = 0
 
 	default:
 		err = ErrInvalidAddr
@@ -139,10 +464,330 @@ func (c *RandChannel) WriteReg(port, addr, val int, timeout time.Duration) (elap
 	return
 }
 
+// what a perfect receiver makes of a frame
+func resolve(f *frame) (int, error) {
+	if f.wired {
+		return f.val, nil
+	}
+	switch len(f.ids) {
+	case 0:
+		return -1, ErrTimeout
+	case 1:
+		return f.ids[0], nil
+	}
+	return -1, ErrCollision
+}
+
+// the original model, a broadcast probe collides with probability
+// 1/(devices+1) and otherwise hears one random answering device
+type RandChannel struct {
+	Bus
+}
+
+func (c *RandChannel) Init(opt *Option) {
+	c.init(opt, c)
+}
+
+func (c *RandChannel) read(b *Bus, f *frame) (int, error) {
+	if f.wired || !f.broadcast {
+		return resolve(f)
+	}
+	if len(f.ids) == 0 {
+		return -1, ErrInvalidPort
+	}
+	if prob := 1 / float64(len(b.id)+1); rand.Float64() < prob {
+		return -1, ErrCollision
+	}
+	return f.ids[rand.Intn(len(f.ids))], nil
+}
+
+func (c *RandChannel) write(b *Bus, val, bits int) (int, bool) {
+	return val, true
+}
+
+// perfect collision detection, nothing is lost
+type IdealChannel struct {
+	Bus
+}
+
+func (c *IdealChannel) Init(opt *Option) {
+	c.init(opt, c)
+}
+
+func (c *IdealChannel) read(b *Bus, f *frame) (int, error) {
+	return resolve(f)
+}
+
+func (c *IdealChannel) write(b *Bus, val, bits int) (int, bool) {
+	return val, true
+}
+
+// every frame is lost with probability Prob, a lost answer on the
+// wired line reads as the idle high level
+type LossChannel struct {
+	Bus
+	Prob float64
+}
+
+func (c *LossChannel) Init(opt *Option) {
+	c.init(opt, c)
+}
+
+func (c *LossChannel) read(b *Bus, f *frame) (int, error) {
+	if rand.Float64() < c.Prob {
+		if f.wired {
+			return 1<<f.bits - 1, nil
+		}
+		return -1, ErrTimeout
+	}
+	return resolve(f)
+}
+
+func (c *LossChannel) write(b *Bus, val, bits int) (int, bool) {
+	return val, rand.Float64() >= c.Prob
+}
+
+// flips bits independently with probability BER, with CRC set word
+// frames with errors are detected and dropped, search bits never are
+type BERChannel struct {
+	Bus
+	BER float64
+	CRC bool
+}
+
+func (c *BERChannel) Init(opt *Option) {
+	c.init(opt, c)
+}
+
+func (c *BERChannel) corrupt(val, bits int) (int, bool) {
+	flipped := false
+	for i := 0; i < bits; i++ {
+		if rand.Float64() < c.BER {
+			val ^= 1 << i
+			flipped = true
+		}
+	}
+	return val, flipped
+}
+
+func (c *BERChannel) read(b *Bus, f *frame) (int, error) {
+	val, err := resolve(f)
+	if err != nil {
+		return val, err
+	}
+	val, flipped := c.corrupt(val, f.bits)
+	if flipped && c.CRC && !f.wired {
+		return -1, ErrCorrupt
+	}
+	return val, nil
+}
+
+func (c *BERChannel) write(b *Bus, val, bits int) (int, bool) {
+	val, flipped := c.corrupt(val, bits)
+	return val, !(flipped && c.CRC && bits > 1)
+}
+
+// every device gets a random received power, when devices collide the
+// strongest one is still heard if it beats the next by Threshold dB
+type CaptureChannel struct {
+	Bus
+	Threshold float64
+	Spread    float64
+	power     []float64
+}
+
+func (c *CaptureChannel) Init(opt *Option) {
+	c.init(opt, c)
+	c.power = make([]float64, opt.Devices)
+	for i := range c.power {
+		c.power[i] = rand.NormFloat64() * c.Spread
+	}
+}
+
+func (c *CaptureChannel) read(b *Bus, f *frame) (int, error) {
+	if f.wired || len(f.ids) < 2 {
+		return resolve(f)
+	}
+
+	best, first, second := -1, math.Inf(-1), math.Inf(-1)
+	for _, id := range f.ids {
+		p := c.power[b.lookup(b.id, id)]
+		switch {
+		case p > first:
+			best, first, second = id, p, first
+		case p > second:
+			second = p
+		}
+	}
+	if first-second >= c.Threshold {
+		return best, nil
+	}
+	return -1, ErrCollision
+}
+
+func (c *CaptureChannel) write(b *Bus, val, bits int) (int, bool) {
+	return val, true
+}
+
+// replays a trace written with -record, every init starts the next run
+// in the file and wraps around at the end. the sim has to issue the same
+// transactions as the recording or it gets ErrTrace
+type TraceChannel struct {
+	File string
+	runs [][]traceRecord
+	run  int
+	pos  int
+}
+
+type traceRecord struct {
+	write   bool
+	port    int
+	addr    int
+	val     int
+	elapsed time.Duration
+	err     error
+}
+
+func (c *TraceChannel) Init(opt *Option) {
+	if c.runs == nil {
+		runs, err := loadTrace(c.File)
+		ck(err)
+		c.runs = runs
+		c.run = -1
+	}
+	c.run = (c.run + 1) % len(c.runs)
+	c.pos = 0
+}
+
+func (c *TraceChannel) next(write bool, port, addr, val int) (traceRecord, bool) {
+	recs := c.runs[c.run]
+	if c.pos >= len(recs) {
+		return traceRecord{}, false
+	}
+	r := recs[c.pos]
+	if r.write != write || r.port != port || r.addr != addr || (write && r.val != val) {
+		return traceRecord{}, false
+	}
+	c.pos++
+	return r, true
+}
+
+func (c *TraceChannel) ReadReg(port, addr int, timeout time.Duration) (int, time.Duration, error) {
+	r, ok := c.next(false, port, addr, 0)
+	if !ok {
+		return -1, timeout, ErrTrace
+	}
+	return r.val, r.elapsed, r.err
+}
+
+func (c *TraceChannel) WriteReg(port, addr, val int, timeout time.Duration) (time.Duration, error) {
+	r, ok := c.next(true, port, addr, val)
+	if !ok {
+		return timeout, ErrTrace
+	}
+	return r.elapsed, r.err
+}
+
+// trace lines are
+// init
+// read|write port addr val elapsed_ns error|-
+func loadTrace(name string) ([][]traceRecord, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var runs [][]traceRecord
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] == "init" {
+			runs = append(runs, nil)
+			continue
+		}
+		if len(fields) != 6 || (fields[0] != "read" && fields[0] != "write") || len(runs) == 0 {
+			return nil, fmt.Errorf("%s:%d: malformed trace record", name, line)
+		}
+
+		var r traceRecord
+		var nums [4]int64
+		for i := range nums {
+			nums[i], err = strconv.ParseInt(fields[i+1], 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", name, line, err)
+			}
+		}
+		r.write = fields[0] == "write"
+		r.port, r.addr, r.val = int(nums[0]), int(nums[1]), int(nums[2])
+		r.elapsed = time.Duration(nums[3])
+		if fields[5] != "-" {
+			for _, e := range errNames {
+				if e.name == fields[5] {
+					r.err = e.err
+				}
+			}
+			if r.err == nil {
+				return nil, fmt.Errorf("%s:%d: unknown error %q", name, line, fields[5])
+			}
+		}
+		runs[len(runs)-1] = append(runs[len(runs)-1], r)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 {
+		return nil, fmt.Errorf("%s: empty trace", name)
+	}
+	return runs, nil
+}
+
+// writes every transaction going through a channel in the trace format
+type Recorder struct {
+	Channel
+	w io.Writer
+}
+
+func (r *Recorder) Init(opt *Option) {
+	r.Channel.Init(opt)
+	fmt.Fprintln(r.w, "init")
+}
+
+func (r *Recorder) ReadReg(port, addr int, timeout time.Duration) (int, time.Duration, error) {
+	val, elapsed, err := r.Channel.ReadReg(port, addr, timeout)
+	fmt.Fprintf(r.w, "read %d %d %d %d %s\n", port, addr, val, int64(elapsed), errName(err))
+	return val, elapsed, err
+}
+
+func (r *Recorder) WriteReg(port, addr, val int, timeout time.Duration) (time.Duration, error) {
+	elapsed, err := r.Channel.WriteReg(port, addr, val, timeout)
+	fmt.Fprintf(r.w, "write %d %d %d %d %s\n", port, addr, val, int64(elapsed), errName(err))
+	return elapsed, err
+}
+
+func errName(err error) string {
+	if err == nil {
+		return "-"
+	}
+	for _, e := range errNames {
+		if e.err == err {
+			return e.name
+		}
+	}
+	return "-"
+}
+
 type Sim interface {
 	Run(Channel, *Option) map[string]int
 }
 
+// probes for a fixed share of the time budget, then hands out ports.
+// it relies on devices answering one at a time at random like
+// RandChannel models it, with every device answering at once it
+// only ever sees collisions
 type Sim1 struct {
 	ptt   time.Duration
 	att   time.Duration
@@ -156,15 +801,18 @@ func (s *Sim1) Run(ch Channel, opt *Option) map[string]int {
 	s.devs = make(map[int]int)
 	s.stats = make(map[string]int)
 
-	ch.WriteReg(0, 0, 0, 100*time.Millisecond)
+	ch.WriteReg(0, RegProbe, 0, 100*time.Millisecond)
 
 	for t := time.Duration(0); t < s.ptt; {
-		dev, dt, err := ch.ReadReg(0, 0, 1*time.Second)
+		dev, dt, err := ch.ReadReg(0, RegProbe, 1*time.Second)
 		t += dt
 
 		s.stats["probe_total"]++
 		if err != nil {
 			s.stats["probe_miss"]++
+			if err == ErrCollision {
+				s.stats["collisions"]++
+			}
 			continue
 		}
 
@@ -173,10 +821,14 @@ func (s *Sim1) Run(ch Channel, opt *Option) map[string]int {
 		}
 	}
 
+	// sorted so the transactions are the same from run to run
+	// and a recorded trace can be replayed
+	ids := sortedKeys(s.devs)
+	t := time.Duration(0)
 loop:
-	for t := time.Duration(0); ; {
-		for id, port := range s.devs {
-			dt, _ := ch.WriteReg(0, 0, port<<16|id, 200*time.Millisecond)
+	for len(ids) > 0 {
+		for _, id := range ids {
+			dt, _ := ch.WriteReg(0, RegProbe, s.devs[id]<<16|id, 200*time.Millisecond)
 			t += dt
 			if t >= s.att {
 				break loop
@@ -184,23 +836,253 @@ loop:
 		}
 	}
 
-	s.stats["assigned"] = 0
-	for id, port := range s.devs {
-		aid, _, _ := ch.ReadReg(port, 0, 1*time.Second)
-		if id == aid {
-			s.stats["assigned"]++
+	s.stats["time_us"] = int(opt.Duration / time.Microsecond)
+	verify(ch, s.devs, s.stats, opt)
+	return s.stats
+}
+
+// binary tree splitting, a collision splits the group on the next id bit
+// and both halves are probed again until each one is empty or has one
+// device left, passes repeat until one finds nothing new
+type TreeSim struct {
+	stats map[string]int
+}
+
+type treeNode struct {
+	prefix int
+	bits   int
+}
+
+func (s *TreeSim) Run(ch Channel, opt *Option) map[string]int {
+	s.stats = make(map[string]int)
+	devs := make(map[int]int)
+
+	t, _ := ch.WriteReg(0, RegProbe, 0, 100*time.Millisecond)
+	dt, _ := ch.WriteReg(0, RegMode, ModeAll, 100*time.Millisecond)
+	t += dt
+
+	for progress := true; progress && t < opt.Duration; {
+		progress = false
+		stack := []treeNode{{0, 0}}
+		for len(stack) > 0 && t < opt.Duration {
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			dt, _ := ch.WriteReg(0, RegSelect, n.bits<<16|n.prefix, 100*time.Millisecond)
+			t += dt
+			id, dt, err := ch.ReadReg(0, RegProbe, 1*time.Second)
+			t += dt
+			s.stats["probe_total"]++
+
+			switch err {
+			case nil:
+				if id < 1 || id >= 1<<idBits {
+					break
+				}
+				// seen before means the assignment got lost, send it again
+				if _, found := devs[id]; !found {
+					devs[id] = 0x10 + len(devs)
+				}
+				dt, _ := ch.WriteReg(0, RegProbe, devs[id]<<16|id, 200*time.Millisecond)
+				t += dt
+				progress = true
+
+			case ErrCollision:
+				s.stats["probe_miss"]++
+				s.stats["collisions"]++
+				progress = true
+				if n.bits >= idBits {
+					s.stats["unresolved"]++
+					break
+				}
+				stack = append(stack,
+					treeNode{n.prefix | 1<<n.bits, n.bits + 1},
+					treeNode{n.prefix, n.bits + 1})
+
+			case ErrCorrupt:
+				s.stats["probe_miss"]++
+				progress = true
+				stack = append(stack, n)
+
+			default:
+				s.stats["probe_miss"]++
+			}
+		}
+	}
+
+	s.stats["time_us"] = int(min(t, opt.Duration) / time.Microsecond)
+	verify(ch, devs, s.stats, opt)
+	return s.stats
+}
+
+// slotted aloha, the devices back off on their own and the master keeps
+// probing slots until it has seen enough empty ones in a row that every
+// backoff counter must have run out
+type AlohaSim struct {
+	stats map[string]int
+}
+
+func (s *AlohaSim) Run(ch Channel, opt *Option) map[string]int {
+	s.stats = make(map[string]int)
+	devs := make(map[int]int)
+	maxExp := max(opt.MaxBackoff, 1)
+
+	t, _ := ch.WriteReg(0, RegProbe, 0, 100*time.Millisecond)
+	dt, _ := ch.WriteReg(0, RegSelect, 0, 100*time.Millisecond)
+	t += dt
+	dt, _ = ch.WriteReg(0, RegMode, ModeAloha|maxExp<<8, 100*time.Millisecond)
+	t += dt
+
+	for idle := 0; idle <= 1<<maxExp && t < opt.Duration; {
+		id, dt, err := ch.ReadReg(0, RegProbe, 1*time.Second)
+		t += dt
+		s.stats["probe_total"]++
+
+		switch err {
+		case nil:
+			idle = 0
+			if id < 1 || id >= 1<<idBits {
+				break
+			}
+			if _, found := devs[id]; !found {
+				devs[id] = 0x10 + len(devs)
+			}
+			dt, _ := ch.WriteReg(0, RegProbe, devs[id]<<16|id, 200*time.Millisecond)
+			t += dt
+
+		case ErrCollision:
+			idle = 0
+			s.stats["probe_miss"]++
+			s.stats["collisions"]++
+
+		case ErrTimeout, ErrInvalidPort:
+			idle++
+			s.stats["probe_miss"]++
+
+		default:
+			idle = 0
+			s.stats["probe_miss"]++
 		}
 	}
 
-	if s.stats["assigned"] == len(s.devs) {
-		s.stats["success"] = 1
-	} else {
-		s.stats["fail"] = 1
+	s.stats["time_us"] = int(min(t, opt.Duration) / time.Microsecond)
+	verify(ch, devs, s.stats, opt)
+	return s.stats
+}
+
+// the 1-wire search rom algorithm, every pass walks the id bits and
+// remembers the last bit where it took the zero branch of a discrepancy
+// so the next pass can take the one branch there. ports are handed out
+// once the search is done
+type SearchSim struct {
+	stats map[string]int
+}
+
+func (s *SearchSim) Run(ch Channel, opt *Option) map[string]int {
+	s.stats = make(map[string]int)
+	devs := make(map[int]int)
+
+	t, _ := ch.WriteReg(0, RegProbe, 0, 100*time.Millisecond)
+	last, prev, empty := -1, 0, 0
+
+search:
+	for t < opt.Duration {
+		dt, _ := ch.WriteReg(0, RegReset, 0, 100*time.Millisecond)
+		t += dt
+		s.stats["probe_total"]++
+
+		zero, id := -1, 0
+		for i := 0; i < idBits; i++ {
+			v, dt, err := ch.ReadReg(0, RegSearch, 1*time.Second)
+			t += dt
+			bit, cbit := v&1, v>>1&1
+			if err != nil || (bit == 1 && cbit == 1) {
+				// nobody answered, a few times in a row on the
+				// first bit means there are no devices left
+				s.stats["probe_miss"]++
+				if i == 0 && err == nil {
+					if empty++; empty >= 3 {
+						break search
+					}
+				}
+				continue search
+			}
+
+			dir := bit
+			if bit == cbit {
+				s.stats["collisions"]++
+				switch {
+				case i < last:
+					dir = prev >> i & 1
+				case i == last:
+					dir = 1
+				default:
+					dir = 0
+				}
+				if dir == 0 {
+					zero = i
+				}
+			}
+			dt, _ = ch.WriteReg(0, RegSearch, dir, 1*time.Second)
+			t += dt
+			id |= dir << i
+		}
+		empty = 0
+
+		if _, found := devs[id]; !found {
+			devs[id] = 0x10 + len(devs)
+		}
+		prev, last = id, zero
+		if last < 0 {
+			break
+		}
 	}
 
+	for _, id := range sortedKeys(devs) {
+		dt, _ := ch.WriteReg(0, RegProbe, devs[id]<<16|id, 200*time.Millisecond)
+		t += dt
+	}
+
+	s.stats["time_us"] = int(min(t, opt.Duration) / time.Microsecond)
+	verify(ch, devs, s.stats, opt)
 	return s.stats
 }
 
+// reads back every assigned port, a run only counts as a success if
+// every device was found and every one of them answers on its port.
+// ids that came from corrupt answers don't answer anywhere, so they
+// fail the run too
+func verify(ch Channel, devs map[int]int, stats map[string]int, opt *Option) {
+	stats["assigned"] = 0
+	for _, id := range sortedKeys(devs) {
+		for try := 0; try < 3; try++ {
+			aid, _, err := ch.ReadReg(devs[id], RegProbe, 1*time.Second)
+			if id == aid {
+				stats["assigned"]++
+			}
+			if err == nil || err == ErrInvalidPort {
+				break
+			}
+		}
+	}
+	stats["found"] = len(devs)
+
+	if stats["found"] == opt.Devices && stats["assigned"] == opt.Devices {
+		stats["success"] = 1
+	} else {
+		stats["fail"] = 1
+	}
+}
+
+func sortedKeys(m map[int]int) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
 func runSims(sim Sim, ch Channel, opt *Option) (trials []map[string]int, stats map[string]int) {
 	for i := 0; i < opt.Iterations; i++ {
 		ch.Init(opt)
@@ -211,6 +1093,8 @@ func runSims(sim Sim, ch Channel, opt *Option) (trials []map[string]int, stats m
 	stats["total_trials"] = len(trials)
 	stats["total_probe_miss"] = sumMapInts(trials, "probe_miss")
 	stats["total_probe_total"] = sumMapInts(trials, "probe_total")
+	stats["total_collisions"] = sumMapInts(trials, "collisions")
+	stats["total_found"] = sumMapInts(trials, "found")
 	stats["total_fail"] = sumMapInts(trials, "fail")
 	stats["total_success"] = sumMapInts(trials, "success")
 
@@ -228,3 +1112,52 @@ func sumMapInts(m []map[string]int, key string) int {
 func averageMapInts(m []map[string]int, key string) float64 {
 	return float64(sumMapInts(m, key)) / float64(len(m))
 }
+
+// mean and the half width of its confidence interval
+func meanCI(m []map[string]int, key string, z float64) (mean, ci float64) {
+	n := float64(len(m))
+	if n == 0 {
+		return math.NaN(), math.NaN()
+	}
+	mean = averageMapInts(m, key)
+	if n < 2 {
+		return mean, math.NaN()
+	}
+	var ss float64
+	for i := range m {
+		d := float64(m[i][key]) - mean
+		ss += d * d
+	}
+	return mean, z * math.Sqrt(ss/(n-1)/n)
+}
+
+// wilson score interval, it stays sensible at rates of 0 and 1
+func wilson(k, n int, z float64) (p, lo, hi float64) {
+	if n == 0 {
+		return math.NaN(), math.NaN(), math.NaN()
+	}
+	fn := float64(n)
+	p = float64(k) / fn
+	d := 1 + z*z/fn
+	c := (p + z*z/(2*fn)) / d
+	h := z * math.Sqrt(p*(1-p)/fn+z*z/(4*fn*fn)) / d
+	return p, math.Max(0, c-h), math.Min(1, c+h)
+}
+
+func row(sim, ch string, opt *Option, trials []map[string]int, stats map[string]int, z float64) []string {
+	f := func(x float64) string { return strconv.FormatFloat(x, 'g', 6, 64) }
+
+	p, lo, hi := wilson(stats["total_success"], stats["total_trials"], z)
+	found, foundCI := meanCI(trials, "found", z)
+	us, usCI := meanCI(trials, "time_us", z)
+	probes, probesCI := meanCI(trials, "probe_total", z)
+	miss := float64(stats["total_probe_miss"]) / float64(max(stats["total_probe_total"], 1))
+	coll := averageMapInts(trials, "collisions")
+
+	return []string{
+		sim, ch, strconv.Itoa(opt.Devices), strconv.FormatUint(opt.Speed, 10), strconv.Itoa(len(trials)),
+		f(p), f(lo), f(hi),
+		f(found), f(foundCI), f(us / 1e3), f(usCI / 1e3),
+		f(probes), f(probesCI), f(miss), f(coll),
+	}
+}
@@ -1,14 +1,30 @@
+// sends a dhcp discover and prints the offers that come back,
+// with -full it goes through the whole discover, offer, request, ack
+// exchange and releases the lease afterwards. -server runs a small
+// dhcp server with a lease pool and static reservations instead
+
+// the ports are configurable so client and server can be tried out
+// against each other on loopback without privileges:
+// dhcp-discover -server -l 127.0.0.1:6767 -pool 10.9.0.100-10.9.0.110 -sid 127.0.0.1
+// dhcp-discover -full -l 127.0.0.1:6868 -d 127.0.0.1:6767
+
 package main
 
 import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,11 +35,31 @@ func main() {
 	var opt option
 	flag.DurationVar(&opt.timeout, "t", 3*time.Second, "set timeout")
 	flag.BoolVar(&opt.randmac, "r", false, "use random mac address")
+	flag.BoolVar(&opt.full, "full", false, "do the full discover/offer/request/ack exchange and release the lease")
+	flag.BoolVar(&opt.server, "server", false, "run as a dhcp server")
+	flag.StringVar(&opt.laddr, "l", "", "local address (default 0.0.0.0:68 for the client, 0.0.0.0:67 for the server)")
+	flag.StringVar(&opt.raddr, "d", "255.255.255.255:67", "server address to send requests to")
+
+	flag.StringVar(&opt.pool, "pool", "", "server: address pool, start-end")
+	flag.StringVar(&opt.mask, "mask", "255.255.255.0", "server: subnet mask")
+	flag.StringVar(&opt.router, "router", "", "server: default router")
+	flag.StringVar(&opt.dns, "dns", "", "server: comma separated list of dns servers")
+	flag.StringVar(&opt.domain, "domain", "", "server: domain name")
+	flag.StringVar(&opt.sid, "sid", "", "server: server identifier (default is the local address)")
+	flag.StringVar(&opt.nextServer, "next-server", "", "server: boot server address")
+	flag.StringVar(&opt.bootFile, "boot-file", "", "server: boot file name")
+	flag.DurationVar(&opt.lease, "lease", time.Hour, "server: lease time")
+	flag.Var(&opt.reserve, "reserve", "server: static reservation mac=ip, can be repeated")
 
 	flag.Usage = usage
 	flag.Parse()
 
-	err := discover(opt)
+	var err error
+	if opt.server {
+		err = serve(opt)
+	} else {
+		err = discover(opt)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -38,14 +74,29 @@ func usage() {
 type option struct {
 	timeout time.Duration
 	randmac bool
-}
+	full    bool
+	server  bool
+	laddr   string
+	raddr   string
 
-type result struct {
-	laddr net.Addr
-	raddr net.Addr
-	found bool
+	pool       string
+	mask       string
+	router     string
+	dns        string
+	domain     string
+	sid        string
+	nextServer string
+	bootFile   string
+	lease      time.Duration
+	reserve    reservations
 }
 
+type reservations []string
+
+func (r *reservations) String() string     { return strings.Join(*r, ",") }
+func (r *reservations) Set(s string) error { *r = append(*r, s); return nil }
+
+// fixed part of the message, options follow the magic cookie
 type message struct {
 	Op     uint8
 	Htype  uint8
@@ -54,57 +105,465 @@ type message struct {
 	Xid    uint32
 	Secs   uint16
 	Flags  uint16
-	Ciaddr uint32
-	Yiaddr uint32
-	Siaddr uint32
-	Giaddr uint32
+	Ciaddr [4]byte
+	Yiaddr [4]byte
+	Siaddr [4]byte
+	Giaddr [4]byte
 	Chaddr [16]byte
+	Sname  [64]byte
+	File   [128]byte
 	Magic  uint32
-	Dtype  uint8
-	Cid    [16]byte
-	Mark   uint8
 }
 
-func discover(opt option) error {
-	err := sendpacket(opt)
-	if err != nil {
-		return err
+const (
+	BOOTREQUEST = 1
+	BOOTREPLY   = 2
+
+	MAGIC = 0x63825363
+)
+
+// message types, option 53
+const (
+	DHCPDISCOVER = 1 + iota
+	DHCPOFFER
+	DHCPREQUEST
+	DHCPDECLINE
+	DHCPACK
+	DHCPNAK
+	DHCPRELEASE
+	DHCPINFORM
+)
+
+var msgTypes = []string{
+	DHCPDISCOVER: "DISCOVER",
+	DHCPOFFER:    "OFFER",
+	DHCPREQUEST:  "REQUEST",
+	DHCPDECLINE:  "DECLINE",
+	DHCPACK:      "ACK",
+	DHCPNAK:      "NAK",
+	DHCPRELEASE:  "RELEASE",
+	DHCPINFORM:   "INFORM",
+}
+
+type packet struct {
+	message
+	options []dhcpOption
+}
+
+type dhcpOption struct {
+	code byte
+	data []byte
+}
+
+func (p *packet) marshal() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, p.message)
+	for _, o := range p.options {
+		buf.WriteByte(o.code)
+		buf.WriteByte(byte(len(o.data)))
+		buf.Write(o.data)
 	}
+	buf.WriteByte(255)
 
-	var lns []*net.UDPConn
-	ln, err := net.ListenUDP("udp4", &net.UDPAddr{
-		IP:   net.IPv4zero,
-		Port: 68,
-	})
+	// some old relays and servers drop anything shorter than a bootp packet
+	for buf.Len() < 300 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func unmarshal(b []byte) (*packet, error) {
+	p := new(packet)
+	err := binary.Read(bytes.NewReader(b), binary.BigEndian, &p.message)
 	if err != nil {
-		return err
+		return nil, errors.New("short dhcp packet")
+	}
+	if p.Magic != MAGIC {
+		return nil, errors.New("bad magic cookie")
+	}
+
+	opts := b[binary.Size(p.message):]
+	for len(opts) > 0 {
+		code := opts[0]
+		switch {
+		case code == 0:
+			opts = opts[1:]
+			continue
+		case code == 255:
+			return p, nil
+		case len(opts) < 2 || len(opts) < 2+int(opts[1]):
+			return nil, errors.New("truncated option")
+		}
+
+		// long options are split over several instances (rfc 3396)
+		data := opts[2 : 2+opts[1]]
+		if o := p.option(code); o != nil {
+			o.data = append(o.data, data...)
+		} else {
+			p.options = append(p.options, dhcpOption{code, append([]byte(nil), data...)})
+		}
+		opts = opts[2+len(data):]
+	}
+	return p, nil
+}
+
+func (p *packet) option(code byte) *dhcpOption {
+	for i := range p.options {
+		if p.options[i].code == code {
+			return &p.options[i]
+		}
 	}
-	lns = append(lns, ln)
+	return nil
+}
+
+func (p *packet) add(code byte, data []byte) {
+	p.options = append(p.options, dhcpOption{code, data})
+}
+
+func (p *packet) msgType() byte {
+	o := p.option(53)
+	if o == nil || len(o.data) != 1 {
+		return 0
+	}
+	return o.data[0]
+}
+
+func (p *packet) ip(code byte) net.IP {
+	o := p.option(code)
+	if o == nil || len(o.data) != 4 {
+		return nil
+	}
+	return net.IP(o.data)
+}
 
-	ch := make(chan result)
-	for _, ln := range lns {
-		go fetch(opt, ln, ch)
+func (p *packet) mac() net.HardwareAddr {
+	n := int(p.Hlen)
+	if n > len(p.Chaddr) {
+		n = len(p.Chaddr)
+	}
+	return net.HardwareAddr(p.Chaddr[:n])
+}
+
+func msgTypeName(t byte) string {
+	if int(t) < len(msgTypes) && msgTypes[t] != "" {
+		return msgTypes[t]
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+// option formats
+const (
+	optHex = iota
+	optIP
+	optIPs
+	optU8
+	optU16
+	optU32
+	optTime
+	optString
+	optMsgType
+	optParams
+	optClientID
+	optRoutes
+	optDomains
+	optVendor
+	optRelay
+	optFQDN
+)
+
+var optionInfo = map[byte]struct {
+	name   string
+	format int
+}{
+	1:   {"Subnet mask", optIP},
+	2:   {"Time offset", optU32},
+	3:   {"Router", optIPs},
+	4:   {"Time server", optIPs},
+	6:   {"Domain name server", optIPs},
+	7:   {"Log server", optIPs},
+	12:  {"Host name", optString},
+	13:  {"Boot file size", optU16},
+	15:  {"Domain name", optString},
+	17:  {"Root path", optString},
+	23:  {"Default IP TTL", optU8},
+	26:  {"Interface MTU", optU16},
+	28:  {"Broadcast address", optIP},
+	33:  {"Static route", optIPs},
+	40:  {"NIS domain", optString},
+	41:  {"NIS servers", optIPs},
+	42:  {"NTP servers", optIPs},
+	43:  {"Vendor specific", optVendor},
+	44:  {"NetBIOS name server", optIPs},
+	46:  {"NetBIOS node type", optU8},
+	47:  {"NetBIOS scope", optString},
+	50:  {"Requested IP address", optIP},
+	51:  {"Lease time", optTime},
+	52:  {"Option overload", optU8},
+	53:  {"Message type", optMsgType},
+	54:  {"Server identifier", optIP},
+	55:  {"Parameter request list", optParams},
+	56:  {"Message", optString},
+	57:  {"Maximum message size", optU16},
+	58:  {"Renewal time", optTime},
+	59:  {"Rebinding time", optTime},
+	60:  {"Vendor class identifier", optString},
+	61:  {"Client identifier", optClientID},
+	64:  {"NIS+ domain", optString},
+	66:  {"TFTP server name", optString},
+	67:  {"Bootfile name", optString},
+	69:  {"SMTP server", optIPs},
+	77:  {"User class", optHex},
+	81:  {"Client FQDN", optFQDN},
+	82:  {"Relay agent information", optRelay},
+	93:  {"Client system architecture", optU16},
+	94:  {"Client network interface", optHex},
+	97:  {"Client machine identifier", optHex},
+	100: {"Timezone (POSIX)", optString},
+	101: {"Timezone (tz database)", optString},
+	114: {"Captive portal", optString},
+	119: {"Domain search", optDomains},
+	121: {"Classless static route", optRoutes},
+	150: {"TFTP server address", optIPs},
+	249: {"Classless static route (Microsoft)", optRoutes},
+	252: {"Proxy autodiscovery", optString},
+}
+
+func optionName(code byte) string {
+	if info, ok := optionInfo[code]; ok {
+		return info.name
+	}
+	return "Unknown"
+}
+
+func (p *packet) print(w io.Writer) {
+	fmt.Fprintf(w, "Op                       %v\n", p.Op)
+	fmt.Fprintf(w, "Transaction ID           %#08x\n", p.Xid)
+	fmt.Fprintf(w, "Seconds                  %v\n", p.Secs)
+	fmt.Fprintf(w, "Flags                    %#04x\n", p.Flags)
+	fmt.Fprintf(w, "Client address           %v\n", net.IP(p.Ciaddr[:]))
+	fmt.Fprintf(w, "Your address             %v\n", net.IP(p.Yiaddr[:]))
+	fmt.Fprintf(w, "Next server address      %v\n", net.IP(p.Siaddr[:]))
+	fmt.Fprintf(w, "Relay agent address      %v\n", net.IP(p.Giaddr[:]))
+	fmt.Fprintf(w, "Client hardware address  %v\n", p.mac())
+	if s := cstring(p.Sname[:]); s != "" {
+		fmt.Fprintf(w, "Server host name         %v\n", s)
+	}
+	if s := cstring(p.File[:]); s != "" {
+		fmt.Fprintf(w, "Boot file                %v\n", s)
+	}
+
+	vendor := ""
+	if o := p.option(60); o != nil {
+		vendor = string(o.data)
+	}
+	for _, o := range p.options {
+		fmt.Fprintf(w, "Option %-3d %-30s %s\n", o.code, optionName(o.code), formatOption(o, vendor))
+	}
+}
+
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func formatOption(o dhcpOption, vendor string) string {
+	d := o.data
+	format := optHex
+	if info, ok := optionInfo[o.code]; ok {
+		format = info.format
+	}
+
+	switch format {
+	case optIP:
+		if len(d) == 4 {
+			return net.IP(d).String()
+		}
+	case optIPs:
+		if len(d)%4 == 0 {
+			var ips []string
+			for ; len(d) > 0; d = d[4:] {
+				ips = append(ips, net.IP(d[:4]).String())
+			}
+			return strings.Join(ips, " ")
+		}
+	case optU8:
+		if len(d) == 1 {
+			return strconv.Itoa(int(d[0]))
+		}
+	case optU16:
+		if len(d) == 2 {
+			return strconv.Itoa(int(binary.BigEndian.Uint16(d)))
+		}
+	case optU32:
+		if len(d) == 4 {
+			return strconv.Itoa(int(int32(binary.BigEndian.Uint32(d))))
+		}
+	case optTime:
+		if len(d) == 4 {
+			secs := binary.BigEndian.Uint32(d)
+			if secs == 0xffffffff {
+				return "infinite"
+			}
+			return (time.Duration(secs) * time.Second).String()
+		}
+	case optString:
+		return strconv.Quote(string(d))
+	case optMsgType:
+		if len(d) == 1 {
+			return msgTypeName(d[0])
+		}
+	case optParams:
+		var names []string
+		for _, c := range d {
+			names = append(names, fmt.Sprintf("%d(%s)", c, optionName(c)))
+		}
+		return strings.Join(names, " ")
+	case optClientID:
+		if len(d) == 7 && d[0] == 1 {
+			return "ethernet " + net.HardwareAddr(d[1:]).String()
+		}
+	case optRoutes:
+		if s, ok := formatRoutes(d); ok {
+			return s
+		}
+	case optDomains:
+		if s, ok := formatDomains(d); ok {
+			return s
+		}
+	case optVendor:
+		// pxe clients and servers use encapsulated options (pxe spec 2.1)
+		if strings.HasPrefix(vendor, "PXEClient") {
+			if s, ok := formatSubOptions(d, pxeSubOptions); ok {
+				return s
+			}
+		}
+	case optRelay:
+		if s, ok := formatSubOptions(d, relaySubOptions); ok {
+			return s
+		}
+	case optFQDN:
+		if len(d) >= 3 {
+			return fmt.Sprintf("flags %#02x %q", d[0], d[3:])
+		}
 	}
+	return fmt.Sprintf("% x", d)
+}
+
+var pxeSubOptions = map[byte]string{
+	6:   "discovery control",
+	8:   "boot servers",
+	9:   "boot menu",
+	10:  "menu prompt",
+	71:  "boot item",
+	255: "end",
+}
 
-	var res []result
-	for range lns {
-		r := <-ch
-		if !r.found {
+var relaySubOptions = map[byte]string{
+	1:   "circuit id",
+	2:   "remote id",
+	5:   "link selection",
+	6:   "subscriber id",
+	9:   "vendor specific",
+	11:  "server identifier override",
+	151: "vss",
+}
+
+func formatSubOptions(d []byte, names map[byte]string) (string, bool) {
+	var subs []string
+	for len(d) > 0 {
+		code := d[0]
+		if code == 255 {
+			break
+		}
+		if code == 0 {
+			d = d[1:]
 			continue
 		}
-		res = append(res, r)
+		if len(d) < 2 || len(d) < 2+int(d[1]) {
+			return "", false
+		}
+		data := d[2 : 2+d[1]]
+		name := names[code]
+		if name == "" {
+			name = strconv.Itoa(int(code))
+		}
+		if printable(data) {
+			subs = append(subs, fmt.Sprintf("[%s %q]", name, data))
+		} else {
+			subs = append(subs, fmt.Sprintf("[%s % x]", name, data))
+		}
+		d = d[2+len(data):]
 	}
-	if len(res) == 0 {
-		return fmt.Errorf("no response received")
+	return strings.Join(subs, " "), true
+}
+
+func printable(b []byte) bool {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
 	}
+	return len(b) > 0
+}
 
-	for i, r := range res {
-		fmt.Printf("Response %v of %v", i+1, len(res))
-		fmt.Printf("Local address %v\n", r.laddr)
-		fmt.Printf("Remote address %v\n", r.raddr)
+// rfc 3442, the destination is only as long as the prefix needs
+func formatRoutes(d []byte) (string, bool) {
+	var routes []string
+	for len(d) > 0 {
+		bits := int(d[0])
+		n := (bits + 7) / 8
+		if bits > 32 || len(d) < 1+n+4 {
+			return "", false
+		}
+		var dst [4]byte
+		copy(dst[:], d[1:1+n])
+		gw := net.IP(d[1+n : 1+n+4])
+		routes = append(routes, fmt.Sprintf("%v/%d via %v", net.IP(dst[:]), bits, gw))
+		d = d[1+n+4:]
 	}
+	return strings.Join(routes, ", "), true
+}
 
-	return nil
+// rfc 3397, dns encoded names with compression relative to the option
+func formatDomains(d []byte) (string, bool) {
+	var names []string
+	for off := 0; off < len(d); {
+		var labels []string
+		end := -1
+		p := off
+		for hops := 0; ; hops++ {
+			if p >= len(d) || hops > 64 {
+				return "", false
+			}
+			l := int(d[p])
+			if l == 0 {
+				if end < 0 {
+					end = p + 1
+				}
+				break
+			}
+			if l&0xc0 == 0xc0 {
+				if p+1 >= len(d) {
+					return "", false
+				}
+				if end < 0 {
+					end = p + 2
+				}
+				p = (l&0x3f)<<8 | int(d[p+1])
+				continue
+			}
+			if p+1+l > len(d) {
+				return "", false
+			}
+			labels = append(labels, string(d[p+1:p+1+l]))
+			p += 1 + l
+		}
+		names = append(names, strings.Join(labels, "."))
+		off = end
+	}
+	return strings.Join(names, " "), true
 }
 
 func rand4() uint32 {
@@ -116,20 +575,45 @@ func rand4() uint32 {
 
 func genmac() (mac [6]byte, err error) {
 	_, err = rand.Read(mac[:])
+	// locally administered unicast
+	mac[0] = mac[0]&^1 | 2
 	return
 }
 
-func sendpacket(opt option) error {
-	conn, err := net.DialUDP("udp4",
-		&net.UDPAddr{
-			IP:   net.IPv4zero,
-			Port: 68,
-		},
-		&net.UDPAddr{
-			IP:   net.IPv4bcast,
-			Port: 67,
-		},
-	)
+func newRequest(typ byte, xid uint32, mac [6]byte) *packet {
+	p := &packet{message: message{
+		Op:    BOOTREQUEST,
+		Htype: 1,
+		Hlen:  6,
+		Xid:   xid,
+		Flags: 0x8000,
+		Magic: MAGIC,
+	}}
+	copy(p.Chaddr[:], mac[:])
+
+	p.add(53, []byte{typ})
+	p.add(61, append([]byte{1}, mac[:]...))
+	return p
+}
+
+var requestParams = []byte{1, 3, 6, 12, 15, 26, 28, 42, 43, 51, 54, 58, 59, 60, 66, 67, 119, 121}
+
+func discover(opt option) error {
+	if opt.laddr == "" {
+		opt.laddr = "0.0.0.0:68"
+	}
+	laddr, err := net.ResolveUDPAddr("udp4", opt.laddr)
+	if err != nil {
+		return err
+	}
+	raddr, err := net.ResolveUDPAddr("udp4", opt.raddr)
+	if err != nil {
+		return err
+	}
+
+	// one socket for sending and receiving so no reply can slip
+	// in between, go turns on SO_BROADCAST for udp sockets
+	conn, err := net.ListenUDP("udp4", laddr)
 	if err != nil {
 		return err
 	}
@@ -137,54 +621,520 @@ func sendpacket(opt option) error {
 
 	mac := [6]byte{0xde, 0xad, 0xc0, 0xde, 0xca, 0xfe}
 	if opt.randmac {
-		var err error
 		mac, err = genmac()
 		if err != nil {
 			return err
 		}
 	}
 
-	msg := message{
-		Op:    1,
-		Htype: 1,
-		Hlen:  6,
-		Xid:   rand4(),
-		Secs:  0,
-		Flags: 0x8000,
-		Magic: 0x63825363,
-		Dtype: 1,
-		Mark:  0xff,
+	xid := rand4()
+	req := newRequest(DHCPDISCOVER, xid, mac)
+	req.add(55, requestParams)
+	req.add(57, []byte{0x05, 0xdc})
+	err = send(conn, raddr, req)
+	if err != nil {
+		return err
 	}
-	copy(msg.Chaddr[:], mac[:])
-	copy(msg.Cid[:], mac[:])
 
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.BigEndian, msg)
-	_, err = conn.Write(buf.Bytes())
+	if !opt.full {
+		n := 0
+		deadline := time.Now().Add(opt.timeout)
+		for {
+			p, from, err := receive(conn, xid, deadline, DHCPOFFER)
+			if err != nil {
+				break
+			}
+			n++
+			fmt.Printf("Response %v\n", n)
+			fmt.Printf("Local address %v\n", conn.LocalAddr())
+			fmt.Printf("Remote address %v\n", from)
+			p.print(os.Stdout)
+			fmt.Println()
+		}
+		if n == 0 {
+			return fmt.Errorf("no response received")
+		}
+		return nil
+	}
+
+	offer, from, err := receive(conn, xid, time.Now().Add(opt.timeout), DHCPOFFER)
+	if err != nil {
+		return fmt.Errorf("no offer received: %v", err)
+	}
+	fmt.Printf("OFFER from %v\n", from)
+	offer.print(os.Stdout)
+	fmt.Println()
+
+	sid := offer.ip(54)
+	if sid == nil {
+		return fmt.Errorf("offer without server identifier")
+	}
+	yiaddr := net.IP(offer.Yiaddr[:])
+
+	req = newRequest(DHCPREQUEST, xid, mac)
+	req.add(50, yiaddr.To4())
+	req.add(54, sid.To4())
+	req.add(55, requestParams)
+	err = send(conn, raddr, req)
+	if err != nil {
+		return err
+	}
+
+	ack, from, err := receive(conn, xid, time.Now().Add(opt.timeout), DHCPACK, DHCPNAK)
+	if err != nil {
+		return fmt.Errorf("no ack received: %v", err)
+	}
+	fmt.Printf("%v from %v\n", msgTypeName(ack.msgType()), from)
+	ack.print(os.Stdout)
+	fmt.Println()
+	if ack.msgType() == DHCPNAK {
+		return fmt.Errorf("request for %v refused", yiaddr)
+	}
+
+	// the release goes straight to the server that gave us the lease
+	rel := newRequest(DHCPRELEASE, rand4(), mac)
+	rel.Flags = 0
+	copy(rel.Ciaddr[:], ack.Yiaddr[:])
+	rel.add(54, sid.To4())
+	err = send(conn, from, rel)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("RELEASE of %v sent to %v\n", net.IP(ack.Yiaddr[:]), from)
+	return nil
+}
 
+func send(conn *net.UDPConn, addr *net.UDPAddr, p *packet) error {
+	_, err := conn.WriteToUDP(p.marshal(), addr)
 	return err
 }
 
-func fetch(opt option, ln *net.UDPConn, ch chan result) {
-	r := result{
-		laddr: ln.LocalAddr(),
-		found: true,
+// waits for a reply to our transaction of one of the given types
+func receive(conn *net.UDPConn, xid uint32, deadline time.Time, types ...byte) (*packet, *net.UDPAddr, error) {
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, 4096)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		p, err := unmarshal(buf[:n])
+		if err != nil || p.Op != BOOTREPLY || p.Xid != xid {
+			continue
+		}
+		for _, t := range types {
+			if p.msgType() == t {
+				return p, from, nil
+			}
+		}
+	}
+}
+
+type server struct {
+	mu       sync.Mutex
+	conn     *net.UDPConn
+	opt      option
+	sid      net.IP
+	start    uint32
+	end      uint32
+	mask     net.IP
+	router   net.IP
+	dns      []net.IP
+	leases   map[string]*lease
+	byIP     map[uint32]*lease
+	reserved map[string]uint32
+}
+
+type lease struct {
+	mac     string
+	ip      uint32
+	expiry  time.Time
+	bound   bool
+	decline bool
+}
+
+func ip2int(ip net.IP) uint32 {
+	ip = ip.To4()
+	if ip == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(ip)
+}
+
+func int2ip(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+func parseIP4(s, what string) (net.IP, error) {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid %s %q", what, s)
+	}
+	return ip, nil
+}
+
+func newServer(opt option) (*server, error) {
+	s := &server{
+		opt:      opt,
+		leases:   make(map[string]*lease),
+		byIP:     make(map[uint32]*lease),
+		reserved: make(map[string]uint32),
+	}
+
+	i := strings.Index(opt.pool, "-")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid pool %q, want start-end", opt.pool)
+	}
+	start, err := parseIP4(opt.pool[:i], "pool start")
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseIP4(opt.pool[i+1:], "pool end")
+	if err != nil {
+		return nil, err
+	}
+	s.start, s.end = ip2int(start), ip2int(end)
+	if s.start > s.end {
+		return nil, fmt.Errorf("invalid pool %q", opt.pool)
+	}
+
+	s.mask, err = parseIP4(opt.mask, "subnet mask")
+	if err != nil {
+		return nil, err
+	}
+	if opt.router != "" {
+		s.router, err = parseIP4(opt.router, "router")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opt.dns != "" {
+		for _, d := range strings.Split(opt.dns, ",") {
+			ip, err := parseIP4(strings.TrimSpace(d), "dns server")
+			if err != nil {
+				return nil, err
+			}
+			s.dns = append(s.dns, ip)
+		}
 	}
 
-	defer func() {
-		ln.Close()
-		ch <- r
-	}()
+	for _, r := range opt.reserve {
+		i := strings.Index(r, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid reservation %q, want mac=ip", r)
+		}
+		mac, err := net.ParseMAC(r[:i])
+		if err != nil {
+			return nil, err
+		}
+		ip, err := parseIP4(r[i+1:], "reserved address")
+		if err != nil {
+			return nil, err
+		}
+		s.reserved[mac.String()] = ip2int(ip)
+	}
+	return s, nil
+}
 
-	ln.SetReadDeadline(time.Now().Add(opt.timeout))
+func serve(opt option) error {
+	if opt.laddr == "" {
+		opt.laddr = "0.0.0.0:67"
+	}
+	s, err := newServer(opt)
+	if err != nil {
+		return err
+	}
+
+	laddr, err := net.ResolveUDPAddr("udp4", opt.laddr)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case opt.sid != "":
+		s.sid, err = parseIP4(opt.sid, "server identifier")
+		if err != nil {
+			return err
+		}
+	case !laddr.IP.IsUnspecified() && laddr.IP != nil:
+		s.sid = laddr.IP.To4()
+	default:
+		s.sid = localAddrFor(int2ip(s.start))
+		if s.sid == nil {
+			return fmt.Errorf("can't find an interface on the pool network, use -sid")
+		}
+	}
+
+	s.conn, err = net.ListenUDP("udp4", laddr)
+	if err != nil {
+		return err
+	}
+	defer s.conn.Close()
+	log.Printf("serving %v-%v on %v as %v", int2ip(s.start), int2ip(s.end), s.conn.LocalAddr(), s.sid)
 
 	buf := make([]byte, 4096)
-	_, raddr, err := ln.ReadFromUDP(buf)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+
+		p, err := unmarshal(buf[:n])
+		if err != nil {
+			log.Printf("%v: %v", from, err)
+			continue
+		}
+		if p.Op != BOOTREQUEST {
+			continue
+		}
+		s.handle(p, from)
+	}
+}
+
+func localAddrFor(ip net.IP) net.IP {
+	addrs, err := net.InterfaceAddrs()
 	if err != nil {
-		r.found = false
+		return nil
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil && n.Contains(ip) {
+			return n.IP.To4()
+		}
+	}
+	return nil
+}
+
+func (s *server) handle(req *packet, from *net.UDPAddr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mac := req.mac().String()
+	typ := req.msgType()
+	log.Printf("%v from %v (%v)", msgTypeName(typ), mac, from)
+
+	var reply *packet
+	switch typ {
+	case DHCPDISCOVER:
+		ip := s.allocate(mac, ip2int(req.ip(50)))
+		if ip == 0 {
+			log.Printf("pool exhausted, no offer for %v", mac)
+			return
+		}
+		reply = s.reply(req, DHCPOFFER, ip)
+
+	case DHCPREQUEST:
+		// a request naming another server means our offer was turned down
+		if sid := req.ip(54); sid != nil && !sid.Equal(s.sid) {
+			s.free(mac, false)
+			return
+		}
+
+		want := ip2int(req.ip(50))
+		if want == 0 {
+			want = ip2int(net.IP(req.Ciaddr[:]))
+		}
+		l := s.leases[mac]
+		if l == nil || l.ip != want {
+			// after a restart we don't know the client, give it the address
+			// if it is free so renewals don't fail needlessly
+			if want == 0 || s.allocate(mac, want) != want {
+				reply = s.reply(req, DHCPNAK, 0)
+				break
+			}
+			l = s.leases[mac]
+		}
+		l.bound = true
+		l.expiry = time.Now().Add(s.opt.lease)
+		reply = s.reply(req, DHCPACK, l.ip)
+
+	case DHCPDECLINE:
+		// somebody else is using the address, keep it out of the pool
+		if l := s.leases[mac]; l != nil {
+			delete(s.leases, mac)
+			l.mac, l.decline = "", true
+			l.expiry = time.Now().Add(s.opt.lease)
+		}
+		return
+
+	case DHCPRELEASE:
+		s.free(mac, true)
+		return
+
+	case DHCPINFORM:
+		reply = s.reply(req, DHCPACK, 0)
+
+	default:
 		return
 	}
-	r.raddr = raddr
 
-	return
+	s.send(req, reply, from)
+}
+
+// picks an address for the client, reservations come first, then any lease
+// it already has, then the address it asked for and last the first free one
+func (s *server) allocate(mac string, want uint32) uint32 {
+	now := time.Now()
+	if ip, ok := s.reserved[mac]; ok {
+		return s.bind(mac, ip, now)
+	}
+	if l := s.leases[mac]; l != nil {
+		l.expiry = maxTime(l.expiry, now.Add(s.opt.timeout))
+		return l.ip
+	}
+
+	if s.available(want, now) {
+		return s.bind(mac, want, now)
+	}
+	for ip := s.start; ip <= s.end && ip != 0; ip++ {
+		if s.available(ip, now) {
+			return s.bind(mac, ip, now)
+		}
+	}
+	return 0
+}
+
+func (s *server) available(ip uint32, now time.Time) bool {
+	if ip < s.start || ip > s.end || ip == ip2int(s.sid) {
+		return false
+	}
+	for _, r := range s.reserved {
+		if r == ip {
+			return false
+		}
+	}
+	l := s.byIP[ip]
+	return l == nil || now.After(l.expiry)
+}
+
+func (s *server) bind(mac string, ip uint32, now time.Time) uint32 {
+	if old := s.byIP[ip]; old != nil && old.mac != "" {
+		delete(s.leases, old.mac)
+	}
+
+	// an offer is held for a while before the address goes back to the pool
+	l := &lease{mac: mac, ip: ip, expiry: now.Add(maxDuration(s.opt.timeout, 10*time.Second))}
+	s.leases[mac] = l
+	s.byIP[ip] = l
+	return ip
+}
+
+func (s *server) free(mac string, bound bool) {
+	l := s.leases[mac]
+	if l == nil || (l.bound && !bound) {
+		return
+	}
+	log.Printf("freeing %v from %v", int2ip(l.ip), mac)
+	delete(s.leases, mac)
+	delete(s.byIP, l.ip)
+}
+
+func (s *server) reply(req *packet, typ byte, ip uint32) *packet {
+	p := &packet{message: message{
+		Op:     BOOTREPLY,
+		Htype:  req.Htype,
+		Hlen:   req.Hlen,
+		Xid:    req.Xid,
+		Flags:  req.Flags,
+		Giaddr: req.Giaddr,
+		Chaddr: req.Chaddr,
+		Magic:  MAGIC,
+	}}
+	p.add(53, []byte{typ})
+	p.add(54, s.sid.To4())
+	if typ == DHCPNAK {
+		p.add(56, []byte("requested address not available"))
+		return p
+	}
+
+	if typ == DHCPACK && ip == 0 {
+		// inform, the client already has an address
+		p.Ciaddr = req.Ciaddr
+	} else {
+		binary.BigEndian.PutUint32(p.Yiaddr[:], ip)
+		secs := uint32(s.opt.lease / time.Second)
+		p.add(51, be32(secs))
+		p.add(58, be32(secs/2))
+		p.add(59, be32(secs/8*7))
+	}
+
+	p.add(1, s.mask)
+	if s.router != nil {
+		p.add(3, s.router)
+	}
+	if len(s.dns) > 0 {
+		var d []byte
+		for _, ip := range s.dns {
+			d = append(d, ip...)
+		}
+		p.add(6, d)
+	}
+	if s.opt.domain != "" {
+		p.add(15, []byte(s.opt.domain))
+	}
+	if s.opt.nextServer != "" {
+		if ip := net.ParseIP(s.opt.nextServer).To4(); ip != nil {
+			copy(p.Siaddr[:], ip)
+		}
+		p.add(66, []byte(s.opt.nextServer))
+	}
+	if s.opt.bootFile != "" {
+		copy(p.File[:], s.opt.bootFile)
+		p.add(67, []byte(s.opt.bootFile))
+	}
+
+	// only send what was asked for, plus the options every client needs
+	if prl := req.option(55); prl != nil {
+		var opts []dhcpOption
+		for _, o := range p.options {
+			if o.code == 53 || o.code == 54 || o.code == 51 || bytes.IndexByte(prl.data, o.code) >= 0 {
+				opts = append(opts, o)
+			}
+		}
+		p.options = opts
+	}
+	sort.SliceStable(p.options, func(i, j int) bool { return p.options[i].code == 53 && p.options[j].code != 53 })
+	return p
+}
+
+// rfc 2131 4.1, we can't unicast to a client without an address since
+// that needs an arp entry, so that falls back to a broadcast
+func (s *server) send(req, reply *packet, from *net.UDPAddr) {
+	var to *net.UDPAddr
+	switch {
+	case req.Giaddr != [4]byte{}:
+		to = &net.UDPAddr{IP: net.IP(req.Giaddr[:]), Port: 67}
+	case !from.IP.IsUnspecified():
+		to = from
+	default:
+		to = &net.UDPAddr{IP: net.IPv4bcast, Port: from.Port}
+	}
+
+	log.Printf("%v %v to %v", msgTypeName(reply.msgType()), net.IP(reply.Yiaddr[:]), to)
+	_, err := s.conn.WriteToUDP(reply.marshal(), to)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func be32(n uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	return b[:]
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
 }
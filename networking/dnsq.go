@@ -0,0 +1,2363 @@
+// dig-like dns query tool, it builds and parses the messages itself so
+// any server can be asked and everything that came back is shown:
+// dnsq [options] [@server] name [type] [class] [+option ...]
+// dnsq -x 192.0.2.1
+// dnsq +trace www.example.com
+// dnsq +tls @1.1.1.1 example.com aaaa
+// it can also be a small authoritative server for zone files, answering
+// over udp and tcp, and over tls with -serve-tls:
+// dnsq -serve 127.0.0.1:5300 -zone example.zone
+// dnsq -p 5300 @127.0.0.1 www.example.com
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	port      = flag.String("p", "", "server port (default 53, 853 with +tls)")
+	reverse   = flag.String("x", "", "reverse lookup of this address")
+	qtypeArg  = flag.String("t", "", "query type")
+	qclassArg = flag.String("c", "", "query class")
+	rootArg   = flag.String("root", "", "trace: comma separated servers to start at instead of the root hints")
+	serve     = flag.String("serve", "", "serve zones on this address over udp and tcp")
+	serveTLS  = flag.String("serve-tls", "", "serve zones over tls on this address")
+	certFile  = flag.String("cert", "", "server: tls certificate")
+	keyFile   = flag.String("key", "", "server: tls key")
+	zoneFiles stringList
+)
+
+type stringList []string
+
+func (s *stringList) String() string     { return strings.Join(*s, ",") }
+func (s *stringList) Set(v string) error { *s = append(*s, v); return nil }
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("dnsq: ")
+	flag.Var(&zoneFiles, "zone", "server: zone file to serve, can be repeated")
+	flag.Usage = usage
+	flag.Parse()
+
+	if *serve != "" || *serveTLS != "" {
+		ck(server())
+		return
+	}
+
+	o := &Options{
+		Proto:   "udp",
+		Recurse: true,
+		EDNS:    true,
+		BufSize: 1232,
+		Timeout: 5 * time.Second,
+		Tries:   3,
+	}
+	host, names := "", []string{}
+	qtype, qclass := uint16(0), uint16(classIN)
+	for args := flag.Args(); len(args) > 0; {
+		a := args[0]
+		args = args[1:]
+		switch {
+		case strings.HasPrefix(a, "-") && len(a) > 1:
+			// flags can come between the other arguments, as with dig
+			flag.CommandLine.Parse(append([]string{a}, args...))
+			args = flag.Args()
+		case strings.HasPrefix(a, "@"):
+			host = a[1:]
+		case strings.HasPrefix(a, "+"):
+			ck(o.set(a[1:]))
+		default:
+			// like dig, a type or class only counts after the name
+			named := len(names) > 0 || *reverse != ""
+			if t, ok := parseType(a); ok && named {
+				qtype = t
+			} else if c, ok := parseClass(a); ok && named {
+				qclass = c
+			} else {
+				names = append(names, a)
+			}
+		}
+	}
+	if *qtypeArg != "" {
+		t, ok := parseType(*qtypeArg)
+		if !ok {
+			log.Fatalf("unknown type %q", *qtypeArg)
+		}
+		qtype = t
+	}
+	if *qclassArg != "" {
+		c, ok := parseClass(*qclassArg)
+		if !ok {
+			log.Fatalf("unknown class %q", *qclassArg)
+		}
+		qclass = c
+	}
+	if *reverse != "" {
+		name, err := reverseName(*reverse)
+		ck(err)
+		names = append(names, name)
+		if qtype == 0 {
+			qtype = typePTR
+		}
+	}
+	if len(names) == 0 {
+		names = append(names, ".")
+		if qtype == 0 {
+			qtype = typeNS
+		}
+	}
+	if qtype == 0 {
+		qtype = typeA
+	}
+
+	c, err := o.client()
+	ck(err)
+
+	status := 0
+	for _, name := range names {
+		if o.Trace {
+			err = trace(c, o, name, qtype, qclass)
+		} else {
+			err = query(c, o, host, name, qtype, qclass)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dnsq: %s: %v\n", name, err)
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
+
+func ck(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: dnsq [options] [@server] name [type] [class] [+option ...]")
+	fmt.Fprintln(os.Stderr, "       dnsq -serve address -zone file ...")
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "query options, +no turns them off:")
+	fmt.Fprintln(os.Stderr, "  +tcp +tls +tls-ca=file +tls-hostname=name +[no]rec +[no]edns +bufsize=n")
+	fmt.Fprintln(os.Stderr, "  +dnssec +nsid +cookie +adflag +cdflag +ignore +time=s +tries=n")
+	fmt.Fprintln(os.Stderr, "  +trace +short +json")
+	os.Exit(2)
+}
+
+type Options struct {
+	Proto    string // udp, tcp or tls
+	Recurse  bool
+	EDNS     bool
+	BufSize  uint16
+	DNSSEC   bool
+	NSID     bool
+	Cookie   bool
+	AD       bool
+	CD       bool
+	IgnoreTC bool
+	Trace    bool
+	Short    bool
+	JSON     bool
+	Timeout  time.Duration
+	Tries    int
+	TLSCA    string
+	TLSHost  string
+}
+
+func (o *Options) set(opt string) error {
+	val := ""
+	if i := strings.IndexByte(opt, '='); i >= 0 {
+		opt, val = opt[:i], opt[i+1:]
+	}
+	on := true
+	if strings.HasPrefix(opt, "no") {
+		opt, on = opt[2:], false
+	}
+	num := func(bits int) (uint64, error) {
+		n, err := strconv.ParseUint(val, 10, bits)
+		if err != nil {
+			return 0, fmt.Errorf("+%s: bad value %q", opt, val)
+		}
+		return n, nil
+	}
+
+	switch opt {
+	case "tcp", "vc":
+		if on {
+			o.Proto = "tcp"
+		} else if o.Proto == "tcp" {
+			o.Proto = "udp"
+		}
+	case "tls":
+		if on {
+			o.Proto = "tls"
+		} else if o.Proto == "tls" {
+			o.Proto = "udp"
+		}
+	case "tls-ca":
+		o.Proto, o.TLSCA = "tls", val
+	case "tls-hostname":
+		o.Proto, o.TLSHost = "tls", val
+	case "rec", "recurse":
+		o.Recurse = on
+	case "edns":
+		o.EDNS = on
+	case "bufsize":
+		n, err := num(16)
+		if err != nil {
+			return err
+		}
+		o.BufSize, o.EDNS = uint16(n), true
+	case "dnssec":
+		o.DNSSEC = on
+		o.EDNS = o.EDNS || on
+	case "nsid":
+		o.NSID = on
+		o.EDNS = o.EDNS || on
+	case "cookie":
+		o.Cookie = on
+		o.EDNS = o.EDNS || on
+	case "adflag":
+		o.AD = on
+	case "cdflag":
+		o.CD = on
+	case "ignore":
+		o.IgnoreTC = on
+	case "trace":
+		o.Trace = on
+	case "short":
+		o.Short = on
+	case "json":
+		o.JSON = on
+	case "time":
+		n, err := num(16)
+		if err != nil {
+			return err
+		}
+		o.Timeout = time.Duration(n) * time.Second
+	case "tries":
+		n, err := num(8)
+		if err != nil || n == 0 {
+			return fmt.Errorf("+tries: bad value %q", val)
+		}
+		o.Tries = int(n)
+	default:
+		return fmt.Errorf("unknown option +%s", opt)
+	}
+	return nil
+}
+
+func (o *Options) client() (*Client, error) {
+	c := &Client{
+		Proto:    o.Proto,
+		Timeout:  o.Timeout,
+		Tries:    o.Tries,
+		IgnoreTC: o.IgnoreTC,
+		Notify:   os.Stdout,
+	}
+	if o.JSON || o.Short {
+		c.Notify = os.Stderr
+	}
+	if o.Proto == "tls" {
+		c.TLS = &tls.Config{ServerName: o.TLSHost}
+		if o.TLSCA != "" {
+			pem, err := os.ReadFile(o.TLSCA)
+			if err != nil {
+				return nil, err
+			}
+			c.TLS.RootCAs = x509.NewCertPool()
+			if !c.TLS.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("%s: no certificates found", o.TLSCA)
+			}
+		}
+	}
+	return c, nil
+}
+
+func (o *Options) port() string {
+	if *port != "" {
+		return *port
+	}
+	if o.Proto == "tls" {
+		return "853"
+	}
+	return "53"
+}
+
+func (o *Options) query(name string, qtype, qclass uint16) *Message {
+	m := &Message{
+		ID:               uint16(rand.Uint32()),
+		RecursionDesired: o.Recurse,
+		AuthenticData:    o.AD,
+		CheckingDisabled: o.CD,
+		Question:         []Question{{fqdn(name), qtype, qclass}},
+	}
+	if o.EDNS {
+		m.EDNS = &EDNS{UDPSize: o.BufSize, DO: o.DNSSEC}
+		if o.NSID {
+			m.EDNS.Options = append(m.EDNS.Options, EDNSOption{optNSID, nil})
+		}
+		if o.Cookie {
+			cookie := make([]byte, 8)
+			binary.BigEndian.PutUint64(cookie, rand.Uint64())
+			m.EDNS.Options = append(m.EDNS.Options, EDNSOption{optCookie, cookie})
+		}
+	}
+	return m
+}
+
+func query(c *Client, o *Options, host, name string, qtype, qclass uint16) error {
+	if host == "" {
+		host = systemServer()
+	}
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		addr = net.JoinHostPort(host, o.port())
+	}
+
+	q := o.query(name, qtype, qclass)
+	start := time.Now()
+	r, err := c.Exchange(q, addr)
+	if err != nil {
+		return err
+	}
+	r.RTT = time.Since(start)
+
+	switch {
+	case o.JSON:
+		return printJSON(r)
+	case o.Short:
+		printShort(r.Msg)
+	default:
+		fmt.Printf("\n; <<>> dnsq <<>> %s\n", strings.Join(os.Args[1:], " "))
+		printDig(r)
+	}
+	return nil
+}
+
+// the first nameserver in resolv.conf, like dig
+func systemServer() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return fields[1]
+		}
+	}
+	return "127.0.0.1"
+}
+
+func reverseName(addr string) (string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", fmt.Errorf("%q is not an ip address", addr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", ip4[3], ip4[2], ip4[1], ip4[0]), nil
+	}
+	var sb strings.Builder
+	const digits = "0123456789abcdef"
+	for i := len(ip) - 1; i >= 0; i-- {
+		sb.WriteByte(digits[ip[i]&0xf])
+		sb.WriteByte('.')
+		sb.WriteByte(digits[ip[i]>>4])
+		sb.WriteByte('.')
+	}
+	sb.WriteString("ip6.arpa.")
+	return sb.String(), nil
+}
+
+const (
+	typeA     = 1
+	typeNS    = 2
+	typeCNAME = 5
+	typeSOA   = 6
+	typePTR   = 12
+	typeMX    = 15
+	typeTXT   = 16
+	typeAAAA  = 28
+	typeSRV   = 33
+	typeOPT   = 41
+	typeANY   = 255
+	typeCAA   = 257
+
+	classIN  = 1
+	classCH  = 3
+	classHS  = 4
+	classANY = 255
+
+	optNSID   = 3
+	optCookie = 10
+)
+
+const (
+	rcodeNoError  = 0
+	rcodeFormErr  = 1
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeNotImp   = 4
+	rcodeRefused  = 5
+	rcodeBadVers  = 16
+)
+
+// the rdata layout of each type, one letter per field:
+// a ipv4 address, 6 ipv6 address, n compressible name, N name,
+// 1 2 4 unsigned integers of that many bytes, s character string,
+// S one or more character strings to the end, t character string
+// shown bare, v the rest of the rdata as a quoted string
+var types = map[uint16]struct {
+	name   string
+	layout string
+}{
+	typeA:     {"A", "a"},
+	typeNS:    {"NS", "n"},
+	typeCNAME: {"CNAME", "n"},
+	typeSOA:   {"SOA", "nn44444"},
+	typePTR:   {"PTR", "n"},
+	typeMX:    {"MX", "2n"},
+	typeTXT:   {"TXT", "S"},
+	typeAAAA:  {"AAAA", "6"},
+	typeSRV:   {"SRV", "222N"},
+	typeOPT:   {"OPT", ""},
+	typeANY:   {"ANY", ""},
+	typeCAA:   {"CAA", "1tv"},
+}
+
+var classes = map[uint16]string{
+	classIN:  "IN",
+	classCH:  "CH",
+	classHS:  "HS",
+	classANY: "ANY",
+}
+
+var rcodes = map[int]string{
+	rcodeNoError:  "NOERROR",
+	rcodeFormErr:  "FORMERR",
+	rcodeServFail: "SERVFAIL",
+	rcodeNXDomain: "NXDOMAIN",
+	rcodeNotImp:   "NOTIMP",
+	rcodeRefused:  "REFUSED",
+	6:             "YXDOMAIN",
+	7:             "YXRRSET",
+	8:             "NXRRSET",
+	9:             "NOTAUTH",
+	10:            "NOTZONE",
+	rcodeBadVers:  "BADVERS",
+}
+
+var opcodes = []string{"QUERY", "IQUERY", "STATUS", "OPCODE3", "NOTIFY", "UPDATE"}
+
+func typeString(t uint16) string {
+	if i, ok := types[t]; ok {
+		return i.name
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+func classString(c uint16) string {
+	if s, ok := classes[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("CLASS%d", c)
+}
+
+func rcodeString(r int) string {
+	if s, ok := rcodes[r]; ok {
+		return s
+	}
+	return fmt.Sprintf("RCODE%d", r)
+}
+
+func opcodeString(o int) string {
+	if o < len(opcodes) {
+		return opcodes[o]
+	}
+	return fmt.Sprintf("OPCODE%d", o)
+}
+
+// the names above, or the rfc 3597 TYPEnnn and CLASSnnn forms
+func parseType(s string) (uint16, bool) {
+	return parseMnemonic(s, "TYPE", func(t uint16) string { return types[t].name }, types)
+}
+
+func parseClass(s string) (uint16, bool) {
+	return parseMnemonic(s, "CLASS", func(c uint16) string { return classes[c] }, classes)
+}
+
+func parseMnemonic[V any](s, prefix string, name func(uint16) string, table map[uint16]V) (uint16, bool) {
+	s = strings.ToUpper(s)
+	for k := range table {
+		if name(k) == s {
+			return k, true
+		}
+	}
+	if strings.HasPrefix(s, prefix) {
+		n, err := strconv.ParseUint(s[len(prefix):], 10, 16)
+		if err == nil {
+			return uint16(n), true
+		}
+	}
+	return 0, false
+}
+
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// rdata is kept in presentation form, one string per field,
+// the same whether it came off the wire or out of a zone file
+type RR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []string
+}
+
+func (rr *RR) String() string {
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", rr.Name, rr.TTL, classString(rr.Class), typeString(rr.Type), strings.Join(rr.Data, " "))
+}
+
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+type EDNS struct {
+	UDPSize uint16
+	Version uint8
+	DO      bool
+	Options []EDNSOption
+}
+
+type Message struct {
+	ID                 uint16
+	Response           bool
+	Opcode             int
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	AuthenticData      bool
+	CheckingDisabled   bool
+	Rcode              int // with the extended bits from edns
+	Question           []Question
+	Answer             []RR
+	Authority          []RR
+	Additional         []RR
+	EDNS               *EDNS
+}
+
+func (m *Message) flags() []string {
+	var f []string
+	for _, x := range []struct {
+		set  bool
+		name string
+	}{
+		{m.Response, "qr"},
+		{m.Authoritative, "aa"},
+		{m.Truncated, "tc"},
+		{m.RecursionDesired, "rd"},
+		{m.RecursionAvailable, "ra"},
+		{m.AuthenticData, "ad"},
+		{m.CheckingDisabled, "cd"},
+	} {
+		if x.set {
+			f = append(f, x.name)
+		}
+	}
+	return f
+}
+
+var (
+	errTruncated = errors.New("message truncated")
+	errLoop      = errors.New("name compression loop")
+)
+
+type builder struct {
+	buf   []byte
+	names map[string]int
+}
+
+func (b *builder) u16(v uint16) { b.buf = binary.BigEndian.AppendUint16(b.buf, v) }
+func (b *builder) u32(v uint32) { b.buf = binary.BigEndian.AppendUint32(b.buf, v) }
+
+// names are compressed against every earlier name in the message when
+// allowed, and always remembered so later ones can point at them
+func (b *builder) name(name string, compress bool) error {
+	ls, err := labels(name)
+	if err != nil {
+		return err
+	}
+	for i := range ls {
+		key := strings.ToLower(strings.Join(ls[i:], "\x00"))
+		if off, ok := b.names[key]; ok && compress {
+			b.u16(0xc000 | uint16(off))
+			return nil
+		}
+		if len(b.buf) < 0x3fff {
+			b.names[key] = len(b.buf)
+		}
+		b.buf = append(b.buf, byte(len(ls[i])))
+		b.buf = append(b.buf, ls[i]...)
+	}
+	b.buf = append(b.buf, 0)
+	return nil
+}
+
+func (b *builder) cstring(s []byte) error {
+	if len(s) > 255 {
+		return errors.New("character string longer than 255 bytes")
+	}
+	b.buf = append(b.buf, byte(len(s)))
+	b.buf = append(b.buf, s...)
+	return nil
+}
+
+func (b *builder) rr(rr *RR) error {
+	err := b.name(rr.Name, true)
+	if err != nil {
+		return err
+	}
+	b.u16(rr.Type)
+	b.u16(rr.Class)
+	b.u32(rr.TTL)
+	at := len(b.buf)
+	b.u16(0)
+	err = b.rdata(rr.Type, rr.Data)
+	if err != nil {
+		return fmt.Errorf("%s %s: %v", rr.Name, typeString(rr.Type), err)
+	}
+	n := len(b.buf) - at - 2
+	if n > 0xffff {
+		return errors.New("rdata too long")
+	}
+	binary.BigEndian.PutUint16(b.buf[at:], uint16(n))
+	return nil
+}
+
+func (b *builder) rdata(typ uint16, data []string) error {
+	if len(data) > 0 && data[0] == `\#` {
+		raw, err := genericData(data[1:])
+		if err != nil {
+			return err
+		}
+		b.buf = append(b.buf, raw...)
+		return nil
+	}
+
+	layout := types[typ].layout
+	if layout == "" {
+		return errors.New("no layout for type, use the \\# form")
+	}
+	k := 0
+	for _, f := range layout {
+		if f == 'S' {
+			if k >= len(data) {
+				return errors.New("missing rdata")
+			}
+			for ; k < len(data); k++ {
+				err := b.cstring(unquote(data[k]))
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if k >= len(data) {
+			return errors.New("missing rdata")
+		}
+		v := data[k]
+		k++
+
+		var err error
+		switch f {
+		case 'a':
+			ip := net.ParseIP(v).To4()
+			if ip == nil {
+				return fmt.Errorf("bad ipv4 address %q", v)
+			}
+			b.buf = append(b.buf, ip...)
+		case '6':
+			ip := net.ParseIP(v)
+			if ip == nil || !strings.Contains(v, ":") {
+				return fmt.Errorf("bad ipv6 address %q", v)
+			}
+			b.buf = append(b.buf, ip.To16()...)
+		case 'n', 'N':
+			err = b.name(v, f == 'n')
+		case '1', '2', '4':
+			bits := int(f-'0') * 8
+			n, perr := strconv.ParseUint(v, 10, bits)
+			if perr != nil {
+				return fmt.Errorf("bad %d bit number %q", bits, v)
+			}
+			switch f {
+			case '1':
+				b.buf = append(b.buf, byte(n))
+			case '2':
+				b.u16(uint16(n))
+			case '4':
+				b.u32(uint32(n))
+			}
+		case 's', 't':
+			err = b.cstring(unquote(v))
+		case 'v':
+			b.buf = append(b.buf, unquote(v)...)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if k != len(data) {
+		return errors.New("too much rdata")
+	}
+	return nil
+}
+
+func (m *Message) Pack() ([]byte, error) {
+	b := &builder{names: make(map[string]int)}
+
+	var flags uint16
+	bit := func(set bool, n uint) {
+		if set {
+			flags |= 1 << n
+		}
+	}
+	bit(m.Response, 15)
+	flags |= uint16(m.Opcode&0xf) << 11
+	bit(m.Authoritative, 10)
+	bit(m.Truncated, 9)
+	bit(m.RecursionDesired, 8)
+	bit(m.RecursionAvailable, 7)
+	bit(m.AuthenticData, 5)
+	bit(m.CheckingDisabled, 4)
+	flags |= uint16(m.Rcode & 0xf)
+
+	arcount := len(m.Additional)
+	if m.EDNS != nil {
+		arcount++
+	}
+	b.u16(m.ID)
+	b.u16(flags)
+	b.u16(uint16(len(m.Question)))
+	b.u16(uint16(len(m.Answer)))
+	b.u16(uint16(len(m.Authority)))
+	b.u16(uint16(arcount))
+
+	for _, q := range m.Question {
+		err := b.name(q.Name, true)
+		if err != nil {
+			return nil, err
+		}
+		b.u16(q.Type)
+		b.u16(q.Class)
+	}
+	for _, section := range [][]RR{m.Answer, m.Authority, m.Additional} {
+		for i := range section {
+			err := b.rr(&section[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// the opt pseudo record reuses class for the udp size and the ttl
+	// for the upper rcode bits, the version and the do flag
+	if e := m.EDNS; e != nil {
+		b.buf = append(b.buf, 0)
+		b.u16(typeOPT)
+		b.u16(e.UDPSize)
+		ttl := uint32(m.Rcode>>4&0xff)<<24 | uint32(e.Version)<<16
+		if e.DO {
+			ttl |= 1 << 15
+		}
+		b.u32(ttl)
+		n := 0
+		for _, o := range e.Options {
+			n += 4 + len(o.Data)
+		}
+		b.u16(uint16(n))
+		for _, o := range e.Options {
+			b.u16(o.Code)
+			b.u16(uint16(len(o.Data)))
+			b.buf = append(b.buf, o.Data...)
+		}
+	}
+	return b.buf, nil
+}
+
+func Unpack(msg []byte) (*Message, error) {
+	if len(msg) < 12 {
+		return nil, errTruncated
+	}
+	m := &Message{ID: binary.BigEndian.Uint16(msg)}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	m.Response = flags&(1<<15) != 0
+	m.Opcode = int(flags >> 11 & 0xf)
+	m.Authoritative = flags&(1<<10) != 0
+	m.Truncated = flags&(1<<9) != 0
+	m.RecursionDesired = flags&(1<<8) != 0
+	m.RecursionAvailable = flags&(1<<7) != 0
+	m.AuthenticData = flags&(1<<5) != 0
+	m.CheckingDisabled = flags&(1<<4) != 0
+	m.Rcode = int(flags & 0xf)
+
+	var counts [4]int
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(msg[4+2*i:]))
+	}
+
+	off := 12
+	for i := 0; i < counts[0]; i++ {
+		name, n, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if n+4 > len(msg) {
+			return nil, errTruncated
+		}
+		m.Question = append(m.Question, Question{name, binary.BigEndian.Uint16(msg[n:]), binary.BigEndian.Uint16(msg[n+2:])})
+		off = n + 4
+	}
+
+	sections := []*[]RR{&m.Answer, &m.Authority, &m.Additional}
+	for s, section := range sections {
+		for i := 0; i < counts[s+1]; i++ {
+			rr, raw, n, err := readRR(msg, off)
+			if err != nil {
+				return nil, err
+			}
+			off = n
+			if rr.Type == typeOPT && s == 2 {
+				if m.EDNS != nil {
+					return nil, errors.New("more than one opt record")
+				}
+				m.EDNS, err = readEDNS(rr, raw)
+				if err != nil {
+					return nil, err
+				}
+				m.Rcode |= int(rr.TTL>>24) << 4
+				continue
+			}
+			*section = append(*section, rr)
+		}
+	}
+	return m, nil
+}
+
+func readEDNS(rr RR, raw []byte) (*EDNS, error) {
+	e := &EDNS{
+		UDPSize: rr.Class,
+		Version: uint8(rr.TTL >> 16),
+		DO:      rr.TTL&(1<<15) != 0,
+	}
+	for len(raw) > 0 {
+		if len(raw) < 4 {
+			return nil, errTruncated
+		}
+		code, n := binary.BigEndian.Uint16(raw), int(binary.BigEndian.Uint16(raw[2:]))
+		if 4+n > len(raw) {
+			return nil, errTruncated
+		}
+		e.Options = append(e.Options, EDNSOption{code, raw[4 : 4+n]})
+		raw = raw[4+n:]
+	}
+	return e, nil
+}
+
+func readRR(msg []byte, off int) (RR, []byte, int, error) {
+	var rr RR
+	name, off, err := readName(msg, off)
+	if err != nil {
+		return rr, nil, 0, err
+	}
+	if off+10 > len(msg) {
+		return rr, nil, 0, errTruncated
+	}
+	rr.Name = name
+	rr.Type = binary.BigEndian.Uint16(msg[off:])
+	rr.Class = binary.BigEndian.Uint16(msg[off+2:])
+	rr.TTL = binary.BigEndian.Uint32(msg[off+4:])
+	n := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	if off+n > len(msg) {
+		return rr, nil, 0, errTruncated
+	}
+	raw := msg[off : off+n]
+	if rr.Type != typeOPT {
+		// anything that does not parse is still shown, in the generic form
+		rr.Data, err = readRData(msg, off, off+n, types[rr.Type].layout)
+		if err != nil || types[rr.Type].layout == "" {
+			rr.Data = []string{`\#`, strconv.Itoa(n)}
+			if n > 0 {
+				rr.Data = append(rr.Data, hex.EncodeToString(raw))
+			}
+		}
+	}
+	return rr, raw, off + n, nil
+}
+
+func readRData(msg []byte, off, end int, layout string) ([]string, error) {
+	var data []string
+	need := func(n int) error {
+		if off+n > end {
+			return errTruncated
+		}
+		return nil
+	}
+	for _, f := range layout {
+		switch f {
+		case 'a', '6':
+			n := 4
+			if f == '6' {
+				n = 16
+			}
+			if err := need(n); err != nil {
+				return nil, err
+			}
+			data = append(data, net.IP(msg[off:off+n]).String())
+			off += n
+		case 'n', 'N':
+			name, n, err := readName(msg, off)
+			if err != nil {
+				return nil, err
+			}
+			if n > end {
+				return nil, errTruncated
+			}
+			data = append(data, name)
+			off = n
+		case '1', '2', '4':
+			n := int(f - '0')
+			if err := need(n); err != nil {
+				return nil, err
+			}
+			var v uint64
+			for _, c := range msg[off : off+n] {
+				v = v<<8 | uint64(c)
+			}
+			data = append(data, strconv.FormatUint(v, 10))
+			off += n
+		case 's', 't', 'S':
+			for {
+				if err := need(1); err != nil {
+					return nil, err
+				}
+				n := int(msg[off])
+				if err := need(1 + n); err != nil {
+					return nil, err
+				}
+				s := msg[off+1 : off+1+n]
+				if f == 't' {
+					data = append(data, string(s))
+				} else {
+					data = append(data, quote(s))
+				}
+				off += 1 + n
+				if f != 'S' || off == end {
+					break
+				}
+			}
+		case 'v':
+			data = append(data, quote(msg[off:end]))
+			off = end
+		}
+	}
+	if off != end {
+		return nil, errors.New("rdata length mismatch")
+	}
+	return data, nil
+}
+
+// follows compression pointers, a pointer may only ever lead to
+// something earlier so a limit on jumps catches loops
+func readName(msg []byte, off int) (string, int, error) {
+	var sb strings.Builder
+	end, jumps, size := -1, 0, 0
+	for {
+		if off >= len(msg) {
+			return "", 0, errTruncated
+		}
+		c := int(msg[off])
+		if c == 0 {
+			off++
+			break
+		}
+		switch c & 0xc0 {
+		case 0x00:
+			if off+1+c > len(msg) {
+				return "", 0, errTruncated
+			}
+			writeLabel(&sb, msg[off+1:off+1+c])
+			sb.WriteByte('.')
+			size += 1 + c
+			off += 1 + c
+		case 0xc0:
+			if off+2 > len(msg) {
+				return "", 0, errTruncated
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			if jumps++; jumps > 64 {
+				return "", 0, errLoop
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			return "", 0, fmt.Errorf("bad label type %#x", c&0xc0)
+		}
+		if size > 254 {
+			return "", 0, errors.New("name longer than 255 bytes")
+		}
+	}
+	if end < 0 {
+		end = off
+	}
+	if sb.Len() == 0 {
+		return ".", end, nil
+	}
+	return sb.String(), end, nil
+}
+
+func writeLabel(sb *strings.Builder, l []byte) {
+	for _, c := range l {
+		switch {
+		case c == '.' || c == '\\' || c == '"' || c == '(' || c == ')' || c == ';' || c == '@' || c == '$':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c <= ' ' || c >= 0x7f:
+			fmt.Fprintf(sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+}
+
+// splits a name in presentation form into raw labels
+func labels(name string) ([]string, error) {
+	if name == "." || name == "" {
+		return nil, nil
+	}
+	var ls []string
+	var cur []byte
+	size := 1
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch c {
+		case '\\':
+			b, n, err := unescapeAt(name, i)
+			if err != nil {
+				return nil, err
+			}
+			cur = append(cur, b)
+			i += n - 1
+		case '.':
+			if len(cur) == 0 {
+				return nil, fmt.Errorf("%q: empty label", name)
+			}
+			ls = append(ls, string(cur))
+			cur = nil
+		default:
+			cur = append(cur, c)
+		}
+	}
+	if len(cur) > 0 {
+		ls = append(ls, string(cur))
+	}
+	for _, l := range ls {
+		if len(l) > 63 {
+			return nil, fmt.Errorf("%q: label longer than 63 bytes", name)
+		}
+		size += 1 + len(l)
+	}
+	if size > 255 {
+		return nil, fmt.Errorf("%q: name longer than 255 bytes", name)
+	}
+	return ls, nil
+}
+
+// \DDD is a decimal byte, \X is X itself
+func unescapeAt(s string, i int) (byte, int, error) {
+	if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+		n, _ := strconv.Atoi(s[i+1 : i+4])
+		if n > 255 {
+			return 0, 0, fmt.Errorf("bad escape %q", s[i:i+4])
+		}
+		return byte(n), 4, nil
+	}
+	if i+1 < len(s) {
+		return s[i+1], 2, nil
+	}
+	return 0, 0, errors.New("escape at end of string")
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+func unescape(s string) []byte {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			c, n, err := unescapeAt(s, i)
+			if err == nil {
+				b = append(b, c)
+				i += n - 1
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
+
+func quote(s []byte) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+func unquote(s string) []byte {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	return unescape(s)
+}
+
+// rfc 3597, a length and the data in hex
+func genericData(f []string) ([]byte, error) {
+	if len(f) < 1 {
+		return nil, errors.New(`\# needs a length`)
+	}
+	n, err := strconv.Atoi(f[0])
+	if err != nil || n < 0 || n > 0xffff {
+		return nil, fmt.Errorf(`\# bad length %q`, f[0])
+	}
+	raw, err := hex.DecodeString(strings.Join(f[1:], ""))
+	if err != nil {
+		return nil, fmt.Errorf(`\# bad hex data: %v`, err)
+	}
+	if len(raw) != n {
+		return nil, fmt.Errorf(`\# length is %d but there are %d bytes`, n, len(raw))
+	}
+	return raw, nil
+}
+
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") && !strings.HasSuffix(name, `\.`) {
+		return name
+	}
+	return name + "."
+}
+
+func canon(name string) string {
+	return strings.ToLower(fqdn(name))
+}
+
+func isSubdomain(child, parent string) bool {
+	c, p := canon(child), canon(parent)
+	return p == "." || c == p || strings.HasSuffix(c, "."+p)
+}
+
+// the name with its first label removed
+func parent(name string) string {
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '\\':
+			i++
+		case '.':
+			if i+1 < len(name) {
+				return name[i+1:]
+			}
+			return "."
+		}
+	}
+	return "."
+}
+
+type Reply struct {
+	Msg    *Message
+	Server string
+	Proto  string
+	Size   int
+	RTT    time.Duration
+}
+
+type Client struct {
+	Proto    string
+	Timeout  time.Duration
+	Tries    int
+	TLS      *tls.Config
+	IgnoreTC bool
+	Notify   io.Writer // told about the fallback to tcp
+}
+
+// udp is retried on timeouts, a truncated reply is asked for again over tcp
+func (c *Client) Exchange(q *Message, server string) (*Reply, error) {
+	req, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if c.Proto != "udp" {
+		return c.stream(req, q, server, c.Proto)
+	}
+
+	var r *Reply
+	for try := 0; try < c.Tries; try++ {
+		r, err = c.udp(req, q, server)
+		var ne net.Error
+		if err == nil || !errors.As(err, &ne) || !ne.Timeout() {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.Msg.Truncated && !c.IgnoreTC {
+		fmt.Fprintln(c.Notify, ";; Truncated, retrying in TCP mode.")
+		return c.stream(req, q, server, "tcp")
+	}
+	return r, nil
+}
+
+func (c *Client) udp(req []byte, q *Message, server string) (*Reply, error) {
+	conn, err := net.DialTimeout("udp", server, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+	_, err = conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// anything not matching could be spoofed or late, keep waiting
+		m, err := Unpack(buf[:n])
+		if err != nil || !answers(m, q) {
+			continue
+		}
+		return &Reply{Msg: m, Server: server, Proto: "UDP", Size: n}, nil
+	}
+}
+
+func (c *Client) stream(req []byte, q *Message, server, proto string) (*Reply, error) {
+	d := &net.Dialer{Timeout: c.Timeout}
+	var conn net.Conn
+	var err error
+	if proto == "tls" {
+		conn, err = tls.DialWithDialer(d, "tcp", server, c.TLS)
+	} else {
+		conn, err = d.Dial("tcp", server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+
+	err = writeStream(conn, req)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := readStream(conn)
+	if err != nil {
+		return nil, err
+	}
+	m, err := Unpack(buf)
+	if err != nil {
+		return nil, err
+	}
+	if !answers(m, q) {
+		return nil, errors.New("reply does not match the query")
+	}
+	return &Reply{Msg: m, Server: server, Proto: strings.ToUpper(proto), Size: len(buf)}, nil
+}
+
+// over a stream each message has a two byte length in front
+func writeStream(w io.Writer, msg []byte) error {
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+	_, err := w.Write(append(b, msg...))
+	return err
+}
+
+func readStream(r io.Reader) ([]byte, error) {
+	var n [2]byte
+	_, err := io.ReadFull(r, n[:])
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(n[:]))
+	_, err = io.ReadFull(r, buf)
+	return buf, err
+}
+
+func answers(m, q *Message) bool {
+	if !m.Response || m.ID != q.ID {
+		return false
+	}
+	// some servers leave the question out of errors
+	if len(m.Question) == 0 {
+		return m.Rcode != rcodeNoError
+	}
+	a, b := m.Question[0], q.Question[0]
+	return a.Type == b.Type && a.Class == b.Class && canon(a.Name) == canon(b.Name)
+}
+
+func printDig(r *Reply) {
+	m := r.Msg
+	fmt.Println(";; Got answer:")
+	fmt.Printf(";; ->>HEADER<<- opcode: %s, status: %s, id: %d\n", opcodeString(m.Opcode), rcodeString(m.Rcode), m.ID)
+	arcount := len(m.Additional)
+	if m.EDNS != nil {
+		arcount++
+	}
+	fmt.Printf(";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		strings.Join(m.flags(), " "), len(m.Question), len(m.Answer), len(m.Authority), arcount)
+	if !m.RecursionAvailable && m.RecursionDesired {
+		fmt.Println(";; WARNING: recursion requested but not available")
+	}
+
+	if e := m.EDNS; e != nil {
+		fmt.Println("\n;; OPT PSEUDOSECTION:")
+		flags := ""
+		if e.DO {
+			flags = " do"
+		}
+		fmt.Printf("; EDNS: version: %d, flags:%s; udp: %d\n", e.Version, flags, e.UDPSize)
+		for _, o := range e.Options {
+			switch o.Code {
+			case optNSID:
+				fmt.Printf("; NSID: %s (%s)\n", hex.EncodeToString(o.Data), quote(o.Data))
+			case optCookie:
+				fmt.Printf("; COOKIE: %s\n", hex.EncodeToString(o.Data))
+			default:
+				fmt.Printf("; OPT=%d: %s\n", o.Code, hex.EncodeToString(o.Data))
+			}
+		}
+	}
+
+	if len(m.Question) > 0 {
+		fmt.Println("\n;; QUESTION SECTION:")
+		for _, q := range m.Question {
+			fmt.Printf(";%s\t\t%s\t%s\n", q.Name, classString(q.Class), typeString(q.Type))
+		}
+	}
+	for _, s := range []struct {
+		name string
+		rrs  []RR
+	}{
+		{"ANSWER", m.Answer},
+		{"AUTHORITY", m.Authority},
+		{"ADDITIONAL", m.Additional},
+	} {
+		if len(s.rrs) == 0 {
+			continue
+		}
+		fmt.Printf("\n;; %s SECTION:\n", s.name)
+		for i := range s.rrs {
+			fmt.Println(s.rrs[i].String())
+		}
+	}
+
+	fmt.Printf("\n;; Query time: %d msec\n", r.RTT.Milliseconds())
+	host, port, _ := net.SplitHostPort(r.Server)
+	fmt.Printf(";; SERVER: %s#%s(%s) (%s)\n", host, port, host, r.Proto)
+	fmt.Printf(";; WHEN: %s\n", time.Now().Format("Mon Jan 02 15:04:05 MST 2006"))
+	fmt.Printf(";; MSG SIZE  rcvd: %d\n\n", r.Size)
+}
+
+func printShort(m *Message) {
+	for _, rr := range m.Answer {
+		fmt.Println(strings.Join(rr.Data, " "))
+	}
+}
+
+type jsonRR struct {
+	Name  string `json:"name"`
+	TTL   uint32 `json:"ttl"`
+	Class string `json:"class"`
+	Type  string `json:"type"`
+	Data  string `json:"data"`
+}
+
+type jsonQuestion struct {
+	Name  string `json:"name"`
+	Class string `json:"class"`
+	Type  string `json:"type"`
+}
+
+type jsonEDNS struct {
+	Version uint8             `json:"version"`
+	UDPSize uint16            `json:"udp_size"`
+	DO      bool              `json:"do"`
+	Options map[string]string `json:"options,omitempty"`
+}
+
+type jsonReply struct {
+	Server     string         `json:"server"`
+	Proto      string         `json:"proto"`
+	TimeMs     float64        `json:"time_ms"`
+	Size       int            `json:"size"`
+	ID         uint16         `json:"id"`
+	Opcode     string         `json:"opcode"`
+	Status     string         `json:"status"`
+	Flags      []string       `json:"flags"`
+	EDNS       *jsonEDNS      `json:"edns,omitempty"`
+	Question   []jsonQuestion `json:"question"`
+	Answer     []jsonRR       `json:"answer"`
+	Authority  []jsonRR       `json:"authority"`
+	Additional []jsonRR       `json:"additional"`
+}
+
+func printJSON(r *Reply) error {
+	m := r.Msg
+	j := jsonReply{
+		Server:     r.Server,
+		Proto:      r.Proto,
+		TimeMs:     float64(r.RTT.Microseconds()) / 1000,
+		Size:       r.Size,
+		ID:         m.ID,
+		Opcode:     opcodeString(m.Opcode),
+		Status:     rcodeString(m.Rcode),
+		Flags:      m.flags(),
+		Question:   []jsonQuestion{},
+		Answer:     jsonRRs(m.Answer),
+		Authority:  jsonRRs(m.Authority),
+		Additional: jsonRRs(m.Additional),
+	}
+	if j.Flags == nil {
+		j.Flags = []string{}
+	}
+	for _, q := range m.Question {
+		j.Question = append(j.Question, jsonQuestion{q.Name, classString(q.Class), typeString(q.Type)})
+	}
+	if e := m.EDNS; e != nil {
+		j.EDNS = &jsonEDNS{Version: e.Version, UDPSize: e.UDPSize, DO: e.DO}
+		for _, o := range e.Options {
+			if j.EDNS.Options == nil {
+				j.EDNS.Options = make(map[string]string)
+			}
+			name := fmt.Sprintf("OPT%d", o.Code)
+			switch o.Code {
+			case optNSID:
+				name = "NSID"
+			case optCookie:
+				name = "COOKIE"
+			}
+			j.EDNS.Options[name] = hex.EncodeToString(o.Data)
+		}
+	}
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+func jsonRRs(rrs []RR) []jsonRR {
+	j := []jsonRR{}
+	for _, rr := range rrs {
+		j = append(j, jsonRR{rr.Name, rr.TTL, classString(rr.Class), typeString(rr.Type), strings.Join(rr.Data, " ")})
+	}
+	return j
+}
+
+type nameserver struct {
+	name string
+	addr string
+}
+
+var rootHints = []nameserver{
+	{"a.root-servers.net.", "198.41.0.4"},
+	{"b.root-servers.net.", "170.247.170.2"},
+	{"c.root-servers.net.", "192.33.4.12"},
+	{"d.root-servers.net.", "199.7.91.13"},
+	{"e.root-servers.net.", "192.203.230.10"},
+	{"f.root-servers.net.", "192.5.5.241"},
+	{"g.root-servers.net.", "192.112.36.4"},
+	{"h.root-servers.net.", "198.97.190.53"},
+	{"i.root-servers.net.", "192.36.148.17"},
+	{"j.root-servers.net.", "192.58.128.30"},
+	{"k.root-servers.net.", "193.0.14.129"},
+	{"l.root-servers.net.", "199.7.83.42"},
+	{"m.root-servers.net.", "202.12.27.33"},
+}
+
+type tracer struct {
+	c     *Client
+	o     *Options
+	depth int
+}
+
+func trace(c *Client, o *Options, name string, qtype, qclass uint16) error {
+	// referrals only give addresses, nothing says a server does tls
+	if o.Proto == "tls" {
+		return errors.New("+trace works over udp and tcp only")
+	}
+	t := &tracer{c: c, o: o}
+	if !o.JSON {
+		fmt.Printf("\n; <<>> dnsq <<>> %s\n", strings.Join(os.Args[1:], " "))
+		for _, ns := range t.roots() {
+			rr := RR{".", typeNS, classIN, 518400, []string{ns.name}}
+			fmt.Println(rr.String())
+		}
+		fmt.Println(";; Using root hints")
+		fmt.Println()
+	}
+	_, err := t.iterate(name, qtype, qclass, true)
+	return err
+}
+
+func (t *tracer) roots() []nameserver {
+	if *rootArg == "" {
+		return rootHints
+	}
+	var ns []nameserver
+	for _, a := range strings.Split(*rootArg, ",") {
+		ns = append(ns, nameserver{a, a})
+	}
+	return ns
+}
+
+// follows referrals down from the root with recursion off until some
+// server answers with authority, showing each step when asked to
+func (t *tracer) iterate(name string, qtype, qclass uint16, show bool) (*Message, error) {
+	if t.depth++; t.depth > 8 {
+		return nil, errors.New("too many levels of nameserver lookups")
+	}
+	defer func() { t.depth-- }()
+
+	servers := t.roots()
+	zone := "."
+	for step := 0; step < 32; step++ {
+		q := t.o.query(name, qtype, qclass)
+		q.RecursionDesired = false
+		r, ns, err := t.ask(q, servers)
+		if err != nil {
+			return nil, err
+		}
+		m := r.Msg
+		if show {
+			t.print(r, ns)
+		}
+		if m.Rcode != rcodeNoError || len(m.Answer) > 0 || m.Authoritative {
+			return m, nil
+		}
+
+		var cut string
+		var names []string
+		for _, rr := range m.Authority {
+			if rr.Type == typeNS {
+				cut = rr.Name
+				names = append(names, rr.Data[0])
+			}
+		}
+		if cut == "" {
+			return m, nil
+		}
+		if canon(cut) == canon(zone) || !isSubdomain(cut, zone) || !isSubdomain(name, cut) {
+			return nil, fmt.Errorf("bad referral to %s from %s", cut, ns.name)
+		}
+		zone = cut
+
+		servers = t.glue(m, names)
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("no addresses for the %s nameservers", cut)
+		}
+	}
+	return nil, errors.New("too many referrals")
+}
+
+// addresses from the additional section, or looked up from the
+// root for the first few nameservers when there is no glue
+func (t *tracer) glue(m *Message, names []string) []nameserver {
+	var servers []nameserver
+	for _, n := range names {
+		for _, rr := range m.Additional {
+			if rr.Type == typeA && canon(rr.Name) == canon(n) {
+				servers = append(servers, nameserver{n, rr.Data[0]})
+			}
+		}
+	}
+	if len(servers) > 0 {
+		return servers
+	}
+	for _, n := range names[:min(len(names), 3)] {
+		for _, a := range t.lookup(n) {
+			servers = append(servers, nameserver{n, a})
+		}
+		if len(servers) > 0 {
+			break
+		}
+	}
+	return servers
+}
+
+func (t *tracer) lookup(name string) []string {
+	for i := 0; i < 8; i++ {
+		m, err := t.iterate(name, typeA, classIN, false)
+		if err != nil {
+			return nil
+		}
+		var addrs []string
+		var cname string
+		for _, rr := range m.Answer {
+			switch rr.Type {
+			case typeA:
+				addrs = append(addrs, rr.Data[0])
+			case typeCNAME:
+				cname = rr.Data[0]
+			}
+		}
+		if len(addrs) > 0 || cname == "" {
+			return addrs
+		}
+		name = cname
+	}
+	return nil
+}
+
+func (t *tracer) ask(q *Message, servers []nameserver) (*Reply, nameserver, error) {
+	var err error
+	port := *port
+	if port == "" {
+		port = "53"
+	}
+	for _, i := range rand.Perm(len(servers)) {
+		ns := servers[i]
+		start := time.Now()
+		var r *Reply
+		r, err = t.c.Exchange(q, net.JoinHostPort(ns.addr, port))
+		if err != nil {
+			continue
+		}
+		r.RTT = time.Since(start)
+		// a lame server is as good as no answer
+		if r.Msg.Rcode == rcodeRefused || r.Msg.Rcode == rcodeServFail {
+			err = fmt.Errorf("%s answered %s", ns.name, rcodeString(r.Msg.Rcode))
+			continue
+		}
+		return r, ns, nil
+	}
+	return nil, nameserver{}, err
+}
+
+func (t *tracer) print(r *Reply, ns nameserver) {
+	if t.o.JSON {
+		printJSON(r)
+		return
+	}
+	for _, section := range [][]RR{r.Msg.Answer, r.Msg.Authority} {
+		for i := range section {
+			fmt.Println(section[i].String())
+		}
+	}
+	host, port, _ := net.SplitHostPort(r.Server)
+	fmt.Printf(";; Received %d bytes from %s#%s(%s) in %d ms\n\n", r.Size, host, port, ns.name, r.RTT.Milliseconds())
+}
+
+type Zone struct {
+	Origin  string
+	SOA     RR
+	records map[string][]RR
+	names   map[string]bool // every owner and the empty names above them
+}
+
+func (z *Zone) add(rr RR) {
+	key := canon(rr.Name)
+	z.records[key] = append(z.records[key], rr)
+	for n := key; !z.names[n]; n = parent(n) {
+		z.names[n] = true
+		if n == canon(z.Origin) {
+			break
+		}
+	}
+}
+
+func (z *Zone) rrset(name string, typ uint16) []RR {
+	var rrs []RR
+	for _, rr := range z.records[canon(name)] {
+		if rr.Type == typ {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// the topmost delegation at or above name, below the apex
+func (z *Zone) cut(name string) string {
+	var above []string
+	for n := canon(name); n != canon(z.Origin) && n != "."; n = parent(n) {
+		above = append(above, n)
+	}
+	for i := len(above) - 1; i >= 0; i-- {
+		if len(z.rrset(above[i], typeNS)) > 0 {
+			return above[i]
+		}
+	}
+	return ""
+}
+
+// the records at name, from a wildcard at the closest
+// existing name above it if name itself does not exist
+func (z *Zone) find(name string) ([]RR, bool) {
+	key := canon(name)
+	if z.names[key] {
+		return z.records[key], true
+	}
+	encloser := parent(key)
+	for !z.names[encloser] && encloser != "." {
+		encloser = parent(encloser)
+	}
+	wild := z.records["*."+encloser]
+	if len(wild) == 0 {
+		return nil, false
+	}
+	var rrs []RR
+	for _, rr := range wild {
+		rr.Name = name
+		rrs = append(rrs, rr)
+	}
+	return rrs, true
+}
+
+// the soa for negative answers, its ttl capped by the minimum field (rfc 2308)
+func (z *Zone) negative() RR {
+	soa := z.SOA
+	neg, _ := strconv.ParseUint(soa.Data[6], 10, 32)
+	soa.TTL = min(soa.TTL, uint32(neg))
+	return soa
+}
+
+func (z *Zone) resolve(q Question, m *Message) {
+	name := q.Name
+	m.Authoritative = true
+	for chain := 0; chain < 8; chain++ {
+		if cut := z.cut(name); cut != "" {
+			// not ours, refer to the child zone's servers
+			ns := z.rrset(cut, typeNS)
+			m.Authority = append(m.Authority, ns...)
+			z.additional(m, ns)
+			if len(m.Answer) == 0 {
+				m.Authoritative = false
+			}
+			return
+		}
+
+		rrs, ok := z.find(name)
+		if !ok {
+			m.Rcode = rcodeNXDomain
+			m.Authority = append(m.Authority, z.negative())
+			return
+		}
+		var match []RR
+		var cname *RR
+		for i, rr := range rrs {
+			if rr.Type == q.Type || q.Type == typeANY {
+				match = append(match, rr)
+			}
+			if rr.Type == typeCNAME {
+				cname = &rrs[i]
+			}
+		}
+		if len(match) > 0 {
+			m.Answer = append(m.Answer, match...)
+			z.additional(m, match)
+			return
+		}
+		if cname == nil {
+			m.Authority = append(m.Authority, z.negative())
+			return
+		}
+		m.Answer = append(m.Answer, *cname)
+		name = cname.Data[0]
+		if !isSubdomain(name, z.Origin) {
+			return
+		}
+	}
+}
+
+// addresses we know for the names in ns, mx and srv records
+func (z *Zone) additional(m *Message, rrs []RR) {
+	for _, rr := range rrs {
+		var target string
+		switch rr.Type {
+		case typeNS:
+			target = rr.Data[0]
+		case typeMX:
+			target = rr.Data[1]
+		case typeSRV:
+			target = rr.Data[3]
+		default:
+			continue
+		}
+		if !isSubdomain(target, z.Origin) {
+			continue
+		}
+		m.Additional = append(m.Additional, z.rrset(target, typeA)...)
+		m.Additional = append(m.Additional, z.rrset(target, typeAAAA)...)
+	}
+}
+
+type token struct {
+	text   string
+	quoted bool
+}
+
+type zoneLine struct {
+	tokens []token
+	blank  bool // started with white space, the owner is the previous one
+	line   int
+}
+
+// splits a master file (rfc 1035) into logical lines, joining
+// the ones continued inside parentheses and dropping comments
+func lexZone(src string) ([]zoneLine, error) {
+	var lines []zoneLine
+	cur := zoneLine{line: 1}
+	lineno, paren, start := 1, 0, true
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			lineno++
+			i++
+			if paren == 0 {
+				if len(cur.tokens) > 0 {
+					lines = append(lines, cur)
+				}
+				cur = zoneLine{line: lineno}
+				start = true
+			}
+			continue
+		case c == ' ' || c == '\t' || c == '\r':
+			if start {
+				cur.blank = true
+			}
+			i++
+		case c == ';':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '(':
+			paren++
+			i++
+		case c == ')':
+			if paren == 0 {
+				return nil, fmt.Errorf("line %d: unbalanced )", lineno)
+			}
+			paren--
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				if j < len(src) && src[j] == '\n' {
+					lineno++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("line %d: unterminated string", lineno)
+			}
+			cur.tokens = append(cur.tokens, token{src[i+1 : j], true})
+			i = j + 1
+		default:
+			j := i
+			for j < len(src) && !strings.ContainsRune(" \t\r\n;()\"", rune(src[j])) {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			j = min(j, len(src))
+			cur.tokens = append(cur.tokens, token{src[i:j], false})
+			i = j
+		}
+		start = false
+	}
+	if paren != 0 {
+		return nil, errors.New("unbalanced ( at end of file")
+	}
+	if len(cur.tokens) > 0 {
+		lines = append(lines, cur)
+	}
+	return lines, nil
+}
+
+// ttls can be plain seconds or like 1h30m, with s m h d w units
+func parseTTL(s string) (uint32, error) {
+	if s == "" || !isDigit(s[0]) {
+		return 0, fmt.Errorf("bad ttl %q", s)
+	}
+	var total, n uint64
+	digits := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isDigit(c) {
+			n = n*10 + uint64(c-'0')
+			digits = true
+			continue
+		}
+		unit, ok := map[byte]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}[c|0x20]
+		if !ok || !digits {
+			return 0, fmt.Errorf("bad ttl %q", s)
+		}
+		total += n * unit
+		n, digits = 0, false
+	}
+	total += n
+	if total > 1<<31-1 {
+		return 0, fmt.Errorf("ttl %q too large", s)
+	}
+	return uint32(total), nil
+}
+
+type zoneParser struct {
+	origin  string
+	owner   string
+	ttl     uint32
+	haveTTL bool
+}
+
+func (p *zoneParser) abs(name string) (string, error) {
+	if name == "@" {
+		if p.origin == "" {
+			return "", errors.New("@ used without an $ORIGIN")
+		}
+		return p.origin, nil
+	}
+	if strings.HasSuffix(name, ".") && !strings.HasSuffix(name, `\.`) {
+		_, err := labels(name)
+		return name, err
+	}
+	if p.origin == "" {
+		return "", fmt.Errorf("relative name %q without an $ORIGIN", name)
+	}
+	if p.origin == "." {
+		name += "."
+	} else {
+		name += "." + p.origin
+	}
+	_, err := labels(name)
+	return name, err
+}
+
+func loadZone(file string) (*Zone, error) {
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := lexZone(string(src))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	p := &zoneParser{ttl: 3600}
+	var rrs []RR
+	for _, l := range lines {
+		rr, err := p.line(l)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, l.line, err)
+		}
+		if rr != nil {
+			rrs = append(rrs, *rr)
+		}
+	}
+
+	if len(rrs) == 0 || rrs[0].Type != typeSOA {
+		return nil, fmt.Errorf("%s: the first record must be the soa", file)
+	}
+	z := &Zone{
+		Origin:  rrs[0].Name,
+		SOA:     rrs[0],
+		records: make(map[string][]RR),
+		names:   make(map[string]bool),
+	}
+	for _, rr := range rrs {
+		if !isSubdomain(rr.Name, z.Origin) {
+			return nil, fmt.Errorf("%s: %s is outside the zone %s", file, rr.Name, z.Origin)
+		}
+		if rr.Type == typeSOA && canon(rr.Name) != canon(z.Origin) || rr.Type == typeSOA && len(z.rrset(rr.Name, typeSOA)) > 0 {
+			return nil, fmt.Errorf("%s: extra soa at %s", file, rr.Name)
+		}
+		// a name with a cname can have nothing else
+		others := len(z.records[canon(rr.Name)]) > 0
+		if rr.Type == typeCNAME && others || rr.Type != typeCNAME && len(z.rrset(rr.Name, typeCNAME)) > 0 {
+			return nil, fmt.Errorf("%s: %s has a cname and other data", file, rr.Name)
+		}
+		// check it packs now rather than on every answer
+		b := &builder{names: make(map[string]int)}
+		err := b.rr(&rr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		z.add(rr)
+	}
+	return z, nil
+}
+
+func (p *zoneParser) line(l zoneLine) (*RR, error) {
+	toks := l.tokens
+	switch strings.ToUpper(toks[0].text) {
+	case "$ORIGIN":
+		if len(toks) != 2 {
+			return nil, errors.New("$ORIGIN takes one name")
+		}
+		if !strings.HasSuffix(toks[1].text, ".") {
+			return nil, errors.New("$ORIGIN must be absolute")
+		}
+		p.origin = toks[1].text
+		return nil, nil
+	case "$TTL":
+		if len(toks) != 2 {
+			return nil, errors.New("$TTL takes one value")
+		}
+		ttl, err := parseTTL(toks[1].text)
+		if err != nil {
+			return nil, err
+		}
+		p.ttl, p.haveTTL = ttl, true
+		return nil, nil
+	case "$INCLUDE", "$GENERATE":
+		return nil, fmt.Errorf("%s is not supported", toks[0].text)
+	}
+
+	if !l.blank {
+		owner, err := p.abs(toks[0].text)
+		if err != nil {
+			return nil, err
+		}
+		p.owner = owner
+		toks = toks[1:]
+	}
+	if p.owner == "" {
+		return nil, errors.New("no owner name")
+	}
+
+	rr := &RR{Name: p.owner, Class: classIN, TTL: p.ttl}
+	for len(toks) > 0 {
+		if ttl, err := parseTTL(toks[0].text); err == nil {
+			rr.TTL = ttl
+			if !p.haveTTL {
+				// without $TTL the last explicit one carries on
+				p.ttl = ttl
+			}
+		} else if c, ok := parseClass(toks[0].text); ok && c != classANY {
+			rr.Class = c
+		} else {
+			break
+		}
+		toks = toks[1:]
+	}
+	if len(toks) == 0 {
+		return nil, errors.New("missing type")
+	}
+	typ, ok := parseType(toks[0].text)
+	if !ok || typ == typeANY || typ == typeOPT {
+		return nil, fmt.Errorf("bad type %q", toks[0].text)
+	}
+	rr.Type = typ
+
+	var err error
+	rr.Data, err = p.rdata(typ, toks[1:])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", typeString(typ), err)
+	}
+	return rr, nil
+}
+
+func (p *zoneParser) rdata(typ uint16, toks []token) ([]string, error) {
+	if len(toks) > 0 && toks[0].text == `\#` && !toks[0].quoted {
+		var f []string
+		for _, t := range toks[1:] {
+			f = append(f, t.text)
+		}
+		raw, err := genericData(f)
+		if err != nil {
+			return nil, err
+		}
+		data := []string{`\#`, strconv.Itoa(len(raw))}
+		if len(raw) > 0 {
+			data = append(data, hex.EncodeToString(raw))
+		}
+		return data, nil
+	}
+
+	layout := types[typ].layout
+	if layout == "" {
+		return nil, errors.New(`unknown type, use the \# form`)
+	}
+	var data []string
+	k := 0
+	for _, f := range layout {
+		if f == 'S' {
+			if k >= len(toks) {
+				return nil, errors.New("missing rdata")
+			}
+			// long strings are split into several character strings
+			for ; k < len(toks); k++ {
+				s := unescape(toks[k].text)
+				for len(s) > 255 {
+					data = append(data, quote(s[:255]))
+					s = s[255:]
+				}
+				data = append(data, quote(s))
+			}
+			continue
+		}
+		if k >= len(toks) {
+			return nil, errors.New("missing rdata")
+		}
+		v := toks[k].text
+		k++
+
+		switch f {
+		case 'a', '6':
+			ip := net.ParseIP(v)
+			if ip == nil || (f == 'a') != (ip.To4() != nil && !strings.Contains(v, ":")) {
+				return nil, fmt.Errorf("bad address %q", v)
+			}
+			data = append(data, ip.String())
+		case 'n', 'N':
+			name, err := p.abs(v)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, name)
+		case '1', '2':
+			_, err := strconv.ParseUint(v, 10, int(f-'0')*8)
+			if err != nil {
+				return nil, fmt.Errorf("bad number %q", v)
+			}
+			data = append(data, v)
+		case '4':
+			n, err := parseTTL(v)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, strconv.FormatUint(uint64(n), 10))
+		case 's', 'v':
+			data = append(data, quote(unescape(v)))
+		case 't':
+			for _, c := range v {
+				if !('a' <= c|0x20 && c|0x20 <= 'z' || '0' <= c && c <= '9') {
+					return nil, fmt.Errorf("bad tag %q", v)
+				}
+			}
+			data = append(data, v)
+		}
+	}
+	if k != len(toks) {
+		return nil, errors.New("too much rdata")
+	}
+	return data, nil
+}
+
+type Server struct {
+	zones []*Zone
+}
+
+func server() error {
+	if len(zoneFiles) == 0 {
+		return errors.New("no -zone to serve")
+	}
+	s := &Server{}
+	for _, f := range zoneFiles {
+		z, err := loadZone(f)
+		if err != nil {
+			return err
+		}
+		log.Printf("loaded %s from %s", z.Origin, f)
+		s.zones = append(s.zones, z)
+	}
+
+	errc := make(chan error, 3)
+	if *serve != "" {
+		pc, err := net.ListenPacket("udp", *serve)
+		if err != nil {
+			return err
+		}
+		ln, err := net.Listen("tcp", pc.LocalAddr().String())
+		if err != nil {
+			return err
+		}
+		log.Printf("serving on %v udp and tcp", pc.LocalAddr())
+		go func() { errc <- s.serveUDP(pc) }()
+		go func() { errc <- s.serveStream(ln, "tcp") }()
+	}
+	if *serveTLS != "" {
+		if *certFile == "" || *keyFile == "" {
+			return errors.New("-serve-tls needs -cert and -key")
+		}
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return err
+		}
+		ln, err := tls.Listen("tcp", *serveTLS, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err != nil {
+			return err
+		}
+		log.Printf("serving on %v tls", ln.Addr())
+		go func() { errc <- s.serveStream(ln, "tls") }()
+	}
+	return <-errc
+}
+
+func (s *Server) serveUDP(pc net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, raddr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		req, err := Unpack(buf[:n])
+		if err != nil || req.Response {
+			continue
+		}
+		resp := s.answer(req, raddr, "udp")
+
+		// the reply has to fit what the client can take
+		size := 512
+		if req.EDNS != nil {
+			size = min(max(int(req.EDNS.UDPSize), 512), 4096)
+		}
+		b, err := resp.Pack()
+		if err == nil && len(b) > size {
+			resp.Answer, resp.Authority, resp.Additional = nil, nil, nil
+			resp.Truncated = true
+			b, err = resp.Pack()
+		}
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		pc.WriteTo(b, raddr)
+	}
+}
+
+func (s *Server) serveStream(ln net.Listener, proto string) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(30 * time.Second))
+				buf, err := readStream(conn)
+				if err != nil {
+					return
+				}
+				req, err := Unpack(buf)
+				if err != nil || req.Response {
+					return
+				}
+				b, err := s.answer(req, conn.RemoteAddr(), proto).Pack()
+				if err != nil {
+					log.Print(err)
+					return
+				}
+				if writeStream(conn, b) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (s *Server) answer(req *Message, from net.Addr, proto string) *Message {
+	resp := &Message{
+		ID:               req.ID,
+		Response:         true,
+		Opcode:           req.Opcode,
+		RecursionDesired: req.RecursionDesired,
+		CheckingDisabled: req.CheckingDisabled,
+		Question:         req.Question,
+	}
+	if req.EDNS != nil {
+		resp.EDNS = &EDNS{UDPSize: 1232, DO: req.EDNS.DO}
+	}
+
+	switch {
+	case req.EDNS != nil && req.EDNS.Version > 0:
+		resp.Rcode = rcodeBadVers
+	case req.Opcode != 0:
+		resp.Rcode = rcodeNotImp
+	case len(req.Question) != 1:
+		resp.Rcode = rcodeFormErr
+	default:
+		q := req.Question[0]
+		z := s.zone(q.Name)
+		if z == nil || q.Class != classIN && q.Class != classANY {
+			resp.Rcode = rcodeRefused
+			break
+		}
+		z.resolve(q, resp)
+	}
+
+	q := "-"
+	if len(req.Question) > 0 {
+		q = req.Question[0].Name + " " + typeString(req.Question[0].Type)
+	}
+	log.Printf("%v %s %s %s", from, proto, q, rcodeString(resp.Rcode))
+	return resp
+}
+
+// the most specific zone holding name
+func (s *Server) zone(name string) *Zone {
+	var best *Zone
+	for _, z := range s.zones {
+		if isSubdomain(name, z.Origin) && (best == nil || len(z.Origin) > len(best.Origin)) {
+			best = z
+		}
+	}
+	return best
+}
@@ -1,14 +1,25 @@
 // an echo server, writes back to client what client sent it
+// it can also serve the rest of the classic test services
+// (discard, chargen, daytime, time and qotd) each on their own address,
+// or act as a proxy to an upstream that injects network faults
 package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -23,10 +34,26 @@ var options struct {
 	Addr       string
 	Log        string
 	Timeout    time.Duration
+
+	EchoAddr    string
+	DiscardAddr string
+	ChargenAddr string
+	DaytimeAddr string
+	TimeAddr    string
+	QOTDAddr    string
+	QuoteFile   string
+	Status      string
+	TLSCert     string
+	TLSKey      string
+	Proxy       string
+	Control     string
 }
 
 var (
-	logger Logger
+	logger    Logger
+	stats     = NewStats()
+	quotes    = defaultQuotes
+	tlsConfig *tls.Config
 )
 
 func main() {
@@ -37,6 +64,22 @@ func main() {
 	flag.StringVar(&options.Addr, "addr", ":12321", "binding address")
 	flag.StringVar(&options.Log, "log", "", "log file")
 	flag.DurationVar(&options.Timeout, "timeout", 5*time.Second, "connection timeout")
+	flag.StringVar(&options.EchoAddr, "echo-addr", "", "serve echo (rfc 862) on tcp and udp at address")
+	flag.StringVar(&options.DiscardAddr, "discard-addr", "", "serve discard (rfc 863) on tcp and udp at address")
+	flag.StringVar(&options.ChargenAddr, "chargen-addr", "", "serve chargen (rfc 864) on tcp and udp at address")
+	flag.StringVar(&options.DaytimeAddr, "daytime-addr", "", "serve daytime (rfc 867) on tcp and udp at address")
+	flag.StringVar(&options.TimeAddr, "time-addr", "", "serve time (rfc 868) on tcp and udp at address")
+	flag.StringVar(&options.QOTDAddr, "qotd-addr", "", "serve quote of the day (rfc 865) on tcp and udp at address")
+	flag.StringVar(&options.QuoteFile, "quotes", "", "quote file for qotd, quotes are separated by lines containing only %")
+	flag.StringVar(&options.Status, "status", "", "serve connection statistics over http at address")
+	flag.StringVar(&options.TLSCert, "tls-cert", "", "tls certificate file, enables tls on stream services")
+	flag.StringVar(&options.TLSKey, "tls-key", "", "tls key file")
+	flag.StringVar(&options.Proxy, "proxy", "", "proxy connections on addr to upstream address, injecting faults")
+	flag.StringVar(&options.Control, "control", "", "control socket for changing fault rules at runtime (unix socket path or tcp address)")
+	for _, r := range faultRuleHelp {
+		name := r.name
+		flag.Func(name, r.help, func(value string) error { return faults.Set(name, value) })
+	}
 	flag.Parse()
 
 	if options.MaxConns < 0 {
@@ -51,6 +94,21 @@ func main() {
 		logger.Warnln(err)
 	}
 
+	if options.TLSCert != "" || options.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(options.TLSCert, options.TLSKey)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	if options.QuoteFile != "" {
+		quotes, err = loadQuotes(options.QuoteFile)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+
 	ticker := time.Tick(5 * time.Second)
 	go func() {
 		for {
@@ -61,11 +119,70 @@ func main() {
 		}
 	}()
 
-	if isPacketNetwork(options.Net) {
-		packetListen()
-	} else {
-		streamListen()
+	if options.Status != "" {
+		go func() {
+			logger.Printf("status listener on http://%v/\n", options.Status)
+			logger.Fatal(http.ListenAndServe(options.Status, stats))
+		}()
+	}
+
+	if options.Control != "" {
+		go controlListen(options.Control)
+	}
+
+	if options.Proxy != "" {
+		if isPacketNetwork(options.Net) {
+			packetProxy(options.Net, options.Addr, options.Proxy)
+		} else {
+			streamProxy(options.Net, options.Addr, options.Proxy)
+		}
+		return
+	}
+
+	listeners := []struct {
+		addr string
+		svc  *Service
+	}{
+		{options.EchoAddr, echoService},
+		{options.DiscardAddr, discardService},
+		{options.ChargenAddr, chargenService},
+		{options.DaytimeAddr, daytimeService},
+		{options.TimeAddr, timeService},
+		{options.QOTDAddr, qotdService},
+	}
+
+	var wg sync.WaitGroup
+	nlisten := 0
+	listen := func(svc *Service, network, addr string) {
+		nlisten++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if isPacketNetwork(network) {
+				packetListen(svc, network, addr)
+			} else {
+				streamListen(svc, network, addr)
+			}
+		}()
 	}
+
+	for _, l := range listeners {
+		if l.addr != "" {
+			listen(l.svc, "tcp", l.addr)
+			listen(l.svc, "udp", l.addr)
+		}
+	}
+
+	// without any of the service addresses, act as the
+	// plain echo/discard server on the single address
+	if nlisten == 0 {
+		svc := echoService
+		if options.Discard {
+			svc = discardService
+		}
+		listen(svc, options.Net, options.Addr)
+	}
+	wg.Wait()
 }
 
 func isPacketNetwork(network string) bool {
@@ -94,42 +211,98 @@ func mtuSize() int {
 	return mtu
 }
 
-func packetListen() {
-	logger.Printf("packet listener on options %v!%v\n", options.Net, options.Addr)
+type Service struct {
+	Name   string
+	Stream func(conn net.Conn)
+	Packet func(conn net.PacketConn, addr net.Addr, buf []byte)
+}
+
+var (
+	echoService = &Service{
+		Name:   "echo",
+		Stream: func(conn net.Conn) { copyStream(conn, conn) },
+		Packet: func(conn net.PacketConn, addr net.Addr, buf []byte) { packetReply(conn, addr, buf) },
+	}
+
+	discardService = &Service{
+		Name:   "discard",
+		Stream: func(conn net.Conn) { copyStream(ioutil.Discard, conn) },
+		Packet: func(net.PacketConn, net.Addr, []byte) {},
+	}
+
+	chargenService = &Service{
+		Name:   "chargen",
+		Stream: chargenStream,
+		Packet: func(conn net.PacketConn, addr net.Addr, buf []byte) {
+			packetReply(conn, addr, chargen(rand.Intn(513), rand.Intn(len(chargenChars))))
+		},
+	}
+
+	daytimeService = &Service{
+		Name:   "daytime",
+		Stream: func(conn net.Conn) { streamReply(conn, daytime()) },
+		Packet: func(conn net.PacketConn, addr net.Addr, buf []byte) { packetReply(conn, addr, daytime()) },
+	}
+
+	timeService = &Service{
+		Name:   "time",
+		Stream: func(conn net.Conn) { streamReply(conn, rfc868Time()) },
+		Packet: func(conn net.PacketConn, addr net.Addr, buf []byte) { packetReply(conn, addr, rfc868Time()) },
+	}
 
-	conn, err := net.ListenPacket(options.Net, options.Addr)
+	qotdService = &Service{
+		Name:   "qotd",
+		Stream: func(conn net.Conn) { streamReply(conn, quote()) },
+		Packet: func(conn net.PacketConn, addr net.Addr, buf []byte) { packetReply(conn, addr, quote()) },
+	}
+)
+
+func packetListen(svc *Service, network, addr string) {
+	logger.Printf("%v packet listener on %v!%v\n", svc.Name, network, addr)
+
+	c, err := net.ListenPacket(network, addr)
 	if err != nil {
 		logger.Fatal(err)
 	}
+	conn := stats.TrackPacket(svc.Name, network, c)
 
 	buf := make([]byte, mtuSize())
 	for {
 		n, addr, err := conn.ReadFrom(buf)
 		if err != nil {
 			logger.Warnln(err)
+			continue
 		}
-		go packetServe(conn, addr, buf[:n])
+		go packetServe(svc, conn, addr, append([]byte(nil), buf[:n]...))
 	}
 }
 
-func packetServe(conn net.PacketConn, addr net.Addr, buf []byte) {
-	logger.Printf("got packet connection from %v\n", addr)
-	conn.SetDeadline(time.Now().Add(options.Timeout))
+func packetServe(svc *Service, conn net.PacketConn, addr net.Addr, buf []byte) {
+	logger.Printf("got %v packet connection from %v\n", svc.Name, addr)
+	svc.Packet(conn, addr, buf)
+}
+
+func packetReply(conn net.PacketConn, addr net.Addr, buf []byte) {
+	conn.SetWriteDeadline(time.Now().Add(options.Timeout))
 	_, err := conn.WriteTo(buf, addr)
 	if err != nil {
 		logger.Warnf("failed to write to %v: %v\n", addr, err)
 	}
 }
 
-func streamListen() {
-	ln, err := net.Listen(options.Net, options.Addr)
+func streamListen(svc *Service, network, addr string) {
+	ln, err := net.Listen(network, addr)
 	if err != nil {
 		logger.Fatal(err)
 	}
 
-	logger.Printf("stream listener on options %v!%v\n", options.Net, options.Addr)
+	logger.Printf("%v stream listener on %v!%v\n", svc.Name, network, addr)
 
 	ln = NewLimitedListener(ln, options.MaxConns)
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
 	numConns := uint64(0)
 	for {
 		conn, err := ln.Accept()
@@ -138,24 +311,28 @@ func streamListen() {
 			continue
 		}
 		atomic.AddUint64(&numConns, 1)
-		go streamServe(conn, &numConns)
+		go streamServe(svc, stats.Track(svc.Name, network, conn), &numConns)
 	}
 }
 
-func streamServe(conn net.Conn, numConns *uint64) {
-	logger.Printf("serving %v (%v connections total)", conn.RemoteAddr(), atomic.LoadUint64(numConns))
+func streamServe(svc *Service, conn net.Conn, numConns *uint64) {
+	logger.Printf("serving %v to %v (%v connections total)", svc.Name, conn.RemoteAddr(), atomic.LoadUint64(numConns))
 
 	conn.SetDeadline(time.Now().Add(options.Timeout))
+	svc.Stream(conn)
+
+	logger.Printf("closing %v connection to %v (%v connections total)",
+		svc.Name, conn.RemoteAddr(), atomic.AddUint64(numConns, ^uint64(0)))
+	conn.Close()
+}
+
+func copyStream(output io.Writer, conn net.Conn) {
 	retries := 0
 	for {
-		output := ioutil.Discard
-		if !options.Discard {
-			output = conn
-		}
 		_, err := io.Copy(output, conn)
 		if err != nil {
 			ne, ok := err.(net.Error)
-			if ok && ne.Temporary() {
+			if ok && ne.Timeout() {
 				conn.SetDeadline(time.Now().Add(options.Timeout))
 				if options.MaxRetries > 0 {
 					if retries++; retries > options.MaxRetries {
@@ -166,13 +343,817 @@ func streamServe(conn net.Conn, numConns *uint64) {
 				continue
 			}
 			logger.Println(err)
+		}
+		break
+	}
+}
+
+func streamReply(conn net.Conn, buf []byte) {
+	_, err := conn.Write(buf)
+	if err != nil {
+		logger.Warnf("failed to write to %v: %v\n", conn.RemoteAddr(), err)
+	}
+}
+
+// chargen over a stream keeps sending until the client goes away,
+// whatever the client sends is thrown away
+func chargenStream(conn net.Conn) {
+	go io.Copy(ioutil.Discard, conn)
+
+	for offset := 0; ; offset++ {
+		conn.SetWriteDeadline(time.Now().Add(options.Timeout))
+		_, err := conn.Write(chargen(chargenLine+2, offset))
+		if err != nil {
 			break
 		}
 	}
+}
 
-	logger.Printf("closing connection to %v (%v connections total)",
-		conn.RemoteAddr(), atomic.AddUint64(numConns, ^uint64(0)))
-	conn.Close()
+const (
+	chargenChars = "!\"#$%&'()*+,-./0123456789:;<=>?@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\\]^_`abcdefghijklmnopqrstuvwxyz{|}~ "
+	chargenLine  = 72
+)
+
+// the rotating pattern from rfc 864, each line starts
+// one character further into the printable set
+func chargen(n, offset int) []byte {
+	buf := make([]byte, 0, n)
+	for len(buf) < n {
+		for i := 0; i < chargenLine && len(buf) < n; i++ {
+			buf = append(buf, chargenChars[(offset+i)%len(chargenChars)])
+		}
+		buf = append(buf, '\r', '\n')
+		offset++
+	}
+	return buf[:n]
+}
+
+func daytime() []byte {
+	return []byte(time.Now().Format("Monday, January 2, 2006 15:04:05-MST\r\n"))
+}
+
+// seconds since 1900-01-01 00:00 UTC, truncated to 32 bits
+func rfc868Time() []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(time.Now().Unix()+2208988800))
+	return buf[:]
+}
+
+// rfc 865 limits a quote to 512 characters
+func quote() []byte {
+	q := quotes[rand.Intn(len(quotes))]
+	q = strings.Replace(strings.TrimSpace(q), "\n", "\r\n", -1) + "\r\n"
+	if len(q) > 512 {
+		q = q[:510] + "\r\n"
+	}
+	return []byte(q)
+}
+
+// fortune(6) format
+func loadQuotes(name string) ([]string, error) {
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var q []string
+	var sb strings.Builder
+	for _, line := range strings.Split(string(buf), "\n") {
+		if strings.TrimSpace(line) == "%" {
+			if strings.TrimSpace(sb.String()) != "" {
+				q = append(q, sb.String())
+			}
+			sb.Reset()
+			continue
+		}
+		sb.WriteString(line + "\n")
+	}
+	if strings.TrimSpace(sb.String()) != "" {
+		q = append(q, sb.String())
+	}
+	if len(q) == 0 {
+		q = defaultQuotes
+	}
+	return q, nil
+}
+
+var defaultQuotes = []string{
+	"Be liberal in what you accept, and conservative in what you send.\n\t-- Jon Postel",
+	"The network is reliable.\n\t-- first fallacy of distributed computing",
+	"There is no problem in computer science that cannot be solved by\nanother level of indirection.\n\t-- David Wheeler",
+	"Never underestimate the bandwidth of a station wagon full of tapes\nhurtling down the highway.\n\t-- Andrew Tanenbaum",
+}
+
+// Stats keeps byte counters for every service and for the stream
+// connections that are currently open, it serves them as json
+type Stats struct {
+	mu       sync.Mutex
+	start    time.Time
+	nextID   uint64
+	services map[string]*ServiceStats
+	conns    map[uint64]*ConnStats
+}
+
+type ServiceStats struct {
+	Name       string `json:"name"`
+	Network    string `json:"network"`
+	Addr       string `json:"addr"`
+	Conns      uint64 `json:"conns"`
+	Active     int64  `json:"active"`
+	BytesIn    uint64 `json:"bytes_in"`
+	BytesOut   uint64 `json:"bytes_out"`
+	PacketsIn  uint64 `json:"packets_in"`
+	PacketsOut uint64 `json:"packets_out"`
+}
+
+type ConnStats struct {
+	ID       uint64    `json:"id"`
+	Service  string    `json:"service"`
+	Local    string    `json:"local"`
+	Remote   string    `json:"remote"`
+	Start    time.Time `json:"start"`
+	BytesIn  uint64    `json:"bytes_in"`
+	BytesOut uint64    `json:"bytes_out"`
+	RateIn   float64   `json:"rate_in"`
+	RateOut  float64   `json:"rate_out"`
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		start:    time.Now(),
+		services: make(map[string]*ServiceStats),
+		conns:    make(map[uint64]*ConnStats),
+	}
+}
+
+func (s *Stats) service(name, network string, addr net.Addr) *ServiceStats {
+	key := name + "/" + network + "/" + addr.String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss := s.services[key]
+	if ss == nil {
+		ss = &ServiceStats{Name: name, Network: network, Addr: addr.String()}
+		s.services[key] = ss
+	}
+	return ss
+}
+
+func (s *Stats) Track(name, network string, conn net.Conn) net.Conn {
+	ss := s.service(name, network, conn.LocalAddr())
+	atomic.AddUint64(&ss.Conns, 1)
+	atomic.AddInt64(&ss.Active, 1)
+
+	s.mu.Lock()
+	s.nextID++
+	cs := &ConnStats{
+		ID:      s.nextID,
+		Service: name,
+		Local:   conn.LocalAddr().String(),
+		Remote:  conn.RemoteAddr().String(),
+		Start:   time.Now(),
+	}
+	s.conns[cs.ID] = cs
+	s.mu.Unlock()
+
+	return &StatsConn{Conn: conn, stats: s, ss: ss, cs: cs}
+}
+
+func (s *Stats) TrackPacket(name, network string, conn net.PacketConn) net.PacketConn {
+	return &StatsPacketConn{PacketConn: conn, ss: s.service(name, network, conn.LocalAddr())}
+}
+
+func (s *Stats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	resp := struct {
+		Start       time.Time      `json:"start"`
+		Uptime      string         `json:"uptime"`
+		Services    []ServiceStats `json:"services"`
+		Connections []ConnStats    `json:"connections"`
+	}{
+		Start:       s.start,
+		Uptime:      now.Sub(s.start).Round(time.Second).String(),
+		Services:    []ServiceStats{},
+		Connections: []ConnStats{},
+	}
+
+	s.mu.Lock()
+	for _, ss := range s.services {
+		resp.Services = append(resp.Services, ServiceStats{
+			Name:       ss.Name,
+			Network:    ss.Network,
+			Addr:       ss.Addr,
+			Conns:      atomic.LoadUint64(&ss.Conns),
+			Active:     atomic.LoadInt64(&ss.Active),
+			BytesIn:    atomic.LoadUint64(&ss.BytesIn),
+			BytesOut:   atomic.LoadUint64(&ss.BytesOut),
+			PacketsIn:  atomic.LoadUint64(&ss.PacketsIn),
+			PacketsOut: atomic.LoadUint64(&ss.PacketsOut),
+		})
+	}
+	for _, cs := range s.conns {
+		c := ConnStats{
+			ID:       cs.ID,
+			Service:  cs.Service,
+			Local:    cs.Local,
+			Remote:   cs.Remote,
+			Start:    cs.Start,
+			BytesIn:  atomic.LoadUint64(&cs.BytesIn),
+			BytesOut: atomic.LoadUint64(&cs.BytesOut),
+		}
+		if secs := now.Sub(c.Start).Seconds(); secs > 0 {
+			c.RateIn = float64(c.BytesIn) / secs
+			c.RateOut = float64(c.BytesOut) / secs
+		}
+		resp.Connections = append(resp.Connections, c)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(resp.Services, func(i, j int) bool {
+		a, b := resp.Services[i], resp.Services[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Network < b.Network
+	})
+	sort.Slice(resp.Connections, func(i, j int) bool {
+		return resp.Connections[i].ID < resp.Connections[j].ID
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(resp)
+}
+
+type StatsConn struct {
+	net.Conn
+	stats *Stats
+	ss    *ServiceStats
+	cs    *ConnStats
+	once  sync.Once
+}
+
+func (c *StatsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.cs.BytesIn, uint64(n))
+	atomic.AddUint64(&c.ss.BytesIn, uint64(n))
+	return n, err
+}
+
+func (c *StatsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.cs.BytesOut, uint64(n))
+	atomic.AddUint64(&c.ss.BytesOut, uint64(n))
+	return n, err
+}
+
+func (c *StatsConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.ss.Active, -1)
+		c.stats.mu.Lock()
+		delete(c.stats.conns, c.cs.ID)
+		c.stats.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+type StatsPacketConn struct {
+	net.PacketConn
+	ss *ServiceStats
+}
+
+func (c *StatsPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil {
+		atomic.AddUint64(&c.ss.PacketsIn, 1)
+		atomic.AddUint64(&c.ss.BytesIn, uint64(n))
+	}
+	return n, addr, err
+}
+
+func (c *StatsPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if err == nil {
+		atomic.AddUint64(&c.ss.PacketsOut, 1)
+		atomic.AddUint64(&c.ss.BytesOut, uint64(n))
+	}
+	return n, err
+}
+
+// FaultRules describe how the proxy mistreats traffic, they apply
+// to every connection and can be changed while it is running
+type FaultRules struct {
+	Latency    time.Duration
+	Jitter     time.Duration
+	Dist       string
+	Drop       float64
+	Reorder    float64
+	ResetAfter int64
+	RateUp     float64
+	RateDown   float64
+	Burst      int64
+}
+
+type Faults struct {
+	mu    sync.RWMutex
+	rules FaultRules
+}
+
+var faults = &Faults{rules: FaultRules{Dist: "uniform"}}
+
+var faultRuleHelp = []struct {
+	name string
+	help string
+}{
+	{"latency", "proxy: added delay per packet or chunk"},
+	{"jitter", "proxy: spread of the added delay"},
+	{"dist", "proxy: latency distribution [constant, uniform, normal, exponential]"},
+	{"drop", "proxy: probability of dropping a udp packet"},
+	{"reorder", "proxy: probability of holding back a udp packet past later ones"},
+	{"reset-after", "proxy: reset tcp connections after this many bytes in both directions (k/m/g suffixes allowed)"},
+	{"rate-up", "proxy: client to upstream bandwidth in bytes/sec (k/m/g suffixes allowed)"},
+	{"rate-down", "proxy: upstream to client bandwidth in bytes/sec (k/m/g suffixes allowed)"},
+	{"burst", "proxy: token bucket size in bytes for the bandwidth limits"},
+}
+
+func (f *Faults) Rules() FaultRules {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.rules
+}
+
+func (f *Faults) Reset() {
+	f.mu.Lock()
+	f.rules = FaultRules{Dist: "uniform"}
+	f.mu.Unlock()
+}
+
+func (f *Faults) Set(name, value string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	r := &f.rules
+	var err error
+	switch name {
+	case "latency":
+		r.Latency, err = parseDuration(value)
+	case "jitter":
+		r.Jitter, err = parseDuration(value)
+	case "dist":
+		switch value {
+		case "constant", "uniform", "normal", "exponential":
+			r.Dist = value
+		default:
+			err = fmt.Errorf("unknown latency distribution %q", value)
+		}
+	case "drop":
+		r.Drop, err = parseProbability(value)
+	case "reorder":
+		r.Reorder, err = parseProbability(value)
+	case "reset-after":
+		r.ResetAfter, err = parseSize(value)
+	case "rate-up":
+		var n int64
+		n, err = parseSize(value)
+		r.RateUp = float64(n)
+	case "rate-down":
+		var n int64
+		n, err = parseSize(value)
+		r.RateDown = float64(n)
+	case "burst":
+		r.Burst, err = parseSize(value)
+	default:
+		err = fmt.Errorf("unknown rule %q", name)
+	}
+	return err
+}
+
+func (r FaultRules) String() string {
+	return fmt.Sprintf("latency=%v jitter=%v dist=%v drop=%v reorder=%v reset-after=%v rate-up=%v rate-down=%v burst=%v",
+		r.Latency, r.Jitter, r.Dist, r.Drop, r.Reorder, r.ResetAfter, r.RateUp, r.RateDown, r.Burst)
+}
+
+// Delay samples the latency distribution, the result is never negative
+func (r FaultRules) Delay() time.Duration {
+	d := float64(r.Latency)
+	j := float64(r.Jitter)
+	switch r.Dist {
+	case "uniform":
+		d += (2*rand.Float64() - 1) * j
+	case "normal":
+		d += rand.NormFloat64() * j
+	case "exponential":
+		d += rand.ExpFloat64() * j
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+func parseDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("negative duration %v", value)
+	}
+	return d, err
+}
+
+func parseProbability(value string) (float64, error) {
+	p, err := strconv.ParseFloat(value, 64)
+	if err == nil && (p < 0 || p > 1) {
+		err = fmt.Errorf("probability %v out of range [0, 1]", value)
+	}
+	return p, err
+}
+
+func parseSize(value string) (int64, error) {
+	mult := int64(1)
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'k', 'K':
+			mult = 1 << 10
+		case 'm', 'M':
+			mult = 1 << 20
+		case 'g', 'G':
+			mult = 1 << 30
+		}
+	}
+	if mult != 1 {
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err == nil && n < 0 {
+		err = fmt.Errorf("negative size %v", value)
+	}
+	return n * mult, err
+}
+
+// TokenBucket hands out the time to wait before n bytes may be sent
+// at the given rate, the rate is passed in on every call so the
+// limits can change at runtime
+type TokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (tb *TokenBucket) Reserve(n int, rate float64, burst int64) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	size := float64(burst)
+	if size <= 0 {
+		size = rate / 10
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+	if tb.last.IsZero() {
+		tb.tokens = size
+	} else {
+		tb.tokens += now.Sub(tb.last).Seconds() * rate
+		if tb.tokens > size {
+			tb.tokens = size
+		}
+	}
+	tb.last = now
+
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / rate * float64(time.Second))
+}
+
+func controlListen(addr string) {
+	network := "tcp"
+	if strings.Contains(addr, "/") {
+		network = "unix"
+		os.Remove(addr)
+	}
+
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	logger.Printf("control listener on %v!%v\n", network, addr)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logger.Warnln(err)
+			continue
+		}
+		go controlServe(conn)
+	}
+}
+
+// the control protocol is line based:
+// show, reset, set <rule> <value>
+func controlServe(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+
+		switch strings.ToLower(args[0]) {
+		case "show":
+			fmt.Fprintln(conn, faults.Rules())
+		case "reset":
+			faults.Reset()
+			fmt.Fprintln(conn, "ok")
+		case "set":
+			if len(args) != 3 {
+				fmt.Fprintln(conn, "error: usage: set <rule> <value>")
+				break
+			}
+			if err := faults.Set(args[1], args[2]); err != nil {
+				fmt.Fprintln(conn, "error:", err)
+				break
+			}
+			logger.Printf("fault rules changed: %v\n", faults.Rules())
+			fmt.Fprintln(conn, "ok")
+		case "help":
+			fmt.Fprintln(conn, "show | reset | set <rule> <value>")
+			for _, r := range faultRuleHelp {
+				fmt.Fprintf(conn, "  %-12s %s\n", r.name, strings.TrimPrefix(r.help, "proxy: "))
+			}
+		case "quit":
+			return
+		default:
+			fmt.Fprintln(conn, "error: unknown command", args[0])
+		}
+	}
+}
+
+func streamProxy(network, addr, upstream string) {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	logger.Printf("stream proxy on %v!%v to %v\n", network, addr, upstream)
+
+	ln = NewLimitedListener(ln, options.MaxConns)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logger.Warnln(err)
+			continue
+		}
+		go streamProxyServe(conn, network, upstream)
+	}
+}
+
+type proxySession struct {
+	client   net.Conn
+	upstream net.Conn
+	bytes    int64
+	once     sync.Once
+}
+
+func streamProxyServe(client net.Conn, network, upstream string) {
+	logger.Printf("proxying %v to %v\n", client.RemoteAddr(), upstream)
+
+	up, err := net.DialTimeout(network, upstream, options.Timeout)
+	if err != nil {
+		logger.Warnf("failed to connect to %v: %v\n", upstream, err)
+		client.Close()
+		return
+	}
+
+	s := &proxySession{client: client, upstream: up}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { s.pipe(up, client, true); wg.Done() }()
+	go func() { s.pipe(client, up, false); wg.Done() }()
+	wg.Wait()
+
+	logger.Printf("closing proxy connection from %v (%v bytes)\n", client.RemoteAddr(), atomic.LoadInt64(&s.bytes))
+	client.Close()
+	up.Close()
+}
+
+type proxyChunk struct {
+	buf []byte
+	at  time.Time
+}
+
+// pipe copies one direction of the connection, the reader stamps every chunk
+// with its delivery time and the writer holds it until then, delivery times
+// never go backwards since a stream has to stay in order
+func (s *proxySession) pipe(dst, src net.Conn, up bool) {
+	var tb TokenBucket
+	ch := make(chan proxyChunk, 64)
+
+	go func() {
+		defer close(ch)
+		var last time.Time
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := src.Read(buf)
+			if n > 0 {
+				at := time.Now().Add(faults.Rules().Delay())
+				if at.Before(last) {
+					at = last
+				}
+				last = at
+				ch <- proxyChunk{buf[:n], at}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for c := range ch {
+		time.Sleep(time.Until(c.at))
+
+		r := faults.Rules()
+		rate := r.RateDown
+		if up {
+			rate = r.RateUp
+		}
+		time.Sleep(tb.Reserve(len(c.buf), rate, r.Burst))
+
+		buf := c.buf
+		reset := false
+		total := atomic.AddInt64(&s.bytes, int64(len(buf)))
+		if r.ResetAfter > 0 && total >= r.ResetAfter {
+			buf = buf[:max(0, int64(len(buf))-(total-r.ResetAfter))]
+			reset = true
+		}
+
+		_, err := dst.Write(buf)
+		if reset {
+			s.reset()
+		}
+		if err != nil || reset {
+			// unblock the reader
+			src.Close()
+			for range ch {
+			}
+			return
+		}
+	}
+
+	// pass the half close through so the other side sees eof
+	if tc := tcpConn(dst); tc != nil {
+		tc.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+func (s *proxySession) reset() {
+	s.once.Do(func() {
+		logger.Printf("resetting proxy connection from %v after %v bytes\n", s.client.RemoteAddr(), atomic.LoadInt64(&s.bytes))
+		for _, c := range []net.Conn{s.client, s.upstream} {
+			if tc := tcpConn(c); tc != nil {
+				tc.SetLinger(0)
+			}
+			c.Close()
+		}
+	})
+}
+
+func tcpConn(c net.Conn) *net.TCPConn {
+	if lc, ok := c.(*LimitedConn); ok {
+		c = lc.Conn
+	}
+	tc, _ := c.(*net.TCPConn)
+	return tc
+}
+
+func packetProxy(network, addr, upstream string) {
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	logger.Printf("packet proxy on %v!%v to %v\n", network, addr, upstream)
+
+	var (
+		mu       sync.Mutex
+		sessions = make(map[string]*packetSession)
+		sem      Semaphore
+		tb       TokenBucket
+	)
+	if options.MaxConns > 0 {
+		sem = NewSemaphore(options.MaxConns)
+	}
+
+	buf := make([]byte, mtuSize())
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			logger.Warnln(err)
+			continue
+		}
+
+		mu.Lock()
+		s := sessions[addr.String()]
+		if s == nil {
+			if sem != nil && !sem.TryAcquire() {
+				mu.Unlock()
+				logger.Warnf("too many sessions, dropping packet from %v\n", addr)
+				continue
+			}
+
+			up, err := net.Dial(network, upstream)
+			if err != nil {
+				mu.Unlock()
+				if sem != nil {
+					sem.Release()
+				}
+				logger.Warnf("failed to connect to %v: %v\n", upstream, err)
+				continue
+			}
+
+			logger.Printf("proxying packets from %v to %v\n", addr, upstream)
+			s = &packetSession{conn: conn, addr: addr, upstream: up}
+			sessions[addr.String()] = s
+			go func() {
+				s.serve()
+				mu.Lock()
+				delete(sessions, s.addr.String())
+				mu.Unlock()
+				if sem != nil {
+					sem.Release()
+				}
+				logger.Printf("closing packet session from %v\n", s.addr)
+			}()
+		}
+		mu.Unlock()
+
+		s.upstream.SetReadDeadline(time.Now().Add(options.Timeout))
+		deliverPacket(&tb, true, append([]byte(nil), buf[:n]...), func(b []byte) {
+			s.upstream.Write(b)
+		})
+	}
+}
+
+// packetSession forwards replies from the upstream back to one client,
+// it ends when the upstream has been quiet for the timeout
+type packetSession struct {
+	conn     net.PacketConn
+	addr     net.Addr
+	upstream net.Conn
+	tb       TokenBucket
+}
+
+func (s *packetSession) serve() {
+	defer s.upstream.Close()
+
+	buf := make([]byte, mtuSize())
+	s.upstream.SetReadDeadline(time.Now().Add(options.Timeout))
+	for {
+		n, err := s.upstream.Read(buf)
+		if err != nil {
+			ne, ok := err.(net.Error)
+			if !ok || !ne.Timeout() {
+				logger.Warnln(err)
+			}
+			return
+		}
+		s.upstream.SetReadDeadline(time.Now().Add(options.Timeout))
+		deliverPacket(&s.tb, false, append([]byte(nil), buf[:n]...), func(b []byte) {
+			s.conn.WriteTo(b, s.addr)
+		})
+	}
+}
+
+// deliverPacket applies the fault rules to a datagram, unlike a stream
+// packets are scheduled independently so jitter alone can reorder them
+func deliverPacket(tb *TokenBucket, up bool, buf []byte, send func([]byte)) {
+	r := faults.Rules()
+	if r.Drop > 0 && rand.Float64() < r.Drop {
+		return
+	}
+
+	rate := r.RateDown
+	if up {
+		rate = r.RateUp
+	}
+	delay := r.Delay() + tb.Reserve(len(buf), rate, r.Burst)
+	if r.Reorder > 0 && rand.Float64() < r.Reorder {
+		delay += max(r.Latency+r.Jitter, 10*time.Millisecond)
+	}
+
+	if delay == 0 {
+		send(buf)
+		return
+	}
+	time.AfterFunc(delay, func() { send(buf) })
 }
 
 type Logger struct {
@@ -255,6 +1236,15 @@ func NewSemaphore(n int) Semaphore {
 func (s Semaphore) Acquire() { <-s }
 func (s Semaphore) Release() { s <- struct{}{} }
 
+func (s Semaphore) TryAcquire() bool {
+	select {
+	case <-s:
+		return true
+	default:
+		return false
+	}
+}
+
 type LimitedListener struct {
 	net.Listener
 	sem Semaphore
@@ -282,10 +1272,13 @@ func (ln *LimitedListener) Accept() (net.Conn, error) {
 
 type LimitedConn struct {
 	net.Conn
-	sem Semaphore
+	sem  Semaphore
+	once sync.Once
 }
 
+// the proxy can close a connection from both of its pipes and again
+// when it is done, the slot is only given back the first time
 func (c *LimitedConn) Close() error {
-	c.sem.Release()
+	c.once.Do(c.sem.Release)
 	return c.Conn.Close()
 }
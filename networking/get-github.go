@@ -1,22 +1,47 @@
+// lists and clones a github user's repos, -m keeps a set of bare
+// mirrors up to date instead and writes a manifest of what was synced
+
+// a token in GITHUB_TOKEN (or GH_TOKEN) is sent with every api request
+// and handed to git, that raises the rate limit and makes private repos
+// visible when it belongs to the user being mirrored
+
 package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
-	all    = flag.Bool("a", false, "get all projects")
-	output = flag.String("o", ".", "output directory")
-
+	all      = flag.Bool("a", false, "get all projects")
+	output   = flag.String("o", ".", "output directory")
+	mirror   = flag.Bool("m", false, "keep bare mirrors of everything selected up to date")
+	orgs     = flag.Bool("orgs", false, "include repos of the user's organizations")
+	starred  = flag.Bool("starred", false, "include repos the user starred")
+	gists    = flag.Bool("gists", false, "include the user's gists")
+	wikis    = flag.Bool("wikis", false, "include wikis of the repos")
+	forks    = flag.Bool("forks", true, "include forks")
+	force    = flag.Bool("f", false, "fetch everything even if the manifest says it is unchanged")
+	manifest = flag.String("manifest", "", "manifest file (default manifest.json in the output directory with -m)")
+	apiBase  = flag.String("api", "https://api.github.com", "api base url")
+	wait     = flag.Bool("wait", true, "wait for the rate limit to reset instead of failing")
+
+	token  = ""
 	status = 0
 )
 
@@ -27,22 +52,44 @@ func main() {
 		usage()
 	}
 
+	token = os.Getenv("GITHUB_TOKEN")
+	if token == "" {
+		token = os.Getenv("GH_TOKEN")
+	}
+	if env := os.Getenv("GITHUB_API_URL"); env != "" && !isFlagSet("api") {
+		*apiBase = env
+	}
+	*apiBase = strings.TrimSuffix(*apiBase, "/")
+
 	user, err := getUser(flag.Arg(0))
 	ck(err)
 
-	repos, err := getRepos(user)
+	items, err := collect(user)
 	ck(err)
 
+	if *mirror {
+		ck(os.MkdirAll(*output, 0755))
+		if *manifest == "" {
+			*manifest = filepath.Join(*output, "manifest.json")
+		}
+		sync(user, selectItems(items))
+		os.Exit(status)
+	}
+
 	if flag.NArg() == 1 && !*all {
 		fmt.Println(user)
-		fmt.Println("Repos:\n")
-		for i, r := range repos {
-			fmt.Printf("%d %s %q %s", i+1, r.Name, r.Description, r.Url)
-			if r.Stargazers_Count != 0 {
-				fmt.Printf(" (%d stars) ", r.Stargazers_Count)
+		fmt.Println("Repos:")
+		fmt.Println()
+		for i, it := range items {
+			fmt.Printf("%d %s %q %s", i+1, it.Name, it.Description, it.Url)
+			if it.Stars != 0 {
+				fmt.Printf(" (%d stars) ", it.Stars)
 			}
-			if r.Forks_Count != 0 {
-				fmt.Printf("(%d forks) ", r.Forks_Count)
+			if it.Forks != 0 {
+				fmt.Printf("(%d forks) ", it.Forks)
+			}
+			if it.Kind != "repo" {
+				fmt.Printf("[%s]", it.Kind)
 			}
 			fmt.Printf("\n")
 		}
@@ -52,21 +99,42 @@ func main() {
 	os.MkdirAll(*output, 0755)
 	ck(os.Chdir(*output))
 
-	if *all {
-		for _, r := range repos {
-			clup(r.Name, r.Clone_Url)
+	for _, it := range selectItems(items) {
+		clup(it.Name, it.Clone_Url)
+	}
+	os.Exit(status)
+}
+
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
-	} else {
-		for _, name := range flag.Args()[1:] {
-			for _, r := range repos {
-				if strings.ToLower(r.Name) == strings.ToLower(name) {
-					clup(r.Name, r.Clone_Url)
-					break
-				}
+	})
+	return set
+}
+
+// everything with -a, otherwise the projects named on the command line
+func selectItems(items []Item) []Item {
+	if *all || flag.NArg() == 1 {
+		return items
+	}
+
+	var sel []Item
+	for _, name := range flag.Args()[1:] {
+		found := false
+		for _, it := range items {
+			if strings.EqualFold(it.Name, name) || strings.EqualFold(it.Owner+"/"+it.Name, name) {
+				sel = append(sel, it)
+				found = true
 			}
 		}
+		if !found {
+			ek(fmt.Errorf("%s: no such project", name))
+		}
 	}
-	os.Exit(status)
+	return sel
 }
 
 func clup(name string, url string) {
@@ -99,27 +167,122 @@ func ek(err error) {
 }
 
 func get(url string, v interface{}) error {
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
+	_, err := request(url, v)
+	return err
+}
+
+// fetches every page of a list, following the next links
+func getPages[T any](u string) ([]T, error) {
+	var list []T
+	u = withPerPage(u)
+	for u != "" {
+		var page []T
+		next, err := request(u, &page)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, page...)
+		u = next
 	}
-	defer resp.Body.Close()
+	return list, nil
+}
 
-	buf, err := ioutil.ReadAll(resp.Body)
+func withPerPage(u string) string {
+	p, err := url.Parse(u)
 	if err != nil {
-		return err
+		return u
+	}
+	q := p.Query()
+	if q.Get("per_page") == "" {
+		q.Set("per_page", "100")
+		p.RawQuery = q.Encode()
 	}
+	return p.String()
+}
 
-	if resp.StatusCode != 200 {
-		e := &Error{}
-		err := json.Unmarshal(buf, &e)
+// does one api request, waiting out the rate limit if we hit it,
+// and returns the url of the next page if there is one
+func request(url string, v interface{}) (next string, err error) {
+	for try := 0; ; try++ {
+		req, err := http.NewRequest("GET", url, nil)
 		if err != nil {
-			return err
+			return "", err
 		}
-		return e
+		req.Header.Set("Accept", "application/vnd.github+json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		buf, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+
+		if delay, limited := rateLimited(resp); limited {
+			if !*wait || try >= 3 {
+				return "", fmt.Errorf("rate limit exceeded, resets in %v", delay.Round(time.Second))
+			}
+			fmt.Fprintf(os.Stderr, "get-github: rate limit exceeded, waiting %v\n", delay.Round(time.Second))
+			time.Sleep(delay)
+			continue
+		}
+		if n, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil && n > 0 && n < 10 {
+			fmt.Fprintf(os.Stderr, "get-github: only %d api requests left\n", n)
+		}
+
+		if resp.StatusCode != 200 {
+			e := &Error{}
+			err := json.Unmarshal(buf, &e)
+			if err != nil {
+				return "", fmt.Errorf("%s: %s", url, resp.Status)
+			}
+			return "", e
+		}
+
+		return nextLink(resp.Header.Get("Link")), json.Unmarshal(buf, v)
+	}
+}
+
+// primary limits come with X-RateLimit-Remaining: 0 and a reset time,
+// secondary limits with Retry-After
+func rateLimited(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != 403 && resp.StatusCode != 429 {
+		return 0, false
 	}
+	if s := resp.Header.Get("Retry-After"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil {
+			return time.Duration(n) * time.Second, true
+		}
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+		if err != nil {
+			return time.Minute, true
+		}
+		return max(time.Until(time.Unix(reset, 0))+time.Second, time.Second), true
+	}
+	return 0, false
+}
 
-	return json.Unmarshal(buf, v)
+var (
+	linkTag = regexp.MustCompile("<(.*?)>")
+	linkRel = regexp.MustCompile("rel=\"(.*?)\"")
+)
+
+func nextLink(link string) string {
+	for _, part := range strings.Split(link, ",") {
+		m := linkTag.FindStringSubmatch(part)
+		n := linkRel.FindStringSubmatch(part)
+		if m != nil && n != nil && n[1] == "next" {
+			return m[1]
+		}
+	}
+	return ""
 }
 
 type Error struct {
@@ -170,7 +333,7 @@ func (u *User) String() string {
 }
 
 func getUser(name string) (*User, error) {
-	url := fmt.Sprintf("https://api.github.com/users/%v", name)
+	url := fmt.Sprintf("%s/users/%v", *apiBase, url.PathEscape(name))
 	user := &User{}
 	err := get(url, user)
 	if err != nil {
@@ -179,79 +342,304 @@ func getUser(name string) (*User, error) {
 	return user, nil
 }
 
+type Owner struct {
+	Login string
+}
+
 type Repo struct {
 	Id               uint64
 	Name             string
 	Full_Name        string
 	Description      string
 	Url              string
+	Html_Url         string
 	Clone_Url        string
+	Owner            Owner
+	Fork             bool
+	Private          bool
+	Has_Wiki         bool
+	Pushed_At        string
 	Stargazers_Count uint64
 	Forks_Count      uint64
 }
 
+type Gist struct {
+	Id           string
+	Description  string
+	Html_Url     string
+	Git_Pull_Url string
+	Owner        Owner
+	Updated_At   string
+}
+
+type Org struct {
+	Login     string
+	Repos_Url string
+}
+
+// with a token belonging to the user we can list their private repos too
 func getRepos(u *User) ([]Repo, error) {
+	if token != "" {
+		var me User
+		if err := get(*apiBase+"/user", &me); err == nil && strings.EqualFold(me.Login, u.Login) {
+			return getPages[Repo](*apiBase + "/user/repos?affiliation=owner")
+		}
+	}
+	return getPages[Repo](u.Repos_Url)
+}
+
+// something that can be cloned, a repo, its wiki or a gist
+type Item struct {
+	Kind        string `json:"kind"`
+	Owner       string `json:"owner"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Url         string `json:"url"`
+	Clone_Url   string `json:"clone_url"`
+	Updated     string `json:"updated,omitempty"`
+	Stars       uint64 `json:"-"`
+	Forks       uint64 `json:"-"`
+}
+
+func (it *Item) Path() string {
+	switch it.Kind {
+	case "gist":
+		return filepath.Join(it.Owner, "gists", it.Name+".git")
+	case "wiki":
+		return filepath.Join(it.Owner, it.Name+".wiki.git")
+	}
+	return filepath.Join(it.Owner, it.Name+".git")
+}
+
+func collect(u *User) ([]Item, error) {
 	var repos []Repo
+	kinds := map[string]string{}
 
-	tag := regexp.MustCompile("<(.*?)>")
-	rel := regexp.MustCompile("(rel=\".*?\")")
-	url := u.Repos_Url
-loop:
-	for {
-		resp, err := http.Get(url)
-		if err != nil {
-			return nil, err
+	add := func(list []Repo, kind string) {
+		for _, r := range list {
+			if _, dup := kinds[r.Full_Name]; dup {
+				continue
+			}
+			kinds[r.Full_Name] = kind
+			repos = append(repos, r)
 		}
+	}
 
-		buf, err := ioutil.ReadAll(resp.Body)
+	list, err := getRepos(u)
+	if err != nil {
+		return nil, err
+	}
+	add(list, "repo")
+
+	if *orgs {
+		ol, err := getPages[Org](fmt.Sprintf("%s/users/%s/orgs", *apiBase, url.PathEscape(u.Login)))
 		if err != nil {
 			return nil, err
 		}
-
-		if resp.StatusCode != 200 {
-			e := &Error{}
-			err := json.Unmarshal(buf, &e)
+		for _, o := range ol {
+			list, err := getPages[Repo](fmt.Sprintf("%s/orgs/%s/repos?type=all", *apiBase, url.PathEscape(o.Login)))
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("org %s: %v", o.Login, err)
 			}
-			return nil, e
+			add(list, "org")
 		}
+	}
 
-		repo := make([]Repo, 0)
-		err = json.Unmarshal(buf, &repo)
+	if *starred {
+		list, err := getPages[Repo](fmt.Sprintf("%s/users/%s/starred", *apiBase, url.PathEscape(u.Login)))
 		if err != nil {
 			return nil, err
 		}
-		repos = append(repos, repo...)
+		add(list, "starred")
+	}
 
-		link := resp.Header.Get("Link")
-		m := tag.FindAllString(link, -1)
-		n := rel.FindAllString(link, -1)
-		if len(m) != len(n) {
-			break
+	var items []Item
+	for _, r := range repos {
+		if r.Fork && !*forks {
+			continue
+		}
+		owner := r.Owner.Login
+		if owner == "" {
+			owner, _, _ = strings.Cut(r.Full_Name, "/")
 		}
+		it := Item{
+			Kind:        kinds[r.Full_Name],
+			Owner:       owner,
+			Name:        r.Name,
+			Description: r.Description,
+			Url:         r.Url,
+			Clone_Url:   r.Clone_Url,
+			Updated:     r.Pushed_At,
+			Stars:       r.Stargazers_Count,
+			Forks:       r.Forks_Count,
+		}
+		items = append(items, it)
+
+		// a wiki that was enabled but never written to doesn't exist,
+		// the clone of it fails and that is reported as missing
+		if *wikis && r.Has_Wiki {
+			it.Kind = "wiki"
+			it.Clone_Url = strings.TrimSuffix(r.Clone_Url, ".git") + ".wiki.git"
+			it.Updated = ""
+			items = append(items, it)
+		}
+	}
 
-		for i, s := range m {
-			if len(s) >= 2 {
-				m[i] = s[1 : len(s)-1]
-			}
+	if *gists {
+		gl, err := getPages[Gist](fmt.Sprintf("%s/users/%s/gists", *apiBase, url.PathEscape(u.Login)))
+		if err != nil {
+			return nil, err
 		}
-		for i, s := range n {
-			if len(s) >= 6 {
-				n[i] = s[5 : len(s)-1]
+		for _, g := range gl {
+			owner := g.Owner.Login
+			if owner == "" {
+				owner = u.Login
 			}
+			items = append(items, Item{
+				Kind:        "gist",
+				Owner:       owner,
+				Name:        g.Id,
+				Description: g.Description,
+				Url:         g.Html_Url,
+				Clone_Url:   g.Git_Pull_Url,
+				Updated:     g.Updated_At,
+			})
 		}
+	}
 
-		for i := range n {
-			if n[i] == "next" {
-				url = m[i]
-				continue loop
+	return items, nil
+}
+
+type Manifest struct {
+	User    string  `json:"user"`
+	Api     string  `json:"api"`
+	Synced  string  `json:"synced"`
+	Entries []Entry `json:"entries"`
+}
+
+type Entry struct {
+	Item
+	Path     string  `json:"path"`
+	Status   string  `json:"status"`
+	Error    string  `json:"error,omitempty"`
+	Synced   string  `json:"synced,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+}
+
+func loadManifest(name string) map[string]Entry {
+	prev := make(map[string]Entry)
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return prev
+	}
+	var m Manifest
+	if err := json.Unmarshal(buf, &m); err != nil {
+		ek(fmt.Errorf("%s: %v", name, err))
+		return prev
+	}
+	for _, e := range m.Entries {
+		prev[e.Path] = e
+	}
+	return prev
+}
+
+// clones missing mirrors and fetches existing ones, anything whose push
+// time didn't change since the last run is skipped unless forced
+func sync(u *User, items []Item) {
+	prev := loadManifest(*manifest)
+	m := Manifest{
+		User:   u.Login,
+		Api:    *apiBase,
+		Synced: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	for _, it := range items {
+		e := Entry{Item: it, Path: filepath.ToSlash(it.Path())}
+		dir := filepath.Join(*output, it.Path())
+		old, seen := prev[e.Path]
+		_, err := os.Stat(dir)
+		exists := err == nil
+
+		start := time.Now()
+		switch {
+		case exists && seen && !*force && it.Updated != "" && old.Updated == it.Updated && old.Error == "":
+			e.Status = "unchanged"
+			e.Synced = old.Synced
+		case exists:
+			fmt.Printf("fetching %s\n", e.Path)
+			err = git("-C", dir, "fetch", "--prune", "--quiet", "origin")
+			e.Status = "updated"
+		default:
+			fmt.Printf("cloning %s\n", e.Path)
+			os.MkdirAll(filepath.Dir(dir), 0755)
+			err = git("clone", "--mirror", "--quiet", it.Clone_Url, dir)
+			e.Status = "cloned"
+		}
+
+		if err != nil {
+			e.Status, e.Error = "failed", err.Error()
+			if it.Kind == "wiki" && !exists {
+				e.Status = "missing"
+				fmt.Fprintf(os.Stderr, "get-github: %s: no wiki\n", e.Path)
+			} else {
+				ek(fmt.Errorf("%s: %v", e.Path, err))
 			}
 		}
-		break
+		if e.Status != "unchanged" {
+			e.Synced = time.Now().UTC().Format(time.RFC3339)
+			e.Duration = time.Since(start).Seconds()
+		}
+		m.Entries = append(m.Entries, e)
 	}
 
-	return repos, nil
+	sort.Slice(m.Entries, func(i, j int) bool { return m.Entries[i].Path < m.Entries[j].Path })
+	buf, err := json.MarshalIndent(&m, "", "\t")
+	ck(err)
+	ck(writeFile(*manifest, append(buf, '\n')))
+}
+
+// written next to the old one and renamed so an interrupted run
+// doesn't leave a truncated manifest behind
+func writeFile(name string, buf []byte) error {
+	tmp := name + ".tmp"
+	err := os.WriteFile(tmp, buf, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// the token goes in through the environment so it doesn't show up
+// in the process list or get saved in the mirror's config
+func git(args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if token != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + token))
+		cmd.Env = append(cmd.Env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+		)
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return err
+		}
+		for _, line := range strings.Split(msg, "\n") {
+			if strings.HasPrefix(line, "fatal: ") {
+				return errors.New(strings.TrimPrefix(line, "fatal: "))
+			}
+		}
+		return errors.New(msg)
+	}
+	return nil
 }
 
 func execl(name string, args ...string) {
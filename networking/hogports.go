@@ -1,22 +1,78 @@
 // hogs a range of ports, ported from 9front
+
+// with -d it keeps the ports as a pool and leases them out over a unix
+// socket so parallel test runs on one host never pick the same port.
+// the daemon holds every free port bound, a lease with bind lets go of
+// it right before the client binds it and it is taken back once the
+// lease is freed, expires or the process that owns it dies
+//
+// hogports -d tcp:127.0.0.1:20000-20999 &
+// port=$(hogports -c -ttl 10m)
+//
+// the protocol is one line per request, answered with "ok ..." or "err ..."
+// lease [net=tcp] [ttl=5m] [pid=n] [bind]
+// bind port [net=tcp]
+// renew port [net=tcp] [ttl=5m]
+// free port [net=tcp]
+//
+// without net= a port leased on more than one network is ambiguous
+// list
+// quit
+
 package main
 
 import (
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 var wg sync.WaitGroup
 
+var (
+	daemonMode = flag.Bool("d", false, "run as a port lease daemon")
+	clientMode = flag.Bool("c", false, "lease ports from the daemon and print them")
+	sockPath   = flag.String("s", filepath.Join(os.TempDir(), "hogports.sock"), "daemon socket")
+	ttl        = flag.Duration("ttl", 5*time.Minute, "client: lease time")
+	pid        = flag.Int("pid", os.Getppid(), "client: process owning the lease, 0 for none")
+	count      = flag.Int("n", 1, "client: number of ports")
+	network    = flag.String("net", "tcp", "client: network of the port")
+	hold       = flag.Bool("hold", false, "client: keep the daemon holding the port until a bind request")
+	free       = flag.Int("free", 0, "client: free a leased port")
+	list       = flag.Bool("list", false, "client: list the pool")
+)
+
 func main() {
+	log.SetFlags(0)
+	log.SetPrefix("hogports: ")
 	flag.Usage = usage
 	flag.Parse()
-	if flag.NArg() == 0 {
+
+	switch {
+	case *clientMode || *free != 0 || *list:
+		if err := client(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case flag.NArg() == 0:
 		usage()
+	case *daemonMode:
+		if err := daemon(*sockPath, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
 	for i := 0; i < flag.NArg(); i++ {
@@ -30,14 +86,13 @@ func main() {
 
 func usage() {
 	fmt.Fprintln(os.Stderr, "usage: hogports net:[host]:portrange...")
+	fmt.Fprintln(os.Stderr, "       hogports -d [-s socket] net:[host]:portrange...")
+	fmt.Fprintln(os.Stderr, "       hogports -c [-s socket] [-n count] [-ttl ttl] [-pid pid]")
 	flag.PrintDefaults()
 	os.Exit(2)
 }
 
-func hogRange(str string) {
-	var network, hostname string
-	var start, end int
-
+func parseRange(str string) (network, hostname string, start, end int, err error) {
 	fields := strings.Split(str, ":")
 	switch len(fields) {
 	case 3:
@@ -56,13 +111,22 @@ func hogRange(str string) {
 		}
 		fallthrough
 	default:
-		fmt.Fprintf(os.Stderr, "bad syntax: %q\n", str)
+		err = fmt.Errorf("bad syntax: %q", str)
 		return
 	}
 
 	if end < start {
 		start, end = end, start
 	}
+	return
+}
+
+func hogRange(str string) {
+	network, hostname, start, end, err := parseRange(str)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
 
 	for port := start; port <= end; port++ {
 		wg.Add(1)
@@ -88,3 +152,419 @@ func hogPort(network, laddr string) {
 		conn.Close()
 	}
 }
+
+type Slot struct {
+	network string
+	addr    string
+	port    int
+
+	// the socket holding the port while nobody else has it
+	conn  io.Closer
+	lease *Lease
+}
+
+type Lease struct {
+	pid     int
+	expires time.Time
+	bound   bool
+}
+
+// binds the port so nothing outside the pool can take it
+func (s *Slot) hold() error {
+	if s.conn != nil {
+		return nil
+	}
+	if strings.HasPrefix(s.network, "udp") {
+		c, err := net.ListenPacket(s.network, s.addr)
+		if err != nil {
+			return err
+		}
+		s.conn = c
+		return nil
+	}
+
+	ln, err := net.Listen(s.network, s.addr)
+	if err != nil {
+		return err
+	}
+	s.conn = ln
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err == nil {
+				conn.Close()
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *Slot) release() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *Slot) state() string {
+	switch {
+	case s.lease != nil && s.lease.bound:
+		return "bound"
+	case s.lease != nil:
+		return "leased"
+	case s.conn == nil:
+		return "busy"
+	}
+	return "free"
+}
+
+type Pool struct {
+	mu    sync.Mutex
+	slots []*Slot
+	next  int
+}
+
+// hands out ports round robin so a port that was just given back
+// (and may still have connections in TIME_WAIT) is used last
+func (p *Pool) lease(network string, ttl time.Duration, pid int, bind bool) (*Slot, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.slots {
+		s := p.slots[(p.next+i)%len(p.slots)]
+		if s.lease != nil || s.conn == nil || !sameNetwork(s.network, network) {
+			continue
+		}
+		p.next = (p.next + i + 1) % len(p.slots)
+		s.lease = &Lease{pid: pid, expires: time.Now().Add(ttl)}
+		if bind {
+			s.lease.bound = true
+			s.release()
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("no free %s ports", network)
+}
+
+func sameNetwork(a, b string) bool {
+	return strings.TrimRight(a, "46") == strings.TrimRight(b, "46")
+}
+
+// an empty network matches any, as long as only one has the port leased
+func (p *Pool) find(port int, network string) (*Slot, error) {
+	var found *Slot
+	for _, s := range p.slots {
+		if s.port != port || s.lease == nil {
+			continue
+		}
+		if network != "" && !sameNetwork(s.network, network) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("port %d is leased on more than one network, give net=", port)
+		}
+		found = s
+	}
+	if found == nil {
+		return nil, fmt.Errorf("port %d is not leased", port)
+	}
+	return found, nil
+}
+
+func (p *Pool) bind(port int, network string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, err := p.find(port, network)
+	if err != nil {
+		return err
+	}
+	s.lease.bound = true
+	s.release()
+	return nil
+}
+
+func (p *Pool) renew(port int, network string, ttl time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, err := p.find(port, network)
+	if err != nil {
+		return err
+	}
+	s.lease.expires = time.Now().Add(ttl)
+	return nil
+}
+
+func (p *Pool) free(port int, network string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, err := p.find(port, network)
+	if err != nil {
+		return err
+	}
+	p.reclaim(s, "freed")
+	return nil
+}
+
+// the port goes back into the pool as soon as we can bind it again,
+// until then it stays busy
+func (p *Pool) reclaim(s *Slot, why string) {
+	log.Printf("%s %d %s", s.network, s.port, why)
+	s.lease = nil
+	s.hold()
+}
+
+func (p *Pool) reap() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for _, s := range p.slots {
+		switch {
+		case s.lease == nil:
+			s.hold()
+		case now.After(s.lease.expires):
+			p.reclaim(s, "expired")
+		case s.lease.pid > 0 && !alive(s.lease.pid):
+			p.reclaim(s, fmt.Sprintf("owner %d died", s.lease.pid))
+		}
+	}
+}
+
+func alive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+func (p *Pool) list(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for _, s := range p.slots {
+		fmt.Fprintf(w, "%s %d %s", s.network, s.port, s.state())
+		if s.lease != nil {
+			fmt.Fprintf(w, " pid=%d ttl=%v", s.lease.pid, s.lease.expires.Sub(now).Round(time.Second))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func daemon(sock string, ranges []string) error {
+	pool := &Pool{}
+	for _, r := range ranges {
+		network, hostname, start, end, err := parseRange(r)
+		if err != nil {
+			return err
+		}
+		for port := start; port <= end; port++ {
+			s := &Slot{network: network, addr: net.JoinHostPort(hostname, strconv.Itoa(port)), port: port}
+			if err := s.hold(); err != nil {
+				log.Printf("failed to hog %s %s: %v", network, s.addr, err)
+				continue
+			}
+			pool.slots = append(pool.slots, s)
+		}
+	}
+	if len(pool.slots) == 0 {
+		return errors.New("failed to hog any ports")
+	}
+
+	// a socket left behind by a daemon that died is removed,
+	// one that still answers belongs to a running daemon
+	if c, err := net.Dial("unix", sock); err == nil {
+		c.Close()
+		return fmt.Errorf("%s: daemon already running", sock)
+	}
+	os.Remove(sock)
+
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		return err
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		ln.Close()
+	}()
+
+	go func() {
+		for range time.Tick(time.Second) {
+			pool.reap()
+		}
+	}()
+
+	log.Printf("holding %d ports on %s", len(pool.slots), sock)
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			os.Remove(sock)
+			return nil
+		}
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		go serve(pool, conn)
+	}
+}
+
+func serve(pool *Pool, conn net.Conn) {
+	defer conn.Close()
+
+	s := bufio.NewScanner(conn)
+	for s.Scan() {
+		args := strings.Fields(s.Text())
+		if len(args) == 0 {
+			continue
+		}
+
+		opts := map[string]string{}
+		for _, a := range args[1:] {
+			k, v, _ := strings.Cut(a, "=")
+			opts[k] = v
+		}
+
+		var err error
+		switch args[0] {
+		case "lease":
+			network := "tcp"
+			if v := opts["net"]; v != "" {
+				network = v
+			}
+			lt := 5 * time.Minute
+			if v := opts["ttl"]; v != "" {
+				lt, err = time.ParseDuration(v)
+			}
+			owner := 0
+			if v := opts["pid"]; v != "" && err == nil {
+				owner, err = strconv.Atoi(v)
+			}
+			if err == nil {
+				var slot *Slot
+				_, bind := opts["bind"]
+				slot, err = pool.lease(network, lt, owner, bind)
+				if err == nil {
+					fmt.Fprintf(conn, "ok %d\n", slot.port)
+					continue
+				}
+			}
+
+		case "bind", "renew", "free":
+			if len(args) < 2 {
+				err = fmt.Errorf("usage: %s port [net=tcp]", args[0])
+				break
+			}
+			var port int
+			port, err = strconv.Atoi(args[1])
+			if err != nil {
+				break
+			}
+			switch args[0] {
+			case "bind":
+				err = pool.bind(port, opts["net"])
+			case "renew":
+				lt := 5 * time.Minute
+				if v := opts["ttl"]; v != "" {
+					lt, err = time.ParseDuration(v)
+				}
+				if err == nil {
+					err = pool.renew(port, opts["net"], lt)
+				}
+			case "free":
+				err = pool.free(port, opts["net"])
+			}
+
+		case "list":
+			pool.list(conn)
+
+		case "quit":
+			return
+
+		default:
+			err = fmt.Errorf("unknown request %q", args[0])
+		}
+
+		if err != nil {
+			fmt.Fprintf(conn, "err %v\n", err)
+		} else {
+			fmt.Fprintln(conn, "ok")
+		}
+	}
+}
+
+// what a test harness needs to get a port, lease one that
+// the daemon already let go of so it can be bound right away
+func leasePort(sock, network string, ttl time.Duration, pid int, bind bool) (int, error) {
+	req := fmt.Sprintf("lease net=%s ttl=%v pid=%d", network, ttl, pid)
+	if bind {
+		req += " bind"
+	}
+	reply, err := request(sock, req)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(reply)
+}
+
+func freePort(sock, network string, port int) error {
+	_, err := request(sock, fmt.Sprintf("free %d net=%s", port, network))
+	return err
+}
+
+func request(sock, req string) (string, error) {
+	conn, err := net.DialTimeout("unix", sock, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "%s\nquit\n", req)
+
+	var lines []string
+	s := bufio.NewScanner(conn)
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case line == "ok" || strings.HasPrefix(line, "ok "):
+			lines = append(lines, strings.TrimPrefix(strings.TrimPrefix(line, "ok"), " "))
+			return strings.Join(lines, "\n"), nil
+		case strings.HasPrefix(line, "err "):
+			return "", errors.New(strings.TrimPrefix(line, "err "))
+		}
+		lines = append(lines, line)
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("connection closed by daemon")
+}
+
+func client() error {
+	switch {
+	case *list:
+		reply, err := request(*sockPath, "list")
+		if err != nil {
+			return err
+		}
+		fmt.Print(reply)
+		return nil
+
+	case *free != 0:
+		return freePort(*sockPath, *network, *free)
+	}
+
+	for i := 0; i < *count; i++ {
+		port, err := leasePort(*sockPath, *network, *ttl, *pid, !*hold)
+		if err != nil {
+			return err
+		}
+		fmt.Println(port)
+	}
+	return nil
+}
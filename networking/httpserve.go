@@ -1,35 +1,748 @@
+// serves a directory over http(s) with directory listings, zip downloads
+// of folders, uploads, basic auth, zstd or gzip compression and access logs
+
+// responses are compressed with whichever of zstd and gzip the client
+// prefers, zstd when it takes both alike. zstd is
+// github.com/klauspost/compress/zstd, it isn't in the standard library
+
 package main
 
 import (
+	"archive/zip"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
 	"log"
+	"math/big"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	addr      = flag.String("addr", ":8080", "address to bind to")
+	useTLS    = flag.Bool("tls", false, "serve https with a self-signed certificate generated on startup")
+	certFile  = flag.String("cert", "", "serve https with this certificate")
+	keyFile   = flag.String("key", "", "private key for -cert")
+	auth      = flag.String("auth", "", "require basic auth, user:password (or set HTTPSERVE_AUTH)")
+	compress  = flag.Bool("gzip", true, "compress responses with zstd or gzip when the client accepts it")
+	logFormat = flag.String("log", "text", "access log format: text, combined, json or none")
+	upload    = flag.Bool("upload", false, "allow uploads into served directories")
+	maxUpload = flag.Int64("max-upload", 0, "maximum upload size in bytes, 0 for no limit")
 )
 
 type Logger struct {
 	handler http.Handler
+	format  string
+}
+
+type logWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *logWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *logWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type accessLog struct {
+	Time      time.Time     `json:"time"`
+	Remote    string        `json:"remote"`
+	User      string        `json:"user,omitempty"`
+	Method    string        `json:"method"`
+	URI       string        `json:"uri"`
+	Proto     string        `json:"proto"`
+	Host      string        `json:"host"`
+	Status    int           `json:"status"`
+	Size      int64         `json:"size"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"user_agent,omitempty"`
+	Duration  time.Duration `json:"duration_ns"`
 }
 
 func (l *Logger) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	str := "{\n"
-	str += fmt.Sprintf("\tHost           %v\n", req.Host)
-	str += fmt.Sprintf("\tRemote Addr    %v\n", req.RemoteAddr)
-	str += fmt.Sprintf("\tRequest URI    %v\n", req.RequestURI)
-	str += fmt.Sprintf("\tHost           %v\n", req.Host)
-	str += fmt.Sprintf("\tMethod         %v\n", req.Method)
-	str += fmt.Sprintf("\tURL            %v\n", req.URL)
-	str += "}"
-	log.Printf("\n%s\n\n", str)
+	if l.format == "none" {
+		l.handler.ServeHTTP(w, req)
+		return
+	}
+
+	start := time.Now()
+	lw := &logWriter{ResponseWriter: w}
+	l.handler.ServeHTTP(lw, req)
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+
+	user, _, _ := req.BasicAuth()
+	e := accessLog{
+		Time:      start,
+		Remote:    req.RemoteAddr,
+		User:      user,
+		Method:    req.Method,
+		URI:       req.RequestURI,
+		Proto:     req.Proto,
+		Host:      req.Host,
+		Status:    lw.status,
+		Size:      lw.size,
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+		Duration:  time.Since(start),
+	}
 
-	l.handler.ServeHTTP(w, req)
+	switch l.format {
+	case "combined":
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		fmt.Fprintf(os.Stdout, "%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+			host, dash(user), start.Format("02/Jan/2006:15:04:05 -0700"),
+			req.Method, req.RequestURI, req.Proto, lw.status, dash(strconv.FormatInt(lw.size, 10)),
+			dash(e.Referer), dash(e.UserAgent))
+	case "json":
+		b, _ := json.Marshal(e)
+		fmt.Fprintf(os.Stdout, "%s\n", b)
+	default:
+		str := "{\n"
+		str += fmt.Sprintf("\tHost           %v\n", req.Host)
+		str += fmt.Sprintf("\tRemote Addr    %v\n", req.RemoteAddr)
+		str += fmt.Sprintf("\tRequest URI    %v\n", req.RequestURI)
+		str += fmt.Sprintf("\tMethod         %v\n", req.Method)
+		str += fmt.Sprintf("\tURL            %v\n", req.URL)
+		str += fmt.Sprintf("\tStatus         %v\n", lw.status)
+		str += fmt.Sprintf("\tSize           %v\n", lw.size)
+		str += fmt.Sprintf("\tDuration       %v\n", e.Duration)
+		str += "}"
+		log.Printf("\n%s\n\n", str)
+	}
 }
 
-var (
-	addr = flag.String("addr", ":8080", "address to bind to")
-)
+func dash(s string) string {
+	if s == "" || s == "0" {
+		return "-"
+	}
+	return s
+}
+
+type Auth struct {
+	handler  http.Handler
+	user     string
+	password string
+}
+
+func (a *Auth) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	user, password, ok := req.BasicAuth()
+	if !ok ||
+		subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="httpserve", charset="UTF-8"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	a.handler.ServeHTTP(w, req)
+}
+
+type Compress struct {
+	handler http.Handler
+}
+
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	zw       io.WriteCloser
+	decided  bool
+}
+
+// decides whether to compress once the handler has set the content type
+func (w *compressWriter) WriteHeader(status int) {
+	if !w.decided {
+		w.decided = true
+		h := w.Header()
+		if status == http.StatusOK && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", w.encoding)
+			h.Add("Vary", "Accept-Encoding")
+			if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("Etag", "W/"+etag)
+			}
+			w.zw = newEncoder(w.encoding, w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// browsers won't take a zstd window over 8MB, and one response
+// doesn't need goroutines of its own
+func newEncoder(encoding string, w io.Writer) io.WriteCloser {
+	if encoding == "zstd" {
+		zw, err := zstd.NewWriter(w, zstd.WithWindowSize(8<<20), zstd.WithEncoderConcurrency(1))
+		if err == nil {
+			return zw
+		}
+	}
+	return gzip.NewWriter(w)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.zw != nil {
+		return w.zw.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressWriter) Close() error {
+	if w.zw != nil {
+		return w.zw.Close()
+	}
+	return nil
+}
+
+func compressible(ctype string) bool {
+	ctype, _, _ = mime.ParseMediaType(ctype)
+	switch {
+	case strings.HasPrefix(ctype, "text/"),
+		strings.HasSuffix(ctype, "+xml"),
+		strings.HasSuffix(ctype, "+json"):
+		return true
+	}
+	switch ctype {
+	case "application/json", "application/javascript", "application/xml",
+		"application/wasm", "application/x-tar", "application/octet-stream",
+		"image/svg+xml", "image/bmp":
+		return true
+	}
+	return false
+}
+
+func (c *Compress) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// ranges refer to the uncompressed bytes, so leave those alone
+	enc := acceptedEncoding(req)
+	if enc == "" || req.Header.Get("Range") != "" || req.Method == http.MethodHead {
+		c.handler.ServeHTTP(w, req)
+		return
+	}
+	cw := &compressWriter{ResponseWriter: w, encoding: enc}
+	defer cw.Close()
+	c.handler.ServeHTTP(cw, req)
+}
+
+// the encoding with the highest q, zstd on a tie, "" when the client
+// takes neither. * stands for whichever isn't named
+func acceptedEncoding(req *http.Request) string {
+	q := map[string]float64{}
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q[name] = 1
+		for _, p := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if strings.TrimSpace(k) == "q" {
+				f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+				if err != nil {
+					f = 0
+				}
+				q[name] = f
+			}
+		}
+	}
+	best, bestQ := "", 0.0
+	for _, name := range []string{"zstd", "gzip"} {
+		v, ok := q[name]
+		if !ok {
+			v, ok = q["*"]
+		}
+		if ok && v > bestQ {
+			best, bestQ = name, v
+		}
+	}
+	return best
+}
+
+type FileServer struct {
+	root   *os.Root
+	upload bool
+}
+
+func (s *FileServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	upath := path.Clean("/" + req.URL.Path)
+	name := strings.TrimPrefix(upath, "/")
+	if name == "" {
+		name = "."
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost, http.MethodPut:
+		if !s.upload {
+			http.Error(w, "uploads are disabled", http.StatusForbidden)
+			return
+		}
+		if req.Method == http.MethodPut {
+			s.put(w, req, name)
+		} else {
+			s.post(w, req, name)
+		}
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	f, err := s.root.Open(name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	if !fi.IsDir() {
+		http.ServeContent(w, req, fi.Name(), fi.ModTime(), f)
+		return
+	}
+
+	// relative links in the listing need the trailing slash
+	if !strings.HasSuffix(req.URL.Path, "/") {
+		u := *req.URL
+		u.Path += "/"
+		http.Redirect(w, req, u.String(), http.StatusMovedPermanently)
+		return
+	}
+
+	if _, ok := req.URL.Query()["zip"]; ok {
+		s.zip(w, name)
+		return
+	}
+
+	if _, ok := req.URL.Query()["index"]; !ok {
+		idx, err := s.root.Open(path.Join(name, "index.html"))
+		if err == nil {
+			defer idx.Close()
+			if ifi, err := idx.Stat(); err == nil && ifi.Mode().IsRegular() {
+				http.ServeContent(w, req, "index.html", ifi.ModTime(), idx)
+				return
+			}
+		}
+	}
+
+	s.list(w, req, upath, f)
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "404 page not found", http.StatusNotFound)
+	case errors.Is(err, fs.ErrPermission):
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type entry struct {
+	Name    string
+	URL     string
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+}
+
+func (e entry) HumanSize() string {
+	if e.IsDir {
+		return "-"
+	}
+	return humanSize(e.Size)
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+var listing = template.Must(template.New("listing").Parse(`<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Index of {{.Path}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.2em 1em; text-align: left; }
+td.size { text-align: right; font-family: monospace; }
+tr:nth-child(even) { background: #f4f4f4; }
+</style>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<p><a href="?zip">Download as zip</a></p>
+<table>
+<tr>
+<th><a href="?sort=name&amp;order={{.Next "name"}}">Name</a></th>
+<th><a href="?sort=size&amp;order={{.Next "size"}}">Size</a></th>
+<th><a href="?sort=time&amp;order={{.Next "time"}}">Modified</a></th>
+</tr>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.URL}}">{{.Name}}{{if .IsDir}}/{{end}}</a></td><td class="size">{{.HumanSize}}</td><td>{{.ModTime.Format "2006-01-02 15:04:05"}}</td></tr>
+{{end}}</table>
+{{if .Upload}}<form method="post" enctype="multipart/form-data">
+<input type="hidden" name="redirect" value="1">
+<p><input type="file" name="file" multiple> <input type="submit" value="Upload"></p>
+</form>
+{{end}}</body>
+</html>
+`))
+
+type listingPage struct {
+	Path    string
+	Entries []entry
+	Upload  bool
+	Sort    string
+	Order   string
+}
+
+func (p *listingPage) Next(key string) string {
+	if p.Sort == key && p.Order == "asc" {
+		return "desc"
+	}
+	return "asc"
+}
+
+func (s *FileServer) list(w http.ResponseWriter, req *http.Request, upath string, f *os.File) {
+	dirents, err := f.ReadDir(-1)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	var entries []entry
+	for _, d := range dirents {
+		fi, err := d.Info()
+		if err != nil {
+			continue
+		}
+		e := entry{
+			Name:    d.Name(),
+			URL:     (&url.URL{Path: d.Name()}).String(),
+			IsDir:   fi.IsDir(),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		}
+		if e.IsDir {
+			e.URL += "/"
+		}
+		entries = append(entries, e)
+	}
+
+	q := req.URL.Query()
+	page := &listingPage{
+		Path:   upath,
+		Upload: s.upload,
+		Sort:   q.Get("sort"),
+		Order:  q.Get("order"),
+	}
+	if page.Sort == "" {
+		page.Sort = "name"
+	}
+	if page.Order != "desc" {
+		page.Order = "asc"
+	}
+
+	// directories first, then by the chosen key
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		var less bool
+		switch page.Sort {
+		case "size":
+			less = a.Size < b.Size
+		case "time":
+			less = a.ModTime.Before(b.ModTime)
+		default:
+			less = strings.ToLower(a.Name) < strings.ToLower(b.Name)
+		}
+		if page.Order == "desc" {
+			return !less
+		}
+		return less
+	})
+	page.Entries = entries
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = listing.Execute(w, page)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// streams the directory as a zip, nothing is buffered on disk
+func (s *FileServer) zip(w http.ResponseWriter, name string) {
+	base := path.Base(name)
+	if name == "." {
+		base = "root"
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": base + ".zip"}))
+
+	zw := zip.NewWriter(w)
+	fsys := s.root.FS()
+	err := fs.WalkDir(fsys, name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, name), "/")
+		if name == "." {
+			rel = p
+		}
+		if rel == "" || rel == "." {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		hdr, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(base, rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		} else {
+			hdr.Method = zip.Deflate
+		}
+		zf, err := zw.CreateHeader(hdr)
+		if err != nil || fi.IsDir() {
+			return err
+		}
+
+		f, err := fsys.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(zf, f)
+		return err
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+
+	// the headers are long gone, all we can do is cut the archive short
+	if err != nil {
+		log.Printf("zip %s: %v", name, err)
+	}
+}
+
+func (s *FileServer) post(w http.ResponseWriter, req *http.Request, dir string) {
+	if *maxUpload > 0 {
+		req.Body = http.MaxBytesReader(w, req.Body, *maxUpload)
+	}
+	mr, err := req.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var saved []string
+	redirect := false
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if part.FileName() == "" {
+			if part.FormName() == "redirect" {
+				redirect = true
+			}
+			part.Close()
+			continue
+		}
+
+		name := path.Join(dir, path.Base(filepath.ToSlash(part.FileName())))
+		err = s.save(name, part)
+		part.Close()
+		if err != nil {
+			log.Printf("%s: upload %q: %v", req.RemoteAddr, name, err)
+			httpError(w, err)
+			return
+		}
+		log.Printf("%s: upload %q completed", req.RemoteAddr, name)
+		saved = append(saved, name)
+	}
+
+	if redirect {
+		http.Redirect(w, req, req.URL.Path, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, name := range saved {
+		fmt.Fprintf(w, "File uploaded successfully: %s\n", name)
+	}
+}
+
+func (s *FileServer) put(w http.ResponseWriter, req *http.Request, name string) {
+	if *maxUpload > 0 {
+		req.Body = http.MaxBytesReader(w, req.Body, *maxUpload)
+	}
+	if fi, err := s.root.Stat(name); err == nil && fi.IsDir() {
+		http.Error(w, "can't put onto a directory", http.StatusConflict)
+		return
+	}
+	err := s.save(name, req.Body)
+	if err != nil {
+		log.Printf("%s: upload %q: %v", req.RemoteAddr, name, err)
+		httpError(w, err)
+		return
+	}
+	log.Printf("%s: upload %q completed", req.RemoteAddr, name)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "File uploaded successfully: %s\n", name)
+}
+
+// writes to a temporary file first so a failed upload doesn't
+// leave a truncated file behind under the real name
+func (s *FileServer) save(name string, r io.Reader) error {
+	tmp := path.Join(path.Dir(name), fmt.Sprintf(".%s.upload%d", path.Base(name), time.Now().UnixNano()))
+	f, err := s.root.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if xerr := f.Close(); err == nil {
+		err = xerr
+	}
+	if err == nil {
+		err = s.root.Rename(tmp, name)
+	}
+	if err != nil {
+		s.root.Remove(tmp)
+	}
+	return err
+}
+
+// self-signed certificate for the names this server is likely reached by
+func selfSigned() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "httpserve"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host, err := os.Hostname(); err == nil {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	if host, _, err := net.SplitHostPort(*addr); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, n.IP)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	log.Printf("Generated self-signed certificate, SHA-256 fingerprint %X", sha256.Sum256(der))
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
 
 func main() {
 	flag.Usage = usage
@@ -45,8 +758,58 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("Serving %q on %q", dir, *addr)
-	log.Fatal(http.ListenAndServe(*addr, &Logger{http.FileServer(http.Dir(dir))}))
+
+	switch *logFormat {
+	case "text", "combined", "json", "none":
+	default:
+		log.Fatalf("unknown log format %q", *logFormat)
+	}
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var handler http.Handler = &FileServer{root: root, upload: *upload}
+	if *compress {
+		handler = &Compress{handler}
+	}
+	if *auth == "" {
+		*auth = os.Getenv("HTTPSERVE_AUTH")
+	}
+	if *auth != "" {
+		user, password, ok := strings.Cut(*auth, ":")
+		if !ok {
+			log.Fatal("auth must be user:password")
+		}
+		handler = &Auth{handler, user, password}
+	}
+	handler = &Logger{handler, *logFormat}
+
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	switch {
+	case *certFile != "" || *keyFile != "":
+		log.Printf("Serving %q on %q over https", dir, *addr)
+		err = srv.ListenAndServeTLS(*certFile, *keyFile)
+	case *useTLS:
+		var cert tls.Certificate
+		cert, err = selfSigned()
+		if err != nil {
+			break
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		log.Printf("Serving %q on %q over https", dir, *addr)
+		err = srv.ListenAndServeTLS("", "")
+	default:
+		log.Printf("Serving %q on %q", dir, *addr)
+		err = srv.ListenAndServe()
+	}
+	log.Fatal(err)
 }
 
 func usage() {
@@ -1,16 +1,29 @@
 // send some packets see if we get it back and keep track of some stats
+
+// the sender stamps every packet with a sequence number and its send time,
+// the receiver reflects it back after adding its own receive and send time.
+// from the four timestamps we get the round trip time with the reflector
+// processing time taken out, the one way delays (only meaningful if the
+// clocks are synchronized) and the rfc 3550 interarrival jitter (which does
+// not depend on the clock offset). with -n tcp it measures bulk throughput
+
 package main
 
 import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	mrand "math/rand"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,13 +34,53 @@ var opt struct {
 	laddr    string
 	raddr    []net.Addr
 	interval time.Duration
+	report   time.Duration
+	duration time.Duration
+	wait     time.Duration
+	count    uint64
 	mtu      int
+	size     string
 	sender   bool
+	json     bool
+	verbose  bool
 }
 
+// packet header, all little endian
+// 0  sequence number
+// 8  sender transmit time
+// 16 reflector receive time
+// 24 reflector transmit time
+// 32 random payload
+const hdrsize = 32
+
+var (
+	done   = make(chan struct{})
+	outmu  sync.Mutex
+	jsonw  = json.NewEncoder(os.Stdout)
+	sizefn func() int
+)
+
 func main() {
 	parseopt()
 
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt)
+	go func() {
+		<-sigc
+		close(done)
+		<-sigc
+		os.Exit(1)
+	}()
+
+	if strings.HasPrefix(opt.network, "tcp") {
+		if opt.sender {
+			bulksend()
+		} else {
+			bulkrecv()
+		}
+		return
+	}
+
 	conn, err := net.ListenPacket(opt.network, opt.laddr)
 	ck(err)
 	defer conn.Close()
@@ -56,16 +109,30 @@ func parseopt() {
 	flag.StringVar(&opt.laddr, "l", ":0", "listen on address")
 	flag.BoolVar(&opt.sender, "s", opt.sender, "become a sender")
 	flag.IntVar(&opt.mtu, "m", mtusize(), "mtu size")
+	flag.StringVar(&opt.size, "z", "", "packet size distribution [N, min-max, imix], defaults to the mtu size")
 	flag.DurationVar(&opt.interval, "i", 1*time.Second, "interval")
+	flag.DurationVar(&opt.report, "r", 5*time.Second, "report interval, 0 to only report the summary")
+	flag.DurationVar(&opt.duration, "d", 0, "duration of the test, 0 to run until interrupted (10s for tcp)")
+	flag.DurationVar(&opt.wait, "w", 2*time.Second, "how long to wait for a reply before counting a packet as lost")
+	flag.Uint64Var(&opt.count, "c", 0, "number of packets to send, 0 for no limit")
+	flag.BoolVar(&opt.json, "j", false, "output reports as json")
+	flag.BoolVar(&opt.verbose, "v", false, "log every packet")
 
 	flag.Usage = usage
 	flag.Parse()
-	if opt.mtu < 16 {
+	if opt.mtu < hdrsize {
 		log.Fatal("mtu size too small")
 	}
 	if opt.interval <= 0 {
 		log.Fatal("invalid interval")
 	}
+	if opt.report < 0 || opt.duration < 0 || opt.wait < 0 {
+		log.Fatal("invalid duration")
+	}
+
+	var err error
+	sizefn, err = sizedist(opt.size, opt.mtu)
+	ck(err)
 
 	for _, addr := range flag.Args() {
 		var raddr net.Addr
@@ -77,6 +144,8 @@ func parseopt() {
 			raddr, err = net.ResolveUDPAddr(opt.network, addr)
 		case strings.HasPrefix(opt.network, "unix"):
 			raddr, err = net.ResolveUnixAddr(opt.network, addr)
+		case strings.HasPrefix(opt.network, "tcp"):
+			raddr, err = net.ResolveTCPAddr(opt.network, addr)
 		default:
 			log.Fatal("unsupported network protocol", opt.network)
 		}
@@ -110,6 +179,47 @@ func mtusize() int {
 	return mtu
 }
 
+// sizedist returns a generator for packet sizes, sizes are clamped
+// to fit the header and the mtu
+func sizedist(spec string, mtu int) (func() int, error) {
+	clamp := func(n int) int {
+		if n < hdrsize {
+			return hdrsize
+		}
+		if n > mtu {
+			return mtu
+		}
+		return n
+	}
+
+	switch {
+	case spec == "":
+		return func() int { return mtu }, nil
+
+	case spec == "imix":
+		// simple imix 7:4:1 of 64, 576 and 1500 byte ip packets,
+		// less the ip and udp headers
+		sizes := []int{36, 36, 36, 36, 36, 36, 36, 548, 548, 548, 548, 1472}
+		return func() int { return clamp(sizes[mrand.Intn(len(sizes))]) }, nil
+
+	case strings.Contains(spec, "-"):
+		i := strings.Index(spec, "-")
+		lo, err1 := strconv.Atoi(spec[:i])
+		hi, err2 := strconv.Atoi(spec[i+1:])
+		if err1 != nil || err2 != nil || lo > hi {
+			return nil, fmt.Errorf("invalid size range %q", spec)
+		}
+		return func() int { return clamp(lo + mrand.Intn(hi-lo+1)) }, nil
+
+	default:
+		n, err := strconv.Atoi(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %q", spec)
+		}
+		return func() int { return clamp(n) }, nil
+	}
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -124,25 +234,164 @@ type Pkt struct {
 	seq    []*Seq
 	sender bool
 	recv   uint64
+	pkts   uint64
 }
 
 type Seq struct {
-	mu      sync.Mutex
-	ticker  *time.Ticker
-	wbuf    []byte
-	cnt     uint64
-	addr    net.Addr
-	seen    map[uint64]uint64
-	hist    map[uint64][]byte
-	histlen uint64
-
-	sent    uint64
-	dups    uint64
-	lostcnt uint64
-	deadcnt uint64
-	badcnt  uint64
-	badbuf  uint64
-	badsz   uint64
+	mu     sync.Mutex
+	ticker *time.Ticker
+	cnt    uint64
+	addr   net.Addr
+	seen   map[uint64]uint64
+	hist   map[uint64]*sent
+	start  time.Time
+
+	maxseq  uint64
+	havemax bool
+
+	total Stats
+	ival  Stats
+}
+
+type sent struct {
+	buf  []byte
+	time time.Time
+}
+
+// Stats accumulates over the whole run and over one report interval
+type Stats struct {
+	start     time.Time
+	sentpkts  uint64
+	sent      uint64
+	recvpkts  uint64
+	recv      uint64
+	dups      uint64
+	lostcnt   uint64
+	deadcnt   uint64
+	badcnt    uint64
+	badbuf    uint64
+	badsz     uint64
+	reordered uint64
+	maxreord  uint64
+	rtt       Delay
+	fwd       Delay
+	rev       Delay
+}
+
+// Delay tracks a delay in nanoseconds along with the
+// rfc 3550 interarrival jitter estimate of it
+type Delay struct {
+	n      uint64
+	sum    float64
+	min    float64
+	max    float64
+	last   float64
+	jitter float64
+}
+
+func (d *Delay) add(x float64) {
+	if d.n == 0 {
+		d.min, d.max = x, x
+	} else {
+		d.jitter += (math.Abs(x-d.last) - d.jitter) / 16
+	}
+	d.min = math.Min(d.min, x)
+	d.max = math.Max(d.max, x)
+	d.sum += x
+	d.last = x
+	d.n++
+}
+
+type DelayReport struct {
+	Min    float64 `json:"min_ms"`
+	Mean   float64 `json:"mean_ms"`
+	Max    float64 `json:"max_ms"`
+	Jitter float64 `json:"jitter_ms"`
+}
+
+func (d *Delay) report() *DelayReport {
+	if d.n == 0 {
+		return nil
+	}
+	ms := float64(time.Millisecond)
+	return &DelayReport{
+		Min:    d.min / ms,
+		Mean:   d.sum / float64(d.n) / ms,
+		Max:    d.max / ms,
+		Jitter: d.jitter / ms,
+	}
+}
+
+type Report struct {
+	Type       string       `json:"type"`
+	Addr       string       `json:"addr"`
+	Start      float64      `json:"start"`
+	End        float64      `json:"end"`
+	SentPkts   uint64       `json:"sent_packets"`
+	SentBytes  uint64       `json:"sent_bytes"`
+	RecvPkts   uint64       `json:"recv_packets"`
+	RecvBytes  uint64       `json:"recv_bytes"`
+	Lost       uint64       `json:"lost"`
+	Loss       float64      `json:"loss_percent"`
+	Dups       uint64       `json:"duplicates"`
+	Late       uint64       `json:"late"`
+	Reordered  uint64       `json:"reordered"`
+	MaxReorder uint64       `json:"max_reorder_distance"`
+	BadSize    uint64       `json:"bad_size"`
+	BadSeq     uint64       `json:"bad_seq"`
+	BadData    uint64       `json:"bad_data"`
+	TxRate     float64      `json:"tx_bps"`
+	RxRate     float64      `json:"rx_bps"`
+	RTT        *DelayReport `json:"rtt,omitempty"`
+	Forward    *DelayReport `json:"forward_delay,omitempty"`
+	Reverse    *DelayReport `json:"reverse_delay,omitempty"`
+}
+
+func (r *Report) print() {
+	outmu.Lock()
+	defer outmu.Unlock()
+
+	if opt.json {
+		jsonw.Encode(r)
+		return
+	}
+
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "%v %v %.1f-%.1fs sent %v pkts %v bytes recv %v pkts %v bytes",
+		r.Type, r.Addr, r.Start, r.End, r.SentPkts, r.SentBytes, r.RecvPkts, r.RecvBytes)
+	if r.SentPkts > 0 || r.RecvPkts > 0 {
+		fmt.Fprintf(b, " lost %v (%.2f%%) dups %v late %v reordered %v (max distance %v)",
+			r.Lost, r.Loss, r.Dups, r.Late, r.Reordered, r.MaxReorder)
+	}
+	if r.BadSize+r.BadSeq+r.BadData > 0 {
+		fmt.Fprintf(b, " badsz %v badcnt %v badbuf %v", r.BadSize, r.BadSeq, r.BadData)
+	}
+	fmt.Fprintf(b, " tx %s rx %s", bitrate(r.TxRate), bitrate(r.RxRate))
+	for _, d := range []struct {
+		name string
+		r    *DelayReport
+	}{
+		{"rtt", r.RTT},
+		{"fwd", r.Forward},
+		{"rev", r.Reverse},
+	} {
+		if d.r != nil {
+			fmt.Fprintf(b, " %s %.3f/%.3f/%.3f/%.3f ms", d.name, d.r.Min, d.r.Mean, d.r.Max, d.r.Jitter)
+		}
+	}
+	fmt.Println(b.String())
+}
+
+func bitrate(bps float64) string {
+	switch {
+	case bps >= 1e9:
+		return fmt.Sprintf("%.2f Gbit/s", bps/1e9)
+	case bps >= 1e6:
+		return fmt.Sprintf("%.2f Mbit/s", bps/1e6)
+	case bps >= 1e3:
+		return fmt.Sprintf("%.2f Kbit/s", bps/1e3)
+	}
+	return fmt.Sprintf("%.0f bit/s", bps)
 }
 
 func newpkt(conn net.PacketConn, addr []net.Addr, interval time.Duration, mtu int, sender bool) *Pkt {
@@ -152,7 +401,7 @@ func newpkt(conn net.PacketConn, addr []net.Addr, interval time.Duration, mtu in
 		sender: sender,
 	}
 	for _, addr := range addr {
-		p.seq = append(p.seq, newseq(addr, interval, mtu))
+		p.seq = append(p.seq, newseq(addr, interval))
 	}
 	return p
 }
@@ -165,30 +414,64 @@ func (p *Pkt) check(prefix string, err error) bool {
 	unrecoverable := err == io.EOF
 	ne, ok := err.(net.Error)
 	if ok {
-		unrecoverable = !ne.Temporary()
+		unrecoverable = !ne.Timeout()
 	}
 	return unrecoverable
 }
 
 func (p *Pkt) Run() {
-	p.wg.Add(1)
 	go p.read()
 
-	if p.sender {
-		for _, s := range p.seq {
-			p.wg.Add(1)
-			go p.write(s)
-		}
+	if !p.sender {
+		<-done
+		log.Printf("reflected %v packets %v bytes\n", p.pkts, p.recv)
+		return
 	}
 
+	for _, s := range p.seq {
+		p.wg.Add(1)
+		go p.write(s)
+	}
+	if opt.report > 0 {
+		go p.reports()
+	}
 	p.wg.Wait()
+
+	// give the stragglers a chance before counting them as lost
+	time.Sleep(opt.wait)
+	for _, s := range p.seq {
+		s.mu.Lock()
+		s.cleanhist(time.Now().Add(time.Hour))
+		r := s.total.report("summary", s.addr, s.start, time.Now())
+		s.mu.Unlock()
+		r.print()
+	}
 }
 
-func (p *Pkt) read() {
-	defer p.wg.Done()
+func (p *Pkt) reports() {
+	ticker := time.NewTicker(opt.report)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			for _, s := range p.seq {
+				s.mu.Lock()
+				s.cleanhist(now)
+				r := s.ival.report("interval", s.addr, s.start, now)
+				s.ival = Stats{start: now}
+				s.mu.Unlock()
+				r.print()
+			}
+		}
+	}
+}
 
+func (p *Pkt) read() {
 	for {
 		n, addr, err := p.conn.ReadFrom(p.rbuf)
+		now := time.Now()
 		p.recv += uint64(n)
 		if p.check("", err) {
 			break
@@ -196,19 +479,28 @@ func (p *Pkt) read() {
 		if err != nil {
 			continue
 		}
+		p.pkts++
 
 		if p.sender {
 			for _, s := range p.seq {
 				if s.matchaddr(addr) {
-					log.Printf("%v: received %v bytes total %v bytes\n", s.addr, n, p.recv)
+					if opt.verbose {
+						log.Printf("%v: received %v bytes total %v bytes\n", s.addr, n, p.recv)
+					}
 					s.mu.Lock()
-					s.checkbuf(p.rbuf[:n])
+					s.checkbuf(p.rbuf[:n], now)
 					s.mu.Unlock()
 					break
 				}
 			}
 		} else {
-			log.Printf("write %v %v %v...\n", p.conn.LocalAddr(), p.recv, p.rbuf[:min(n, 16)])
+			if opt.verbose {
+				log.Printf("write %v %v %v...\n", p.conn.LocalAddr(), p.recv, p.rbuf[:min(n, 16)])
+			}
+			if n >= hdrsize {
+				binary.LittleEndian.PutUint64(p.rbuf[16:], uint64(now.UnixNano()))
+				binary.LittleEndian.PutUint64(p.rbuf[24:], uint64(time.Now().UnixNano()))
+			}
 			p.conn.WriteTo(p.rbuf[:n], addr)
 		}
 	}
@@ -217,32 +509,48 @@ func (p *Pkt) read() {
 
 func (p *Pkt) write(s *Seq) {
 	defer p.wg.Done()
+	defer s.ticker.Stop()
+
+	var deadline <-chan time.Time
+	if opt.duration > 0 {
+		deadline = time.After(opt.duration)
+	}
+
+	for opt.count == 0 || s.cnt < opt.count {
+		select {
+		case <-done:
+			return
+		case <-deadline:
+			return
+		case <-s.ticker.C:
+		}
 
-	for {
-		<-s.ticker.C
 		s.mu.Lock()
-		s.dumpstats()
-		s.cleanhist()
-		s.fillbuf()
+		s.cleanhist(time.Now())
+		wbuf := s.fillbuf(sizefn())
 		s.mu.Unlock()
 
-		log.Printf("%v: writing seq %v buf %v...\n", s.addr, s.cnt-1, s.wbuf[8:16])
-		_, err := p.conn.WriteTo(s.wbuf, s.addr)
+		if opt.verbose {
+			log.Printf("%v: writing seq %v size %v buf %v...\n", s.addr, s.cnt-1, len(wbuf), wbuf[hdrsize:min(len(wbuf), hdrsize+8)])
+		}
+		_, err := p.conn.WriteTo(wbuf, s.addr)
 		if p.check(fmt.Sprintf("%v", s.addr), err) {
 			break
 		}
 	}
-	log.Printf("%v: writer died\n", s.addr)
+	log.Printf("%v: writer done\n", s.addr)
 }
 
-func newseq(addr net.Addr, interval time.Duration, mtu int) *Seq {
+func newseq(addr net.Addr, interval time.Duration) *Seq {
+	now := time.Now()
 	return &Seq{
-		ticker:  time.NewTicker(interval),
-		seen:    make(map[uint64]uint64),
-		hist:    make(map[uint64][]byte),
-		wbuf:    make([]byte, mtu),
-		addr:    addr,
-		histlen: 50,
+		ticker: time.NewTicker(interval),
+		seen:   make(map[uint64]uint64),
+		hist:   make(map[uint64]*sent),
+		addr:   addr,
+		start:  now,
+		total:  Stats{start: now},
+		ival:   Stats{start: now},
 	}
 }
 
@@ -250,62 +558,296 @@ func (s *Seq) matchaddr(a net.Addr) bool {
 	return s.addr.Network() == a.Network() && s.addr.String() == a.String()
 }
 
-func (s *Seq) checkbuf(b []byte) {
-	if len(b) != len(s.wbuf) {
-		s.badsz++
+func (s *Seq) stats(fn func(st *Stats)) {
+	fn(&s.total)
+	fn(&s.ival)
+}
+
+func (s *Seq) checkbuf(b []byte, now time.Time) {
+	if len(b) < hdrsize {
+		s.stats(func(st *Stats) { st.badsz++ })
 		return
 	}
 
 	cnt := binary.LittleEndian.Uint64(b)
+	h := s.hist[cnt]
 	switch {
-	case cnt > s.cnt: // sequence number newer than what we sent
-		s.badcnt++
-	case s.cnt-cnt >= s.histlen: // sequence number too old
-		s.deadcnt++
-	default:
-		if s.seen[cnt] != 0 {
-			// duplicates
-			s.dups++
-		}
-
-		// validate integrity of data
-		if bytes.Compare(s.hist[cnt], b) != 0 {
-			s.badbuf++
-		}
+	case cnt >= s.cnt: // sequence number newer than what we sent
+		s.stats(func(st *Stats) { st.badcnt++ })
+		return
+	case h == nil: // sequence number too old
+		s.stats(func(st *Stats) { st.deadcnt++ })
+		return
+	case len(b) != len(h.buf):
+		s.stats(func(st *Stats) { st.badsz++ })
+		return
+	case s.seen[cnt] != 0:
 		s.seen[cnt]++
+		s.stats(func(st *Stats) { st.dups++ })
+		return
 	}
-}
+	s.seen[cnt]++
+	s.reorder(cnt)
 
-func (s *Seq) fillbuf() {
-	binary.LittleEndian.PutUint64(s.wbuf[0:], s.cnt)
-	rand.Read(s.wbuf[8:])
+	// validate integrity of data, the reflector only touches its timestamps
+	if !bytes.Equal(h.buf[:16], b[:16]) || !bytes.Equal(h.buf[hdrsize:], b[hdrsize:]) {
+		s.stats(func(st *Stats) { st.badbuf++ })
+		return
+	}
+
+	// an older reflector echoes the packet as is
+	t1 := int64(binary.LittleEndian.Uint64(b[8:]))
+	t2 := int64(binary.LittleEndian.Uint64(b[16:]))
+	t3 := int64(binary.LittleEndian.Uint64(b[24:]))
+	t4 := now.UnixNano()
+	rtt := t4 - t1
+	if t2 != 0 && t3 >= t2 {
+		rtt -= t3 - t2
+	}
 
-	s.hist[s.cnt], s.cnt = append([]byte{}, s.wbuf...), s.cnt+1
-	s.sent += uint64(len(s.wbuf))
+	s.stats(func(st *Stats) {
+		st.recvpkts++
+		st.recv += uint64(len(b))
+		st.rtt.add(float64(rtt))
+		if t2 != 0 {
+			st.fwd.add(float64(t2 - t1))
+			st.rev.add(float64(t4 - t3))
+		}
+	})
 }
 
-func (s *Seq) cleanhist() {
-	if uint64(len(s.hist)) < s.histlen {
+// reordering is measured against the highest sequence number seen
+// before this one arrived, in the spirit of rfc 4737
+func (s *Seq) reorder(cnt uint64) {
+	if !s.havemax || cnt > s.maxseq {
+		s.maxseq, s.havemax = cnt, true
 		return
 	}
 
+	dist := s.maxseq - cnt
+	s.stats(func(st *Stats) {
+		st.reordered++
+		if dist > st.maxreord {
+			st.maxreord = dist
+		}
+	})
+}
+
+func (s *Seq) fillbuf(size int) []byte {
+	wbuf := make([]byte, size)
+	now := time.Now()
+	binary.LittleEndian.PutUint64(wbuf[0:], s.cnt)
+	binary.LittleEndian.PutUint64(wbuf[8:], uint64(now.UnixNano()))
+	rand.Read(wbuf[hdrsize:])
+
+	s.hist[s.cnt], s.cnt = &sent{wbuf, now}, s.cnt+1
+	s.stats(func(st *Stats) {
+		st.sentpkts++
+		st.sent += uint64(len(wbuf))
+	})
+	return wbuf
+}
+
+// anything that did not come back within the wait time is lost
+func (s *Seq) cleanhist(now time.Time) {
 	n := 0
-	for k, _ := range s.hist {
-		if s.cnt > s.histlen && s.cnt-s.histlen > k {
+	for k, h := range s.hist {
+		if now.Sub(h.time) >= opt.wait {
 			if s.seen[k] == 0 {
-				s.lostcnt++
+				s.stats(func(st *Stats) { st.lostcnt++ })
 			}
 			delete(s.hist, k)
+			delete(s.seen, k)
 			n++
 		}
 	}
-	log.Printf("%v: histsize %d reclaimed %d\n", s.addr, len(s.hist), n)
+	if n > 0 && opt.verbose {
+		log.Printf("%v: histsize %d reclaimed %d\n", s.addr, len(s.hist), n)
+	}
 }
 
-func (s *Seq) dumpstats() {
-	b := new(bytes.Buffer)
-	fmt.Fprintf(b, "\n")
-	fmt.Fprintf(b, "%v sent %v bytes dups %v lostcnt %v deadcnt %v badsz %v badcnt %v badbuf %v\n",
-		s.addr, s.sent, s.dups, s.lostcnt, s.deadcnt, s.badsz, s.badcnt, s.badbuf)
-	log.Printf("%s\n", b.String())
+func (st *Stats) report(typ string, addr net.Addr, start, now time.Time) *Report {
+	secs := now.Sub(st.start).Seconds()
+	r := &Report{
+		Type:       typ,
+		Addr:       addr.String(),
+		Start:      st.start.Sub(start).Seconds(),
+		End:        now.Sub(start).Seconds(),
+		SentPkts:   st.sentpkts,
+		SentBytes:  st.sent,
+		RecvPkts:   st.recvpkts,
+		RecvBytes:  st.recv,
+		Lost:       st.lostcnt,
+		Dups:       st.dups,
+		Late:       st.deadcnt,
+		Reordered:  st.reordered,
+		MaxReorder: st.maxreord,
+		BadSize:    st.badsz,
+		BadSeq:     st.badcnt,
+		BadData:    st.badbuf,
+		RTT:        st.rtt.report(),
+		Forward:    st.fwd.report(),
+		Reverse:    st.rev.report(),
+	}
+	if n := st.recvpkts + st.lostcnt; n > 0 {
+		r.Loss = 100 * float64(st.lostcnt) / float64(n)
+	}
+	if secs > 0 {
+		r.TxRate = float64(st.sent) * 8 / secs
+		r.RxRate = float64(st.recv) * 8 / secs
+	}
+	return r
+}
+
+// bulk throughput over tcp, the sender writes as fast as it can for the
+// duration then half closes, the receiver answers with the number of bytes
+// it read and how long that took so both ends of the measurement are known
+func bulksend() {
+	if opt.duration == 0 {
+		opt.duration = 10 * time.Second
+	}
+
+	var wg sync.WaitGroup
+	for _, addr := range opt.raddr {
+		wg.Add(1)
+		go func(addr net.Addr) {
+			defer wg.Done()
+			bulkconn(addr)
+		}(addr)
+	}
+	wg.Wait()
+}
+
+func bulkconn(addr net.Addr) {
+	conn, err := net.Dial(opt.network, addr.String())
+	if err != nil {
+		log.Printf("%v: %v\n", addr, err)
+		return
+	}
+	defer conn.Close()
+	log.Printf("%v: connected from %v\n", addr, conn.LocalAddr())
+
+	buf := make([]byte, 128*1024)
+	rand.Read(buf)
+
+	start := time.Now()
+	total := Stats{start: start}
+	ival := Stats{start: start}
+	end := start.Add(opt.duration)
+	next := start.Add(opt.report)
+loop:
+	for {
+		select {
+		case <-done:
+			break loop
+		default:
+		}
+
+		now := time.Now()
+		if !now.Before(end) {
+			break
+		}
+		if opt.report > 0 && !now.Before(next) {
+			ival.report("interval", addr, start, now).print()
+			ival = Stats{start: now}
+			next = next.Add(opt.report)
+		}
+
+		conn.SetWriteDeadline(end)
+		n, err := conn.Write(buf)
+		total.sent += uint64(n)
+		ival.sent += uint64(n)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			log.Printf("%v: %v\n", addr, err)
+			return
+		}
+	}
+	now := time.Now()
+	conn.(*net.TCPConn).CloseWrite()
+
+	// the receiver's view of the transfer
+	var reply [16]byte
+	conn.SetReadDeadline(time.Now().Add(opt.wait + 5*time.Second))
+	_, err = io.ReadFull(conn, reply[:])
+	r := total.report("summary", addr, start, now)
+	if err != nil {
+		log.Printf("%v: no reply from receiver: %v\n", addr, err)
+	} else {
+		r.RecvBytes = binary.LittleEndian.Uint64(reply[0:])
+		secs := time.Duration(binary.LittleEndian.Uint64(reply[8:])).Seconds()
+		if secs > 0 {
+			r.RxRate = float64(r.RecvBytes) * 8 / secs
+		}
+	}
+	r.print()
+}
+
+func bulkrecv() {
+	ln, err := net.Listen(opt.network, opt.laddr)
+	ck(err)
+	defer ln.Close()
+	log.Printf("local address: %v\n", ln.Addr())
+
+	go func() {
+		<-done
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			log.Println(err)
+			continue
+		}
+		go bulkserve(conn)
+	}
+}
+
+func bulkserve(conn net.Conn) {
+	defer conn.Close()
+
+	addr := conn.RemoteAddr()
+	log.Printf("%v: receiving\n", addr)
+
+	buf := make([]byte, 128*1024)
+	start := time.Now()
+	last := start
+	total := Stats{start: start}
+	ival := Stats{start: start}
+	next := start.Add(opt.report)
+	for {
+		n, err := conn.Read(buf)
+		now := time.Now()
+		total.recv += uint64(n)
+		ival.recv += uint64(n)
+		if n > 0 {
+			last = now
+		}
+		if opt.report > 0 && !now.Before(next) {
+			ival.report("interval", addr, start, now).print()
+			ival = Stats{start: now}
+			next = next.Add(opt.report)
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("%v: %v\n", addr, err)
+			}
+			break
+		}
+	}
+
+	var reply [16]byte
+	binary.LittleEndian.PutUint64(reply[0:], total.recv)
+	binary.LittleEndian.PutUint64(reply[8:], uint64(last.Sub(start)))
+	conn.Write(reply[:])
+
+	total.report("summary", addr, start, last).print()
 }
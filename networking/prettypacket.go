@@ -1,14 +1,26 @@
 // ported from hexinject
 // http://hexinject.sourceforge.net/
 
+// reads raw frames from stdin, or every packet of a pcap/pcapng capture
+// with -r, and prints them layer by layer. packets can be selected with
+// a tcpdump style display filter, see compileFilter for the syntax
+
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math/bits"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -16,8 +28,27 @@ const (
 	BYTE_MULT = 3
 )
 
+// link types from http://www.tcpdump.org/linktypes.html
+const (
+	LINKTYPE_NULL        = 0
+	LINKTYPE_ETHERNET    = 1
+	LINKTYPE_RAW         = 101
+	LINKTYPE_LOOP        = 108
+	LINKTYPE_LINUX_SLL   = 113
+	LINKTYPE_IPV4        = 228
+	LINKTYPE_IPV6        = 229
+	LINKTYPE_LINUX_SLL2  = 276
+	LINKTYPE_RAW_OPENBSD = 12
+	LINKTYPE_RAW_BSDI    = 14
+)
+
 var (
-	example = flag.String("x", "", "print example output for packet type")
+	example  = flag.String("x", "", "print example output for packet type")
+	readFile = flag.String("r", "", "read packets from pcap or pcapng file")
+	linkType = flag.Int("l", LINKTYPE_ETHERNET, "link type of packets read from stdin")
+	expr     = flag.String("f", "", "display filter expression")
+
+	filter Filter
 )
 
 func main() {
@@ -26,18 +57,39 @@ func main() {
 
 	flag.Usage = usage
 	flag.Parse()
-	if *example != "" {
-		decodeLayer2(packet(*example), 0)
+
+	filterExpr := *expr
+	if filterExpr == "" && flag.NArg() > 0 {
+		filterExpr = strings.Join(flag.Args(), " ")
+	}
+	if filterExpr != "" {
+		var err error
+		filter, err = compileFilter(filterExpr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	switch {
+	case *example != "":
+		if match(packet(*example), LINKTYPE_ETHERNET) {
+			decodePacket(packet(*example), LINKTYPE_ETHERNET)
+		}
 		fmt.Println()
-	} else {
+	case *readFile != "":
+		err := readCapture(*readFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
 		loop()
 	}
 }
 
 func usage() {
-	fmt.Fprintln(os.Stderr, "usage: [options]")
+	fmt.Fprintln(os.Stderr, "usage: [options] [filter expression]")
 	flag.PrintDefaults()
-	fmt.Fprintln(os.Stderr, "\navailable examples: tcp udp icmp igmp arp")
+	fmt.Fprintln(os.Stderr, "\navailable examples: tcp udp icmp igmp arp ipv6 vlan http tls dhcp vxlan")
 	os.Exit(2)
 }
 
@@ -53,6 +105,18 @@ func packet(str string) []byte {
 		return []byte(igmp)
 	case "arp":
 		return []byte(arp)
+	case "ipv6":
+		return []byte(ipv6)
+	case "vlan":
+		return []byte(vlan)
+	case "http":
+		return []byte(http)
+	case "tls":
+		return []byte(tls)
+	case "dhcp":
+		return []byte(dhcp)
+	case "vxlan":
+		return []byte(vxlan)
 	}
 
 	log.Fatalf("unknown packet type %q", str)
@@ -200,6 +264,14 @@ func printIP(buf []byte) {
 		return
 	}
 
+	ihl := int(buf[0]&0xf) * 4
+	tot := int(extractBE(buf[2:], 2))
+	frag := extractBE(buf[6:], 2) & 0x1fff
+	if ihl < 20 || len(buf) < ihl {
+		fmt.Println(" invalid header size")
+		return
+	}
+
 	buf = printField(buf, 1, "Version / Header length")
 	buf = printField(buf, 1, "Tos / DFS")
 	buf = printField(buf, 2, "Total length")
@@ -213,8 +285,207 @@ func printIP(buf []byte) {
 	buf = printField(buf, 2, "Checksum")
 	buf = printField(buf, 4, "Source address")
 	buf = printField(buf, 4, "Destination address")
+	if ihl > 20 {
+		buf = printField(buf, ihl-20, "Options")
+	}
+
+	// anything past the total length is link layer padding
+	var trailer []byte
+	if tot >= ihl && tot-ihl <= len(buf) {
+		buf, trailer = buf[:tot-ihl], buf[tot-ihl:]
+	}
 
-	decodeLayer4(buf, prot)
+	if frag != 0 {
+		printPayload(buf)
+	} else {
+		decodeLayer4(buf, prot)
+	}
+	printPayload(trailer)
+}
+
+func printIPv6(buf []byte) {
+	fmt.Println("\nIPv6 Header:")
+	if len(buf) < 40 {
+		fmt.Println(" invalid header size")
+		return
+	}
+
+	plen := int(extractBE(buf[4:], 2))
+	buf = printField(buf, 4, "Version / Traffic class / Flow label")
+	buf = printField(buf, 2, "Payload length")
+
+	next := extractBE(buf, 1)
+	buf = printField(buf, 1, "Next header")
+	buf = printField(buf, 1, "Hop limit")
+	buf = printField(buf, 16, "Source address")
+	buf = printField(buf, 16, "Destination address")
+
+	var trailer []byte
+	if plen <= len(buf) {
+		buf, trailer = buf[:plen], buf[plen:]
+	}
+
+	for {
+		name := ipv6ExtHeaders[next]
+		if name == "" {
+			break
+		}
+
+		fmt.Printf("\nIPv6 %s Header:\n", name)
+		if len(buf) < 8 {
+			fmt.Println(" invalid header size")
+			return
+		}
+
+		size := (int(buf[1]) + 1) * 8
+		switch next {
+		case 44:
+			size = 8
+		case 51:
+			size = (int(buf[1]) + 2) * 4
+		}
+		if len(buf) < size {
+			fmt.Println(" invalid header size")
+			return
+		}
+
+		frag := uint64(0)
+		nnext := extractBE(buf, 1)
+		buf = printField(buf, 1, "Next header")
+		switch next {
+		case 44:
+			buf = printField(buf, 1, "Reserved")
+			frag = extractBE(buf, 2) >> 3
+			buf = printField(buf, 2, "Fragment offset / Flags")
+			buf = printField(buf, 4, "Identification")
+		case 51:
+			buf = printField(buf, 1, "Payload length")
+			buf = printField(buf, 2, "Reserved")
+			buf = printField(buf, 4, "Security parameters index")
+			buf = printField(buf, 4, "Sequence number")
+			if size > 12 {
+				buf = printField(buf, size-12, "Integrity check value")
+			}
+		default:
+			buf = printField(buf, 1, "Header extension length")
+			buf = printField(buf, size-2, "Options / Data")
+		}
+
+		next = nnext
+		if frag != 0 {
+			printPayload(buf)
+			printPayload(trailer)
+			return
+		}
+	}
+
+	decodeLayer4(buf, next)
+	printPayload(trailer)
+}
+
+var ipv6ExtHeaders = map[uint64]string{
+	0:  "Hop-by-Hop Options",
+	43: "Routing",
+	44: "Fragment",
+	51: "Authentication",
+	60: "Destination Options",
+}
+
+func printVLAN(buf []byte, tpid uint64) {
+	if tpid == 0x8100 {
+		fmt.Println("\n802.1Q VLAN Header:")
+	} else {
+		fmt.Println("\n802.1ad Service VLAN Header:")
+	}
+	if len(buf) < 4 {
+		fmt.Println(" invalid header size")
+		return
+	}
+
+	buf = printField(buf, 2, "Priority / DEI / VLAN ID")
+	prot := extractBE(buf, 2)
+	buf = printField(buf, 2, "Length/Type")
+
+	if prot > 1500 {
+		decodeLayer3(buf, prot)
+	} else {
+		printLLC(buf)
+	}
+}
+
+func printSLL(buf []byte) {
+	fmt.Println("\nLinux Cooked Capture Header:")
+	if len(buf) < 16 {
+		fmt.Println(" invalid header size")
+		return
+	}
+
+	buf = printField(buf, 2, "Packet type")
+	buf = printField(buf, 2, "ARPHRD type")
+	buf = printField(buf, 2, "Link-layer address length")
+	buf = printField(buf, 8, "Link-layer address")
+	prot := extractBE(buf, 2)
+	buf = printField(buf, 2, "Protocol")
+
+	decodeLayer3(buf, prot)
+}
+
+func printSLL2(buf []byte) {
+	fmt.Println("\nLinux Cooked Capture v2 Header:")
+	if len(buf) < 20 {
+		fmt.Println(" invalid header size")
+		return
+	}
+
+	prot := extractBE(buf, 2)
+	buf = printField(buf, 2, "Protocol")
+	buf = printField(buf, 2, "Reserved")
+	buf = printField(buf, 4, "Interface index")
+	buf = printField(buf, 2, "ARPHRD type")
+	buf = printField(buf, 1, "Packet type")
+	buf = printField(buf, 1, "Link-layer address length")
+	buf = printField(buf, 8, "Link-layer address")
+
+	decodeLayer3(buf, prot)
+}
+
+// the family is in the byte order of the host that did the capture
+func printNull(buf []byte) {
+	fmt.Println("\nLoopback Header:")
+	if len(buf) < 4 {
+		fmt.Println(" invalid header size")
+		return
+	}
+
+	family := extractLE(buf, 4)
+	if family > 0xffff {
+		family = extractBE(buf, 4)
+	}
+	buf = printField(buf, 4, "Address family")
+
+	switch family {
+	case 2:
+		printIP(buf)
+	case 24, 28, 30:
+		printIPv6(buf)
+	default:
+		printPayload(buf)
+	}
+}
+
+func decodeRaw(buf []byte) {
+	if len(buf) < 1 {
+		return
+	}
+
+	switch buf[0] >> 4 {
+	case 4:
+		printIP(buf)
+	case 6:
+		printIPv6(buf)
+	default:
+		printPayload(buf)
+	}
 }
 
 func printARP(buf []byte) {
@@ -235,6 +506,11 @@ func printARP(buf []byte) {
 
 	buf = printField(buf, 2, "Opcode")
 
+	// the sizes come from the packet
+	if len(buf) < 2*hs+2*ps {
+		fmt.Println(" invalid header size")
+		return
+	}
 	buf = printField(buf, hs, "Sender hardware address")
 	buf = printField(buf, ps, "Sender protocol address")
 	buf = printField(buf, hs, "Target hardware address")
@@ -274,6 +550,20 @@ func printICMP(buf []byte) {
 	printPayload(buf)
 }
 
+func printICMPv6(buf []byte) {
+	fmt.Println("\nICMPv6 Header:")
+	if len(buf) < 4 {
+		fmt.Println(" invalid header size")
+		return
+	}
+
+	buf = printField(buf, 1, "Type")
+	buf = printField(buf, 1, "Code")
+	buf = printField(buf, 2, "Checksum")
+
+	printPayload(buf)
+}
+
 func printIGMP(buf []byte) {
 	fmt.Println("\nIGMP Header:")
 	if len(buf) < 8 {
@@ -291,7 +581,15 @@ func printIGMP(buf []byte) {
 
 func printTCP(buf []byte) {
 	fmt.Println("\nTCP header:")
-	if len(buf) < 8 {
+	if len(buf) < 20 {
+		fmt.Println(" invalid header size")
+		return
+	}
+
+	sport := extractBE(buf, 2)
+	dport := extractBE(buf[2:], 2)
+	doff := int(buf[12]>>4) * 4
+	if doff < 20 || len(buf) < doff {
 		fmt.Println(" invalid header size")
 		return
 	}
@@ -305,8 +603,22 @@ func printTCP(buf []byte) {
 	buf = printField(buf, 2, "Window")
 	buf = printField(buf, 2, "Checksum")
 	buf = printField(buf, 2, "Urgent Pointer")
+	if doff > 20 {
+		buf = printField(buf, doff-20, "Options")
+	}
 
-	printPayload(buf)
+	switch {
+	case len(buf) == 0:
+	case isHTTP(buf):
+		printHTTP(buf)
+	case isTLS(buf):
+		printTLS(buf)
+	case (sport == 53 || dport == 53) && len(buf) >= 2:
+		buf = printField(buf, 2, "DNS message length")
+		printDNS(buf)
+	default:
+		printPayload(buf)
+	}
 }
 
 func printUDP(buf []byte) {
@@ -316,14 +628,443 @@ func printUDP(buf []byte) {
 		return
 	}
 
+	sport := extractBE(buf, 2)
+	dport := extractBE(buf[2:], 2)
+
 	buf = printField(buf, 2, "Source port")
 	buf = printField(buf, 2, "Destination port")
 	buf = printField(buf, 2, "Length")
 	buf = printField(buf, 2, "Checksum")
 
+	port := func(p uint64) bool { return sport == p || dport == p }
+	switch {
+	case port(53), port(5353):
+		printDNS(buf)
+	case port(67), port(68):
+		printDHCP(buf)
+	case dport == 4789:
+		printVXLAN(buf)
+	default:
+		printPayload(buf)
+	}
+}
+
+func printVXLAN(buf []byte) {
+	fmt.Println("\nVXLAN Header:")
+	if len(buf) < 8 {
+		fmt.Println(" invalid header size")
+		return
+	}
+
+	buf = printField(buf, 1, "Flags")
+	buf = printField(buf, 3, "Reserved")
+	buf = printField(buf, 3, "VXLAN network identifier")
+	buf = printField(buf, 1, "Reserved")
+
+	printEthernet(buf)
+}
+
+func printDNS(buf []byte) {
+	fmt.Println("\nDNS Header:")
+	if len(buf) < 12 {
+		fmt.Println(" invalid header size")
+		return
+	}
+
+	msg := buf
+	counts := [4]int{
+		int(extractBE(buf[4:], 2)),
+		int(extractBE(buf[6:], 2)),
+		int(extractBE(buf[8:], 2)),
+		int(extractBE(buf[10:], 2)),
+	}
+
+	buf = printField(buf, 2, "ID")
+	buf = printField(buf, 2, "Flags")
+	buf = printField(buf, 2, "Questions")
+	buf = printField(buf, 2, "Answer RRs")
+	buf = printField(buf, 2, "Authority RRs")
+	buf = printField(buf, 2, "Additional RRs")
+
+	off := 12
+	for i := 0; i < counts[0]; i++ {
+		name, n := dnsName(msg, off)
+		if n < 0 || off+n+4 > len(msg) {
+			fmt.Println(" invalid question")
+			return
+		}
+		off += n
+		typ := extractBE(msg[off:], 2)
+		class := extractBE(msg[off+2:], 2)
+		off += 4
+		printText("Query", fmt.Sprintf("%s %s %s", name, dnsType(typ), dnsClass(class)))
+	}
+
+	sections := []string{"Answer", "Authority", "Additional"}
+	for s, label := range sections {
+		for i := 0; i < counts[s+1]; i++ {
+			name, n := dnsName(msg, off)
+			if n < 0 || off+n+10 > len(msg) {
+				fmt.Println(" invalid resource record")
+				return
+			}
+			off += n
+			typ := extractBE(msg[off:], 2)
+			class := extractBE(msg[off+2:], 2)
+			ttl := extractBE(msg[off+4:], 4)
+			rdlen := int(extractBE(msg[off+8:], 2))
+			off += 10
+			if off+rdlen > len(msg) {
+				fmt.Println(" invalid resource record")
+				return
+			}
+
+			if typ == 41 {
+				printText(label, fmt.Sprintf("OPT udp size %d", class))
+			} else {
+				printText(label, fmt.Sprintf("%s %d %s %s %s", name, ttl, dnsClass(class), dnsType(typ), dnsRData(msg, off, rdlen, typ)))
+			}
+			off += rdlen
+		}
+	}
+
+	printPayload(msg[off:])
+}
+
+// returns the name at off and how many bytes it takes up at off,
+// following compression pointers
+func dnsName(msg []byte, off int) (string, int) {
+	var labels []string
+	start, end := off, -1
+	for hops := 0; hops < 128; hops++ {
+		if off >= len(msg) {
+			return "", -1
+		}
+
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end - start
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", -1
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = (l&0x3f)<<8 | int(msg[off+1])
+		default:
+			if off+1+l > len(msg) {
+				return "", -1
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+	return "", -1
+}
+
+var dnsTypes = map[uint64]string{
+	1: "A", 2: "NS", 5: "CNAME", 6: "SOA", 12: "PTR", 15: "MX", 16: "TXT",
+	28: "AAAA", 33: "SRV", 41: "OPT", 43: "DS", 46: "RRSIG", 47: "NSEC",
+	48: "DNSKEY", 64: "SVCB", 65: "HTTPS", 255: "ANY", 257: "CAA",
+}
+
+func dnsType(typ uint64) string {
+	if name, ok := dnsTypes[typ]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", typ)
+}
+
+func dnsClass(class uint64) string {
+	switch class &^ 0x8000 {
+	case 1:
+		return "IN"
+	case 3:
+		return "CH"
+	case 255:
+		return "ANY"
+	}
+	return fmt.Sprintf("CLASS%d", class)
+}
+
+func dnsRData(msg []byte, off, size int, typ uint64) string {
+	rdata := msg[off : off+size]
+	name := func(o int) string {
+		n, l := dnsName(msg, o)
+		if l < 0 {
+			return "<invalid>"
+		}
+		return n
+	}
+
+	switch {
+	case typ == 1 && size == 4, typ == 28 && size == 16:
+		return net.IP(rdata).String()
+	case typ == 2, typ == 5, typ == 12:
+		return name(off)
+	case typ == 15 && size > 2:
+		return fmt.Sprintf("%d %s", extractBE(rdata, 2), name(off+2))
+	case typ == 33 && size > 6:
+		return fmt.Sprintf("%d %d %d %s", extractBE(rdata, 2), extractBE(rdata[2:], 2), extractBE(rdata[4:], 2), name(off+6))
+	case typ == 6:
+		mname, n1 := dnsName(msg, off)
+		rname, n2 := dnsName(msg, off+max(n1, 0))
+		p := off + n1 + n2
+		if n1 < 0 || n2 < 0 || p+20 > off+size {
+			break
+		}
+		return fmt.Sprintf("%s %s %d %d %d %d %d", mname, rname, extractBE(msg[p:], 4), extractBE(msg[p+4:], 4),
+			extractBE(msg[p+8:], 4), extractBE(msg[p+12:], 4), extractBE(msg[p+16:], 4))
+	case typ == 16:
+		var txt []string
+		for len(rdata) > 0 && int(rdata[0]) < len(rdata) {
+			txt = append(txt, strconv.Quote(string(rdata[1:1+rdata[0]])))
+			rdata = rdata[1+rdata[0]:]
+		}
+		return strings.Join(txt, " ")
+	case typ == 257 && size > 2 && 2+int(rdata[1]) <= size:
+		return fmt.Sprintf("%d %s %q", rdata[0], rdata[2:2+rdata[1]], rdata[2+rdata[1]:])
+	}
+	return fmt.Sprintf("% X", rdata)
+}
+
+func printDHCP(buf []byte) {
+	fmt.Println("\nDHCP Header:")
+	if len(buf) < 236 {
+		fmt.Println(" invalid header size")
+		return
+	}
+
+	buf = printField(buf, 1, "Opcode")
+	buf = printField(buf, 1, "Hardware type")
+	buf = printField(buf, 1, "Hardware address length")
+	buf = printField(buf, 1, "Hops")
+	buf = printField(buf, 4, "Transaction ID")
+	buf = printField(buf, 2, "Seconds elapsed")
+	buf = printField(buf, 2, "Flags")
+	buf = printField(buf, 4, "Client IP address")
+	buf = printField(buf, 4, "Your IP address")
+	buf = printField(buf, 4, "Server IP address")
+	buf = printField(buf, 4, "Gateway IP address")
+	buf = printField(buf, 16, "Client hardware address")
+	buf = printString(buf, 64, "Server host name")
+	buf = printString(buf, 128, "Boot file name")
+
+	if len(buf) < 4 || extractBE(buf, 4) != 0x63825363 {
+		printPayload(buf)
+		return
+	}
+	buf = printField(buf, 4, "Magic cookie")
+
+	for len(buf) > 0 {
+		code := buf[0]
+		switch {
+		case code == 0:
+			buf = buf[1:]
+			continue
+		case code == 255:
+			buf = printField(buf, 1, "End")
+			printPayload(buf)
+			return
+		case len(buf) < 2 || len(buf) < 2+int(buf[1]):
+			fmt.Println(" invalid option")
+			return
+		}
+
+		size := int(buf[1])
+		data := buf[2 : 2+size]
+		name := dhcpOptions[code]
+		if name == "" {
+			name = "Unknown"
+		}
+		buf = printField(buf, 2+size, fmt.Sprintf("Option %d: %s", code, name))
+		if value := dhcpOptionValue(code, data); value != "" {
+			printText(name, value)
+		}
+	}
+}
+
+var dhcpOptions = map[byte]string{
+	1: "Subnet mask", 3: "Router", 6: "Domain name server", 12: "Host name",
+	15: "Domain name", 28: "Broadcast address", 42: "NTP servers", 43: "Vendor specific",
+	50: "Requested IP address", 51: "Lease time", 53: "Message type", 54: "Server identifier",
+	55: "Parameter request list", 57: "Maximum message size", 58: "Renewal time",
+	59: "Rebinding time", 60: "Vendor class identifier", 61: "Client identifier",
+	66: "TFTP server name", 67: "Bootfile name", 81: "Client FQDN", 82: "Relay agent information",
+	119: "Domain search", 121: "Classless static route",
+}
+
+var dhcpMessageTypes = []string{
+	1: "DISCOVER", 2: "OFFER", 3: "REQUEST", 4: "DECLINE", 5: "ACK", 6: "NAK", 7: "RELEASE", 8: "INFORM",
+}
+
+func dhcpOptionValue(code byte, data []byte) string {
+	switch code {
+	case 1, 3, 6, 28, 42, 50, 54:
+		var ips []string
+		for ; len(data) >= 4; data = data[4:] {
+			ips = append(ips, net.IP(data[:4]).String())
+		}
+		return strings.Join(ips, " ")
+	case 12, 15, 60, 66, 67:
+		return strconv.Quote(string(data))
+	case 51, 58, 59:
+		if len(data) == 4 {
+			return (time.Duration(extractBE(data, 4)) * time.Second).String()
+		}
+	case 53:
+		if len(data) == 1 && int(data[0]) < len(dhcpMessageTypes) {
+			return dhcpMessageTypes[data[0]]
+		}
+	case 55:
+		var names []string
+		for _, c := range data {
+			names = append(names, strconv.Itoa(int(c)))
+		}
+		return strings.Join(names, " ")
+	}
+	return ""
+}
+
+var httpMethods = []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "CONNECT ", "OPTIONS ", "TRACE ", "PATCH ", "HTTP/1."}
+
+func isHTTP(buf []byte) bool {
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(buf, []byte(m)) {
+			return true
+		}
+	}
+	return false
+}
+
+func printHTTP(buf []byte) {
+	fmt.Println("\nHTTP Header:")
+	for len(buf) > 0 {
+		i := bytes.Index(buf, []byte("\r\n"))
+		if i < 0 {
+			// header continues in the next segment
+			fmt.Printf(" %q\n", buf)
+			return
+		}
+
+		line := buf[:i]
+		buf = buf[i+2:]
+		if len(line) == 0 {
+			break
+		}
+		fmt.Printf(" %s\n", line)
+	}
 	printPayload(buf)
 }
 
+func isTLS(buf []byte) bool {
+	return len(buf) >= 5 && buf[0] >= 20 && buf[0] <= 23 && buf[1] == 3 && buf[2] <= 4
+}
+
+func printTLS(buf []byte) {
+	fmt.Println("\nTLS Record Header:")
+	typ := buf[0]
+	size := int(extractBE(buf[3:], 2))
+	buf = printField(buf, 1, "Content type")
+	buf = printField(buf, 2, "Version")
+	buf = printField(buf, 2, "Length")
+	if size > len(buf) {
+		size = len(buf)
+	}
+
+	if typ != 22 || size < 4 || buf[0] != 1 {
+		printPayload(buf)
+		return
+	}
+
+	fmt.Println("\nTLS Handshake Header:")
+	buf = printField(buf, 1, "Handshake type")
+	buf = printField(buf, 3, "Length")
+
+	fmt.Println("\nTLS ClientHello:")
+	if len(buf) < 35 {
+		fmt.Println(" invalid header size")
+		return
+	}
+	buf = printField(buf, 2, "Version")
+	buf = printField(buf, 32, "Random")
+
+	vector := func(lsize int, label string) bool {
+		if len(buf) < lsize || len(buf) < lsize+int(extractBE(buf, lsize)) {
+			fmt.Println(" invalid", strings.ToLower(label))
+			return false
+		}
+		n := int(extractBE(buf, lsize))
+		buf = printField(buf, lsize, label+" length")
+		if n > 0 {
+			buf = printField(buf, n, label)
+		}
+		return true
+	}
+	if !vector(1, "Session ID") || !vector(2, "Cipher suites") || !vector(1, "Compression methods") {
+		return
+	}
+	if len(buf) < 2 {
+		return
+	}
+	buf = printField(buf, 2, "Extensions length")
+
+	for len(buf) >= 4 {
+		ext := extractBE(buf, 2)
+		n := int(extractBE(buf[2:], 2))
+		if len(buf) < 4+n {
+			fmt.Println(" invalid extension")
+			return
+		}
+
+		data := buf[4 : 4+n]
+		name := tlsExtensions[ext]
+		if name == "" {
+			name = "Unknown"
+		}
+		buf = printField(buf, 4+n, fmt.Sprintf("Extension %d: %s", ext, name))
+
+		switch ext {
+		case 0:
+			// server name list, each entry is type, 2 byte length, name
+			if len(data) >= 2 {
+				data = data[2:]
+			}
+			for len(data) >= 3 && len(data) >= 3+int(extractBE(data[1:], 2)) {
+				l := int(extractBE(data[1:], 2))
+				if data[0] == 0 {
+					printText("Server name", string(data[3:3+l]))
+				}
+				data = data[3+l:]
+			}
+		case 16:
+			if len(data) >= 2 {
+				data = data[2:]
+			}
+			var protos []string
+			for len(data) >= 1 && len(data) >= 1+int(data[0]) {
+				protos = append(protos, string(data[1:1+data[0]]))
+				data = data[1+data[0]:]
+			}
+			printText("ALPN", strings.Join(protos, " "))
+		}
+	}
+	printPayload(buf)
+}
+
+var tlsExtensions = map[uint64]string{
+	0: "server_name", 5: "status_request", 10: "supported_groups", 11: "ec_point_formats",
+	13: "signature_algorithms", 16: "application_layer_protocol_negotiation",
+	21: "padding", 23: "extended_master_secret", 35: "session_ticket",
+	41: "pre_shared_key", 43: "supported_versions", 45: "psk_key_exchange_modes",
+	51: "key_share", 65281: "renegotiation_info",
+}
+
 func extractLE(buf []byte, size int) uint64 {
 	v := uint64(0)
 	for i := 0; i < size; i++ {
@@ -346,6 +1087,20 @@ func printField(buf []byte, size int, text string) []byte {
 	return buf[size:]
 }
 
+func printString(buf []byte, size int, text string) []byte {
+	str := buf[:size]
+	if i := bytes.IndexByte(str, 0); i >= 0 {
+		str = str[:i]
+	}
+	fmt.Printf(" %-24q %s\n", str, text)
+	return buf[size:]
+}
+
+// decoded values go under the hex column of the field they came from
+func printText(text, value string) {
+	fmt.Printf(" %-24s %s: %s\n", "", text, value)
+}
+
 func decodeLayer2(buf []byte, prot uint64) {
 	const llc1 = 0x0180C20000
 	const llc2 = 0x01000CCCCCCC
@@ -380,6 +1135,10 @@ func decodeLayer3(buf []byte, prot uint64) {
 			printIP(buf)
 		case 0x0806:
 			printARP(buf)
+		case 0x86dd:
+			printIPv6(buf)
+		case 0x8100, 0x88a8, 0x9100:
+			printVLAN(buf, prot)
 		default:
 			printPayload(buf)
 		}
@@ -398,15 +1157,47 @@ func decodeLayer4(buf []byte, prot uint64) {
 		printICMP(buf)
 	case 2:
 		printIGMP(buf)
+	case 4:
+		printIP(buf)
 	case 6:
 		printTCP(buf)
 	case 17:
 		printUDP(buf)
+	case 41:
+		printIPv6(buf)
+	case 58:
+		printICMPv6(buf)
 	default:
 		printPayload(buf)
 	}
 }
 
+func decodePacket(buf []byte, linktype int) {
+	switch linktype {
+	case LINKTYPE_ETHERNET:
+		decodeLayer2(buf, 0)
+	case LINKTYPE_NULL, LINKTYPE_LOOP:
+		printNull(buf)
+	case LINKTYPE_RAW, LINKTYPE_RAW_OPENBSD, LINKTYPE_RAW_BSDI:
+		decodeRaw(buf)
+	case LINKTYPE_IPV4:
+		printIP(buf)
+	case LINKTYPE_IPV6:
+		printIPv6(buf)
+	case LINKTYPE_LINUX_SLL:
+		printSLL(buf)
+	case LINKTYPE_LINUX_SLL2:
+		printSLL2(buf)
+	default:
+		fmt.Printf("\nUnsupported link type %d\n", linktype)
+		printPayload(buf)
+	}
+}
+
+func match(buf []byte, linktype int) bool {
+	return filter == nil || filter(summarize(buf, linktype))
+}
+
 func loop() {
 	var buf [8192]byte
 	for {
@@ -414,12 +1205,724 @@ func loop() {
 		if err != nil {
 			break
 		}
-		decodeLayer2(buf[:n], 0)
+		if !match(buf[:n], *linkType) {
+			continue
+		}
+		decodePacket(buf[:n], *linkType)
 		fmt.Printf("\n ----------- \n")
 	}
 	fmt.Println()
 }
 
+func readCapture(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(4)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	num := 0
+	show := func(ts time.Time, origlen int, buf []byte, linktype int) {
+		num++
+		if !match(buf, linktype) {
+			return
+		}
+		fmt.Printf("Packet %d: %s, %d bytes captured (%d on wire)\n",
+			num, ts.Format("2006-01-02 15:04:05.000000000"), len(buf), origlen)
+		decodePacket(buf, linktype)
+		fmt.Printf("\n ----------- \n")
+	}
+
+	if bytes.Equal(magic, []byte{0x0a, 0x0d, 0x0d, 0x0a}) {
+		err = readPcapng(r, show)
+	} else {
+		err = readPcap(r, show)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+type packetFunc func(ts time.Time, origlen int, buf []byte, linktype int)
+
+// the largest snapshot length libpcap will write
+const maxSnaplen = 256 * 1024 * 1024
+
+func readPcap(r io.Reader, fn packetFunc) error {
+	var hdr [24]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return err
+	}
+
+	var order binary.ByteOrder
+	nsec := false
+	switch binary.LittleEndian.Uint32(hdr[:]) {
+	case 0xa1b2c3d4:
+		order = binary.LittleEndian
+	case 0xd4c3b2a1:
+		order = binary.BigEndian
+	case 0xa1b23c4d:
+		order, nsec = binary.LittleEndian, true
+	case 0x4d3cb2a1:
+		order, nsec = binary.BigEndian, true
+	default:
+		return fmt.Errorf("not a pcap or pcapng file")
+	}
+	linktype := int(order.Uint32(hdr[20:]) & 0xffff)
+
+	var rec [16]byte
+	for {
+		_, err := io.ReadFull(r, rec[:])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		sec := int64(order.Uint32(rec[0:]))
+		frac := int64(order.Uint32(rec[4:]))
+		caplen := order.Uint32(rec[8:])
+		origlen := order.Uint32(rec[12:])
+		if caplen > maxSnaplen {
+			return fmt.Errorf("invalid packet length %d", caplen)
+		}
+		if !nsec {
+			frac *= 1000
+		}
+
+		buf := make([]byte, caplen)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return err
+		}
+		fn(time.Unix(sec, frac), int(origlen), buf, linktype)
+	}
+}
+
+type pcapngInterface struct {
+	linktype int
+	snaplen  uint32
+	// timestamp units per second
+	units uint64
+}
+
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html
+func readPcapng(r io.Reader, fn packetFunc) error {
+	var order binary.ByteOrder = binary.LittleEndian
+	var ifaces []pcapngInterface
+
+	for {
+		var hdr [8]byte
+		_, err := io.ReadFull(r, hdr[:])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		typ := order.Uint32(hdr[0:])
+		var body []byte
+		if bytes.Equal(hdr[:4], []byte{0x0a, 0x0d, 0x0d, 0x0a}) {
+			// a section header sets the byte order for everything after it
+			var bom [4]byte
+			_, err = io.ReadFull(r, bom[:])
+			if err != nil {
+				return err
+			}
+			switch binary.LittleEndian.Uint32(bom[:]) {
+			case 0x1a2b3c4d:
+				order = binary.LittleEndian
+			case 0x4d3c2b1a:
+				order = binary.BigEndian
+			default:
+				return fmt.Errorf("invalid section header byte order")
+			}
+			typ = 0x0a0d0d0a
+			ifaces = ifaces[:0]
+
+			body, err = readBlock(r, order.Uint32(hdr[4:]), 12)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		body, err = readBlock(r, order.Uint32(hdr[4:]), 8)
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case 1: // interface description
+			if len(body) < 8 {
+				return fmt.Errorf("short interface description block")
+			}
+			iface := pcapngInterface{
+				linktype: int(order.Uint16(body[0:])),
+				snaplen:  order.Uint32(body[4:]),
+				units:    1000000,
+			}
+			for opts := body[8:]; len(opts) >= 4; {
+				code := order.Uint16(opts[0:])
+				size := int(order.Uint16(opts[2:]))
+				if code == 0 || len(opts) < 4+size {
+					break
+				}
+				if code == 9 && size >= 1 {
+					// if_tsresol, the high bit selects a power of 2
+					res := opts[4]
+					base, exp := uint64(10), res
+					if res&0x80 != 0 {
+						base, exp = 2, res&0x7f
+					}
+					iface.units = 1
+					for i := byte(0); i < exp && iface.units <= 1e18; i++ {
+						iface.units *= base
+					}
+					if iface.units > 1e18 {
+						return fmt.Errorf("unsupported timestamp resolution %#x", res)
+					}
+				}
+				// the padding of the last option can be cut off
+				n := 4 + (size+3)&^3
+				if n > len(opts) {
+					break
+				}
+				opts = opts[n:]
+			}
+			ifaces = append(ifaces, iface)
+
+		case 2, 6: // obsolete packet block, enhanced packet block
+			if len(body) < 20 {
+				return fmt.Errorf("short packet block")
+			}
+			var id int
+			if typ == 2 {
+				id = int(order.Uint16(body[0:]))
+			} else {
+				id = int(order.Uint32(body[0:]))
+			}
+			if id >= len(ifaces) {
+				return fmt.Errorf("packet for unknown interface %d", id)
+			}
+			ts := uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+			caplen := int(order.Uint32(body[12:]))
+			origlen := int(order.Uint32(body[16:]))
+			if caplen > len(body)-20 {
+				return fmt.Errorf("invalid packet length %d", caplen)
+			}
+			fn(ifaces[id].time(ts), origlen, body[20:20+caplen], ifaces[id].linktype)
+
+		case 3: // simple packet block
+			if len(body) < 4 || len(ifaces) == 0 {
+				return fmt.Errorf("invalid simple packet block")
+			}
+			origlen := int(order.Uint32(body[0:]))
+			caplen := min(origlen, len(body)-4)
+			if ifaces[0].snaplen > 0 {
+				caplen = min(caplen, int(ifaces[0].snaplen))
+			}
+			fn(time.Time{}, origlen, body[4:4+caplen], ifaces[0].linktype)
+		}
+	}
+}
+
+// reads the rest of a block given its total length and how much of it has
+// been read already, the trailing copy of the length is not returned
+func readBlock(r io.Reader, total uint32, read int) ([]byte, error) {
+	if total%4 != 0 || total < uint32(read)+4 || total > maxSnaplen {
+		return nil, fmt.Errorf("invalid block length %d", total)
+	}
+
+	buf := make([]byte, int(total)-read)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:len(buf)-4], nil
+}
+
+func (i *pcapngInterface) time(ts uint64) time.Time {
+	sec := ts / i.units
+	// the remainder times 1e9 doesn't fit 64 bits past 1.8e10 units
+	hi, lo := bits.Mul64(ts%i.units, 1000000000)
+	nsec, _ := bits.Div64(hi, lo, i.units)
+	return time.Unix(int64(sec), int64(nsec))
+}
+
+// packet summary that the display filter is evaluated against,
+// tunnels add the addresses of every layer
+type pktinfo struct {
+	length int
+	protos map[string]bool
+	src    []net.IP
+	dst    []net.IP
+	sport  []uint64
+	dport  []uint64
+	vlans  []uint64
+	vnis   []uint64
+}
+
+func summarize(buf []byte, linktype int) *pktinfo {
+	p := &pktinfo{
+		length: len(buf),
+		protos: make(map[string]bool),
+	}
+
+	switch linktype {
+	case LINKTYPE_ETHERNET:
+		p.ether(buf)
+	case LINKTYPE_NULL, LINKTYPE_LOOP:
+		if len(buf) >= 4 {
+			family := extractLE(buf, 4)
+			if family > 0xffff {
+				family = extractBE(buf, 4)
+			}
+			switch family {
+			case 2:
+				p.layer3(0x0800, buf[4:])
+			case 24, 28, 30:
+				p.layer3(0x86dd, buf[4:])
+			}
+		}
+	case LINKTYPE_RAW, LINKTYPE_RAW_OPENBSD, LINKTYPE_RAW_BSDI, LINKTYPE_IPV4, LINKTYPE_IPV6:
+		p.raw(buf)
+	case LINKTYPE_LINUX_SLL:
+		if len(buf) >= 16 {
+			p.layer3(extractBE(buf[14:], 2), buf[16:])
+		}
+	case LINKTYPE_LINUX_SLL2:
+		if len(buf) >= 20 {
+			p.layer3(extractBE(buf, 2), buf[20:])
+		}
+	}
+	return p
+}
+
+func (p *pktinfo) ether(buf []byte) {
+	if len(buf) < 14 {
+		return
+	}
+	p.protos["ether"] = true
+
+	prot := extractBE(buf[12:], 2)
+	if prot <= 1500 {
+		p.protos["llc"] = true
+		return
+	}
+	p.layer3(prot, buf[14:])
+}
+
+func (p *pktinfo) raw(buf []byte) {
+	if len(buf) < 1 {
+		return
+	}
+	switch buf[0] >> 4 {
+	case 4:
+		p.layer3(0x0800, buf)
+	case 6:
+		p.layer3(0x86dd, buf)
+	}
+}
+
+func (p *pktinfo) layer3(prot uint64, buf []byte) {
+	switch prot {
+	case 0x8100, 0x88a8, 0x9100:
+		if len(buf) < 4 {
+			return
+		}
+		p.protos["vlan"] = true
+		p.vlans = append(p.vlans, extractBE(buf, 2)&0xfff)
+		p.layer3(extractBE(buf[2:], 2), buf[4:])
+
+	case 0x0806:
+		p.protos["arp"] = true
+		if len(buf) >= 28 && buf[4] == 6 && buf[5] == 4 {
+			p.src = append(p.src, net.IP(buf[14:18]))
+			p.dst = append(p.dst, net.IP(buf[24:28]))
+		}
+
+	case 0x0800:
+		if len(buf) < 20 {
+			return
+		}
+		ihl := int(buf[0]&0xf) * 4
+		tot := int(extractBE(buf[2:], 2))
+		if ihl < 20 || len(buf) < ihl {
+			return
+		}
+		p.protos["ip"] = true
+		p.src = append(p.src, net.IP(buf[12:16]))
+		p.dst = append(p.dst, net.IP(buf[16:20]))
+		if extractBE(buf[6:], 2)&0x1fff != 0 {
+			return
+		}
+		if tot >= ihl && tot <= len(buf) {
+			buf = buf[:tot]
+		}
+		p.layer4(uint64(buf[9]), buf[ihl:])
+
+	case 0x86dd:
+		if len(buf) < 40 {
+			return
+		}
+		p.protos["ip6"] = true
+		p.src = append(p.src, net.IP(buf[8:24]))
+		p.dst = append(p.dst, net.IP(buf[24:40]))
+		next := uint64(buf[6])
+		plen := int(extractBE(buf[4:], 2))
+		buf = buf[40:]
+		if plen <= len(buf) {
+			buf = buf[:plen]
+		}
+		for ipv6ExtHeaders[next] != "" {
+			if len(buf) < 8 {
+				return
+			}
+			size := (int(buf[1]) + 1) * 8
+			switch next {
+			case 44:
+				if extractBE(buf[2:], 2)>>3 != 0 {
+					return
+				}
+				size = 8
+			case 51:
+				size = (int(buf[1]) + 2) * 4
+			}
+			if len(buf) < size {
+				return
+			}
+			next, buf = uint64(buf[0]), buf[size:]
+		}
+		p.layer4(next, buf)
+	}
+}
+
+func (p *pktinfo) layer4(prot uint64, buf []byte) {
+	switch prot {
+	case 1:
+		p.protos["icmp"] = true
+	case 2:
+		p.protos["igmp"] = true
+	case 4:
+		p.layer3(0x0800, buf)
+	case 41:
+		p.layer3(0x86dd, buf)
+	case 58:
+		p.protos["icmp6"] = true
+
+	case 6:
+		if len(buf) < 20 {
+			return
+		}
+		p.protos["tcp"] = true
+		sport, dport := extractBE(buf, 2), extractBE(buf[2:], 2)
+		p.sport = append(p.sport, sport)
+		p.dport = append(p.dport, dport)
+
+		doff := int(buf[12]>>4) * 4
+		if doff < 20 || len(buf) < doff {
+			return
+		}
+		buf = buf[doff:]
+		switch {
+		case len(buf) == 0:
+		case isHTTP(buf):
+			p.protos["http"] = true
+		case isTLS(buf):
+			p.protos["tls"] = true
+		case sport == 53 || dport == 53:
+			p.protos["dns"] = true
+		}
+
+	case 17:
+		if len(buf) < 8 {
+			return
+		}
+		p.protos["udp"] = true
+		sport, dport := extractBE(buf, 2), extractBE(buf[2:], 2)
+		p.sport = append(p.sport, sport)
+		p.dport = append(p.dport, dport)
+
+		port := func(n uint64) bool { return sport == n || dport == n }
+		switch {
+		case port(53), port(5353):
+			p.protos["dns"] = true
+		case port(67), port(68):
+			p.protos["dhcp"] = true
+		case dport == 4789 && len(buf) >= 16:
+			p.protos["vxlan"] = true
+			p.vnis = append(p.vnis, extractBE(buf[12:], 3))
+			p.ether(buf[16:])
+		}
+	}
+}
+
+// Filter selects packets, compileFilter understands a subset of the
+// tcpdump expression language:
+//
+//	expr      = term { ("or" | "||") term }
+//	term      = factor { ("and" | "&&") factor }
+//	factor    = ("not" | "!") factor | "(" expr ")" | primitive
+//	primitive = [src | dst] host addr | [src | dst] net cidr |
+//	            [src | dst] port n | [src | dst] portrange lo-hi |
+//	            vlan [id] | vxlan [vni] | less n | greater n | proto [primitive]
+//
+// where proto is one of ether, llc, arp, ip, ip6, icmp, icmp6, igmp,
+// tcp, udp, dns, dhcp, http or tls
+type Filter func(p *pktinfo) bool
+
+var filterProtos = map[string]string{
+	"ether": "ether", "llc": "llc", "arp": "arp", "ip": "ip", "ip6": "ip6", "ipv6": "ip6",
+	"icmp": "icmp", "icmp6": "icmp6", "icmpv6": "icmp6", "igmp": "igmp", "tcp": "tcp",
+	"udp": "udp", "dns": "dns", "dhcp": "dhcp", "bootp": "dhcp", "http": "http", "tls": "tls",
+	"vlan": "vlan", "vxlan": "vxlan",
+}
+
+type filterParser struct {
+	toks []string
+	pos  int
+}
+
+func compileFilter(expr string) (Filter, error) {
+	p := &filterParser{toks: filterTokens(expr)}
+	f, err := p.expr()
+	if err != nil {
+		return nil, fmt.Errorf("filter: %v", err)
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("filter: unexpected %q", p.toks[p.pos])
+	}
+	return f, nil
+}
+
+func filterTokens(expr string) []string {
+	var toks []string
+	for _, field := range strings.Fields(expr) {
+		for field != "" {
+			switch {
+			case field[0] == '(' || field[0] == ')' || field[0] == '!':
+				toks = append(toks, field[:1])
+				field = field[1:]
+			case strings.HasPrefix(field, "&&") || strings.HasPrefix(field, "||"):
+				toks = append(toks, field[:2])
+				field = field[2:]
+			default:
+				i := strings.IndexAny(field, "()!&|")
+				if i < 0 {
+					i = len(field)
+				}
+				// a lone & or | is a token of its own, the parser rejects it
+				if i == 0 {
+					i = 1
+				}
+				toks = append(toks, strings.ToLower(field[:i]))
+				field = field[i:]
+			}
+		}
+	}
+	return toks
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *filterParser) expr() (Filter, error) {
+	f, err := p.term()
+	for err == nil && (p.peek() == "or" || p.peek() == "||") {
+		p.next()
+		var g Filter
+		g, err = p.term()
+		l, r := f, g
+		f = func(pi *pktinfo) bool { return l(pi) || r(pi) }
+	}
+	return f, err
+}
+
+func (p *filterParser) term() (Filter, error) {
+	f, err := p.factor()
+	for err == nil && (p.peek() == "and" || p.peek() == "&&") {
+		p.next()
+		var g Filter
+		g, err = p.factor()
+		l, r := f, g
+		f = func(pi *pktinfo) bool { return l(pi) && r(pi) }
+	}
+	return f, err
+}
+
+func (p *filterParser) factor() (Filter, error) {
+	switch tok := p.next(); tok {
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case "not", "!":
+		f, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return func(pi *pktinfo) bool { return !f(pi) }, nil
+	case "(":
+		f, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return f, nil
+	default:
+		p.pos--
+		return p.primitive()
+	}
+}
+
+func (p *filterParser) primitive() (Filter, error) {
+	dir := ""
+	if tok := p.peek(); tok == "src" || tok == "dst" {
+		dir = p.next()
+	}
+
+	tok := p.next()
+	switch tok {
+	case "host", "net":
+		arg := p.next()
+		var ipnet *net.IPNet
+		if tok == "host" {
+			ip := net.ParseIP(arg)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid host %q", arg)
+			}
+			ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+			if ip4 := ip.To4(); ip4 != nil {
+				ipnet = &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+			}
+		} else {
+			var err error
+			_, ipnet, err = net.ParseCIDR(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid net %q", arg)
+			}
+		}
+		return func(pi *pktinfo) bool {
+			return matchAddrs(dir != "dst", pi.src, ipnet) || matchAddrs(dir != "src", pi.dst, ipnet)
+		}, nil
+
+	case "port", "portrange":
+		arg := p.next()
+		lo, hi := arg, arg
+		if i := strings.Index(arg, "-"); tok == "portrange" && i >= 0 {
+			lo, hi = arg[:i], arg[i+1:]
+		}
+		l, err1 := strconv.ParseUint(lo, 10, 16)
+		h, err2 := strconv.ParseUint(hi, 10, 16)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid %s %q", tok, arg)
+		}
+		return func(pi *pktinfo) bool {
+			return matchPorts(dir != "dst", pi.sport, l, h) || matchPorts(dir != "src", pi.dport, l, h)
+		}, nil
+	}
+
+	if dir != "" {
+		return nil, fmt.Errorf("%s must be followed by host, net or port", dir)
+	}
+
+	switch tok {
+	case "less", "greater":
+		arg := p.next()
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid length %q", arg)
+		}
+		if tok == "less" {
+			return func(pi *pktinfo) bool { return pi.length <= n }, nil
+		}
+		return func(pi *pktinfo) bool { return pi.length >= n }, nil
+
+	case "vlan", "vxlan":
+		n, err := strconv.ParseUint(p.peek(), 10, 32)
+		if err != nil {
+			return func(pi *pktinfo) bool { return pi.protos[tok] }, nil
+		}
+		p.next()
+		return func(pi *pktinfo) bool {
+			ids := pi.vlans
+			if tok == "vxlan" {
+				ids = pi.vnis
+			}
+			for _, id := range ids {
+				if id == n {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+
+	proto, ok := filterProtos[tok]
+	if !ok {
+		return nil, fmt.Errorf("unknown primitive %q", tok)
+	}
+	f := func(pi *pktinfo) bool { return pi.protos[proto] }
+
+	// tcp port 80 is short for tcp and port 80
+	switch p.peek() {
+	case "src", "dst", "host", "net", "port", "portrange":
+		g, err := p.primitive()
+		if err != nil {
+			return nil, err
+		}
+		return func(pi *pktinfo) bool { return f(pi) && g(pi) }, nil
+	}
+	return f, nil
+}
+
+func matchAddrs(enabled bool, addrs []net.IP, ipnet *net.IPNet) bool {
+	if !enabled {
+		return false
+	}
+	for _, a := range addrs {
+		if ipnet.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPorts(enabled bool, ports []uint64, lo, hi uint64) bool {
+	if !enabled {
+		return false
+	}
+	for _, p := range ports {
+		if lo <= p && p <= hi {
+			return true
+		}
+	}
+	return false
+}
+
 const (
 	arp = "\xFF\xFF\xFF\xFF\xFF\xFF\xAA\x00\x04\x00\x0A\x04\x08\x06\x00\x01\x08\x00\x06\x04\x00\x01\xAA\x00\x04\x00\x0A\x04\xC0\xA8\x01\x09\x00\x00\x00\x00\x00\x00\xC0\xA8\x01\x04"
 
@@ -430,4 +1933,16 @@ const (
 	udp = "\x1C\xAF\xF7\x6B\x0E\x4D\xAA\x00\x04\x00\x0A\x04\x08\x00\x45\x00\x00\x3C\x9B\x23\x00\x00\x40\x11\x70\xBC\xC0\xA8\x01\x09\xD0\x43\xDC\xDC\x91\x02\x00\x35\x00\x28\x6F\x0B\xAE\x9C\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x03\x77\x77\x77\x06\x67\x6F\x6F\x67\x6C\x65\x03\x63\x6F\x6D\x00\x00\x01\x00\x01"
 
 	igmp = "\x1C\xAF\xF7\x6B\x0E\x4D\xAA\x00\x04\x00\x0A\x04\x08\x00\x45\x00\x00\x1C\x00\x00\x40\x00\x40\x02\x54\x4E\xC0\xA8\x01\x09\xC0\xA8\x64\x01\x11\xFF\x0D\xFF\xE0\x00\x00\x01"
+
+	ipv6 = "\x1C\xAF\xF7\x6B\x0E\x4D\xAA\x00\x04\x00\x0A\x04\x86\xDD\x60\x00\x00\x00\x00\x2D\x00\x40\x20\x01\x0D\xB8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x20\x01\x0D\xB8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x35\x11\x00\x05\x02\x00\x00\x01\x00\x9C\x40\x00\x35\x00\x25\x00\x00\xBE\xEF\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x07\x65\x78\x61\x6D\x70\x6C\x65\x03\x6F\x72\x67\x00\x00\x1C\x00\x01"
+
+	vlan = "\x1C\xAF\xF7\x6B\x0E\x4D\xAA\x00\x04\x00\x0A\x04\x88\xA8\x00\x64\x81\x00\x00\x14\x08\x00\x45\x00\x00\x2C\x12\x34\x40\x00\x40\x01\x00\x00\xC0\xA8\x01\x09\xC0\xA8\x64\x01\x08\x00\x00\x00\x12\x34\x00\x01\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0A\x0B\x0C\x0D\x0E\x0F"
+
+	http = "\x1C\xAF\xF7\x6B\x0E\x4D\xAA\x00\x04\x00\x0A\x04\x08\x00\x45\x00\x00\x7E\x12\x34\x40\x00\x40\x06\x00\x00\xC0\xA8\x01\x09\xC0\xA8\x64\x01\xC7\x38\x00\x50\x8E\xB5\xC6\xAC\x15\x93\x47\x9E\x50\x18\x10\x00\x00\x00\x00\x00\x47\x45\x54\x20\x2F\x69\x6E\x64\x65\x78\x2E\x68\x74\x6D\x6C\x20\x48\x54\x54\x50\x2F\x31\x2E\x31\x0D\x0A\x48\x6F\x73\x74\x3A\x20\x77\x77\x77\x2E\x65\x78\x61\x6D\x70\x6C\x65\x2E\x63\x6F\x6D\x0D\x0A\x55\x73\x65\x72\x2D\x41\x67\x65\x6E\x74\x3A\x20\x63\x75\x72\x6C\x2F\x38\x2E\x30\x0D\x0A\x41\x63\x63\x65\x70\x74\x3A\x20\x2A\x2F\x2A\x0D\x0A\x0D\x0A"
+
+	tls = "\x1C\xAF\xF7\x6B\x0E\x4D\xAA\x00\x04\x00\x0A\x04\x08\x00\x45\x00\x00\x8F\x12\x34\x40\x00\x40\x06\x00\x00\xC0\xA8\x01\x09\xC0\xA8\x64\x01\xC7\x39\x01\xBB\x8E\xB5\xC6\xAC\x15\x93\x47\x9E\x50\x18\x10\x00\x00\x00\x00\x00\x16\x03\x01\x00\x62\x01\x00\x00\x5E\x03\x03\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0A\x0B\x0C\x0D\x0E\x0F\x10\x11\x12\x13\x14\x15\x16\x17\x18\x19\x1A\x1B\x1C\x1D\x1E\x1F\x00\x00\x04\x13\x01\xC0\x2F\x01\x00\x00\x31\x00\x00\x00\x14\x00\x12\x00\x00\x0F\x77\x77\x77\x2E\x65\x78\x61\x6D\x70\x6C\x65\x2E\x63\x6F\x6D\x00\x10\x00\x0E\x00\x0C\x02\x68\x32\x08\x68\x74\x74\x70\x2F\x31\x2E\x31\x00\x2B\x00\x03\x02\x03\x04"
+
+	dhcp = "\xFF\xFF\xFF\xFF\xFF\xFF\xAA\x00\x04\x00\x0A\x04\x08\x00\x45\x00\x01\x25\x12\x34\x40\x00\x40\x11\x00\x00\x00\x00\x00\x00\xFF\xFF\xFF\xFF\x00\x44\x00\x43\x01\x11\x00\x00\x01\x01\x06\x00\x39\x03\xF3\x26\x00\x00\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xAA\x00\x04\x00\x0A\x04\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x63\x82\x53\x63\x35\x01\x01\x3D\x07\x01\xAA\x00\x04\x00\x0A\x04\x37\x04\x01\x03\x06\x0F\x0C\x04\x74\x65\x73\x74\xFF"
+
+	vxlan = "\x1C\xAF\xF7\x6B\x0E\x4D\xAA\x00\x04\x00\x0A\x04\x08\x00\x45\x00\x00\x4E\x12\x34\x40\x00\x40\x11\x00\x00\x0A\x00\x00\x01\x0A\x00\x00\x02\xC0\x00\x12\xB5\x00\x3A\x00\x00\x08\x00\x00\x00\x00\x00\x2A\x00\xFF\xFF\xFF\xFF\xFF\xFF\xAA\x00\x04\x00\x0A\x04\x08\x06\x00\x01\x08\x00\x06\x04\x00\x01\xAA\x00\x04\x00\x0A\x04\xC0\xA8\x01\x09\x00\x00\x00\x00\x00\x00\xC0\xA8\x01\x04"
 )
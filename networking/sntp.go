@@ -0,0 +1,400 @@
+//go:build linux
+// +build linux
+
+// sntp client (rfc 4330), polls servers a few times and reports the clock
+// offset and round trip delay of the best sample from each one. the clock
+// can be stepped with settimeofday or slewed with adjtimex to match.
+// -serve runs a tiny server answering from the local clock, -skew makes it
+// lie about the time so the client has something to measure:
+// sntp -serve 127.0.0.1:1123 -skew 1.5s &
+// sntp -n 4 127.0.0.1:1123
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+)
+
+var (
+	polls    = flag.Int("n", 4, "number of polls per server")
+	interval = flag.Duration("i", 1*time.Second, "time between polls")
+	timeout  = flag.Duration("t", 2*time.Second, "timeout per poll")
+	version  = flag.Int("V", 4, "ntp version to send")
+	verbose  = flag.Bool("v", false, "print every sample")
+	step     = flag.Bool("s", false, "step the clock with settimeofday")
+	slew     = flag.Bool("a", false, "slew the clock with adjtimex")
+	serve    = flag.String("serve", "", "run an sntp server on this address")
+	stratum  = flag.Int("stratum", 1, "server: stratum to report")
+	refid    = flag.String("refid", "LOCL", "server: reference id to report")
+	skew     = flag.Duration("skew", 0, "server: add this to the time it hands out")
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("sntp: ")
+	flag.Usage = usage
+	flag.Parse()
+
+	if *serve != "" {
+		ck(server(*serve))
+		return
+	}
+	if flag.NArg() < 1 || *polls < 1 {
+		usage()
+	}
+
+	var best *Result
+	status := 0
+	for _, name := range flag.Args() {
+		r, err := query(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sntp: %s: %v\n", name, err)
+			status = 1
+			continue
+		}
+		r.print()
+		if best == nil || r.distance() < best.distance() {
+			best = r
+		}
+	}
+	if best == nil {
+		os.Exit(1)
+	}
+
+	if len(flag.Args()) > 1 {
+		fmt.Printf("selected %s, offset %+.6f s\n", best.Server, best.Offset.Seconds())
+	}
+	if *step || *slew {
+		if best.Leap == 3 {
+			log.Fatalf("%s is not synchronized, not touching the clock", best.Server)
+		}
+		ck(setClock(best.Offset, *step))
+	}
+	os.Exit(status)
+}
+
+func ck(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: sntp [options] server[:port] ...")
+	fmt.Fprintln(os.Stderr, "       sntp -serve address [options]")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+// seconds between 1900 and 1970
+const ntpEpoch = 2208988800
+
+const (
+	modeClient = 3
+	modeServer = 4
+)
+
+type Packet struct {
+	Settings       uint8 // leap, version and mode
+	Stratum        uint8
+	Poll           int8
+	Precision      int8
+	RootDelay      uint32
+	RootDispersion uint32
+	RefID          uint32
+	RefTime        uint64
+	OrigTime       uint64
+	RecvTime       uint64
+	XmitTime       uint64
+}
+
+func (p *Packet) leap() int    { return int(p.Settings >> 6) }
+func (p *Packet) version() int { return int(p.Settings >> 3 & 7) }
+func (p *Packet) mode() int    { return int(p.Settings & 7) }
+
+func toNTP(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpoch)
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	return secs<<32 | frac
+}
+
+// timestamps wrap in 2036, anything that looks older than 1968
+// is taken to be in the next era
+func fromNTP(ts uint64) time.Time {
+	secs := int64(ts >> 32)
+	if secs < 0x80000000 {
+		secs += 1 << 32
+	}
+	nsec := int64((ts & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(secs-ntpEpoch, nsec)
+}
+
+// 16.16 fixed point seconds
+func shortDuration(v uint32) time.Duration {
+	return time.Duration(float64(v) / 65536 * float64(time.Second))
+}
+
+type Sample struct {
+	Offset time.Duration
+	Delay  time.Duration
+}
+
+type Result struct {
+	Server     string
+	Stratum    int
+	RefID      string
+	Leap       int
+	Version    int
+	Precision  int
+	RootDelay  time.Duration
+	RootDisp   time.Duration
+	Samples    []Sample
+	Offset     time.Duration
+	Delay      time.Duration
+	Jitter     time.Duration
+	Unanswered int
+}
+
+// the root distance, how far off the server could be from true time as seen from here
+func (r *Result) distance() time.Duration {
+	return r.RootDisp + r.RootDelay/2 + r.Delay/2 + r.Jitter
+}
+
+func (r *Result) print() {
+	leap := []string{"none", "+1s", "-1s", "unsynchronized"}[r.Leap]
+	fmt.Printf("server %s, stratum %d, refid %s, leap %s, version %d, precision 2^%d\n",
+		r.Server, r.Stratum, r.RefID, leap, r.Version, r.Precision)
+	fmt.Printf("root delay %.6f s, root dispersion %.6f s\n", r.RootDelay.Seconds(), r.RootDisp.Seconds())
+	if *verbose {
+		for i, s := range r.Samples {
+			fmt.Printf("  sample %d: offset %+.6f s, delay %.6f s\n", i+1, s.Offset.Seconds(), s.Delay.Seconds())
+		}
+	}
+	fmt.Printf("offset %+.6f s, delay %.6f s, jitter %.6f s (%d of %d samples)\n\n",
+		r.Offset.Seconds(), r.Delay.Seconds(), r.Jitter.Seconds(), len(r.Samples), len(r.Samples)+r.Unanswered)
+}
+
+func query(name string) (*Result, error) {
+	addr := name
+	if _, _, err := net.SplitHostPort(name); err != nil {
+		addr = net.JoinHostPort(name, "123")
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	r := &Result{Server: raddr.String()}
+	var lastErr error
+	for i := 0; i < *polls; i++ {
+		if i > 0 {
+			time.Sleep(*interval)
+		}
+		p, s, err := poll(conn)
+		if err != nil {
+			var kod kissError
+			if errors.As(err, &kod) {
+				return nil, err
+			}
+			if *verbose {
+				fmt.Fprintf(os.Stderr, "sntp: %s: %v\n", name, err)
+			}
+			lastErr = err
+			r.Unanswered++
+			continue
+		}
+
+		r.Samples = append(r.Samples, s)
+		r.Stratum = int(p.Stratum)
+		r.RefID = refID(p)
+		r.Leap = p.leap()
+		r.Version = p.version()
+		r.Precision = int(p.Precision)
+		r.RootDelay = shortDuration(p.RootDelay)
+		r.RootDisp = shortDuration(p.RootDispersion)
+	}
+	if len(r.Samples) == 0 {
+		return nil, lastErr
+	}
+
+	// like the ntp clock filter, the sample with the shortest round trip has
+	// the least queueing in it and its offset is the most trustworthy
+	sorted := append([]Sample(nil), r.Samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Delay < sorted[j].Delay })
+	r.Offset, r.Delay = sorted[0].Offset, sorted[0].Delay
+
+	if len(sorted) > 1 {
+		var ss float64
+		for _, s := range sorted[1:] {
+			d := (s.Offset - r.Offset).Seconds()
+			ss += d * d
+		}
+		r.Jitter = time.Duration(math.Sqrt(ss/float64(len(sorted)-1)) * float64(time.Second))
+	}
+	return r, nil
+}
+
+type kissError string
+
+func (k kissError) Error() string {
+	return fmt.Sprintf("kiss-o'-death %s", string(k))
+}
+
+func poll(conn *net.UDPConn) (*Packet, Sample, error) {
+	req := &Packet{Settings: uint8(*version)<<3 | modeClient}
+	t1 := time.Now()
+	req.XmitTime = toNTP(t1)
+
+	conn.SetDeadline(t1.Add(*timeout))
+	err := binary.Write(conn, binary.BigEndian, req)
+	if err != nil {
+		return nil, Sample{}, err
+	}
+
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
+		t4 := time.Now()
+		if err != nil {
+			return nil, Sample{}, err
+		}
+
+		p := &Packet{}
+		if n < binary.Size(p) {
+			continue
+		}
+		binary.Read(bytes.NewReader(buf[:n]), binary.BigEndian, p)
+
+		// a reply to something else, maybe a late answer to an earlier poll
+		if p.OrigTime != req.XmitTime || p.mode() != modeServer {
+			continue
+		}
+		if p.Stratum == 0 {
+			return nil, Sample{}, kissError(refID(p))
+		}
+		if p.XmitTime == 0 {
+			return nil, Sample{}, errors.New("server sent no transmit time")
+		}
+
+		t2, t3 := fromNTP(p.RecvTime), fromNTP(p.XmitTime)
+		s := Sample{
+			Offset: (t2.Sub(t1) + t3.Sub(t4)) / 2,
+			Delay:  t4.Sub(t1) - t3.Sub(t2),
+		}
+		return p, s, nil
+	}
+}
+
+// stratum 0 and 1 carry four ascii characters, above that
+// it is the ipv4 address of the upstream server
+func refID(p *Packet) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], p.RefID)
+	if p.Stratum > 1 {
+		return net.IP(b[:]).String()
+	}
+	n := 0
+	for n < 4 && b[n] >= 0x20 && b[n] < 0x7f {
+		n++
+	}
+	return string(b[:n])
+}
+
+// large offsets are stepped, small ones are slewed so
+// time never goes backwards on the running system
+func setClock(offset time.Duration, stepIt bool) error {
+	if stepIt {
+		tv := syscall.NsecToTimeval(time.Now().Add(offset).UnixNano())
+		err := syscall.Settimeofday(&tv)
+		if err != nil {
+			return fmt.Errorf("settimeofday: %v", err)
+		}
+		fmt.Printf("stepped clock by %+.6f s\n", offset.Seconds())
+		return nil
+	}
+
+	// the single shot offset is limited to half a second by the kernel
+	const adjOffsetSingleshot = 0x8001
+	if offset > 500*time.Millisecond || offset < -500*time.Millisecond {
+		return fmt.Errorf("offset %+.6f s is too large to slew, use -s", offset.Seconds())
+	}
+	tx := syscall.Timex{
+		Modes:  adjOffsetSingleshot,
+		Offset: int64(offset / time.Microsecond),
+	}
+	_, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		return fmt.Errorf("adjtimex: %v", err)
+	}
+	fmt.Printf("slewing clock by %+.6f s\n", offset.Seconds())
+	return nil
+}
+
+func server(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Printf("serving on %v", conn.LocalAddr())
+
+	var id [4]byte
+	copy(id[:], *refid)
+	buf := make([]byte, 1024)
+	for {
+		n, raddr, err := conn.ReadFrom(buf)
+		recv := time.Now().Add(*skew)
+		if err != nil {
+			return err
+		}
+
+		req := &Packet{}
+		if n < binary.Size(req) {
+			continue
+		}
+		binary.Read(bytes.NewReader(buf[:n]), binary.BigEndian, req)
+		if req.mode() != modeClient {
+			continue
+		}
+
+		vn := req.version()
+		if vn < 1 || vn > 4 {
+			vn = 4
+		}
+		resp := &Packet{
+			Settings:       uint8(vn)<<3 | modeServer,
+			Stratum:        uint8(*stratum),
+			Poll:           req.Poll,
+			Precision:      -20,
+			RootDispersion: 1 << 16 / 100,
+			RefID:          binary.BigEndian.Uint32(id[:]),
+			RefTime:        toNTP(recv.Truncate(time.Second)),
+			OrigTime:       req.XmitTime,
+			RecvTime:       toNTP(recv),
+		}
+		resp.XmitTime = toNTP(time.Now().Add(*skew))
+
+		w := new(bytes.Buffer)
+		binary.Write(w, binary.BigEndian, resp)
+		_, err = conn.WriteTo(w.Bytes(), raddr)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
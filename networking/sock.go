@@ -1,46 +1,125 @@
-// UDP sockets created in Go does not use SO_REUSEADDR, so we can't make multiple clients listen on for broadcast messages
-// we can make one if we use the syscall package though, and then create a network connection out of that.
-// This way, we can get broadcast if we ran several instances of this. To see it fail to bind
-// if there is more than one listener, comment out the setsockopt portion with SO_REUSEADDR
+//go:build linux
+// +build linux
 
+// relays data between two endpoints in both directions, like socat.
+// endpoints are written scheme:address[,option[=value]...]
+//
+// -, stdio                       standard input and output
+// tcp:host:port                  connect
+// tcp-listen:port                accept one connection, or one per fork
+// udp:host:port                  connected udp socket
+// udp-listen:port                talk to the first peer, or one session per peer with fork
+// udp-recv:port                  receive only from anybody
+// unix:path                      connect to a unix socket
+// unix-listen:path               accept on a unix socket
+// tls:host:port                  tls client, verify=0 sni=name cafile= cert= key=
+// tls-listen:port                tls server, cert= key= or a self-signed one
+// exec:command args              run a program and talk to its stdin and stdout
+// file:path                      read and write a file, creat append trunc
+// pty                            allocate a pseudo terminal, link=path raw
+//
+// listeners take bind=host and fork, udp takes broadcast and reuseaddr.
+// UDP sockets created in Go don't use SO_REUSEADDR, with reuseaddr several
+// instances can listen for the same broadcasts:
+// sock -u udp-recv:1234,broadcast,reuseaddr -
+//
 // To generate UDP broadcasts, do this:
-// while true; do echo hello world | socat - UDP-DATAGRAM:255.255.255.255:1234,broadcast; sleep 1; done
+// while true; do echo hello world | sock -u - udp:255.255.255.255:1234,broadcast; sleep 1; done
 
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math/big"
 	"net"
 	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	hexdump  = flag.Bool("x", false, "hex dump the traffic in both directions to stderr")
+	textdump = flag.Bool("v", false, "dump the traffic in both directions as text to stderr")
+	debug    = flag.Bool("d", false, "log connections to stderr")
+	uni      = flag.Bool("u", false, "only relay from the first endpoint to the second")
+	reverse  = flag.Bool("U", false, "only relay from the second endpoint to the first")
+	idle     = flag.Duration("T", 0, "close after this long without any traffic")
+	linger   = flag.Duration("t", 500*time.Millisecond, "after one side is done, wait this long for the other if it can't be half-closed")
+
+	dumpMu sync.Mutex
 )
 
 func main() {
-	s, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
-	ck(err)
+	log.SetFlags(0)
+	log.SetPrefix("sock: ")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 2 {
+		usage()
+	}
 
-	err = syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+	a1, err := parseAddr(flag.Arg(0))
 	ck(err)
-
-	err = syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	a2, err := parseAddr(flag.Arg(1))
 	ck(err)
 
-	err = syscall.Bind(s, &syscall.SockaddrInet4{
-		Port: 1234,
-		Addr: [4]byte{255, 255, 255, 255},
-	})
-	ck(err)
+	if !a1.listener() {
+		c1, err := a1.open()
+		ck(err)
+		c2, err := openOrAccept(a2)
+		if err != nil {
+			c1.Close()
+			log.Fatal(err)
+		}
+		relay(c1, c2)
+		return
+	}
 
-	f := os.NewFile(uintptr(s), "socket")
-	c, err := net.FileConn(f)
+	ln, err := a1.listen()
 	ck(err)
-
+	defer ln.Close()
 	for {
-		var buf [8192]byte
-		n, err := c.Read(buf[:])
+		c1, err := ln.Accept()
 		ck(err)
-		fmt.Printf("%q\n", buf[:n])
+		dprintf("accepted %v on %v", c1.Name(), a1)
+
+		if !a1.has("fork") {
+			stopListening(ln)
+			c2, err := openOrAccept(a2)
+			if err != nil {
+				c1.Close()
+				log.Fatal(err)
+			}
+			relay(c1, c2)
+			return
+		}
+
+		go func() {
+			c2, err := a2.open()
+			if err != nil {
+				log.Print(err)
+				c1.Close()
+				return
+			}
+			relay(c1, c2)
+		}()
 	}
 }
 
@@ -49,3 +128,776 @@ func ck(err error) {
 		log.Fatal(err)
 	}
 }
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: sock [options] address address")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func dprintf(format string, args ...interface{}) {
+	if *debug {
+		log.Printf(format, args...)
+	}
+}
+
+type Addr struct {
+	scheme string
+	arg    string
+	opts   map[string]string
+}
+
+func parseAddr(s string) (*Addr, error) {
+	a := &Addr{opts: make(map[string]string)}
+	fields := strings.Split(s, ",")
+	head := fields[0]
+	for _, f := range fields[1:] {
+		k, v, _ := strings.Cut(f, "=")
+		a.opts[strings.ToLower(k)] = v
+	}
+
+	if head == "-" || strings.EqualFold(head, "stdio") {
+		a.scheme = "stdio"
+		return a, nil
+	}
+	if strings.EqualFold(head, "pty") {
+		a.scheme = "pty"
+		return a, nil
+	}
+
+	scheme, arg, ok := strings.Cut(head, ":")
+	if !ok {
+		return nil, fmt.Errorf("%s: missing scheme", s)
+	}
+	a.scheme, a.arg = strings.ToLower(scheme), arg
+	switch a.scheme {
+	case "tcp", "tcp-listen", "udp", "udp-listen", "udp-recv",
+		"unix", "unix-listen", "tls", "tls-listen", "exec", "file":
+	default:
+		return nil, fmt.Errorf("%s: unknown scheme %q", s, scheme)
+	}
+	return a, nil
+}
+
+func (a *Addr) String() string {
+	if a.arg == "" {
+		return a.scheme
+	}
+	return a.scheme + ":" + a.arg
+}
+
+func (a *Addr) has(opt string) bool {
+	_, ok := a.opts[opt]
+	return ok
+}
+
+func (a *Addr) listener() bool {
+	return strings.HasSuffix(a.scheme, "-listen")
+}
+
+// port only arguments of listeners bind to all addresses unless bind= says otherwise
+func (a *Addr) listenAddr() string {
+	if _, err := strconv.Atoi(a.arg); err == nil {
+		return net.JoinHostPort(a.opts["bind"], a.arg)
+	}
+	return a.arg
+}
+
+// an endpoint, CloseWrite returns errNoHalfClose if the
+// other side can't be told we are done sending
+type Conn interface {
+	io.ReadWriteCloser
+	CloseWrite() error
+	Name() string
+}
+
+var errNoHalfClose = errors.New("half-close not supported")
+
+type Listener interface {
+	Accept() (Conn, error)
+	Close() error
+}
+
+func openOrAccept(a *Addr) (Conn, error) {
+	if !a.listener() {
+		return a.open()
+	}
+	ln, err := a.listen()
+	if err != nil {
+		return nil, err
+	}
+	defer stopListening(ln)
+	return ln.Accept()
+}
+
+// udp sessions share the listening socket, so that has to stay
+// open and only stop taking new peers
+func stopListening(ln Listener) {
+	if l, ok := ln.(*udpListener); ok {
+		l.mu.Lock()
+		l.stopped = true
+		l.mu.Unlock()
+		return
+	}
+	ln.Close()
+}
+
+func (a *Addr) open() (Conn, error) {
+	switch a.scheme {
+	case "stdio":
+		return stdio{}, nil
+
+	case "tcp", "unix":
+		c, err := net.Dial(a.scheme, a.arg)
+		if err != nil {
+			return nil, err
+		}
+		return &netConn{c}, nil
+
+	case "udp":
+		d := net.Dialer{Control: a.sockopts}
+		c, err := d.Dial("udp", a.arg)
+		if err != nil {
+			return nil, err
+		}
+		return &netConn{c}, nil
+
+	case "udp-recv":
+		lc := net.ListenConfig{Control: a.sockopts}
+		pc, err := lc.ListenPacket(context.Background(), "udp", a.listenAddr())
+		if err != nil {
+			return nil, err
+		}
+		return &recvConn{pc}, nil
+
+	case "tls":
+		conf, err := a.tlsConfig(false)
+		if err != nil {
+			return nil, err
+		}
+		c, err := tls.Dial("tcp", a.arg, conf)
+		if err != nil {
+			return nil, err
+		}
+		return &netConn{c}, nil
+
+	case "exec":
+		return startExec(a.arg)
+
+	case "file":
+		return openFile(a)
+
+	case "pty":
+		return openPty(a)
+	}
+	return nil, fmt.Errorf("%v: can't connect to a listener here", a)
+}
+
+func (a *Addr) listen() (Listener, error) {
+	switch a.scheme {
+	case "tcp-listen", "unix-listen":
+		network := strings.TrimSuffix(a.scheme, "-listen")
+		if network == "unix" {
+			os.Remove(a.arg)
+		}
+		ln, err := net.Listen(network, a.listenAddr())
+		if err != nil {
+			return nil, err
+		}
+		return &netListener{ln}, nil
+
+	case "tls-listen":
+		conf, err := a.tlsConfig(true)
+		if err != nil {
+			return nil, err
+		}
+		ln, err := tls.Listen("tcp", a.listenAddr(), conf)
+		if err != nil {
+			return nil, err
+		}
+		return &netListener{ln}, nil
+
+	case "udp-listen":
+		lc := net.ListenConfig{Control: a.sockopts}
+		pc, err := lc.ListenPacket(context.Background(), "udp", a.listenAddr())
+		if err != nil {
+			return nil, err
+		}
+		return newUDPListener(pc), nil
+	}
+	return nil, fmt.Errorf("%v: not a listener", a)
+}
+
+func (a *Addr) sockopts(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if a.has("reuseaddr") {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		}
+		if serr == nil && a.has("broadcast") {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func (a *Addr) tlsConfig(server bool) (*tls.Config, error) {
+	conf := &tls.Config{}
+	if v, ok := a.opts["verify"]; ok && v == "0" {
+		conf.InsecureSkipVerify = true
+	}
+	if sni := a.opts["sni"]; sni != "" {
+		conf.ServerName = sni
+	}
+	if ca := a.opts["cafile"]; ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", ca)
+		}
+	}
+
+	cert, key := a.opts["cert"], a.opts["key"]
+	switch {
+	case cert != "":
+		if key == "" {
+			key = cert
+		}
+		c, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{c}
+	case server:
+		c, err := selfSigned()
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{c}
+	}
+	return conf, nil
+}
+
+func selfSigned() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "sock"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+type stdio struct{}
+
+func (stdio) Read(b []byte) (int, error)  { return os.Stdin.Read(b) }
+func (stdio) Write(b []byte) (int, error) { return os.Stdout.Write(b) }
+func (stdio) Close() error                { return nil }
+func (stdio) CloseWrite() error           { return os.Stdout.Close() }
+func (stdio) Name() string                { return "stdio" }
+
+type netConn struct {
+	net.Conn
+}
+
+func (c *netConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errNoHalfClose
+}
+
+func (c *netConn) Name() string {
+	return c.RemoteAddr().String()
+}
+
+type netListener struct {
+	net.Listener
+}
+
+func (l *netListener) Accept() (Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &netConn{c}, nil
+}
+
+// receives datagrams from anybody, there is nobody to send to
+type recvConn struct {
+	pc net.PacketConn
+}
+
+func (c *recvConn) Read(b []byte) (int, error) {
+	n, _, err := c.pc.ReadFrom(b)
+	return n, err
+}
+
+func (c *recvConn) Write(b []byte) (int, error) { return 0, errors.New("udp-recv is receive only") }
+func (c *recvConn) Close() error                { return c.pc.Close() }
+func (c *recvConn) CloseWrite() error           { return errNoHalfClose }
+func (c *recvConn) Name() string                { return c.pc.LocalAddr().String() }
+
+// hands out one session per peer, the datagrams of the peer are
+// demultiplexed to it from the one socket everybody shares
+type udpListener struct {
+	pc       net.PacketConn
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	accept   chan *udpSession
+	stopped  bool
+	err      error
+}
+
+type udpSession struct {
+	l      *udpListener
+	peer   net.Addr
+	in     chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newUDPListener(pc net.PacketConn) *udpListener {
+	l := &udpListener{
+		pc:       pc,
+		sessions: make(map[string]*udpSession),
+		accept:   make(chan *udpSession, 16),
+	}
+	go l.loop()
+	return l
+}
+
+func (l *udpListener) loop() {
+	buf := make([]byte, 65536)
+	for {
+		n, peer, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			l.mu.Lock()
+			l.err = err
+			for _, s := range l.sessions {
+				s.Close()
+			}
+			l.mu.Unlock()
+			close(l.accept)
+			return
+		}
+
+		l.mu.Lock()
+		s := l.sessions[peer.String()]
+		if s == nil && !l.stopped {
+			s = &udpSession{l: l, peer: peer, in: make(chan []byte, 64), closed: make(chan struct{})}
+			select {
+			case l.accept <- s:
+				l.sessions[peer.String()] = s
+			default:
+				s = nil
+			}
+		}
+		l.mu.Unlock()
+		if s == nil {
+			continue
+		}
+
+		p := append([]byte(nil), buf[:n]...)
+		select {
+		case s.in <- p:
+		case <-s.closed:
+		default:
+			// the session is not keeping up, drop like the network would
+		}
+	}
+}
+
+func (l *udpListener) Accept() (Conn, error) {
+	s, ok := <-l.accept
+	if !ok {
+		return nil, l.err
+	}
+	return s, nil
+}
+
+func (l *udpListener) Close() error {
+	return l.pc.Close()
+}
+
+func (s *udpSession) Read(b []byte) (int, error) {
+	select {
+	case p := <-s.in:
+		return copy(b, p), nil
+	case <-s.closed:
+		return 0, io.EOF
+	}
+}
+
+func (s *udpSession) Write(b []byte) (int, error) {
+	return s.l.pc.WriteTo(b, s.peer)
+}
+
+func (s *udpSession) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+		s.l.mu.Lock()
+		delete(s.l.sessions, s.peer.String())
+		s.l.mu.Unlock()
+	})
+	return nil
+}
+
+func (s *udpSession) CloseWrite() error { return errNoHalfClose }
+func (s *udpSession) Name() string      { return s.peer.String() }
+
+// splits a command line on blanks, with single and double quotes
+// and backslash escapes working like they do in the shell
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+	quote := byte(0)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '\'' && c == '\'', quote == '"' && c == '"':
+			quote = 0
+		case quote == '\'':
+			cur.WriteByte(c)
+		case c == '\\' && i+1 < len(s) && (quote == 0 || strings.IndexByte("\"\\$`", s[i+1]) >= 0):
+			i++
+			cur.WriteByte(s[i])
+			inArg = true
+		case quote == '"':
+			cur.WriteByte(c)
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteByte(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("exec: unterminated quote in %q", s)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+type execConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+}
+
+func startExec(command string) (Conn, error) {
+	args, err := splitArgs(command)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("exec: no command")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &execConn{cmd, stdin, stdout}, nil
+}
+
+func (c *execConn) Read(b []byte) (int, error)  { return c.stdout.Read(b) }
+func (c *execConn) Write(b []byte) (int, error) { return c.stdin.Write(b) }
+func (c *execConn) CloseWrite() error           { return c.stdin.Close() }
+func (c *execConn) Name() string                { return c.cmd.Path }
+
+func (c *execConn) Close() error {
+	c.stdin.Close()
+	done := make(chan error, 1)
+	go func() { done <- c.cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Second):
+		c.cmd.Process.Kill()
+		return <-done
+	}
+}
+
+type fileConn struct {
+	*os.File
+}
+
+func (c *fileConn) CloseWrite() error { return errNoHalfClose }
+
+func openFile(a *Addr) (Conn, error) {
+	flags := os.O_RDWR
+	if a.has("creat") {
+		flags |= os.O_CREATE
+	}
+	if a.has("append") {
+		flags |= os.O_APPEND
+	}
+	if a.has("trunc") {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(a.arg, flags, 0644)
+	if errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.EISDIR) {
+		f, err = os.Open(a.arg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &fileConn{f}, nil
+}
+
+// the slave side stays open so reads on the master don't fail
+// while nobody has the terminal open
+type ptyConn struct {
+	master *os.File
+	slave  *os.File
+	link   string
+}
+
+func openPty(a *Addr) (Conn, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var unlock int32
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return nil, err
+	}
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		master.Close()
+		return nil, err
+	}
+	name := fmt.Sprintf("/dev/pts/%d", n)
+
+	slave, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	if a.has("raw") {
+		var t syscall.Termios
+		err := ioctl(slave.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&t)))
+		if err == nil {
+			makeRaw(&t)
+			err = ioctl(slave.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&t)))
+		}
+		if err != nil {
+			master.Close()
+			slave.Close()
+			return nil, err
+		}
+	}
+
+	c := &ptyConn{master: master, slave: slave}
+	if link := a.opts["link"]; link != "" {
+		os.Remove(link)
+		if err := os.Symlink(name, link); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.link = link
+	}
+	fmt.Fprintf(os.Stderr, "sock: pty is %s\n", name)
+	return c, nil
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// what cfmakeraw does
+func makeRaw(t *syscall.Termios) {
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+}
+
+func (c *ptyConn) Read(b []byte) (int, error)  { return c.master.Read(b) }
+func (c *ptyConn) Write(b []byte) (int, error) { return c.master.Write(b) }
+func (c *ptyConn) CloseWrite() error           { return errNoHalfClose }
+func (c *ptyConn) Name() string                { return c.slave.Name() }
+
+func (c *ptyConn) Close() error {
+	if c.link != "" {
+		os.Remove(c.link)
+	}
+	c.slave.Close()
+	return c.master.Close()
+}
+
+// copies both ways until both directions are done. when one side is done
+// the other is half-closed, if that isn't possible the other direction
+// gets -t to finish before everything is closed
+func relay(c1, c2 Conn) {
+	dprintf("relaying %v <-> %v", c1.Name(), c2.Name())
+	defer dprintf("closed %v <-> %v", c1.Name(), c2.Name())
+
+	var activity chan struct{}
+	if *idle > 0 {
+		activity = make(chan struct{}, 1)
+	}
+
+	type result struct {
+		halfClosed bool
+	}
+	done := make(chan result, 2)
+	copyDir := func(dst, src Conn, dir string) {
+		err := pump(dst, src, dir, activity)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			dprintf("%s: %v", dir, err)
+		}
+		done <- result{dst.CloseWrite() == nil}
+	}
+
+	n := 0
+	if !*reverse {
+		go copyDir(c2, c1, ">")
+		n++
+	}
+	if !*uni {
+		go copyDir(c1, c2, "<")
+		n++
+	}
+
+	var timeout <-chan time.Time
+	var idleTimer *time.Timer
+	if *idle > 0 {
+		idleTimer = time.NewTimer(*idle)
+		defer idleTimer.Stop()
+	}
+
+loop:
+	for n > 0 {
+		var idleC <-chan time.Time
+		if idleTimer != nil {
+			idleC = idleTimer.C
+		}
+		select {
+		case r := <-done:
+			n--
+			if n > 0 && !r.halfClosed && timeout == nil {
+				timeout = time.After(*linger)
+			}
+		case <-activity:
+			idleTimer.Reset(*idle)
+		case <-idleC:
+			dprintf("idle for %v", *idle)
+			break loop
+		case <-timeout:
+			break loop
+		}
+	}
+
+	c1.Close()
+	c2.Close()
+}
+
+func pump(dst, src Conn, dir string, activity chan struct{}) error {
+	buf := make([]byte, 65536)
+	var off int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if activity != nil {
+				select {
+				case activity <- struct{}{}:
+				default:
+				}
+			}
+			dump(dir, buf[:n], off)
+			off += int64(n)
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func dump(dir string, b []byte, off int64) {
+	if !*hexdump && !*textdump {
+		return
+	}
+
+	dumpMu.Lock()
+	defer dumpMu.Unlock()
+	fmt.Fprintf(os.Stderr, "%s %s length=%d from=%d to=%d\n",
+		dir, time.Now().Format("2006/01/02 15:04:05.000000"), len(b), off, off+int64(len(b))-1)
+	if *hexdump {
+		os.Stderr.WriteString(hex.Dump(b))
+		return
+	}
+
+	// like socat -v, newlines stay and everything else unprintable is escaped
+	var sb strings.Builder
+	for _, c := range b {
+		switch {
+		case c == '\n':
+			sb.WriteString("\n")
+		case c == '\r':
+			sb.WriteString("\\r")
+		case c == '\t' || (c >= 0x20 && c < 0x7f):
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "\\x%02x", c)
+		}
+	}
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		sb.WriteString("\n")
+	}
+	os.Stderr.WriteString(sb.String())
+}
@@ -4,12 +4,16 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"net/textproto"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -18,9 +22,10 @@ import (
 
 func main() {
 	var host, country, port string
-	var quick bool
+	var quick, rdap, jsonOut, update bool
 	var flags int
 	var timeout time.Duration
+	var bootstrap string
 
 	for _, p := range hosts {
 		h := &hostFlag{p.name, &host}
@@ -31,9 +36,22 @@ func main() {
 	flag.StringVar(&port, "p", "whois", "use port")
 	flag.BoolVar(&quick, "Q", false, "perform quick whois")
 	flag.DurationVar(&timeout, "t", 0, "dial timeout")
+	flag.BoolVar(&rdap, "rdap", false, "query using rdap instead of whois")
+	flag.BoolVar(&jsonOut, "json", false, "output rdap records as json")
+	flag.StringVar(&bootstrap, "bootstrap", defaultBootstrapDir(), "rdap bootstrap directory")
+	flag.BoolVar(&update, "update", false, "download the iana rdap bootstrap files into the bootstrap directory")
 
 	flag.Usage = usage
 	flag.Parse()
+	if update {
+		if err := updateBootstrap(bootstrap, timeout); err != nil {
+			fmt.Fprintln(os.Stderr, "whois:", err)
+			os.Exit(1)
+		}
+		if flag.NArg() < 1 {
+			os.Exit(0)
+		}
+	}
 	if flag.NArg() < 1 || (country != "" && host != "") {
 		usage()
 	}
@@ -46,6 +64,13 @@ func main() {
 	}
 
 	status := 0
+	if rdap {
+		for _, name := range flag.Args() {
+			status |= rdapQuery(name, host, bootstrap, jsonOut, timeout)
+		}
+		os.Exit(status)
+	}
+
 	for _, name := range flag.Args() {
 		xhost := host
 		if xhost == "" {
@@ -63,8 +88,13 @@ func usage() {
 }
 
 func whois(query, server, port string, flags int, timeout time.Duration) int {
+	return whoisRefer(query, server, port, flags, timeout, make(map[string]bool))
+}
+
+func whoisRefer(query, server, port string, flags int, timeout time.Duration, seen map[string]bool) int {
 	fmt.Println(query, server, port)
-	addr := fmt.Sprintf("%s:%s", server, port)
+	addr := net.JoinHostPort(server, port)
+	seen[strings.ToLower(addr)] = true
 	conn, err := net.DialTimeout("tcp", addr, timeout)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "whois:", err)
@@ -85,7 +115,7 @@ func whois(query, server, port string, flags int, timeout time.Duration) int {
 	}
 	fmt.Fprintf(conn, format, query)
 
-	var nhost, line string
+	var nhost, nport, line string
 	r := textproto.NewReader(bufio.NewReader(conn))
 	for {
 		line, err = r.ReadLine()
@@ -103,16 +133,20 @@ func whois(query, server, port string, flags int, timeout time.Duration) int {
 			continue
 		}
 
-		i := strings.Index(line, "Whois Server:")
-		if i > 0 {
-			line = strings.TrimSpace(line)
+		if h, p := parseReferral(line); h != "" {
+			if p == "" {
+				p = port
+			}
+			if !seen[strings.ToLower(net.JoinHostPort(h, p))] {
+				nhost, nport = h, p
+			}
 		} else if server == ANICHOST {
 			ipWhois := []string{LNICHOST, RNICHOST, PNICHOST, BNICHOST, AFNICHOST}
 			line = strings.ToLower(line)
 
 			for _, ip := range ipWhois {
-				if strings.Index(line, ip) >= 0 {
-					nhost = ip
+				if strings.Index(line, ip) >= 0 && !seen[net.JoinHostPort(ip, port)] {
+					nhost, nport = ip, port
 					break
 				}
 			}
@@ -120,15 +154,61 @@ func whois(query, server, port string, flags int, timeout time.Duration) int {
 	}
 
 	status := 0
-	if err != nil {
+	if err != nil && err != io.EOF {
 		status = 1
 	}
 
 	if nhost != "" {
-		status |= whois(query, nhost, port, 0, timeout)
+		fmt.Println()
+		status |= whoisRefer(query, nhost, nport, flags, timeout, seen)
 	}
 
-	return 0
+	return status
+}
+
+// referral keys used by registries to point at a more authoritative server,
+// iana uses refer:, the rirs use ReferralServer: with a whois:// or rwhois:// url
+// and the gtld registries name the registrar server
+var referralKeys = []string{
+	"refer:",
+	"referralserver:",
+	"whois server:",
+	"registrar whois server:",
+}
+
+func parseReferral(line string) (host, port string) {
+	lline := strings.ToLower(line)
+	for _, key := range referralKeys {
+		if !strings.HasPrefix(lline, key) {
+			continue
+		}
+
+		value := strings.TrimSpace(line[len(key):])
+		if value == "" {
+			return "", ""
+		}
+
+		if strings.Contains(value, "://") {
+			u, err := url.Parse(value)
+			if err != nil {
+				return "", ""
+			}
+			switch strings.ToLower(u.Scheme) {
+			case "whois", "rwhois":
+			default:
+				// http referrals are web forms, nothing we can talk to
+				return "", ""
+			}
+			return u.Hostname(), u.Port()
+		}
+
+		value = strings.TrimSuffix(strings.Fields(value)[0], "/")
+		if h, p, err := net.SplitHostPort(value); err == nil {
+			return h, p
+		}
+		return value, ""
+	}
+	return "", ""
 }
 
 // if no country is specified, determine the top level domain from the query
@@ -259,3 +339,480 @@ var hosts = []struct {
 	{"r", RNICHOST},
 	{"R", RUNICHOST},
 }
+
+// rdap queries go to the registry found by matching the query against the
+// iana bootstrap registries (rfc 9224), these are expected to be cached
+// locally in the bootstrap directory, use -update to refresh them
+const IANABOOTSTRAP = "https://data.iana.org/rdap/"
+
+var bootstrapFiles = []string{"dns.json", "ipv4.json", "ipv6.json", "asn.json"}
+
+type rdapBootstrap struct {
+	Version     string       `json:"version"`
+	Publication string       `json:"publication"`
+	Services    [][][]string `json:"services"`
+}
+
+type rdapObject struct {
+	ObjectClassName string       `json:"objectClassName"`
+	Handle          string       `json:"handle"`
+	LDHName         string       `json:"ldhName"`
+	UnicodeName     string       `json:"unicodeName"`
+	Name            string       `json:"name"`
+	Type            string       `json:"type"`
+	Country         string       `json:"country"`
+	StartAddress    string       `json:"startAddress"`
+	EndAddress      string       `json:"endAddress"`
+	StartAutnum     int64        `json:"startAutnum"`
+	EndAutnum       int64        `json:"endAutnum"`
+	Status          []string     `json:"status"`
+	Events          []rdapEvent  `json:"events"`
+	Entities        []rdapEntity `json:"entities"`
+	Nameservers     []rdapObject `json:"nameservers"`
+	Links           []rdapLink   `json:"links"`
+	ErrorCode       int          `json:"errorCode"`
+	Title           string       `json:"title"`
+	Description     []string     `json:"description"`
+}
+
+type rdapEvent struct {
+	Action string `json:"eventAction"`
+	Date   string `json:"eventDate"`
+}
+
+type rdapLink struct {
+	Rel  string `json:"rel"`
+	Href string `json:"href"`
+	Type string `json:"type"`
+}
+
+type rdapEntity struct {
+	Handle     string            `json:"handle"`
+	Roles      []string          `json:"roles"`
+	VcardArray []json.RawMessage `json:"vcardArray"`
+	Entities   []rdapEntity      `json:"entities"`
+}
+
+// normalized view of the interesting parts of a response,
+// registries differ a lot in what they fill in
+type rdapRecord struct {
+	Query       string   `json:"query"`
+	Server      string   `json:"server"`
+	Class       string   `json:"class"`
+	Handle      string   `json:"handle,omitempty"`
+	Name        string   `json:"name,omitempty"`
+	Range       string   `json:"range,omitempty"`
+	Country     string   `json:"country,omitempty"`
+	Registrar   string   `json:"registrar,omitempty"`
+	Status      []string `json:"status,omitempty"`
+	Registered  string   `json:"registered,omitempty"`
+	Updated     string   `json:"updated,omitempty"`
+	Expires     string   `json:"expires,omitempty"`
+	Nameservers []string `json:"nameservers,omitempty"`
+	AbuseName   string   `json:"abuse_name,omitempty"`
+	AbuseEmail  string   `json:"abuse_email,omitempty"`
+	AbusePhone  string   `json:"abuse_phone,omitempty"`
+}
+
+func defaultBootstrapDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "rdap"
+	}
+	return filepath.Join(dir, "rdap")
+}
+
+func updateBootstrap(dir string, timeout time.Duration) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: timeout}
+	for _, name := range bootstrapFiles {
+		resp, err := client.Get(IANABOOTSTRAP + name)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("%s: %s", IANABOOTSTRAP+name, resp.Status)
+		}
+
+		tmp := filepath.Join(dir, name+".tmp")
+		f, err := os.Create(tmp)
+		if err != nil {
+			resp.Body.Close()
+			return err
+		}
+		_, err = io.Copy(f, resp.Body)
+		resp.Body.Close()
+		xerr := f.Close()
+		if err == nil {
+			err = xerr
+		}
+		if err == nil {
+			err = os.Rename(tmp, filepath.Join(dir, name))
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	return nil
+}
+
+func loadBootstrap(dir, name string) (*rdapBootstrap, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("%v (run with -update to fetch the bootstrap files)", err)
+	}
+
+	b := new(rdapBootstrap)
+	err = json.Unmarshal(buf, b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return b, nil
+}
+
+// figures out what kind of object the query is and the path
+// for it relative to the rdap base url
+func rdapClassify(query string) (file, path string, err error) {
+	if ip := net.ParseIP(query); ip != nil {
+		if ip.To4() != nil {
+			return "ipv4.json", "ip/" + query, nil
+		}
+		return "ipv6.json", "ip/" + query, nil
+	}
+	if ip, _, xerr := net.ParseCIDR(query); xerr == nil {
+		if ip.To4() != nil {
+			return "ipv4.json", "ip/" + query, nil
+		}
+		return "ipv6.json", "ip/" + query, nil
+	}
+
+	asn := strings.TrimPrefix(strings.ToUpper(query), "AS")
+	if _, xerr := strconv.ParseUint(asn, 10, 32); xerr == nil {
+		return "asn.json", "autnum/" + asn, nil
+	}
+
+	name := strings.TrimSuffix(strings.ToLower(query), ".")
+	if name == "" || strings.ContainsAny(name, "/ ") {
+		return "", "", fmt.Errorf("%q: unsupported rdap query", query)
+	}
+	return "dns.json", "domain/" + name, nil
+}
+
+// finds the most specific service in the bootstrap registry for the query
+func (b *rdapBootstrap) lookup(file, query string) []string {
+	var urls []string
+	best := -1
+	for _, svc := range b.Services {
+		if len(svc) < 2 {
+			continue
+		}
+
+		for _, entry := range svc[0] {
+			n := bootstrapMatch(file, entry, query)
+			if n > best {
+				best, urls = n, svc[1]
+			}
+		}
+	}
+	return urls
+}
+
+// returns how specific the match of the entry is, or -1 if it does not match
+func bootstrapMatch(file, entry, query string) int {
+	switch file {
+	case "dns.json":
+		name := strings.TrimSuffix(strings.ToLower(query), ".")
+		entry = strings.ToLower(entry)
+		if name == entry || strings.HasSuffix(name, "."+entry) {
+			return strings.Count(entry, ".") + 1
+		}
+
+	case "ipv4.json", "ipv6.json":
+		_, cidr, err := net.ParseCIDR(entry)
+		if err != nil {
+			return -1
+		}
+		ip := net.ParseIP(query)
+		if ip == nil {
+			ip, _, _ = net.ParseCIDR(query)
+		}
+		if ip != nil && cidr.Contains(ip) {
+			ones, _ := cidr.Mask.Size()
+			return ones
+		}
+
+	case "asn.json":
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(query), "AS"), 10, 32)
+		if err != nil {
+			return -1
+		}
+		lo, hi := entry, entry
+		if i := strings.Index(entry, "-"); i >= 0 {
+			lo, hi = entry[:i], entry[i+1:]
+		}
+		l, err1 := strconv.ParseUint(lo, 10, 32)
+		h, err2 := strconv.ParseUint(hi, 10, 32)
+		if err1 == nil && err2 == nil && l <= asn && asn <= h {
+			// narrower ranges are more specific
+			return 32 - bitlen(h-l)
+		}
+	}
+	return -1
+}
+
+func bitlen(x uint64) int {
+	n := 0
+	for ; x != 0; x >>= 1 {
+		n++
+	}
+	return n
+}
+
+func rdapQuery(query, server, bootstrap string, jsonOut bool, timeout time.Duration) int {
+	file, path, err := rdapClassify(query)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "whois:", err)
+		return 1
+	}
+
+	base := server
+	if base == "" {
+		b, err := loadBootstrap(bootstrap, file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "whois:", err)
+			return 1
+		}
+
+		urls := b.lookup(file, path[strings.Index(path, "/")+1:])
+		for _, u := range urls {
+			if strings.HasPrefix(u, "https://") {
+				base = u
+				break
+			}
+		}
+		if base == "" && len(urls) > 0 {
+			base = urls[0]
+		}
+		if base == "" {
+			fmt.Fprintf(os.Stderr, "whois: %s: no rdap service in bootstrap registry\n", query)
+			return 1
+		}
+	} else if !strings.Contains(base, "://") {
+		base = "https://" + base
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+
+	obj, err := rdapFetch(client, base+path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "whois:", err)
+		return 1
+	}
+
+	rec := &rdapRecord{Query: query, Server: base}
+	rec.merge(obj)
+
+	// thin registries point at the registrar's rdap server for the full record,
+	// a failure there is not fatal since we have the registry data already
+	if href := relatedLink(obj, base+path); href != "" {
+		robj, err := rdapFetch(client, href)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "whois:", err)
+		} else {
+			rec.merge(robj)
+		}
+	}
+
+	if jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		enc.Encode(rec)
+	} else {
+		rec.print(os.Stdout)
+	}
+	return 0
+}
+
+func rdapFetch(client *http.Client, url string) (*rdapObject, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/rdap+json, application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	obj := new(rdapObject)
+	err = json.NewDecoder(resp.Body).Decode(obj)
+	if resp.StatusCode != http.StatusOK {
+		if err == nil && obj.Title != "" {
+			return nil, fmt.Errorf("%s: %s: %s", url, resp.Status, obj.Title)
+		}
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", url, err)
+	}
+	return obj, nil
+}
+
+func relatedLink(obj *rdapObject, self string) string {
+	for _, l := range obj.Links {
+		if l.Rel != "related" || l.Href == "" || strings.EqualFold(l.Href, self) {
+			continue
+		}
+		if l.Type == "" || strings.HasPrefix(l.Type, "application/rdap+json") {
+			return l.Href
+		}
+	}
+	return ""
+}
+
+// later responses fill in what earlier ones left empty, except for
+// the abuse contact where the registrar is the better source
+func (r *rdapRecord) merge(obj *rdapObject) {
+	set := func(dst *string, src string) {
+		if *dst == "" {
+			*dst = src
+		}
+	}
+
+	set(&r.Class, obj.ObjectClassName)
+	set(&r.Handle, obj.Handle)
+	set(&r.Country, obj.Country)
+	switch {
+	case obj.UnicodeName != "":
+		set(&r.Name, obj.UnicodeName)
+	case obj.LDHName != "":
+		set(&r.Name, strings.ToLower(obj.LDHName))
+	default:
+		set(&r.Name, obj.Name)
+	}
+
+	switch {
+	case obj.StartAddress != "":
+		set(&r.Range, obj.StartAddress+" - "+obj.EndAddress)
+	case obj.StartAutnum != 0:
+		rng := fmt.Sprintf("AS%d", obj.StartAutnum)
+		if obj.EndAutnum != obj.StartAutnum {
+			rng += fmt.Sprintf(" - AS%d", obj.EndAutnum)
+		}
+		set(&r.Range, rng)
+	}
+
+	if len(r.Status) == 0 {
+		r.Status = obj.Status
+	}
+
+	for _, ev := range obj.Events {
+		switch ev.Action {
+		case "registration":
+			set(&r.Registered, ev.Date)
+		case "last changed":
+			set(&r.Updated, ev.Date)
+		case "expiration":
+			set(&r.Expires, ev.Date)
+		}
+	}
+
+	if len(r.Nameservers) == 0 {
+		for _, ns := range obj.Nameservers {
+			r.Nameservers = append(r.Nameservers, strings.ToLower(ns.LDHName))
+		}
+	}
+
+	if e := findEntity(obj.Entities, "registrar"); e != nil {
+		set(&r.Registrar, vcardValue(e.VcardArray, "fn"))
+	}
+	if e := findEntity(obj.Entities, "abuse"); e != nil {
+		name, email, phone := vcardValue(e.VcardArray, "fn"), vcardValue(e.VcardArray, "email"), vcardValue(e.VcardArray, "tel")
+		if email != "" || phone != "" {
+			r.AbuseName, r.AbuseEmail, r.AbusePhone = name, email, phone
+		}
+	}
+}
+
+func (r *rdapRecord) print(w io.Writer) {
+	line := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(w, "%-14s%s\n", key+":", value)
+		}
+	}
+
+	line("query", r.Query)
+	line("server", r.Server)
+	line("class", r.Class)
+	line("handle", r.Handle)
+	line("name", r.Name)
+	line("range", r.Range)
+	line("country", r.Country)
+	line("registrar", r.Registrar)
+	line("status", strings.Join(r.Status, ", "))
+	line("registered", r.Registered)
+	line("updated", r.Updated)
+	line("expires", r.Expires)
+	for _, ns := range r.Nameservers {
+		line("nameserver", ns)
+	}
+	line("abuse name", r.AbuseName)
+	line("abuse email", r.AbuseEmail)
+	line("abuse phone", r.AbusePhone)
+	fmt.Fprintln(w)
+}
+
+// entities nest, the abuse contact is usually hanging off the registrar
+func findEntity(entities []rdapEntity, role string) *rdapEntity {
+	for i := range entities {
+		for _, r := range entities[i].Roles {
+			if strings.EqualFold(r, role) {
+				return &entities[i]
+			}
+		}
+	}
+	for i := range entities {
+		if e := findEntity(entities[i].Entities, role); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// jcard (rfc 7095) is ["vcard", [[name, params, type, value], ...]]
+func vcardValue(vcard []json.RawMessage, name string) string {
+	if len(vcard) < 2 {
+		return ""
+	}
+
+	var props [][]interface{}
+	if json.Unmarshal(vcard[1], &props) != nil {
+		return ""
+	}
+	for _, p := range props {
+		if len(p) < 4 {
+			continue
+		}
+		if key, _ := p[0].(string); !strings.EqualFold(key, name) {
+			continue
+		}
+		if value, ok := p[3].(string); ok {
+			return strings.TrimPrefix(value, "tel:")
+		}
+	}
+	return ""
+}